@@ -25,10 +25,13 @@ import (
 	"core/nodes"
 	"flag"
 	"fmt"
+	"plugins/configsync"
 	"plugins/core"
 	"plugins/ctls"
+	"plugins/discovery"
 	"plugins/health"
 	"plugins/ldap"
+	"plugins/logstream"
 	"plugins/nft"
 	"plugins/webclient"
 	"runtime"
@@ -40,11 +43,9 @@ type Job struct {
 	randomno int
 }
 
-func main() {
-
-	fmt.Printf("Git Version %s from %s\n", plugincore.Gitversion, plugincore.Gitdate)
+var logging clog.Logger
 
-	go printMemUsage()
+func main() {
 
 	// ########################## Command line parse ##########################
 	// core stuff
@@ -54,16 +55,27 @@ func main() {
 	// plugins
 	pluginwebclient.ParseCmdLine()
 	pluginctls.ParseCmdLine()
+	plugindiscovery.ParseCmdLine()
 	pluginldap.ParseCmdLine()
 	pluginnft.ParseCmdLine()
+	pluginconfigsync.ParseCmdLine()
 	flag.Parse()
 
 	// ########################## Init ##########################
 	// core
 	clog.Init()
+	logging = clog.New("MAIN")
+	logging.Info("VERSION", "Git Version "+plugincore.Gitversion+" from "+plugincore.Gitdate,
+		"version", plugincore.Gitversion, "date", plugincore.Gitdate,
+	)
+
+	go printMemUsage()
+
+	pluginctls.SetVersion(plugincore.Gitversion, plugincore.Gitdate)
 
 	config.Init()
 	config.Read()
+	clog.SetNodeName(config.NodeName)
 
 	nodes.Init()
 
@@ -71,20 +83,19 @@ func main() {
 	msgbus.PluginsInit()
 
 	// get my node
-	var host string
-	var nodeType, port int
-	var err error
-	nodeType, host, port, err = nodes.GetData(config.NodeName)
-	if err != nil {
-		nodes.SaveData(config.NodeName, nodeType, host, port)
+	if _, err := nodes.Get(config.NodeName); err != nil {
+		nodes.Save(nodes.GetOrNew(config.NodeName))
 	}
 
 	plugincore.Init()
 	pluginctls.Init()
+	plugindiscovery.Init()
 	pluginwebclient.Init()
 	pluginhealth.Init()
 	pluginldap.Init()
 	pluginnft.Init()
+	pluginconfigsync.Init()
+	pluginlogstream.Init()
 
 	for {
 		time.Sleep(time.Second)
@@ -95,8 +106,8 @@ func testOnMessage(group, command, payload string) {
 	fmt.Println("GROUP: ", group, " CMD: ", command, " PAYLOAD: ", payload)
 }
 
-func testNodeIter(nodeName string, nodeType int, host string, port int) {
-	fmt.Println("nodeName:", nodeName, "host:", host, "port:", port)
+func testNodeIter(node nodes.Node) {
+	fmt.Println("nodeName:", node.Name, "host:", node.Host, "port:", node.Port)
 }
 
 func bToKb(b uint64) uint64 {
@@ -111,10 +122,12 @@ func printMemUsage() {
 		var m runtime.MemStats
 		runtime.ReadMemStats(&m)
 		// For info on each, see: https://golang.org/pkg/runtime/#MemStats
-		fmt.Printf("Alloc = %v KiB", bToKb(m.Alloc))
-		fmt.Printf("\tTotalAlloc = %v KiB", bToKb(m.TotalAlloc))
-		fmt.Printf("\tSys = %v MiB", bToMb(m.Sys))
-		fmt.Printf("\tNumGC = %v\n", m.NumGC)
+		logging.Info("MEM", "Memory usage",
+			"allocKiB", bToKb(m.Alloc),
+			"totalAllocKiB", bToKb(m.TotalAlloc),
+			"sysMiB", bToMb(m.Sys),
+			"numGC", m.NumGC,
+		)
 		time.Sleep(time.Second * 60)
 	}
 }
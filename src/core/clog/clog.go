@@ -21,20 +21,103 @@ package clog
 import (
 	"flag"
 	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 )
 
-var isDebug bool
+// Level of an log-entry
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelError
+)
+
+// Entry is a single log-line
+type Entry struct {
+	Time    time.Time
+	Level   Level
+	Prefix  string
+	Group   string
+	Message string
+	Fields  []interface{} // key, value, key, value, ...
+}
 
 type Logger struct {
 	prefix string
+	fields []interface{}
 }
 
+// options
+var isDebug bool
+var logFormat string
+var logLevels string
+var logFile string
+var logMaxSize int
+var logMaxAge time.Duration
+var logMaxBackups int
+var logHistory int
+var logSyslog string
+var logSyslogFacility string
+var logSyslogIdent string
+
+// private vars
+var outputMutex sync.Mutex
+var output io.Writer = os.Stdout
+var formatter formatFct = formatText
+
+var levelsMutex sync.RWMutex
+var defaultLevel = LevelInfo
+var prefixLevels = make(map[string]Level)
+
 func ParseCmdLine() {
 	flag.BoolVar(&isDebug, "v", false, "Enable debug")
+	flag.StringVar(&logFormat, "log.format", "text", "Format of the log: text, logfmt or json")
+	flag.StringVar(&logLevels, "log.level", "", "Log-level per prefix, for example 'info,LDAP=debug,SESSION-*=error'")
+	flag.StringVar(&logFile, "log.file", "", "Write the log to this file instead of stdout")
+	flag.IntVar(&logMaxSize, "log.maxSize", 10, "Rotate the log-file if it is bigger than this size in MiB, 0 disable it")
+	flag.DurationVar(&logMaxAge, "log.maxAge", time.Hour*24, "Rotate the log-file if it is older than this, 0 disable it")
+	flag.IntVar(&logMaxBackups, "log.maxBackups", 5, "Keep this count of rotated log-files")
+	flag.IntVar(&logHistory, "log.history", 1000, "Keep this count of log-entrys in memory")
+	flag.StringVar(&logSyslog, "log.syslog", "", "Send the log additional to syslog, for example 'unix:///dev/log' or 'udp://localhost:514'")
+	flag.StringVar(&logSyslogFacility, "log.syslogFacility", "daemon", "Syslog-facility, for example daemon or local0")
+	flag.StringVar(&logSyslogIdent, "log.syslogIdent", "gopilot", "Syslog identity ( APP-NAME )")
 }
 
+// Init apply the command line parameter
 func Init() {
 
+	if isDebug {
+		EnableDebug()
+	}
+
+	if err := SetFormat(logFormat); err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+	}
+
+	if err := SetLevels(logLevels); err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+	}
+
+	SetHistorySize(logHistory)
+
+	if err := SetSyslog(logSyslog, logSyslogFacility, logSyslogIdent); err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+	}
+
+	if logFile != "" {
+		newFile, err := openRotateFile(logFile, int64(logMaxSize)*1024*1024, logMaxAge, logMaxBackups)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			return
+		}
+		SetOutput(newFile)
+	}
 }
 
 func New(prefix string) Logger {
@@ -45,19 +128,176 @@ func New(prefix string) Logger {
 }
 
 func EnableDebug() {
+	levelsMutex.Lock()
 	isDebug = true
+	defaultLevel = LevelDebug
+	levelsMutex.Unlock()
 }
 
-func (logging *Logger) Debug(group, message string) {
-	if isDebug == true {
-		fmt.Printf("[DEBUG] [%s] [%s] %s\n", logging.prefix, group, message)
+// SetOutput set the writer for all log-entrys
+func SetOutput(newOutput io.Writer) {
+	outputMutex.Lock()
+	output = newOutput
+	outputMutex.Unlock()
+}
+
+// SetFormat set the format of all log-entrys ( text, logfmt or json ), an empty format is text
+func SetFormat(format string) error {
+
+	if format == "" {
+		format = "text"
 	}
+
+	newFormatter, ok := formatters[format]
+	if !ok {
+		return fmt.Errorf("Unknown log-format '%s'", format)
+	}
+
+	outputMutex.Lock()
+	formatter = newFormatter
+	outputMutex.Unlock()
+
+	return nil
 }
 
-func (logging *Logger) Info(group, message string) {
-	fmt.Printf("[INFO] [%s] [%s] %s\n", logging.prefix, group, message)
+// SetLevels parse a level-spec like 'info,LDAP=debug,SESSION-*=error'
+// An entry without prefix set the default level, a prefix can end with * to match all prefixes starting with it
+func SetLevels(spec string) error {
+
+	newPrefixLevels := make(map[string]Level)
+	newDefaultLevel := LevelInfo
+	if isDebug {
+		newDefaultLevel = LevelDebug
+	}
+
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		prefixLevel := strings.SplitN(entry, "=", 2)
+		if len(prefixLevel) == 1 {
+			level, err := ParseLevel(prefixLevel[0])
+			if err != nil {
+				return err
+			}
+			newDefaultLevel = level
+			continue
+		}
+
+		level, err := ParseLevel(prefixLevel[1])
+		if err != nil {
+			return err
+		}
+		newPrefixLevels[strings.TrimSpace(prefixLevel[0])] = level
+	}
+
+	levelsMutex.Lock()
+	defaultLevel = newDefaultLevel
+	prefixLevels = newPrefixLevels
+	levelsMutex.Unlock()
+
+	return nil
 }
 
-func (logging *Logger) Error(group, message string) {
-	fmt.Printf("[ERROR] [%s] [%s] %s\n", logging.prefix, group, message)
+// ParseLevel convert debug, info or error to a Level
+func ParseLevel(levelString string) (Level, error) {
+	switch strings.ToLower(strings.TrimSpace(levelString)) {
+	case "debug":
+		return LevelDebug, nil
+	case "info":
+		return LevelInfo, nil
+	case "error":
+		return LevelError, nil
+	}
+	return LevelInfo, fmt.Errorf("Unknown log-level '%s'", levelString)
+}
+
+func (level Level) String() string {
+	switch level {
+	case LevelDebug:
+		return "DEBUG"
+	case LevelInfo:
+		return "INFO"
+	case LevelError:
+		return "ERROR"
+	}
+	return "UNKNOWN"
+}
+
+// Enabled return true if entrys with level of prefix are logged
+func Enabled(prefix string, level Level) bool {
+	levelsMutex.RLock()
+	defer levelsMutex.RUnlock()
+
+	if prefixLevel, ok := prefixLevels[prefix]; ok {
+		return level >= prefixLevel
+	}
+
+	// the longest matching wildcard wins
+	patterns := make([]string, 0)
+	for pattern := range prefixLevels {
+		if strings.HasSuffix(pattern, "*") && MatchPrefix(pattern, prefix) {
+			patterns = append(patterns, pattern)
+		}
+	}
+	if len(patterns) > 0 {
+		sort.Slice(patterns, func(i, j int) bool {
+			return len(patterns[i]) > len(patterns[j])
+		})
+		return level >= prefixLevels[patterns[0]]
+	}
+
+	return level >= defaultLevel
+}
+
+// With return a copy of the logger, which add the key-values to every entry
+func (logging Logger) With(keyValues ...interface{}) Logger {
+	newLog := Logger{
+		prefix: logging.prefix,
+		fields: make([]interface{}, 0, len(logging.fields)+len(keyValues)),
+	}
+	newLog.fields = append(newLog.fields, logging.fields...)
+	newLog.fields = append(newLog.fields, keyValues...)
+	return newLog
+}
+
+func (logging *Logger) Debug(group, message string, keyValues ...interface{}) {
+	logging.log(LevelDebug, group, message, keyValues)
+}
+
+func (logging *Logger) Info(group, message string, keyValues ...interface{}) {
+	logging.log(LevelInfo, group, message, keyValues)
+}
+
+func (logging *Logger) Error(group, message string, keyValues ...interface{}) {
+	logging.log(LevelError, group, message, keyValues)
+}
+
+func (logging *Logger) log(level Level, group, message string, keyValues []interface{}) {
+
+	if !Enabled(logging.prefix, level) {
+		return
+	}
+
+	newEntry := Entry{
+		Time:    time.Now(),
+		Level:   level,
+		Prefix:  logging.prefix,
+		Group:   group,
+		Message: message,
+		Fields:  append(append([]interface{}{}, logging.fields...), keyValues...),
+	}
+
+	write(newEntry)
+}
+
+func write(newEntry Entry) {
+	outputMutex.Lock()
+	output.Write(formatter(&newEntry))
+	outputMutex.Unlock()
+
+	writeSyslog(&newEntry)
+	addHistory(newEntry)
 }
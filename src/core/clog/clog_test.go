@@ -0,0 +1,298 @@
+/*
+Copyright (C) 2018 by Martin Langlotz aka stackshadow
+
+This file is part of gopilot, an rewrite of the copilot-project in go
+
+gopilot is free software: you can redistribute it and/or modify
+it under the terms of the GNU Lesser General Public License as published by
+the Free Software Foundation, version 3 of this License
+
+gopilot is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License
+along with gopilot.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package clog
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLevels(t *testing.T) {
+
+	err := SetLevels("error,LDAP=debug,SESSION-*=info,SESSION-1*=error")
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	defer SetLevels("")
+
+	if Enabled("BUS", LevelInfo) || !Enabled("BUS", LevelError) {
+		t.Error("Default level should be error")
+	}
+	if !Enabled("LDAP", LevelDebug) {
+		t.Error("LDAP should log debug")
+	}
+	if !Enabled("SESSION-2", LevelInfo) || Enabled("SESSION-2", LevelDebug) {
+		t.Error("SESSION-2 should log info")
+	}
+	if Enabled("SESSION-12", LevelInfo) {
+		t.Error("The longest pattern should win")
+	}
+
+	if SetLevels("LDAP=verbose") == nil {
+		t.Error("Unknown level should fail")
+	}
+}
+
+func TestFormats(t *testing.T) {
+
+	var buffer bytes.Buffer
+	SetOutput(&buffer)
+	defer SetOutput(os.Stdout)
+	defer SetFormat("text")
+
+	logging := New("TEST")
+	nodeLogging := logging.With("node", "nodea")
+
+	SetFormat("text")
+	nodeLogging.Info("GROUP", "hello world", "rtt", 5)
+	if buffer.String() != "[INFO] [TEST] [GROUP] hello world node=nodea rtt=5\n" {
+		t.Errorf("Text format is wrong: %s", buffer.String())
+	}
+
+	buffer.Reset()
+	SetFormat("logfmt")
+	nodeLogging.Info("GROUP", "hello world")
+	if !strings.HasPrefix(buffer.String(), "time=") ||
+		!strings.HasSuffix(buffer.String(), " level=info prefix=TEST group=GROUP msg=\"hello world\" node=nodea\n") {
+		t.Errorf("logfmt format is wrong: %s", buffer.String())
+	}
+
+	buffer.Reset()
+	SetFormat("json")
+	nodeLogging.Error("GROUP", "hello \"world\"", "rtt", 5)
+	var jsonEntry map[string]interface{}
+	err := json.Unmarshal(buffer.Bytes(), &jsonEntry)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	if jsonEntry["level"] != "error" || jsonEntry["msg"] != "hello \"world\"" || jsonEntry["node"] != "nodea" || jsonEntry["rtt"] != float64(5) {
+		t.Errorf("json format is wrong: %s", buffer.String())
+	}
+
+	if SetFormat("xml") == nil {
+		t.Error("Unknown format should fail")
+	}
+
+	// without -log.format the text format is used
+	buffer.Reset()
+	if err := SetFormat(""); err != nil {
+		t.Error(err)
+	}
+	nodeLogging.Info("GROUP", "hello world")
+	if buffer.String() != "[INFO] [TEST] [GROUP] hello world node=nodea\n" {
+		t.Errorf("Empty format should be text, but is: %s", buffer.String())
+	}
+}
+
+func TestRotate(t *testing.T) {
+
+	logDir, err := ioutil.TempDir("", "clog")
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	defer os.RemoveAll(logDir)
+
+	logFileName := filepath.Join(logDir, "gopilot.log")
+	logFile, err := openRotateFile(logFileName, 100, 0, 2)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+
+	line := []byte(strings.Repeat("x", 59) + "\n")
+	for count := 0; count < 5; count++ {
+		logFile.Write(line)
+		time.Sleep(time.Millisecond * 2)
+	}
+
+	// every line need a new file, we keep 2 backups
+	backups, _ := filepath.Glob(logFileName + ".*")
+	if len(backups) != 2 {
+		t.Errorf("There should be 2 backups, but there are %d", len(backups))
+	}
+
+	content, _ := ioutil.ReadFile(logFileName)
+	if len(content) != len(line) {
+		t.Errorf("Current log should contain one line, but has %d bytes", len(content))
+	}
+
+	// age
+	logFile.maxSize = 0
+	logFile.maxAge = time.Millisecond
+	time.Sleep(time.Millisecond * 5)
+	logFile.Write(line)
+	content, _ = ioutil.ReadFile(logFileName)
+	if len(content) != len(line) {
+		t.Errorf("Log should be rotated by age")
+	}
+}
+
+func TestHistory(t *testing.T) {
+
+	SetOutput(ioutil.Discard)
+	defer SetOutput(os.Stdout)
+	SetHistorySize(3)
+	defer SetHistorySize(1000)
+
+	var hookEntrys []Entry
+	hookID := AddHook(func(newEntry Entry) {
+		hookEntrys = append(hookEntrys, newEntry)
+	})
+
+	ldapLogging := New("LDAP")
+	busLogging := New("BUS")
+
+	ldapLogging.Info("GROUP", "first")
+	busLogging.Info("GROUP", "second")
+	ldapLogging.Error("GROUP", "third")
+	ldapLogging.Info("GROUP", "fourth", "key", "value")
+
+	RemoveHook(hookID)
+	busLogging.Info("GROUP", "fifth")
+
+	if len(hookEntrys) != 4 {
+		t.Errorf("Hook should be called 4 times, but was called %d times", len(hookEntrys))
+	}
+
+	// the first one is dropped
+	entrys := History(Filter{Level: LevelInfo}, 0)
+	if len(entrys) != 3 || entrys[0].Message != "third" || entrys[2].Message != "fifth" {
+		t.Errorf("History is wrong: %+v", entrys)
+	}
+
+	entrys = History(Filter{Level: LevelInfo, Prefix: "LD*"}, 1)
+	if len(entrys) != 1 || entrys[0].Message != "fourth" || entrys[0].FieldMap()["key"] != "value" {
+		t.Errorf("Filtered history is wrong: %+v", entrys)
+	}
+
+	entrys = History(Filter{Level: LevelError}, 0)
+	if len(entrys) != 1 || entrys[0].Message != "third" {
+		t.Errorf("History filtered by level is wrong: %+v", entrys)
+	}
+}
+
+func TestSyslogTimeout(t *testing.T) {
+
+	syslogWriteTimeout = time.Millisecond * 100
+	defer func() { syslogWriteTimeout = time.Second }()
+
+	// the daemon accept connections, but never read
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	defer listener.Close()
+	go func() {
+		var conns []net.Conn
+		defer func() {
+			for _, conn := range conns {
+				conn.Close()
+			}
+		}()
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conns = append(conns, conn)
+		}
+	}()
+
+	writer := &syslogWriter{network: "tcp", address: listener.Addr().String(), facility: 16}
+	if err := writer.connect(time.Second); err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	defer writer.close()
+
+	newEntry := &Entry{Time: time.Now(), Level: LevelInfo, Prefix: "TEST", Group: "TIMEOUT", Message: strings.Repeat("x", 1024*1024)}
+	for index := 0; index < 64; index++ {
+		entryStart := time.Now()
+		writer.write(newEntry, "nodea")
+		if time.Since(entryStart) > time.Second*2 {
+			t.Errorf("Write to a blocked syslog-daemon need %s", time.Since(entryStart))
+			t.FailNow()
+		}
+	}
+}
+
+func TestSyslog(t *testing.T) {
+
+	socketDir, _ := ioutil.TempDir("", "clogsyslog")
+	defer os.RemoveAll(socketDir)
+	socketName := filepath.Join(socketDir, "log")
+
+	listener, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socketName, Net: "unixgram"})
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	defer listener.Close()
+
+	SetOutput(ioutil.Discard)
+	defer SetOutput(os.Stdout)
+
+	if SetSyslog("unix://"+socketName, "nofacility", "gopilot") == nil {
+		t.Error("Unknown facility should fail")
+	}
+
+	err = SetSyslog("unix://"+socketName, "local0", "gopilot")
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	defer SetSyslog("", "", "")
+	SetNodeName("nodea")
+	defer SetNodeName("")
+
+	logging := New("LDAP")
+	logging.Error("CONNECT", "connection failed", "host", "ldap\"1]")
+
+	buffer := make([]byte, 2048)
+	listener.SetReadDeadline(time.Now().Add(time.Second * 2))
+	readed, err := listener.Read(buffer)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	message := string(buffer[:readed])
+
+	// local0 = 16, error = 3 -> 16 * 8 + 3 = 131
+	if !strings.HasPrefix(message, "<131>1 ") {
+		t.Errorf("Priority is wrong: %s", message)
+	}
+	if !strings.Contains(message, fmt.Sprintf(" gopilot %d CONNECT [gopilot@32473 ", os.Getpid())) {
+		t.Errorf("Header is wrong: %s", message)
+	}
+	if !strings.HasSuffix(message, `[gopilot@32473 node="nodea" component="LDAP" host="ldap\"1\]"] connection failed`) {
+		t.Errorf("Structured data is wrong: %s", message)
+	}
+}
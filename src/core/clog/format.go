@@ -0,0 +1,128 @@
+/*
+Copyright (C) 2018 by Martin Langlotz aka stackshadow
+
+This file is part of gopilot, an rewrite of the copilot-project in go
+
+gopilot is free software: you can redistribute it and/or modify
+it under the terms of the GNU Lesser General Public License as published by
+the Free Software Foundation, version 3 of this License
+
+gopilot is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License
+along with gopilot.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package clog
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type formatFct func(*Entry) []byte
+
+var formatters = map[string]formatFct{
+	"text":   formatText,
+	"logfmt": formatLogfmt,
+	"json":   formatJSON,
+}
+
+const timeFormat = time.RFC3339Nano
+
+// formatText is the classic format: [LEVEL] [prefix] [group] message key=value
+func formatText(newEntry *Entry) []byte {
+	var line bytes.Buffer
+
+	fmt.Fprintf(&line, "[%s] [%s] [%s] %s", newEntry.Level, newEntry.Prefix, newEntry.Group, newEntry.Message)
+	newEntry.iterateFields(func(key string, value interface{}) {
+		fmt.Fprintf(&line, " %s=%s", key, logfmtValue(value))
+	})
+	line.WriteByte('\n')
+
+	return line.Bytes()
+}
+
+// formatLogfmt write time=... level=info prefix=... group=... msg="..." key=value
+func formatLogfmt(newEntry *Entry) []byte {
+	var line bytes.Buffer
+
+	fmt.Fprintf(&line, "time=%s level=%s prefix=%s group=%s msg=%s",
+		newEntry.Time.Format(timeFormat),
+		strings.ToLower(newEntry.Level.String()),
+		logfmtValue(newEntry.Prefix),
+		logfmtValue(newEntry.Group),
+		logfmtValue(newEntry.Message),
+	)
+	newEntry.iterateFields(func(key string, value interface{}) {
+		fmt.Fprintf(&line, " %s=%s", key, logfmtValue(value))
+	})
+	line.WriteByte('\n')
+
+	return line.Bytes()
+}
+
+// formatJSON write one json-object per line
+func formatJSON(newEntry *Entry) []byte {
+	var line bytes.Buffer
+
+	line.WriteString("{")
+	writeJSONField(&line, "time", newEntry.Time.Format(timeFormat), true)
+	writeJSONField(&line, "level", strings.ToLower(newEntry.Level.String()), false)
+	writeJSONField(&line, "prefix", newEntry.Prefix, false)
+	writeJSONField(&line, "group", newEntry.Group, false)
+	writeJSONField(&line, "msg", newEntry.Message, false)
+	newEntry.iterateFields(func(key string, value interface{}) {
+		if err, ok := value.(error); ok {
+			value = err.Error()
+		}
+		writeJSONField(&line, key, value, false)
+	})
+	line.WriteString("}\n")
+
+	return line.Bytes()
+}
+
+func writeJSONField(line *bytes.Buffer, key string, value interface{}, first bool) {
+	if !first {
+		line.WriteByte(',')
+	}
+
+	keyBytes, _ := json.Marshal(key)
+	valueBytes, err := json.Marshal(value)
+	if err != nil {
+		valueBytes, _ = json.Marshal(fmt.Sprintf("%v", value))
+	}
+
+	line.Write(keyBytes)
+	line.WriteByte(':')
+	line.Write(valueBytes)
+}
+
+// logfmtValue quote the value if needed
+func logfmtValue(value interface{}) string {
+	valueString := fmt.Sprintf("%v", value)
+	if valueString == "" || strings.ContainsAny(valueString, " =\"\t\r\n") {
+		return strconv.Quote(valueString)
+	}
+	return valueString
+}
+
+// iterateFields call fieldFct for every key-value, a key without a value get the value "MISSING"
+func (newEntry *Entry) iterateFields(fieldFct func(string, interface{})) {
+	for index := 0; index < len(newEntry.Fields); index += 2 {
+		key := fmt.Sprintf("%v", newEntry.Fields[index])
+		var value interface{} = "MISSING"
+		if index+1 < len(newEntry.Fields) {
+			value = newEntry.Fields[index+1]
+		}
+		fieldFct(key, value)
+	}
+}
@@ -0,0 +1,143 @@
+/*
+Copyright (C) 2018 by Martin Langlotz aka stackshadow
+
+This file is part of gopilot, an rewrite of the copilot-project in go
+
+gopilot is free software: you can redistribute it and/or modify
+it under the terms of the GNU Lesser General Public License as published by
+the Free Software Foundation, version 3 of this License
+
+gopilot is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License
+along with gopilot.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package clog
+
+import (
+	"strings"
+	"sync"
+)
+
+// HookFct is called for every written entry, it must not block and must not log
+type HookFct func(Entry)
+
+// Filter select entrys by level and prefix
+type Filter struct {
+	Level  Level
+	Prefix string // can end with *, empty match all
+}
+
+var historySize = 1000
+
+var historyMutex sync.Mutex
+var history []Entry
+var historyNext int
+
+var hooksMutex sync.Mutex
+var hooks = make(map[int]HookFct)
+var hooksLastID int
+
+// SetHistorySize set the count of entrys that are kept in memory, old entrys are dropped
+func SetHistorySize(size int) {
+	historyMutex.Lock()
+	defer historyMutex.Unlock()
+
+	historySize = size
+	history = nil
+	historyNext = 0
+}
+
+// History return the buffered entrys, which match the filter, oldest first
+// If limit is > 0, only the newest limit entrys are returned
+func History(filter Filter, limit int) []Entry {
+	historyMutex.Lock()
+	defer historyMutex.Unlock()
+
+	entrys := make([]Entry, 0)
+
+	// when the buffer is full, historyNext point to the oldest entry
+	for index := 0; index < len(history); index++ {
+		curEntry := history[(historyNext+index)%len(history)]
+		if filter.Match(&curEntry) {
+			entrys = append(entrys, curEntry)
+		}
+	}
+
+	if limit > 0 && len(entrys) > limit {
+		entrys = entrys[len(entrys)-limit:]
+	}
+
+	return entrys
+}
+
+// AddHook register a function, which is called for every new entry and return its id
+func AddHook(hookFct HookFct) int {
+	hooksMutex.Lock()
+	defer hooksMutex.Unlock()
+
+	hooksLastID++
+	hooks[hooksLastID] = hookFct
+
+	return hooksLastID
+}
+
+// RemoveHook remove the hook with id
+func RemoveHook(id int) {
+	hooksMutex.Lock()
+	defer hooksMutex.Unlock()
+
+	delete(hooks, id)
+}
+
+// MatchPrefix return true if prefix match the pattern
+// A pattern can end with *, an empty pattern match all prefixes
+func MatchPrefix(pattern, prefix string) bool {
+	if pattern == "" || pattern == "*" {
+		return true
+	}
+	if strings.HasSuffix(pattern, "*") {
+		return strings.HasPrefix(prefix, strings.TrimSuffix(pattern, "*"))
+	}
+	return pattern == prefix
+}
+
+// Match return true if the entry match the filter
+func (filter *Filter) Match(curEntry *Entry) bool {
+	return curEntry.Level >= filter.Level && MatchPrefix(filter.Prefix, curEntry.Prefix)
+}
+
+// FieldMap return the key-values of the entry as map
+func (curEntry *Entry) FieldMap() map[string]interface{} {
+	fieldMap := make(map[string]interface{})
+	curEntry.iterateFields(func(key string, value interface{}) {
+		if err, ok := value.(error); ok {
+			value = err.Error()
+		}
+		fieldMap[key] = value
+	})
+	return fieldMap
+}
+
+func addHistory(newEntry Entry) {
+	historyMutex.Lock()
+	if historySize > 0 {
+		if len(history) < historySize {
+			history = append(history, newEntry)
+		} else {
+			history[historyNext] = newEntry
+			historyNext = (historyNext + 1) % historySize
+		}
+	}
+	historyMutex.Unlock()
+
+	hooksMutex.Lock()
+	for _, hookFct := range hooks {
+		hookFct(newEntry)
+	}
+	hooksMutex.Unlock()
+}
@@ -0,0 +1,121 @@
+/*
+Copyright (C) 2018 by Martin Langlotz aka stackshadow
+
+This file is part of gopilot, an rewrite of the copilot-project in go
+
+gopilot is free software: you can redistribute it and/or modify
+it under the terms of the GNU Lesser General Public License as published by
+the Free Software Foundation, version 3 of this License
+
+gopilot is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License
+along with gopilot.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package clog
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// rotateFile is a log-file which will be rotated by size and age
+// rotated files get the suffix .YYYYMMDD-hhmmss.sss
+type rotateFile struct {
+	fileName   string
+	maxSize    int64         // 0 = no limit
+	maxAge     time.Duration // 0 = no limit
+	maxBackups int
+
+	file   *os.File
+	size   int64
+	opened time.Time
+}
+
+func openRotateFile(fileName string, maxSize int64, maxAge time.Duration, maxBackups int) (*rotateFile, error) {
+	newFile := rotateFile{
+		fileName:   fileName,
+		maxSize:    maxSize,
+		maxAge:     maxAge,
+		maxBackups: maxBackups,
+	}
+
+	err := newFile.open()
+	if err != nil {
+		return nil, err
+	}
+
+	return &newFile, nil
+}
+
+func (curFile *rotateFile) open() error {
+
+	file, err := os.OpenFile(curFile.fileName, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0640)
+	if err != nil {
+		return err
+	}
+
+	fileInfo, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	curFile.file = file
+	curFile.size = fileInfo.Size()
+	curFile.opened = time.Now()
+
+	return nil
+}
+
+// Write the data and rotate before, if needed
+func (curFile *rotateFile) Write(data []byte) (int, error) {
+
+	needRotate := curFile.maxSize > 0 && curFile.size > 0 && curFile.size+int64(len(data)) > curFile.maxSize
+	needRotate = needRotate || (curFile.maxAge > 0 && time.Since(curFile.opened) > curFile.maxAge)
+
+	if needRotate {
+		if err := curFile.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	written, err := curFile.file.Write(data)
+	curFile.size += int64(written)
+
+	return written, err
+}
+
+func (curFile *rotateFile) rotate() error {
+
+	curFile.file.Close()
+
+	rotatedName := curFile.fileName + "." + time.Now().Format("20060102-150405.000")
+	err := os.Rename(curFile.fileName, rotatedName)
+	if err == nil {
+		curFile.removeBackups()
+	}
+
+	return curFile.open()
+}
+
+// removeBackups remove the oldest rotated files, so that only maxBackups exist
+func (curFile *rotateFile) removeBackups() {
+
+	backups, err := filepath.Glob(curFile.fileName + ".*")
+	if err != nil || len(backups) <= curFile.maxBackups {
+		return
+	}
+
+	// the suffix is sortable
+	sort.Strings(backups)
+	for _, backup := range backups[:len(backups)-curFile.maxBackups] {
+		os.Remove(backup)
+	}
+}
@@ -0,0 +1,311 @@
+/*
+Copyright (C) 2018 by Martin Langlotz aka stackshadow
+
+This file is part of gopilot, an rewrite of the copilot-project in go
+
+gopilot is free software: you can redistribute it and/or modify
+it under the terms of the GNU Lesser General Public License as published by
+the Free Software Foundation, version 3 of this License
+
+gopilot is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License
+along with gopilot.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package clog
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// syslogSDID is our structured-data-id ( 32473 is reserved for documentation by IANA )
+const syslogSDID = "gopilot@32473"
+
+var syslogFacilities = map[string]int{
+	"kern": 0, "user": 1, "mail": 2, "daemon": 3, "auth": 4, "syslog": 5,
+	"lpr": 6, "news": 7, "uucp": 8, "cron": 9, "authpriv": 10, "ftp": 11,
+	"local0": 16, "local1": 17, "local2": 18, "local3": 19,
+	"local4": 20, "local5": 21, "local6": 22, "local7": 23,
+}
+
+// syslogWriter send entrys in RFC 5424 format to a syslog-daemon
+type syslogWriter struct {
+	mutex    sync.Mutex
+	network  string // unixgram, unix, udp or tcp
+	address  string
+	conn     net.Conn
+	facility int
+	identity string
+	hostname string
+}
+
+// a write to the syslog-daemon run while all logging waits, so it must not block longer than this
+var syslogWriteTimeout = time.Second
+
+// private vars
+var syslogMutex sync.Mutex
+var syslogOutput *syslogWriter
+var nodeName string
+
+// SetNodeName set the node-name, which is added to every syslog-entry
+func SetNodeName(name string) {
+	syslogMutex.Lock()
+	nodeName = name
+	syslogMutex.Unlock()
+}
+
+// SetSyslog send all log-entrys additional to a syslog-daemon
+//
+// target can be:
+//   - unix:///dev/log or only /dev/log
+//   - udp://localhost:514
+//   - tcp://localhost:514
+//
+// An empty target disable the syslog-output
+func SetSyslog(target, facility, identity string) error {
+
+	if target == "" {
+		syslogMutex.Lock()
+		oldOutput := syslogOutput
+		syslogOutput = nil
+		syslogMutex.Unlock()
+
+		if oldOutput != nil {
+			oldOutput.close()
+		}
+		return nil
+	}
+
+	facilityCode, ok := syslogFacilities[strings.ToLower(facility)]
+	if !ok {
+		return fmt.Errorf("Unknown syslog-facility '%s'", facility)
+	}
+
+	newWriter := &syslogWriter{
+		facility: facilityCode,
+		identity: syslogName(identity, 48),
+	}
+
+	newWriter.hostname, _ = os.Hostname()
+	newWriter.hostname = syslogName(newWriter.hostname, 255)
+
+	if strings.HasPrefix(target, "/") {
+		newWriter.network = "unix"
+		newWriter.address = target
+	} else {
+		targetURL, err := url.Parse(target)
+		if err != nil {
+			return err
+		}
+		switch targetURL.Scheme {
+		case "unix", "unixgram":
+			newWriter.network = targetURL.Scheme
+			newWriter.address = targetURL.Path
+		case "udp", "tcp":
+			newWriter.network = targetURL.Scheme
+			newWriter.address = targetURL.Host
+		default:
+			return fmt.Errorf("Unknown syslog-target '%s'", target)
+		}
+	}
+
+	err := newWriter.connect(time.Second * 5)
+	if err != nil {
+		return err
+	}
+
+	syslogMutex.Lock()
+	oldOutput := syslogOutput
+	syslogOutput = newWriter
+	syslogMutex.Unlock()
+
+	if oldOutput != nil {
+		oldOutput.close()
+	}
+
+	return nil
+}
+
+// connect to the syslog-daemon, for unix we try datagram first and then stream
+func (writer *syslogWriter) connect(timeout time.Duration) error {
+
+	if writer.network == "unix" {
+		conn, err := net.DialTimeout("unixgram", writer.address, timeout)
+		if err == nil {
+			writer.conn = conn
+			return nil
+		}
+
+		conn, err = net.DialTimeout("unix", writer.address, timeout)
+		if err != nil {
+			return err
+		}
+		writer.network = "unixstream"
+		writer.conn = conn
+		return nil
+	}
+
+	conn, err := net.DialTimeout(writer.network, writer.address, timeout)
+	if err != nil {
+		return err
+	}
+	writer.conn = conn
+	return nil
+}
+
+func (writer *syslogWriter) close() {
+	writer.mutex.Lock()
+	if writer.conn != nil {
+		writer.conn.Close()
+		writer.conn = nil
+	}
+	writer.mutex.Unlock()
+}
+
+// send the message with a write-deadline, writer.mutex must be locked
+func (writer *syslogWriter) send(message []byte) error {
+	writer.conn.SetWriteDeadline(time.Now().Add(syslogWriteTimeout))
+	_, err := writer.conn.Write(message)
+	return err
+}
+
+// write send the entry, on an error we reconnect once
+// if the daemon dont read in time, the entry is dropped and we reconnect with the next entry
+func (writer *syslogWriter) write(newEntry *Entry, node string) {
+
+	message := formatSyslog(newEntry, writer.facility, writer.hostname, writer.identity, node)
+
+	// stream sockets need framing, we use octet-counting ( RFC 6587 )
+	if writer.network == "tcp" || writer.network == "unixstream" {
+		message = append([]byte(fmt.Sprintf("%d ", len(message))), message...)
+	}
+
+	writer.mutex.Lock()
+	defer writer.mutex.Unlock()
+
+	if writer.conn != nil {
+		err := writer.send(message)
+		if err == nil {
+			return
+		}
+		// a part of the message could be written, so the stream can not be used anymore
+		writer.conn.Close()
+		writer.conn = nil
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			return
+		}
+	}
+
+	if writer.network == "unixstream" {
+		writer.network = "unix"
+	}
+	if err := writer.connect(syslogWriteTimeout); err != nil {
+		return
+	}
+	if err := writer.send(message); err != nil {
+		writer.conn.Close()
+		writer.conn = nil
+	}
+}
+
+func writeSyslog(newEntry *Entry) {
+	syslogMutex.Lock()
+	curOutput := syslogOutput
+	curNodeName := nodeName
+	syslogMutex.Unlock()
+
+	if curOutput != nil {
+		curOutput.write(newEntry, curNodeName)
+	}
+}
+
+// syslogSeverity map our level to the syslog-severity
+func syslogSeverity(level Level) int {
+	switch level {
+	case LevelDebug:
+		return 7
+	case LevelInfo:
+		return 6
+	case LevelError:
+		return 3
+	}
+	return 5
+}
+
+// formatSyslog create an RFC 5424 message:
+// <PRI>1 TIMESTAMP HOSTNAME APP-NAME PROCID MSGID [SD] MSG
+func formatSyslog(newEntry *Entry, facility int, hostname, identity, node string) []byte {
+	var line bytes.Buffer
+
+	fmt.Fprintf(&line, "<%d>1 %s %s %s %d %s ",
+		facility*8+syslogSeverity(newEntry.Level),
+		newEntry.Time.Format(timeFormat),
+		syslogNil(hostname),
+		syslogNil(identity),
+		os.Getpid(),
+		syslogNil(syslogName(newEntry.Group, 32)),
+	)
+
+	line.WriteString("[" + syslogSDID)
+	if node != "" {
+		fmt.Fprintf(&line, " node=\"%s\"", syslogParamValue(node))
+	}
+	fmt.Fprintf(&line, " component=\"%s\"", syslogParamValue(newEntry.Prefix))
+	newEntry.iterateFields(func(key string, value interface{}) {
+		key = syslogName(key, 32)
+		if key == "" {
+			return
+		}
+		fmt.Fprintf(&line, " %s=\"%s\"", key, syslogParamValue(fmt.Sprintf("%v", value)))
+	})
+	line.WriteString("]")
+
+	if newEntry.Message != "" {
+		line.WriteString(" " + newEntry.Message)
+	}
+
+	return line.Bytes()
+}
+
+// syslogName remove all chars that are not allowed in header-fields and param-names
+func syslogName(name string, maxLen int) string {
+	var cleanName strings.Builder
+	for _, char := range name {
+		if char < 33 || char > 126 || char == '=' || char == ']' || char == '"' {
+			continue
+		}
+		cleanName.WriteRune(char)
+	}
+
+	if cleanName.Len() > maxLen {
+		return cleanName.String()[:maxLen]
+	}
+	return cleanName.String()
+}
+
+// syslogNil return the nil-value of RFC 5424 for an empty string
+func syslogNil(value string) string {
+	if value == "" {
+		return "-"
+	}
+	return value
+}
+
+// syslogParamValue escape '"', '\' and ']'
+func syslogParamValue(value string) string {
+	value = strings.Replace(value, "\\", "\\\\", -1)
+	value = strings.Replace(value, "\"", "\\\"", -1)
+	value = strings.Replace(value, "]", "\\]", -1)
+	return value
+}
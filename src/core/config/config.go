@@ -10,6 +10,7 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sync"
 )
 
 var logging clog.Logger
@@ -21,7 +22,31 @@ var NodeName string
 // ConfigPath the path where all config files will stored
 var ConfigPath string
 
-var jsonConfigNew map[string]interface{}
+// Config is the json-config of a node
+// Normally there is one config per process ( Default ), tests can create more with New()
+type Config struct {
+	nodeName   *string
+	configPath *string
+
+	jsonConfigNew map[string]interface{}
+	mutex         sync.RWMutex // plugins use the config from many goroutines
+}
+
+// Default is the config of this process, it use NodeName and ConfigPath
+var Default = &Config{
+	nodeName:      &NodeName,
+	configPath:    &ConfigPath,
+	jsonConfigNew: make(map[string]interface{}),
+}
+
+// New create an new empty config for nodeName, which is saved inside configPath
+func New(nodeName, configPath string) *Config {
+	return &Config{
+		nodeName:      &nodeName,
+		configPath:    &configPath,
+		jsonConfigNew: make(map[string]interface{}),
+	}
+}
 
 // ParseCmdLine parse your command line parameter to internal variables
 func ParseCmdLine() {
@@ -43,11 +68,28 @@ func Init() {
 	logging = clog.New("CORE")
 	logging.Info("HOST", "MyNode: "+NodeName)
 
-	jsonConfigNew = make(map[string]interface{})
+	Default.mutex.Lock()
+	Default.jsonConfigNew = make(map[string]interface{})
+	Default.mutex.Unlock()
+}
+
+// NodeName return the name of the node, this config belongs to
+func (curConfig *Config) NodeName() string {
+	return *curConfig.nodeName
+}
+
+// Path return the path where all config files of the node will stored
+func (curConfig *Config) Path() string {
+	return *curConfig.configPath
 }
 
 // Read will read the config from an file calles core.json
 func Read() {
+	Default.Read()
+}
+
+// Read will read the config from an file calles core.json
+func (curConfig *Config) Read() {
 
 	// current path
 	ex, err := os.Executable()
@@ -57,17 +99,26 @@ func Read() {
 	}
 
 	// Open our jsonFile
-	jsonFile, err := os.Open(ConfigPath + "/core.json")
+	jsonFile, err := os.Open(curConfig.Path() + "/core.json")
 	if err != nil {
 		// okay non existant, create a new one
-		Save()
+		curConfig.Save()
 		return
 	}
 	defer jsonFile.Close()
 
-	logging.Debug("CONFIG", "Successfully Opened '"+ConfigPath+"/core.json'")
+	logging.Debug("CONFIG", "Successfully Opened '"+curConfig.Path()+"/core.json'")
 	byteValue, _ := ioutil.ReadAll(jsonFile)
-	err = json.Unmarshal(byteValue, &jsonConfigNew)
+	jsonConfig := make(map[string]interface{})
+	err = json.Unmarshal(byteValue, &jsonConfig)
+	if err != nil {
+		logging.Error("CONFIG", err.Error())
+		return
+	}
+
+	curConfig.mutex.Lock()
+	curConfig.jsonConfigNew = jsonConfig
+	curConfig.mutex.Unlock()
 
 	/*
 		if jsonNodes, ok := jsonConfig["nodes"].(map[string]interface{}); ok {
@@ -88,10 +139,18 @@ func Read() {
 
 // GetJSONObject Return an json object
 func GetJSONObject(name string) (map[string]interface{}, error) {
+	return Default.GetJSONObject(name)
+}
+
+// GetJSONObject Return a copy of an json object, changes must be saved with SetJSONObject()
+func (curConfig *Config) GetJSONObject(name string) (map[string]interface{}, error) {
+
+	curConfig.mutex.RLock()
+	defer curConfig.mutex.RUnlock()
 
 	// then we try to get the object
-	if jsonObject, ok := jsonConfigNew[name].(map[string]interface{}); ok {
-		return jsonObject, nil
+	if jsonObject, ok := curConfig.jsonConfigNew[name].(map[string]interface{}); ok {
+		return copyJSON(jsonObject).(map[string]interface{}), nil
 	}
 
 	return nil, fmt.Errorf("No Object found with name '%s'", name)
@@ -99,17 +158,55 @@ func GetJSONObject(name string) (map[string]interface{}, error) {
 
 // SetJSONObject set an json object
 func SetJSONObject(name string, jsonNode map[string]interface{}) error {
+	return Default.SetJSONObject(name, jsonNode)
+}
 
-	// save it
-	jsonConfigNew[name] = jsonNode
+// SetJSONObject set an json object
+func (curConfig *Config) SetJSONObject(name string, jsonNode map[string]interface{}) error {
+
+	curConfig.mutex.Lock()
+	defer curConfig.mutex.Unlock()
+
+	// save a copy, so the caller can change jsonNode
+	curConfig.jsonConfigNew[name] = copyJSON(jsonNode)
 
 	return nil
 }
 
+// copyJSON return a deep copy of an unmarshaled json-value
+func copyJSON(value interface{}) interface{} {
+
+	switch typedValue := value.(type) {
+	case map[string]interface{}:
+		newMap := make(map[string]interface{}, len(typedValue))
+		for key, element := range typedValue {
+			newMap[key] = copyJSON(element)
+		}
+		return newMap
+	case []interface{}:
+		newArray := make([]interface{}, len(typedValue))
+		for index, element := range typedValue {
+			newArray[index] = copyJSON(element)
+		}
+		return newArray
+	}
+
+	return value
+}
+
 // Save save you config to the core.json
 func Save() {
-	byteValue, _ := json.MarshalIndent(jsonConfigNew, "", "    ")
-	err := ioutil.WriteFile(ConfigPath+"/core.json", byteValue, 0644)
+	Default.Save()
+}
+
+// Save save you config to the core.json
+func (curConfig *Config) Save() {
+	// we also hold the lock while writing, so an older config never overwrite a newer one
+	curConfig.mutex.Lock()
+	defer curConfig.mutex.Unlock()
+
+	byteValue, _ := json.MarshalIndent(curConfig.jsonConfigNew, "", "    ")
+	err := ioutil.WriteFile(curConfig.Path()+"/core.json", byteValue, 0644)
 	if err != nil {
 		logging.Error("CONFIG", err.Error())
 		os.Exit(-1)
@@ -17,7 +17,11 @@ along with gopilot.  If not, see <http://www.gnu.org/licenses/>.
 */
 package config
 
-import "testing"
+import (
+	"strconv"
+	"sync"
+	"testing"
+)
 
 func TestInit(t *testing.T) {
 	ParseCmdLine()
@@ -28,6 +32,9 @@ func TestInit(t *testing.T) {
 
 	t.Run("Test non existing config", GetNonExistingConfig)
 	t.Run("Test creation of new config", CreateNewConfigEntry)
+	t.Run("Test diff of two objects", DiffObjects)
+	t.Run("Test merge of two objects", MergeObjects)
+	t.Run("Test concurrent access", ConcurrentAccess)
 }
 
 func GetNonExistingConfig(t *testing.T) {
@@ -55,3 +62,97 @@ func CreateNewConfigEntry(t *testing.T) {
 		t.FailNow()
 	}
 }
+
+func DiffObjects(t *testing.T) {
+
+	oldObject := map[string]interface{}{
+		"host": "127.0.0.1",
+		"port": float64(389),
+		"sub":  map[string]interface{}{"a": "b", "c": "d"},
+	}
+	newObject := map[string]interface{}{
+		"host": "10.0.0.1",
+		"sub":  map[string]interface{}{"a": "b", "e": "f"},
+	}
+
+	diff := Diff(oldObject, newObject)
+	if len(diff) != 4 {
+		t.Errorf("We expect 4 changes, but got %d", len(diff))
+		t.FailNow()
+	}
+
+	if diff[0].Path != "/host" || diff[0].Op != "change" ||
+		diff[1].Path != "/port" || diff[1].Op != "remove" ||
+		diff[2].Path != "/sub/c" || diff[2].Op != "remove" ||
+		diff[3].Path != "/sub/e" || diff[3].Op != "add" {
+		t.Errorf("Diff is wrong: %+v", diff)
+		t.FailNow()
+	}
+
+	if len(Diff(oldObject, oldObject)) != 0 {
+		t.Error("The same object should not have a diff")
+		t.FailNow()
+	}
+}
+
+func MergeObjects(t *testing.T) {
+
+	base := map[string]interface{}{
+		"host": "127.0.0.1",
+		"port": float64(389),
+		"sub":  map[string]interface{}{"a": "b", "c": "d"},
+	}
+	override := map[string]interface{}{
+		"port": nil,
+		"sub":  map[string]interface{}{"c": "x"},
+	}
+
+	merged := Merge(base, override)
+	if _, ok := merged["port"]; ok {
+		t.Error("port should be removed")
+		t.FailNow()
+	}
+	if merged["host"] != "127.0.0.1" {
+		t.Error("host should not be touched")
+		t.FailNow()
+	}
+	sub := merged["sub"].(map[string]interface{})
+	if sub["a"] != "b" || sub["c"] != "x" {
+		t.Errorf("sub is not merged: %+v", sub)
+		t.FailNow()
+	}
+
+	// base must be untouched
+	if base["sub"].(map[string]interface{})["c"] != "d" {
+		t.Error("Merge changed the base object")
+		t.FailNow()
+	}
+}
+
+func ConcurrentAccess(t *testing.T) {
+
+	testConfig := New("nodea", t.TempDir())
+	testConfig.SetJSONObject("shared", map[string]interface{}{"sub": map[string]interface{}{}})
+
+	var wait sync.WaitGroup
+	for worker := 0; worker < 4; worker++ {
+		wait.Add(1)
+		go func(worker int) {
+			defer wait.Done()
+			for count := 0; count < 50; count++ {
+				shared, _ := testConfig.GetJSONObject("shared")
+				shared["sub"].(map[string]interface{})[strconv.Itoa(worker)] = count
+				testConfig.SetJSONObject("shared", shared)
+				testConfig.Save()
+			}
+		}(worker)
+	}
+	wait.Wait()
+
+	// changes of a copy are not inside the config
+	shared, _ := testConfig.GetJSONObject("shared")
+	shared["sub"].(map[string]interface{})["copy"] = true
+	if shared, _ = testConfig.GetJSONObject("shared"); shared["sub"].(map[string]interface{})["copy"] != nil {
+		t.Error("GetJSONObject should return a copy")
+	}
+}
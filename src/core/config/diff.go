@@ -0,0 +1,126 @@
+/*
+Copyright (C) 2019 by Martin Langlotz aka stackshadow
+
+This file is part of gopilot, an rewrite of the copilot-project in go
+
+gopilot is free software: you can redistribute it and/or modify
+it under the terms of the GNU Lesser General Public License as published by
+the Free Software Foundation, version 3 of this License
+
+gopilot is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License
+along with gopilot.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package config
+
+import (
+	"encoding/json"
+	"reflect"
+	"sort"
+)
+
+// DiffEntry describe a single change between two json objects
+type DiffEntry struct {
+	Path string      `json:"path"`
+	Op   string      `json:"op"` // add, remove or change
+	Old  interface{} `json:"old,omitempty"`
+	New  interface{} `json:"new,omitempty"`
+}
+
+// Diff compare two json objects and return all changes sorted by path
+// Arrays are compared as a whole value
+func Diff(oldObject, newObject map[string]interface{}) []DiffEntry {
+	diff := make([]DiffEntry, 0)
+	diffObject("", oldObject, newObject, &diff)
+
+	sort.Slice(diff, func(i, j int) bool {
+		return diff[i].Path < diff[j].Path
+	})
+
+	return diff
+}
+
+func diffObject(path string, oldObject, newObject map[string]interface{}, diff *[]DiffEntry) {
+
+	for key, oldValue := range oldObject {
+		curPath := path + "/" + key
+
+		newValue, ok := newObject[key]
+		if !ok {
+			*diff = append(*diff, DiffEntry{Path: curPath, Op: "remove", Old: oldValue})
+			continue
+		}
+
+		// both are objects, go deeper
+		oldChild, oldIsObject := oldValue.(map[string]interface{})
+		newChild, newIsObject := newValue.(map[string]interface{})
+		if oldIsObject && newIsObject {
+			diffObject(curPath, oldChild, newChild, diff)
+			continue
+		}
+
+		if !reflect.DeepEqual(oldValue, newValue) {
+			*diff = append(*diff, DiffEntry{Path: curPath, Op: "change", Old: oldValue, New: newValue})
+		}
+	}
+
+	for key, newValue := range newObject {
+		if _, ok := oldObject[key]; !ok {
+			*diff = append(*diff, DiffEntry{Path: path + "/" + key, Op: "add", New: newValue})
+		}
+	}
+}
+
+// Merge return a copy of base, where all values from override are set
+// Objects are merged recursive, a null-value inside override remove the key
+func Merge(base, override map[string]interface{}) map[string]interface{} {
+
+	merged := Copy(base)
+	if merged == nil {
+		merged = make(map[string]interface{})
+	}
+
+	for key, overrideValue := range override {
+
+		if overrideValue == nil {
+			delete(merged, key)
+			continue
+		}
+
+		baseChild, baseIsObject := merged[key].(map[string]interface{})
+		overrideChild, overrideIsObject := overrideValue.(map[string]interface{})
+		if baseIsObject && overrideIsObject {
+			merged[key] = Merge(baseChild, overrideChild)
+			continue
+		}
+
+		merged[key] = overrideValue
+	}
+
+	return merged
+}
+
+// Copy return a deep copy of an json object
+func Copy(jsonObject map[string]interface{}) map[string]interface{} {
+	if jsonObject == nil {
+		return nil
+	}
+
+	byteValue, err := json.Marshal(jsonObject)
+	if err != nil {
+		return nil
+	}
+
+	var newObject map[string]interface{}
+	err = json.Unmarshal(byteValue, &newObject)
+	if err != nil {
+		return nil
+	}
+
+	return newObject
+}
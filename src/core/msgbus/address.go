@@ -0,0 +1,43 @@
+/*
+Copyright (C) 2019 by Martin Langlotz aka stackshadow
+
+This file is part of gopilot, an rewrite of the copilot-project in go
+
+gopilot is free software: you can redistribute it and/or modify
+it under the terms of the GNU Lesser General Public License as published by
+the Free Software Foundation, version 3 of this License
+
+gopilot is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License
+along with gopilot.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package msgbus
+
+import "strings"
+
+// a client is something outside of the node, like a browser, which get messages over a plugin of the node
+// its address is "nodeName/clientName", so answers from other nodes find the way back
+const clientSeparator = "/"
+
+// ClientAddress return the address of clientName on nodeName
+func ClientAddress(nodeName, clientName string) string {
+	return nodeName + clientSeparator + clientName
+}
+
+// AddressNode return the node of an address, for a node it is the address itself
+func AddressNode(address string) string {
+	if index := strings.Index(address, clientSeparator); index >= 0 {
+		return address[:index]
+	}
+	return address
+}
+
+// IsClientAddress return true if address belongs to a client and not to a node
+func IsClientAddress(address string) bool {
+	return strings.Contains(address, clientSeparator)
+}
@@ -45,26 +45,52 @@ type msgListener struct {
 	onMessage  onMessageFct
 }
 
-var messageList chan Msg
-var messageListLastID int
-var messageListeners []msgListener
-var messageListenersMutex sync.Mutex
+// Bus deliver messages between the plugins of a single node
+// Normally there is one bus per process ( Default ), tests can create more with New()
+type Bus struct {
+	messageList            chan Msg
+	messageListLastID      int
+	messageListLastIDMutex sync.Mutex
+	messageListeners       []msgListener
+	messageListenersMutex  sync.Mutex
+	pluginList             []*Plugin
+	pluginListMutex        sync.Mutex
+}
+
+// Default is the bus of this process, which is used by the package-functions
+var Default = &Bus{}
 
 // callbacks
 type onMessageFct func(*Msg, string /* group */, string /*command*/, string /*payload*/) // For example: onMessage(message *msgbus.Msg, group, command, payload string)
 
+// MsgBusInit start the worker of the default bus
 func MsgBusInit() {
+	Default.start()
+}
 
-	messageList = make(chan Msg, 10)
-	messageListLastID = 0
+// New create a new bus and start its worker
+func New() *Bus {
+	newBus := &Bus{}
+	newBus.start()
+	return newBus
+}
+
+func (curBus *Bus) start() {
+
+	curBus.messageList = make(chan Msg, 10)
+	curBus.messageListLastID = 0
 
 	for w := 1; w <= 1; w++ {
 		logging.Debug("WORKER "+strconv.Itoa(w), "Start")
-		go worker2(w, messageList)
+		go curBus.worker2(w, curBus.messageList)
 	}
 }
 
 func ListenForGroup(pluginName string, group string, onMessageFP onMessageFct) {
+	Default.ListenForGroup(pluginName, group, onMessageFP)
+}
+
+func (curBus *Bus) ListenForGroup(pluginName string, group string, onMessageFP onMessageFct) {
 
 	// create new plugin and append it
 	newListener := msgListener{
@@ -75,9 +101,9 @@ func ListenForGroup(pluginName string, group string, onMessageFP onMessageFct) {
 		onMessage:  onMessageFP,
 	}
 
-	messageListenersMutex.Lock()
-	messageListeners = append(messageListeners, newListener)
-	messageListenersMutex.Unlock()
+	curBus.messageListenersMutex.Lock()
+	curBus.messageListeners = append(curBus.messageListeners, newListener)
+	curBus.messageListenersMutex.Unlock()
 
 	if group != "" {
 		logging.Debug(fmt.Sprintf("PLUGIN %s", newListener.pluginName), "Listen for group: "+group)
@@ -88,11 +114,15 @@ func ListenForGroup(pluginName string, group string, onMessageFP onMessageFct) {
 }
 
 func ListenNoMorePlugin(pluginName string) {
+	Default.ListenNoMorePlugin(pluginName)
+}
 
-	messageListenersMutex.Lock()
+func (curBus *Bus) ListenNoMorePlugin(pluginName string) {
+
+	curBus.messageListenersMutex.Lock()
 	var NewMessageListeners []msgListener
 
-	for listenerIndex, curListener := range messageListeners {
+	for listenerIndex, curListener := range curBus.messageListeners {
 		//curListener := messageListeners[listenerIndex]
 
 		if curListener.pluginName == pluginName {
@@ -106,19 +136,29 @@ func ListenNoMorePlugin(pluginName string) {
 
 	}
 
-	messageListeners = NewMessageListeners
-	messageListenersMutex.Unlock()
+	curBus.messageListeners = NewMessageListeners
+	curBus.messageListenersMutex.Unlock()
 
 }
 
 func ListenersCount() int {
-	return len(messageListeners)
+	return Default.ListenersCount()
+}
+
+func (curBus *Bus) ListenersCount() int {
+	curBus.messageListenersMutex.Lock()
+	defer curBus.messageListenersMutex.Unlock()
+	return len(curBus.messageListeners)
 }
 
 func Publish(pluginName string, nodeSource, nodeTarget, group, command, payload string) {
+	Default.Publish(pluginName, nodeSource, nodeTarget, group, command, payload)
+}
+
+func (curBus *Bus) Publish(pluginName string, nodeSource, nodeTarget, group, command, payload string) {
 
 	newMessage := Msg{
-		id:            messageListLastID,
+		id:            curBus.nextMessageID(),
 		pluginNameSrc: pluginName,
 		NodeSource:    nodeSource,
 		NodeTarget:    nodeTarget,
@@ -134,17 +174,19 @@ func Publish(pluginName string, nodeSource, nodeTarget, group, command, payload
 		),
 	)
 
-	messageListLastID++
-
-	messageList <- newMessage
+	curBus.messageList <- newMessage
 
 	//close(messageList)
 
 }
 
 func PublishMsg(pluginName string, newMessage Msg) {
+	Default.PublishMsg(pluginName, newMessage)
+}
 
-	newMessage.id = messageListLastID
+func (curBus *Bus) PublishMsg(pluginName string, newMessage Msg) {
+
+	newMessage.id = curBus.nextMessageID()
 	newMessage.pluginNameSrc = pluginName
 
 	logging.Debug("MSG "+strconv.Itoa(newMessage.id),
@@ -153,15 +195,22 @@ func PublishMsg(pluginName string, newMessage Msg) {
 			newMessage.pluginNameSrc, newMessage.NodeTarget, newMessage.Group, newMessage.Command,
 		),
 	)
-	messageListLastID++
-
-	messageList <- newMessage
+	curBus.messageList <- newMessage
 
 	//close(messageList)
 
 }
 
-func worker2(no int, messages <-chan Msg) {
+// nextMessageID return the id of the next message, plugins publish from many goroutines
+func (curBus *Bus) nextMessageID() int {
+	curBus.messageListLastIDMutex.Lock()
+	defer curBus.messageListLastIDMutex.Unlock()
+
+	curBus.messageListLastID++
+	return curBus.messageListLastID - 1
+}
+
+func (curBus *Bus) worker2(no int, messages <-chan Msg) {
 	workerName := fmt.Sprintf("WORKER %d", no)
 	logging.Debug(workerName, "Run")
 
@@ -171,9 +220,9 @@ func worker2(no int, messages <-chan Msg) {
 
 		//logging.Debug(workerName, fmt.Sprintf("pluginList contains %d Plugins", len(pluginList)))
 
-		messageListenersMutex.Lock()
-		for listenerIndex := range messageListeners {
-			curListener := messageListeners[listenerIndex]
+		curBus.messageListenersMutex.Lock()
+		for listenerIndex := range curBus.messageListeners {
+			curListener := curBus.messageListeners[listenerIndex]
 
 			// skip if the sender is also the reciever
 			if curListener.pluginName == curMessage.pluginNameSrc {
@@ -210,40 +259,37 @@ func worker2(no int, messages <-chan Msg) {
 			}
 
 		}
-		messageListenersMutex.Unlock()
+		curBus.messageListenersMutex.Unlock()
 
 	}
 
 }
 
 func (curMessage *Msg) ToJsonByteArray() ([]uint8, error) {
-
-	b, err := json.Marshal(curMessage)
-	if err != nil {
-		fmt.Println("error:", err)
-	}
-
-	return b, nil
+	return json.Marshal(curMessage)
 }
 
 func (curMessage *Msg) ToJsonString() (string, error) {
 
 	b, err := json.Marshal(curMessage)
 	if err != nil {
-		fmt.Println("error:", err)
+		return "", err
 	}
 
 	return string(b), nil
 }
 
+// FromJsonString parse a message we get from outside, every message need a group and a command
 func FromJsonString(jsonString string) (Msg, error) {
 
 	var newMessage Msg
 
 	err := json.Unmarshal([]byte(jsonString), &newMessage)
 	if err != nil {
-		fmt.Println("error: ", err)
-		return newMessage, err
+		return Msg{}, fmt.Errorf("Message is not valid: %s", err.Error())
+	}
+	if newMessage.Group == "" || newMessage.Command == "" {
+		return Msg{}, fmt.Errorf("Message without group or command")
 	}
 
 	return newMessage, nil
@@ -251,7 +297,7 @@ func FromJsonString(jsonString string) (Msg, error) {
 
 func (curMessage *Msg) Answer(curPlugin *Plugin, command, payload string) error {
 
-	Publish(
+	curPlugin.getBus().Publish(
 		curPlugin.id,
 		curMessage.NodeTarget,
 		curMessage.NodeSource,
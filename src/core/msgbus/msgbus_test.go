@@ -22,6 +22,7 @@ import "fmt"
 import "time"
 import "core/clog"
 import "os"
+import "sync/atomic"
 
 func TestInit(t *testing.T) {
 
@@ -31,6 +32,7 @@ func TestInit(t *testing.T) {
 	t.Run("Test register/derefister", RegisterDeregister)
 	t.Run("Test json message", jsonMessage)
 	t.Run("Test listener", pluginListener)
+	t.Run("Test client address", clientAddress)
 }
 
 func RegisterDeregister(t *testing.T) {
@@ -123,6 +125,13 @@ func jsonMessage(t *testing.T) {
 		return
 	}
 
+	// invalid messages
+	for _, jsonString := range []string{"", "{", "[]", "{\"g\":\"grp\"}", "{\"c\":\"cmd\"}", "{\"g\":1,\"c\":\"cmd\"}"} {
+		if _, err := FromJsonString(jsonString); err == nil {
+			t.Errorf("Message '%s' should be invalid", jsonString)
+		}
+	}
+
 }
 
 func pluginListener(t *testing.T) {
@@ -150,18 +159,18 @@ func pluginListener(t *testing.T) {
 	time.Sleep(time.Second * 1)
 
 	// not 6, because we won't send the message to ourselfe
-	if testOnMessageCounter != 4 {
+	if atomic.LoadInt32(&testOnMessageCounter) != 4 {
 		t.Error("The message should be fired 4 times, but doenst...")
 		t.FailNow()
 		return
 	}
 }
 
-var testOnMessageCounter = 0
+var testOnMessageCounter int32
 
 func testOnMessage(message *Msg, group, command, payload string) {
 	fmt.Println("GROUP: ", group, " CMD: ", command, " PAYLOAD: ", payload)
-	testOnMessageCounter++
+	atomic.AddInt32(&testOnMessageCounter, 1)
 }
 
 func onMultipleMessage(message *Msg, group, command, payload string) {
@@ -177,3 +186,45 @@ func onSingleMessage(message *Msg, group, command, payload string) {
 func onNeverMessage(message *Msg, group, command, payload string) {
 	fmt.Println("GROUP: ", group, " CMD: ", command, " PAYLOAD: ", payload)
 }
+
+func clientAddress(t *testing.T) {
+
+	address := ClientAddress("nodea", "ws1")
+	if address != "nodea/ws1" || !IsClientAddress(address) || AddressNode(address) != "nodea" {
+		t.Errorf("Client address '%s' is wrong", address)
+		t.FailNow()
+	}
+	if IsClientAddress("nodea") || AddressNode("nodea") != "nodea" {
+		t.Error("Node address is wrong")
+		t.FailNow()
+	}
+}
+
+func FuzzFromJsonString(f *testing.F) {
+
+	f.Add("{\"s\":\"src\",\"t\":\"trg\",\"g\":\"grp\",\"c\":\"cmd\",\"v\":\"pld\"}")
+	f.Add("{\"g\":\"grp\",\"c\":\"cmd\",\"v\":\"\\u0000\\ud800\"}")
+	f.Add("{\"g\":null}")
+
+	f.Fuzz(func(t *testing.T, jsonString string) {
+
+		newMessage, err := FromJsonString(jsonString)
+		if err != nil {
+			return
+		}
+		if newMessage.Group == "" || newMessage.Command == "" {
+			t.Errorf("Message without group or command is valid: %+v", newMessage)
+		}
+
+		// a valid message survive the way to the next node
+		encoded, err := newMessage.ToJsonString()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		decodedMessage, err := FromJsonString(encoded)
+		if err != nil || decodedMessage != newMessage {
+			t.Errorf("Message changed from %+v to %+v", newMessage, decodedMessage)
+		}
+	})
+}
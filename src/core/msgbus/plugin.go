@@ -22,51 +22,74 @@ import (
 	"core/clog"
 	"core/tools"
 	"fmt"
+	"sort"
 )
 
 // structs
 type Plugin struct {
 	id   string
 	name string
+	bus  *Bus // nil for the default bus
 }
 
-var logging clog.Logger
-
-var pluginList []*Plugin
+// set here, because the worker can already run when PluginsInit() is called
+var logging = clog.New("BUS")
 
 func PluginsInit() {
 
-	logging = clog.New("BUS")
-
-	pluginList = make([]*Plugin, 0)
+	Default.pluginListMutex.Lock()
+	Default.pluginList = make([]*Plugin, 0)
+	Default.pluginListMutex.Unlock()
 
 }
 
+// NewPlugin create a plugin on the default bus
 func NewPlugin(pluginName string) Plugin {
+	return Default.NewPlugin(pluginName)
+}
+
+// NewPlugin create a plugin on this bus
+func (curBus *Bus) NewPlugin(pluginName string) Plugin {
 
 	newPlugin := Plugin{
 		id:   pluginName + "-" + tools.RandomString(4),
 		name: pluginName,
+		bus:  curBus,
 	}
 
 	return newPlugin
 }
 
+// getBus return the bus of the plugin
+func (curPlugin *Plugin) getBus() *Bus {
+	if curPlugin.bus == nil {
+		return Default
+	}
+	return curPlugin.bus
+}
+
 func (curPlugin *Plugin) Register() {
-	pluginList = append(pluginList, curPlugin)
+	curBus := curPlugin.getBus()
+	curBus.pluginListMutex.Lock()
+	defer curBus.pluginListMutex.Unlock()
+
+	curBus.pluginList = append(curBus.pluginList, curPlugin)
 
 	logging.Debug(fmt.Sprintf("PLUGIN %s", curPlugin.id),
 		fmt.Sprintf(
 			"New Plugin '%s' registered. We now have %d plugins.",
-			curPlugin.name, len(pluginList),
+			curPlugin.name, len(curBus.pluginList),
 		),
 	)
 }
 
 func (curPlugin *Plugin) DeRegister() {
+	curBus := curPlugin.getBus()
+	curBus.pluginListMutex.Lock()
+	defer curBus.pluginListMutex.Unlock()
 
-	for pluginIndex := range pluginList {
-		actPlugin := pluginList[pluginIndex]
+	for pluginIndex := range curBus.pluginList {
+		actPlugin := curBus.pluginList[pluginIndex]
 
 		if actPlugin == curPlugin {
 			logging.Info(fmt.Sprintf("PLUGIN '%s'", curPlugin.name),
@@ -76,29 +99,55 @@ func (curPlugin *Plugin) DeRegister() {
 				),
 			)
 
-			pluginList = append(pluginList[:pluginIndex], pluginList[pluginIndex+1:]...)
+			curBus.pluginList = append(curBus.pluginList[:pluginIndex], curBus.pluginList[pluginIndex+1:]...)
+			break
 		}
 
 	}
 
-	for pluginIndex := range pluginList {
-		actPlugin := pluginList[pluginIndex]
+	for pluginIndex := range curBus.pluginList {
+		actPlugin := curBus.pluginList[pluginIndex]
 		logging.Debug(fmt.Sprintf("PLUGIN '%s'", actPlugin.name),
 			"",
 		)
 	}
 }
 
+// PluginNames return the names of all registered plugins of the default bus, sorted and without duplicates
+func PluginNames() []string {
+	return Default.PluginNames()
+}
+
+// PluginNames return the names of all registered plugins, sorted and without duplicates
+func (curBus *Bus) PluginNames() []string {
+
+	curBus.pluginListMutex.Lock()
+	defer curBus.pluginListMutex.Unlock()
+
+	nameMap := make(map[string]bool)
+	for _, curPlugin := range curBus.pluginList {
+		nameMap[curPlugin.name] = true
+	}
+
+	names := make([]string, 0, len(nameMap))
+	for name := range nameMap {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
 func (curPlugin *Plugin) ListenForGroup(group string, onMessageFP onMessageFct) {
-	ListenForGroup(curPlugin.id, group, onMessageFP)
+	curPlugin.getBus().ListenForGroup(curPlugin.id, group, onMessageFP)
 }
 
 // publish an message to the BUS
 // @param pluginIDSrc An pointer to an int where the plugin id is saved ( which was create before with Register() )
 func (curPlugin *Plugin) Publish(nodeSource, nodeTarget, group, command, payload string) {
-	Publish(curPlugin.id, nodeSource, nodeTarget, group, command, payload)
+	curPlugin.getBus().Publish(curPlugin.id, nodeSource, nodeTarget, group, command, payload)
 }
 
 func (curPlugin *Plugin) PublishMsg(newMessage Msg) {
-	PublishMsg(curPlugin.id, newMessage)
+	curPlugin.getBus().PublishMsg(curPlugin.id, newMessage)
 }
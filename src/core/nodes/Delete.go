@@ -18,16 +18,19 @@ along with gopilot.  If not, see <http://www.gnu.org/licenses/>.
 
 package nodes
 
-import (
-	"core/config"
-)
-
 // Delete an node
 func Delete(nodeName string) {
+	Default.Delete(nodeName)
+}
+
+// Delete an node
+func (curRegistry *Registry) Delete(nodeName string) {
+	curRegistry.mutex.Lock()
+	defer curRegistry.mutex.Unlock()
 
 	// save it back
 	// first, get the nodes from config
-	nodes, err := config.GetJSONObject("nodes")
+	nodes, err := curRegistry.config.GetJSONObject("nodes")
 	if err != nil {
 		return
 	}
@@ -35,7 +38,11 @@ func Delete(nodeName string) {
 	// delete node
 	delete(nodes, nodeName)
 
+	curRegistry.statesMutex.Lock()
+	delete(curRegistry.states, nodeName)
+	curRegistry.statesMutex.Unlock()
+
 	// save it back
-	config.SetJSONObject("nodes", nodes)
-	config.Save()
+	curRegistry.config.SetJSONObject("nodes", nodes)
+	curRegistry.config.Save()
 }
@@ -0,0 +1,92 @@
+/*
+Copyright (C) 2019 by Martin Langlotz aka stackshadow
+
+This file is part of gopilot, an rewrite of the copilot-project in go
+
+gopilot is free software: you can redistribute it and/or modify
+it under the terms of the GNU Lesser General Public License as published by
+the Free Software Foundation, version 3 of this License
+
+gopilot is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License
+along with gopilot.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package nodes
+
+import (
+	"encoding/json"
+)
+
+// Get return the node with nodeName
+// If the node dont exist, it will not be created
+func Get(nodeName string) (Node, error) {
+	return Default.Get(nodeName)
+}
+
+// Get return the node with nodeName
+// If the node dont exist, it will not be created
+func (curRegistry *Registry) Get(nodeName string) (Node, error) {
+
+	// get the single node
+	nodeObject, err := curRegistry.GetNodeObject(nodeName)
+	if err != nil {
+		return Node{}, err
+	}
+
+	return nodeFromObject(nodeName, nodeObject)
+}
+
+// nodeFromObject convert the json-object from the config to a Node
+func nodeFromObject(nodeName string, nodeObject map[string]interface{}) (Node, error) {
+
+	var node Node
+
+	byteValue, err := json.Marshal(nodeObject)
+	if err != nil {
+		return node, err
+	}
+	err = json.Unmarshal(byteValue, &node)
+	if err != nil {
+		return node, err
+	}
+
+	node.Name = nodeName
+
+	if node.Host == "" {
+		node.Host = defaultHost
+	}
+
+	if node.Port == 0 {
+		node.Port = defaultPort
+	}
+
+	return node, nil
+}
+
+// GetOrNew return the node with nodeName or a new node, if it dont exist
+// The new node will not be saved
+func GetOrNew(nodeName string) Node {
+	return Default.GetOrNew(nodeName)
+}
+
+// GetOrNew return the node with nodeName or a new node, if it dont exist
+// The new node will not be saved
+func (curRegistry *Registry) GetOrNew(nodeName string) Node {
+
+	node, err := curRegistry.Get(nodeName)
+	if err != nil {
+		node = Node{
+			Name: nodeName,
+			Host: defaultHost,
+			Port: defaultPort,
+			Type: NodeTypeUndefined,
+		}
+	}
+
+	return node
+}
@@ -19,16 +19,21 @@ along with gopilot.  If not, see <http://www.gnu.org/licenses/>.
 package nodes
 
 import (
-	"core/config"
 	"fmt"
 )
 
 // GetNodeObject return an map from the node with nodeName
 // If the node dont exist, it will not be created
 func GetNodeObject(nodeName string) (map[string]interface{}, error) {
+	return Default.GetNodeObject(nodeName)
+}
+
+// GetNodeObject return an map from the node with nodeName
+// If the node dont exist, it will not be created
+func (curRegistry *Registry) GetNodeObject(nodeName string) (map[string]interface{}, error) {
 
 	// first, get the nodes from config
-	nodes, err := config.GetJSONObject("nodes")
+	nodes, err := curRegistry.config.GetJSONObject("nodes")
 	if err != nil {
 		return nil, err
 	}
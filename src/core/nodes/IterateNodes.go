@@ -18,41 +18,37 @@ along with gopilot.  If not, see <http://www.gnu.org/licenses/>.
 
 package nodes
 
-import (
-	"core/config"
-	"github.com/mitchellh/mapstructure"
-)
-
 // IterateFct is a callback-function for IterateNodes()
-type IterateFct func(string, JSONNodeType, map[string]interface{}) // name, type, host, port
+type IterateFct func(Node)
 
 // IterateNodes call for every node in the config the NodesIterateFct
 func IterateNodes(nodesIterateFctPt IterateFct) {
+	Default.IterateNodes(nodesIterateFctPt)
+}
+
+// IterateNodes call for every node in the config the NodesIterateFct
+func (curRegistry *Registry) IterateNodes(nodesIterateFctPt IterateFct) {
 
 	// first, get the nodes from config
-	nodes, err := config.GetJSONObject("nodes")
+	nodes, err := curRegistry.config.GetJSONObject("nodes")
 	if err != nil {
 		return
 	}
 
 	for nodeName, jsonNodeInterface := range nodes {
 
-		// convert it to struct
-		var jsonNode JSONNodeType
-		err = mapstructure.Decode(jsonNodeInterface, &jsonNode)
-		if err != nil {
+		nodeObject, ok := jsonNodeInterface.(map[string]interface{})
+		if !ok {
 			continue
 		}
 
-		if jsonNode.Host == "" {
-			jsonNode.Host = "127.0.0.1"
-		}
-
-		if jsonNode.Port == 0 {
-			jsonNode.Port = 4444
+		// convert it to struct
+		node, err := nodeFromObject(nodeName, nodeObject)
+		if err != nil {
+			continue
 		}
 
-		nodesIterateFctPt(nodeName, jsonNode, jsonNodeInterface.(map[string]interface{}))
+		nodesIterateFctPt(node)
 	}
 
 }
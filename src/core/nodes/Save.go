@@ -0,0 +1,99 @@
+/*
+Copyright (C) 2019 by Martin Langlotz aka stackshadow
+
+This file is part of gopilot, an rewrite of the copilot-project in go
+
+gopilot is free software: you can redistribute it and/or modify
+it under the terms of the GNU Lesser General Public License as published by
+the Free Software Foundation, version 3 of this License
+
+gopilot is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License
+along with gopilot.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package nodes
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// nodeKeys contains all json-keys of Node, will be filled once on first use
+var nodeKeys []string
+var nodeKeysOnce sync.Once
+
+// Save will save the node to the config ( will be created if not exist )
+// Lesson Learned: We only overwrite the keys of Node, because other plugins can save additional fields inside the node
+func Save(node Node) error {
+	return Default.Save(node)
+}
+
+// Save will save the node to the config ( will be created if not exist )
+func (curRegistry *Registry) Save(node Node) error {
+	curRegistry.mutex.Lock()
+	defer curRegistry.mutex.Unlock()
+
+	return curRegistry.save(node)
+}
+
+// save the node, the mutex must be locked
+func (curRegistry *Registry) save(node Node) error {
+
+	// first, get the nodes from config
+	nodes, err := curRegistry.config.GetJSONObject("nodes")
+	if err != nil {
+		return err
+	}
+
+	nodeObject, ok := nodes[node.Name].(map[string]interface{})
+	if !ok {
+		nodeObject = make(map[string]interface{})
+	}
+
+	// remove all known keys, so empty fields are removed
+	for _, key := range getNodeKeys() {
+		delete(nodeObject, key)
+	}
+
+	// and set it from the struct
+	byteValue, err := json.Marshal(node)
+	if err != nil {
+		return err
+	}
+	err = json.Unmarshal(byteValue, &nodeObject)
+	if err != nil {
+		return err
+	}
+
+	// overwrite node
+	nodes[node.Name] = nodeObject
+
+	// save it back
+	curRegistry.config.SetJSONObject("nodes", nodes)
+	curRegistry.config.Save()
+
+	return nil
+}
+
+// getNodeKeys return all json-keys of Node
+func getNodeKeys() []string {
+	nodeKeysOnce.Do(func() {
+		nodeType := reflect.TypeOf(Node{})
+		for fieldIndex := 0; fieldIndex < nodeType.NumField(); fieldIndex++ {
+			key := strings.Split(nodeType.Field(fieldIndex).Tag.Get("json"), ",")[0]
+			if key == "" || key == "-" {
+				continue
+			}
+			nodeKeys = append(nodeKeys, key)
+		}
+	})
+
+	return nodeKeys
+}
@@ -18,16 +18,19 @@ along with gopilot.  If not, see <http://www.gnu.org/licenses/>.
 
 package nodes
 
-import (
-	"core/config"
-)
-
 // SaveNodeObject return an map from the node with nodeName
 // This function DONT create a new Node inside the json if it dont exist
 func SaveNodeObject(nodeName string, nodeObject map[string]interface{}) error {
+	return Default.SaveNodeObject(nodeName, nodeObject)
+}
+
+// SaveNodeObject save the map of the node with nodeName
+func (curRegistry *Registry) SaveNodeObject(nodeName string, nodeObject map[string]interface{}) error {
+	curRegistry.mutex.Lock()
+	defer curRegistry.mutex.Unlock()
 
 	// first, get the nodes from config
-	nodes, err := config.GetJSONObject("nodes")
+	nodes, err := curRegistry.config.GetJSONObject("nodes")
 	if err != nil {
 		return err
 	}
@@ -36,8 +39,8 @@ func SaveNodeObject(nodeName string, nodeObject map[string]interface{}) error {
 	nodes[nodeName] = nodeObject
 
 	// save it back
-	config.SetJSONObject("nodes", nodes)
-	config.Save()
+	curRegistry.config.SetJSONObject("nodes", nodes)
+	curRegistry.config.Save()
 
 	return nil
 }
@@ -0,0 +1,284 @@
+/*
+Copyright (C) 2019 by Martin Langlotz aka stackshadow
+
+This file is part of gopilot, an rewrite of the copilot-project in go
+
+gopilot is free software: you can redistribute it and/or modify
+it under the terms of the GNU Lesser General Public License as published by
+the Free Software Foundation, version 3 of this License
+
+gopilot is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License
+along with gopilot.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package nodes
+
+/*
+A selector select nodes by their tags, all terms must match:
+
+role=web,site=berlin    tag role is web and tag site is berlin
+role!=db                tag role is not db ( or not set )
+role=*                  tag role exist
+role!=*                 tag role dont exist
+name=nodea              the node with the name nodea
+@webservers             all nodes which match the selector of the group webservers
+*/
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+type selectorTerm struct {
+	key    string
+	value  string // "*" match every value
+	negate bool
+	group  string // if set, key and value are not used
+}
+
+// Selector is a parsed selector-string
+type Selector struct {
+	terms []selectorTerm
+}
+
+// max depth of groups inside groups
+const selectorMaxDepth = 8
+
+// IsSelector return true if target is a selector and not a node-name
+func IsSelector(target string) bool {
+	return strings.Contains(target, "=") || strings.HasPrefix(target, "@")
+}
+
+// ValidTagKey check if key can be used as tag-key
+func ValidTagKey(key string) error {
+	if key == "" {
+		return fmt.Errorf("Tag-key is empty")
+	}
+	if key == "name" {
+		return fmt.Errorf("Tag-key 'name' is reserved")
+	}
+	if strings.ContainsAny(key, "=!@*,") || strings.IndexFunc(key, unicode.IsSpace) >= 0 {
+		return fmt.Errorf("Tag-key '%s' contains illegal characters", key)
+	}
+	return nil
+}
+
+// ValidTagValue check if value can be used as tag-value, it must be usable inside a selector
+func ValidTagValue(value string) error {
+	if value == "" {
+		return fmt.Errorf("Tag-value is empty")
+	}
+	if strings.ContainsAny(value, "=!@*,") || strings.IndexFunc(value, unicode.IsSpace) >= 0 {
+		return fmt.Errorf("Tag-value '%s' contains illegal characters", value)
+	}
+	return nil
+}
+
+// ParseSelector parse an selector-string
+func ParseSelector(selectorString string) (Selector, error) {
+
+	var selector Selector
+
+	for _, termString := range strings.Split(selectorString, ",") {
+		termString = strings.TrimSpace(termString)
+		if termString == "" {
+			continue
+		}
+
+		var term selectorTerm
+
+		if strings.HasPrefix(termString, "@") {
+			term.group = termString[1:]
+			if term.group == "" {
+				return selector, fmt.Errorf("Group name is missing in '%s'", selectorString)
+			}
+			selector.terms = append(selector.terms, term)
+			continue
+		}
+
+		keyValue := strings.SplitN(termString, "=", 2)
+		if len(keyValue) != 2 {
+			return selector, fmt.Errorf("Term '%s' is not key=value", termString)
+		}
+
+		term.key = strings.TrimSpace(keyValue[0])
+		term.value = strings.TrimSpace(keyValue[1])
+		if strings.HasSuffix(term.key, "!") {
+			term.negate = true
+			term.key = strings.TrimSpace(strings.TrimSuffix(term.key, "!"))
+		}
+
+		if term.key == "" || term.value == "" {
+			return selector, fmt.Errorf("Term '%s' need a key and a value", termString)
+		}
+
+		selector.terms = append(selector.terms, term)
+	}
+
+	if len(selector.terms) == 0 {
+		return selector, fmt.Errorf("Selector '%s' is empty", selectorString)
+	}
+
+	return selector, nil
+}
+
+// Match return true if the node match all terms of the selector, groups are taken from the registry
+func (curRegistry *Registry) Match(selector Selector, node Node) bool {
+	return selector.match(node, curRegistry.GetGroups(), 0)
+}
+
+func (selector *Selector) match(node Node, groups map[string]string, depth int) bool {
+
+	for _, term := range selector.terms {
+
+		if term.group != "" {
+			if !matchGroup(term.group, node, groups, depth+1) {
+				return false
+			}
+			continue
+		}
+
+		var value string
+		var exist bool
+		if term.key == "name" {
+			value, exist = node.Name, true
+		} else {
+			value, exist = node.Tags[term.key]
+		}
+
+		matched := exist && (term.value == "*" || term.value == value)
+		if matched == term.negate {
+			return false
+		}
+	}
+
+	return true
+}
+
+func matchGroup(groupName string, node Node, groups map[string]string, depth int) bool {
+
+	if depth > selectorMaxDepth {
+		return false
+	}
+
+	groupSelectorString, ok := groups[groupName]
+	if !ok {
+		return false
+	}
+
+	groupSelector, err := ParseSelector(groupSelectorString)
+	if err != nil {
+		return false
+	}
+
+	return groupSelector.match(node, groups, depth)
+}
+
+// Select return the sorted names of all nodes which match the selector
+func Select(selectorString string) ([]string, error) {
+	return Default.Select(selectorString)
+}
+
+// Select return the sorted names of all nodes which match the selector
+func (curRegistry *Registry) Select(selectorString string) ([]string, error) {
+
+	selector, err := ParseSelector(selectorString)
+	if err != nil {
+		return nil, err
+	}
+
+	// the groups are read once for all nodes
+	groups := curRegistry.GetGroups()
+
+	nodeNames := make([]string, 0)
+	curRegistry.IterateNodes(func(node Node) {
+		if selector.match(node, groups, 0) {
+			nodeNames = append(nodeNames, node.Name)
+		}
+	})
+	sort.Strings(nodeNames)
+
+	return nodeNames, nil
+}
+
+// GetGroups return all groups with their selector
+func GetGroups() map[string]string {
+	return Default.GetGroups()
+}
+
+// GetGroups return all groups with their selector
+func (curRegistry *Registry) GetGroups() map[string]string {
+
+	groups := make(map[string]string)
+
+	groupsObject, err := curRegistry.config.GetJSONObject("nodegroups")
+	if err != nil {
+		return groups
+	}
+
+	for groupName, selectorInterface := range groupsObject {
+		if selectorString, ok := selectorInterface.(string); ok {
+			groups[groupName] = selectorString
+		}
+	}
+
+	return groups
+}
+
+// SetGroup create or change a group of nodes
+func SetGroup(groupName string, selectorString string) error {
+	return Default.SetGroup(groupName, selectorString)
+}
+
+// SetGroup create or change a group of nodes
+func (curRegistry *Registry) SetGroup(groupName string, selectorString string) error {
+
+	if err := ValidTagKey(groupName); err != nil {
+		return fmt.Errorf("Group name '%s' is not valid", groupName)
+	}
+
+	if _, err := ParseSelector(selectorString); err != nil {
+		return err
+	}
+
+	curRegistry.mutex.Lock()
+	defer curRegistry.mutex.Unlock()
+
+	groupsObject, err := curRegistry.config.GetJSONObject("nodegroups")
+	if err != nil {
+		groupsObject = make(map[string]interface{})
+	}
+
+	groupsObject[groupName] = selectorString
+	curRegistry.config.SetJSONObject("nodegroups", groupsObject)
+	curRegistry.config.Save()
+
+	return nil
+}
+
+// DeleteGroup remove a group of nodes
+func DeleteGroup(groupName string) {
+	Default.DeleteGroup(groupName)
+}
+
+// DeleteGroup remove a group of nodes
+func (curRegistry *Registry) DeleteGroup(groupName string) {
+	curRegistry.mutex.Lock()
+	defer curRegistry.mutex.Unlock()
+
+	groupsObject, err := curRegistry.config.GetJSONObject("nodegroups")
+	if err != nil {
+		return
+	}
+
+	delete(groupsObject, groupName)
+	curRegistry.config.SetJSONObject("nodegroups", groupsObject)
+	curRegistry.config.Save()
+}
@@ -0,0 +1,235 @@
+/*
+Copyright (C) 2019 by Martin Langlotz aka stackshadow
+
+This file is part of gopilot, an rewrite of the copilot-project in go
+
+gopilot is free software: you can redistribute it and/or modify
+it under the terms of the GNU Lesser General Public License as published by
+the Free Software Foundation, version 3 of this License
+
+gopilot is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License
+along with gopilot.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package nodes
+
+import (
+	"time"
+)
+
+// NodeState is the runtime-state of a node, it will not be saved to the config
+type NodeState struct {
+	Connected     bool      `json:"connected"`
+	LastSeen      time.Time `json:"lastSeen"`
+	RemoteVersion string    `json:"remoteVersion"`
+	RTT           float64   `json:"rtt"`         // in milliseconds
+	ClockOffset   float64   `json:"clockOffset"` // in milliseconds, positive if the remote clock is ahead
+	SessionStart  time.Time `json:"sessionStart"`
+	Direction     string    `json:"direction"`  // of the current session, DirectionOutgoing or DirectionIncoming
+	RemoteAddr    string    `json:"remoteAddr"` // of the current session
+
+	Capabilities Capabilities `json:"capabilities"` // announced by the remote node
+	Options      []string     `json:"options"`      // features both nodes use for the session
+
+	Traffic Traffic `json:"traffic"` // of the current session
+
+	generation uint64 // counted up for every new session, a disconnect of an older session is ignored
+}
+
+// Traffic count the bytes of a session, before ( json ) and after framing/compression ( wire )
+type Traffic struct {
+	Sent         int64 `json:"sent"`
+	SentWire     int64 `json:"sentWire"`
+	Received     int64 `json:"received"`
+	ReceivedWire int64 `json:"receivedWire"`
+}
+
+// Capabilities describe what a remote node can do, it is exchanged in the hello
+type Capabilities struct {
+	Protocol int      `json:"protocol"`
+	Version  string   `json:"version"`
+	Date     string   `json:"date"`
+	Plugins  []string `json:"plugins"`
+	Features []string `json:"features"`
+}
+
+// DirectionOutgoing we connected to the node
+const DirectionOutgoing = "outgoing"
+
+// DirectionIncoming the node connected to us, for example because it is behind NAT
+const DirectionIncoming = "incoming"
+
+// getStateLocked return the state of a node, statesMutex must be locked
+func (curRegistry *Registry) getStateLocked(nodeName string) *NodeState {
+	state, ok := curRegistry.states[nodeName]
+	if !ok {
+		state = &NodeState{}
+		curRegistry.states[nodeName] = state
+	}
+	return state
+}
+
+// GetState return a copy of the runtime-state of a node
+func GetState(nodeName string) NodeState {
+	return Default.GetState(nodeName)
+}
+
+// GetState return a copy of the runtime-state of a node
+func (curRegistry *Registry) GetState(nodeName string) NodeState {
+	curRegistry.statesMutex.Lock()
+	defer curRegistry.statesMutex.Unlock()
+
+	if state, ok := curRegistry.states[nodeName]; ok {
+		return *state
+	}
+	return NodeState{}
+}
+
+// SetConnected mark a node as connected, it return the generation of the new session for SetDisconnected
+func SetConnected(nodeName string) uint64 {
+	return Default.SetConnected(nodeName)
+}
+
+// SetConnected mark a node as connected, it return the generation of the new session for SetDisconnected
+func (curRegistry *Registry) SetConnected(nodeName string) uint64 {
+	curRegistry.statesMutex.Lock()
+	defer curRegistry.statesMutex.Unlock()
+
+	state := curRegistry.getStateLocked(nodeName)
+	state.generation++
+	state.Connected = true
+	state.LastSeen = time.Now()
+	state.SessionStart = time.Now()
+	state.Traffic = Traffic{}
+
+	return state.generation
+}
+
+// SetDisconnected mark a node as disconnected, if the session with generation is still the current one
+func SetDisconnected(nodeName string, generation uint64) {
+	Default.SetDisconnected(nodeName, generation)
+}
+
+// SetDisconnected mark a node as disconnected, if the session with generation is still the current one
+// a duplicate session that is closed after the new one was connected, dont change the state
+func (curRegistry *Registry) SetDisconnected(nodeName string, generation uint64) {
+	curRegistry.statesMutex.Lock()
+	defer curRegistry.statesMutex.Unlock()
+
+	state := curRegistry.getStateLocked(nodeName)
+	if state.generation != generation {
+		return
+	}
+	state.Connected = false
+	state.LastSeen = time.Now()
+	state.Traffic = Traffic{}
+	state.SessionStart = time.Time{}
+	state.Direction = ""
+	state.RemoteAddr = ""
+	state.RTT = 0
+	state.ClockOffset = 0
+	state.Options = nil
+}
+
+// Touch set the last-seen time of a node to now
+func Touch(nodeName string) {
+	Default.Touch(nodeName)
+}
+
+// Touch set the last-seen time of a node to now
+func (curRegistry *Registry) Touch(nodeName string) {
+	curRegistry.statesMutex.Lock()
+	defer curRegistry.statesMutex.Unlock()
+
+	curRegistry.getStateLocked(nodeName).LastSeen = time.Now()
+}
+
+// SetRemoteVersion remember the build-version of the remote node
+func SetRemoteVersion(nodeName string, version string) {
+	Default.SetRemoteVersion(nodeName, version)
+}
+
+// SetRemoteVersion remember the build-version of the remote node
+func (curRegistry *Registry) SetRemoteVersion(nodeName string, version string) {
+	curRegistry.statesMutex.Lock()
+	defer curRegistry.statesMutex.Unlock()
+
+	curRegistry.getStateLocked(nodeName).RemoteVersion = version
+}
+
+// SetRTT remember the last measured round-trip-time to the node
+func SetRTT(nodeName string, rtt time.Duration) {
+	Default.SetRTT(nodeName, rtt)
+}
+
+// SetRTT remember the last measured round-trip-time to the node
+func (curRegistry *Registry) SetRTT(nodeName string, rtt time.Duration) {
+	curRegistry.statesMutex.Lock()
+	defer curRegistry.statesMutex.Unlock()
+
+	curRegistry.getStateLocked(nodeName).RTT = float64(rtt) / float64(time.Millisecond)
+}
+
+// SetClockOffset remember the last measured clock-offset to the node
+func SetClockOffset(nodeName string, offset time.Duration) {
+	Default.SetClockOffset(nodeName, offset)
+}
+
+// SetClockOffset remember the last measured clock-offset to the node
+func (curRegistry *Registry) SetClockOffset(nodeName string, offset time.Duration) {
+	curRegistry.statesMutex.Lock()
+	defer curRegistry.statesMutex.Unlock()
+
+	curRegistry.getStateLocked(nodeName).ClockOffset = float64(offset) / float64(time.Millisecond)
+}
+
+// SetCapabilities remember the capabilities of the remote node and the negotiated options
+func SetCapabilities(nodeName string, capabilities Capabilities, options []string) {
+	Default.SetCapabilities(nodeName, capabilities, options)
+}
+
+// SetCapabilities remember the capabilities of the remote node and the negotiated options
+func (curRegistry *Registry) SetCapabilities(nodeName string, capabilities Capabilities, options []string) {
+	curRegistry.statesMutex.Lock()
+	defer curRegistry.statesMutex.Unlock()
+
+	state := curRegistry.getStateLocked(nodeName)
+	state.Capabilities = capabilities
+	state.Options = options
+	if capabilities.Version != "" {
+		state.RemoteVersion = capabilities.Version
+	}
+}
+
+// SetTraffic remember the traffic of the current session to the node
+func SetTraffic(nodeName string, traffic Traffic) {
+	Default.SetTraffic(nodeName, traffic)
+}
+
+// SetTraffic remember the traffic of the current session to the node
+func (curRegistry *Registry) SetTraffic(nodeName string, traffic Traffic) {
+	curRegistry.statesMutex.Lock()
+	defer curRegistry.statesMutex.Unlock()
+
+	curRegistry.getStateLocked(nodeName).Traffic = traffic
+}
+
+// SetRoute remember how the current session to the node was established
+func SetRoute(nodeName string, direction string, remoteAddr string) {
+	Default.SetRoute(nodeName, direction, remoteAddr)
+}
+
+// SetRoute remember how the current session to the node was established
+func (curRegistry *Registry) SetRoute(nodeName string, direction string, remoteAddr string) {
+	curRegistry.statesMutex.Lock()
+	defer curRegistry.statesMutex.Unlock()
+
+	state := curRegistry.getStateLocked(nodeName)
+	state.Direction = direction
+	state.RemoteAddr = remoteAddr
+}
@@ -0,0 +1,65 @@
+/*
+Copyright (C) 2019 by Martin Langlotz aka stackshadow
+
+This file is part of gopilot, an rewrite of the copilot-project in go
+
+gopilot is free software: you can redistribute it and/or modify
+it under the terms of the GNU Lesser General Public License as published by
+the Free Software Foundation, version 3 of this License
+
+gopilot is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License
+along with gopilot.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package nodes
+
+// SetTag set the tag key of an existing node to value
+func SetTag(nodeName, key, value string) (Node, error) {
+	return Default.SetTag(nodeName, key, value)
+}
+
+// SetTag set the tag key of an existing node to value
+func (curRegistry *Registry) SetTag(nodeName, key, value string) (Node, error) {
+
+	if err := ValidTagKey(key); err != nil {
+		return Node{}, err
+	}
+	if err := ValidTagValue(value); err != nil {
+		return Node{}, err
+	}
+
+	var changedNode Node
+	err := curRegistry.Update(nodeName, func(node *Node) bool {
+		if node.Tags == nil {
+			node.Tags = make(map[string]string)
+		}
+		node.Tags[key] = value
+		changedNode = *node
+		return true
+	})
+
+	return changedNode, err
+}
+
+// DeleteTag remove the tag key from an existing node
+func DeleteTag(nodeName, key string) (Node, error) {
+	return Default.DeleteTag(nodeName, key)
+}
+
+// DeleteTag remove the tag key from an existing node
+func (curRegistry *Registry) DeleteTag(nodeName, key string) (Node, error) {
+
+	var changedNode Node
+	err := curRegistry.Update(nodeName, func(node *Node) bool {
+		delete(node.Tags, key)
+		changedNode = *node
+		return true
+	})
+
+	return changedNode, err
+}
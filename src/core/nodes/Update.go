@@ -18,38 +18,26 @@ along with gopilot.  If not, see <http://www.gnu.org/licenses/>.
 
 package nodes
 
-import (
-	"github.com/mitchellh/mapstructure"
-)
+// Update read the node, call change and save the node, if change return true
+// The node can not be changed by others between read and save
+func Update(nodeName string, change func(node *Node) bool) error {
+	return Default.Update(nodeName, change)
+}
 
-// GetData return the node-type, the node-hostname and the node-port
-func GetData(nodeName string) (int, string, int, error) {
+// Update read the node, call change and save the node, if change return true
+// The node can not be changed by others between read and save
+func (curRegistry *Registry) Update(nodeName string, change func(node *Node) bool) error {
+	curRegistry.mutex.Lock()
+	defer curRegistry.mutex.Unlock()
 
-	// get the single node
-	nodeI, err := GetNodeObject(nodeName)
+	node, err := curRegistry.Get(nodeName)
 	if err != nil {
-		return 0, "", 0, err
+		return err
 	}
 
-	// convert it to struct
-	var node JSONNodeType
-	err = mapstructure.Decode(nodeI, node)
-	if err != nil {
-		return 0, "", 0, err
+	if !change(&node) {
+		return nil
 	}
 
-	if node.Type == 0 {
-		node.Type = float64(NodeTypeUndefined)
-	}
-
-	if node.Host == "" {
-		node.Host = "127.0.0.1"
-	}
-
-	if node.Port == 0 {
-		node.Port = float64(4444)
-	}
-
-	return int(node.Type), node.Host, int(node.Port), nil
-
+	return curRegistry.save(node)
 }
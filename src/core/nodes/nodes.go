@@ -20,13 +20,78 @@ package nodes
 
 import (
 	"core/config"
+	"sync"
+	"time"
 )
 
-// JSONNodeType describe a node-configureation
-type JSONNodeType struct {
-	Host string  `json:"host"`
-	Port float64 `json:"port"`
-	Type float64 `json:"type"`
+// Node describe a node-configuration as it is saved inside the config
+type Node struct {
+	Name string `json:"-"` // the key inside the config
+	Host string `json:"host"`
+	Port int    `json:"port"`
+	Type int    `json:"type"`
+
+	URL   string `json:"url,omitempty"`   // connect over a websocket ( ws:// or wss:// ) instead of host:port
+	Proxy string `json:"proxy,omitempty"` // http-proxy for the websocket, if empty the environment is used
+
+	Tags map[string]string `json:"tags,omitempty"` // free labels like role=web, used by selectors
+
+	PeerFingerprint     string       `json:"peerFingerprint,omitempty"`     // accepted sha256 of the public key of the peer
+	PeerFingerprintPrev string       `json:"peerFingerprintPrev,omitempty"` // fingerprint before a rotation, accepted until the peer confirm the rotation
+	PeerFingerprintReq  string       `json:"peerFingerprintReq,omitempty"`  // requested fingerprint, need to be accepted
+	PeerRequest         *NodeRequest `json:"peerRequest,omitempty"`         // details of the connection which requested the fingerprint
+	SharedSecret        string       `json:"sharedSecret,omitempty"`
+	SharedSecretNext    string       `json:"sharedSecretNext,omitempty"` // new secret we sent, until the peer confirm it
+	SharedSecretPrev    string       `json:"sharedSecretPrev,omitempty"` // secret before the peer sent a new one, until the peer use the new one
+	EnrollToken         string       `json:"enrollToken,omitempty"`      // single-use token, send to the server on the first connect
+
+	// older versions pinned the signature of the certificate, it is replaced by PeerFingerprint on the next connect
+	PeerCertSignature    string `json:"peerCertSignature,omitempty"`
+	PeerCertSignatureReq string `json:"peerCertSignatureReq,omitempty"`
+
+	DiscoveredFingerprint string `json:"discoveredFingerprint,omitempty"` // announced fingerprint of a node found by discovery
+
+	Reconnect *ReconnectPolicy `json:"reconnect,omitempty"` // if nil, the defaults of the tls-plugin are used
+
+	// turn the direction of the connection, the type stay the role of the node:
+	// a client-node ( managed by us ) connect to us, because it is behind NAT
+	// to an incoming-node ( which manage us ) we connect
+	ReverseDial bool `json:"reverseDial,omitempty"`
+}
+
+// NodeRequest describe the connection which requested the acceptance of a key
+type NodeRequest struct {
+	RemoteAddr string    `json:"remoteAddr"`
+	Time       time.Time `json:"time"` // of the first request with this fingerprint
+	Subject    string    `json:"subject"`
+	Issuer     string    `json:"issuer"`
+	NotAfter   time.Time `json:"notAfter"`
+}
+
+// ReconnectPolicy describe how often we try to connect to a client-node
+type ReconnectPolicy struct {
+	InitialDelay float64 `json:"initialDelay"` // in seconds, the delay after the first failed attempt
+	MaxDelay     float64 `json:"maxDelay"`     // in seconds, the delay is doubled until it reach this
+	Jitter       float64 `json:"jitter"`       // 0.0 - 1.0, the delay is randomly changed by this fraction
+	MaxAttempts  int     `json:"maxAttempts"`  // give up after this count of failed attempts, 0 try forever
+}
+
+// NodeInfo is the public view of a node, it contains no secrets
+type NodeInfo struct {
+	Host               string            `json:"host"`
+	Port               int               `json:"port"`
+	URL                string            `json:"url"`
+	Type               int               `json:"type"`
+	ReverseDial        bool              `json:"reverseDial"`
+	Requested          bool              `json:"req"`
+	Accepted           bool              `json:"acc"`
+	Discovered         bool              `json:"discovered"`  // found by discovery and not approved yet
+	Fingerprint        string            `json:"fingerprint"` // announced by discovery
+	PeerFingerprint    string            `json:"peerFingerprint"`
+	PeerFingerprintReq string            `json:"reqFingerprint"`
+	PeerRequest        *NodeRequest      `json:"peerRequest,omitempty"`
+	Tags               map[string]string `json:"tags"`
+	State              NodeState         `json:"state"`
 }
 
 const NodeTypeUndefined int = 0 // do nothing with it
@@ -34,12 +99,89 @@ const NodeTypeServer int = 1    // serve an connection
 const NodeTypeClient int = 2    // connect to an server as client
 const NodeTypeIncoming int = 3  // incoming connection from another node
 
+const defaultHost = "127.0.0.1"
+const defaultPort = 4444
+
+// Registry contains the nodes of a config and their runtime-state
+// Normally there is one registry per process ( Default ), tests can create more with NewRegistry()
+type Registry struct {
+	config      *config.Config
+	mutex       sync.Mutex // for changes of the nodes- and nodegroups-section
+	states      map[string]*NodeState
+	statesMutex sync.Mutex
+}
+
+// Default is the registry of this process, it use the default config
+var Default = NewRegistry(config.Default)
+
+// NewRegistry create a registry for the nodes inside nodeConfig
+func NewRegistry(nodeConfig *config.Config) *Registry {
+	return &Registry{
+		config: nodeConfig,
+		states: make(map[string]*NodeState),
+	}
+}
+
 func Init() {
+	Default.Init()
+}
+
+// Init create the nodes-section inside the config, if it not exist and reset the runtime-state
+func (curRegistry *Registry) Init() {
 
 	// first, get the nodes from config
-	nodes, err := config.GetJSONObject("nodes")
+	nodes, err := curRegistry.config.GetJSONObject("nodes")
 	if nodes == nil || err != nil {
 		nodes = make(map[string]interface{})
-		config.SetJSONObject("nodes", nodes)
+		curRegistry.config.SetJSONObject("nodes", nodes)
+	}
+
+	curRegistry.statesMutex.Lock()
+	curRegistry.states = make(map[string]*NodeState)
+	curRegistry.statesMutex.Unlock()
+}
+
+// Info return the public view of the node together with its runtime-state
+func (node *Node) Info() NodeInfo {
+	return Default.Info(*node)
+}
+
+// Info return the public view of the node together with its runtime-state
+func (curRegistry *Registry) Info(node Node) NodeInfo {
+	return NodeInfo{
+		Host:               node.Host,
+		Port:               node.Port,
+		URL:                node.URL,
+		Type:               node.Type,
+		ReverseDial:        node.ReverseDial,
+		Requested:          node.PeerFingerprintReq != "" || node.PeerCertSignatureReq != "",
+		Accepted:           node.PeerFingerprint != "" || node.PeerCertSignature != "",
+		Discovered:         node.IsPendingDiscovered(),
+		Fingerprint:        node.DiscoveredFingerprint,
+		PeerFingerprint:    node.PeerFingerprint,
+		PeerFingerprintReq: node.PeerFingerprintReq,
+		PeerRequest:        node.PeerRequest,
+		Tags:               node.Tags,
+		State:              curRegistry.GetState(node.Name),
+	}
+}
+
+// IsPendingDiscovered return true if the node was found by discovery and is not approved
+func (node *Node) IsPendingDiscovered() bool {
+	return node.Type == NodeTypeUndefined && node.DiscoveredFingerprint != ""
+}
+
+// IsHub return true if the node is our hub ( we are its client ), the hub can relay and change our config
+// ReverseDial dont change the role
+func (node *Node) IsHub() bool {
+	return node.Type == NodeTypeClient
+}
+
+// DialOut return true if we connect to the node, otherwise the node connect to us
+// Normally we connect to our hub, ReverseDial only flip the direction
+func (node *Node) DialOut() bool {
+	if node.ReverseDial {
+		return node.Type == NodeTypeIncoming
 	}
+	return node.Type == NodeTypeClient
 }
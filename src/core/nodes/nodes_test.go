@@ -19,7 +19,11 @@ package nodes
 
 import (
 	"core/config"
+	"io/ioutil"
+	"os"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestInit(t *testing.T) {
@@ -37,6 +41,11 @@ func TestInit(t *testing.T) {
 	t.Run("Check if node dont exist", GetMissingNode)
 	t.Run("Manipulate a Node", ManipulateANode)
 	t.Run("Delete a Node", DeleteANode)
+	t.Run("Save a typed Node", SaveTypedNode)
+	t.Run("Update a Node", UpdateANode)
+	t.Run("Runtime state of a Node", RuntimeState)
+	t.Run("Direction of the connection", ReverseDial)
+	t.Run("Select nodes by tags", SelectNodes)
 
 }
 
@@ -82,3 +91,223 @@ func DeleteANode(t *testing.T) {
 		t.FailNow()
 	}
 }
+
+func SaveTypedNode(t *testing.T) {
+
+	// a node with an additional field from another plugin
+	SaveNodeObject("typednode", map[string]interface{}{"foo": "bar", "sharedSecret": "old"})
+
+	node, err := Get("typednode")
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	if node.Port != defaultPort || node.Host != defaultHost || node.SharedSecret != "old" {
+		t.Errorf("Node is not decoded correctly: %+v", node)
+		t.FailNow()
+	}
+
+	node.Type = NodeTypeClient
+	node.SharedSecret = ""
+	node.PeerCertSignature = "abcd"
+	Save(node)
+
+	config.Read()
+	testNode, _ := GetNodeObject("typednode")
+	if testNode["foo"] != "bar" {
+		t.Error("Unknown fields should not be removed")
+		t.FailNow()
+	}
+	if _, ok := testNode["sharedSecret"]; ok {
+		t.Error("Empty fields should be removed")
+		t.FailNow()
+	}
+
+	node, _ = Get("typednode")
+	if node.Type != NodeTypeClient || node.PeerCertSignature != "abcd" {
+		t.Errorf("Node is not saved correctly: %+v", node)
+		t.FailNow()
+	}
+	if info := node.Info(); info.Accepted != true || info.Requested != false {
+		t.Errorf("Info is wrong: %+v", info)
+		t.FailNow()
+	}
+
+	Delete("typednode")
+}
+
+func UpdateANode(t *testing.T) {
+
+	if err := Update("updatenode", func(node *Node) bool { return true }); err == nil {
+		t.Error("Update should not create a node")
+		t.FailNow()
+	}
+
+	SaveNodeObject("updatenode", map[string]interface{}{"foo": "bar", "peerFingerprintReq": "AB:CD"})
+
+	// no change, nothing is saved
+	Update("updatenode", func(node *Node) bool {
+		node.PeerFingerprintReq = ""
+		return false
+	})
+	node, _ := Get("updatenode")
+	if node.PeerFingerprintReq != "AB:CD" {
+		t.Errorf("Node should not be saved: %+v", node)
+		t.FailNow()
+	}
+
+	err := Update("updatenode", func(node *Node) bool {
+		node.PeerFingerprintReq = ""
+		return true
+	})
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	testNode, _ := GetNodeObject("updatenode")
+	if testNode["foo"] != "bar" || testNode["peerFingerprintReq"] != nil {
+		t.Errorf("Node is not updated correctly: %+v", testNode)
+		t.FailNow()
+	}
+
+	Delete("updatenode")
+}
+
+func RuntimeState(t *testing.T) {
+
+	generation := SetConnected("statenode")
+	SetRTT("statenode", time.Millisecond*5)
+
+	state := GetState("statenode")
+	if state.Connected != true || state.SessionStart.IsZero() || state.RTT != 5 {
+		t.Errorf("State is wrong: %+v", state)
+		t.FailNow()
+	}
+
+	SetRoute("statenode", DirectionIncoming, "10.0.0.1:4444")
+	if state = GetState("statenode"); state.Direction != DirectionIncoming || state.RemoteAddr != "10.0.0.1:4444" {
+		t.Errorf("Route is wrong: %+v", state)
+		t.FailNow()
+	}
+
+	// the disconnect of an older duplicate session dont change the state of the new session
+	newGeneration := SetConnected("statenode")
+	SetRoute("statenode", DirectionIncoming, "10.0.0.1:5555")
+	SetDisconnected("statenode", generation)
+	if state = GetState("statenode"); state.Connected != true || state.RemoteAddr != "10.0.0.1:5555" {
+		t.Errorf("Disconnect of an old session changed the state: %+v", state)
+		t.FailNow()
+	}
+
+	SetDisconnected("statenode", newGeneration)
+	state = GetState("statenode")
+	if state.Connected != false || state.LastSeen.IsZero() || state.Direction != "" {
+		t.Errorf("State is wrong: %+v", state)
+		t.FailNow()
+	}
+}
+
+func ReverseDial(t *testing.T) {
+
+	// reverse-dial only change the direction, not who is the hub
+	tests := []struct {
+		node    Node
+		dialOut bool
+		isHub   bool
+	}{
+		{Node{Type: NodeTypeClient}, true, true},
+		{Node{Type: NodeTypeIncoming}, false, false},
+		{Node{Type: NodeTypeClient, ReverseDial: true}, false, true},
+		{Node{Type: NodeTypeIncoming, ReverseDial: true}, true, false},
+		{Node{Type: NodeTypeServer, ReverseDial: true}, false, false},
+	}
+
+	for _, test := range tests {
+		if test.node.DialOut() != test.dialOut {
+			t.Errorf("DialOut of %+v should be %t", test.node, test.dialOut)
+		}
+		if test.node.IsHub() != test.isHub {
+			t.Errorf("IsHub of %+v should be %t", test.node, test.isHub)
+		}
+	}
+}
+
+func SelectNodes(t *testing.T) {
+
+	Save(Node{Name: "web1", Tags: map[string]string{"role": "web", "site": "berlin"}})
+	Save(Node{Name: "web2", Tags: map[string]string{"role": "web", "site": "paris"}})
+	Save(Node{Name: "db1", Tags: map[string]string{"role": "db", "site": "berlin"}})
+	Save(Node{Name: "untagged"})
+	defer func() {
+		Delete("web1")
+		Delete("web2")
+		Delete("db1")
+		Delete("untagged")
+		DeleteGroup("berlinweb")
+	}()
+
+	SetGroup("berlinweb", "role=web,site=berlin")
+
+	tests := map[string]string{
+		"role=web":              "web1,web2",
+		"role=web,site=berlin":  "web1",
+		"role!=web,site=*":      "db1",
+		"role!=*,name=untagged": "untagged",
+		"role!=*,name=web1":     "",
+		"name=db1":              "db1",
+		"@berlinweb":            "web1",
+		"@unknown":              "",
+	}
+
+	for selectorString, expected := range tests {
+		nodeNames, err := Select(selectorString)
+		if err != nil {
+			t.Error(err)
+			t.FailNow()
+		}
+		if strings.Join(nodeNames, ",") != expected {
+			t.Errorf("Selector '%s' should select '%s' but select '%s'", selectorString, expected, strings.Join(nodeNames, ","))
+			t.FailNow()
+		}
+	}
+
+	for _, selectorString := range []string{"", "role", "=web", "role=", "@"} {
+		if _, err := ParseSelector(selectorString); err == nil {
+			t.Errorf("Selector '%s' should be invalid", selectorString)
+			t.FailNow()
+		}
+	}
+
+	if IsSelector("web1") || !IsSelector("role=web") || !IsSelector("@berlinweb") {
+		t.Error("IsSelector is wrong")
+		t.FailNow()
+	}
+
+	// tag-values must be usable inside a selector
+	for _, value := range []string{"", "a,b", "a=b", "!web", "@web", "*", "new york", "web\t"} {
+		if _, err := SetTag("web1", "role", value); err == nil {
+			t.Errorf("Tag-value '%s' should be invalid", value)
+			t.FailNow()
+		}
+	}
+	if node, err := SetTag("web1", "role", "web-new"); err != nil || node.Tags["role"] != "web-new" {
+		t.Errorf("Tag should be set: %v %+v", err, node)
+		t.FailNow()
+	}
+
+	// groups of another registry are not used
+	otherPath, _ := ioutil.TempDir("", "nodes")
+	defer os.RemoveAll(otherPath)
+	otherRegistry := NewRegistry(config.New("other", otherPath))
+	otherRegistry.Init()
+	otherRegistry.Save(Node{Name: "web3", Tags: map[string]string{"role": "web"}})
+	otherRegistry.SetGroup("otherweb", "role=web")
+	if _, ok := GetGroups()["otherweb"]; ok {
+		t.Error("Group of another registry should not be visible")
+		t.FailNow()
+	}
+	if nodeNames, _ := otherRegistry.Select("@otherweb"); strings.Join(nodeNames, ",") != "web3" {
+		t.Errorf("Other registry should select web3, but select %v", nodeNames)
+		t.FailNow()
+	}
+}
@@ -0,0 +1,595 @@
+/*
+Copyright (C) 2019 by Martin Langlotz aka stackshadow
+
+This file is part of gopilot, an rewrite of the copilot-project in go
+
+gopilot is free software: you can redistribute it and/or modify
+it under the terms of the GNU Lesser General Public License as published by
+the Free Software Foundation, version 3 of this License
+
+gopilot is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License
+along with gopilot.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package pluginconfigsync
+
+/*
+Distribute config-sections from one node ( the hub ) to other nodes
+
+On the hub:
+cfg/distribute  {"section":"nft", "nodes":["nodea","nodeb"], "selector":"role=web", "overrides":{"nodeb":{...}}, "dryRun":true}
+-> cfg/distributeStarted  <id>
+-> cfg/distributeReport   {"id":"<id>", "accepted":[...], "rejected":{...}, "pending":[...], "confirming":[...], "diffs":{...}}
+
+On every node:
+cfg/getSection  <section>
+cfg/setSection  {"id":"<id>", "name":"nft", "value":{...}, "dryRun":false}
+-> cfg/setSectionOk      {"id":"<id>", "node":"<node>", "name":"nft", "diff":[...]}
+-> cfg/setSectionFailed  {"id":"<id>", "node":"<node>", "name":"nft", "error":"..."}
+-> cfg/setSectionPending {"id":"<id>", "node":"<node>", "name":"nft", "diff":[...]}
+   the change wait for a confirm, setSectionOk or setSectionFailed follow later
+
+distribute is only accepted from this node ( and its webclients ).
+setSection is only accepted from this node and from our hubs: the nodes in -configsync.hubs
+or, if not set, the nodes we connect to as client.
+Sections with keys, tokens, users or the deny list can not be read or changed remotely.
+
+A plugin can apply its section itself with HandleSection(). If the plugin return an error,
+the section is not saved and the error is sent back with setSectionFailed.
+A plugin can also wait for a confirm, for example nft apply the rules and wait for nft/confirm:
+the node answer with setSectionPending and send the final result after the confirm or the rollback.
+The distribution wait up to confirmTimeout seconds for them, nodes without a result are reported as confirming.
+*/
+
+import (
+	"core/clog"
+	"core/config"
+	"core/msgbus"
+	"core/nodes"
+	"core/tools"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+type msgSection struct {
+	ID     string                 `json:"id"`
+	Name   string                 `json:"name"`
+	Value  map[string]interface{} `json:"value"`
+	DryRun bool                   `json:"dryRun"`
+}
+
+type msgSectionResult struct {
+	ID    string             `json:"id"`
+	Node  string             `json:"node"`
+	Name  string             `json:"name"`
+	Diff  []config.DiffEntry `json:"diff"`
+	Error string             `json:"error,omitempty"`
+}
+
+type msgDistribute struct {
+	Section   string                            `json:"section"`
+	Nodes     []string                          `json:"nodes"`
+	Selector  string                            `json:"selector"` // select nodes additional to Nodes
+	Overrides map[string]map[string]interface{} `json:"overrides"`
+	DryRun    bool                              `json:"dryRun"`
+	Timeout   int                               `json:"timeout"` // in seconds
+}
+
+type distributeReport struct {
+	ID         string                        `json:"id"`
+	Section    string                        `json:"section"`
+	DryRun     bool                          `json:"dryRun"`
+	Accepted   []string                      `json:"accepted"`
+	Rejected   map[string]string             `json:"rejected"`
+	Pending    []string                      `json:"pending"`
+	Confirming []string                      `json:"confirming"` // applied, but the confirm is missing
+	Diffs      map[string][]config.DiffEntry `json:"diffs"`
+}
+
+type distribution struct {
+	request    msgbus.Msg // the message which start the distribution, we answer to it
+	report     distributeReport
+	pending    map[string]bool
+	confirming map[string]bool // nodes which answered with setSectionPending
+	timer      *time.Timer
+	finished   bool
+}
+
+// these sections will never be distributed, because they contain node-specific secrets
+// or decide which nodes and users are trusted
+var protectedSections = map[string]bool{
+	"nodes":     true, // keys and shared secrets of the nodes
+	"ca":        true, // requests and issued certificates of the CA
+	"caRevoked": true, // deny list, distributed as CRL by the CA-node
+	"enroll":    true, // tokens and their audit-list
+	"ldap":      true, // login of the webclient
+}
+
+const defaultTimeout = 10
+
+// in seconds, how long a distribution wait for nodes which wait for a confirm
+const confirmTimeout = 30
+
+// options
+var hubList string
+
+// private vars
+var plugin msgbus.Plugin
+var logging clog.Logger
+
+var distributions map[string]*distribution
+var distributionsMutex sync.Mutex
+
+// SectionHandler apply a section, the handler must save it
+// If it return pending, the change is not final: the handler must call confirmed later with the result
+type SectionHandler func(value map[string]interface{}, confirmed func(err error)) (pending bool, err error)
+
+var sectionHandlers = make(map[string]SectionHandler)
+var sectionHandlersMutex sync.Mutex
+
+// ParseCmdLine read the options of the configsync-plugin
+func ParseCmdLine() {
+	flag.StringVar(&hubList, "configsync.hubs", "", "Comma separated list of nodes which can change config-sections on this node, if empty the nodes we connect to as client")
+}
+
+// authorizedHub return true, if nodeSource can change config-sections on this node
+func authorizedHub(nodeSource string) bool {
+
+	nodeName := msgbus.AddressNode(nodeSource)
+	if nodeName == config.NodeName {
+		return true
+	}
+
+	if hubList != "" {
+		for _, hubName := range strings.Split(hubList, ",") {
+			if strings.TrimSpace(hubName) == nodeName {
+				return true
+			}
+		}
+		return false
+	}
+
+	node, err := nodes.Get(nodeName)
+	if err != nil {
+		return false
+	}
+	return node.IsHub()
+}
+
+// Init the configsync-plugin
+func Init() {
+	logging = clog.New("CFGSYNC")
+
+	distributions = make(map[string]*distribution)
+
+	// register plugin on messagebus
+	plugin = msgbus.NewPlugin("CFGSYNC")
+	plugin.Register()
+	plugin.ListenForGroup("cfg", onMessage)
+}
+
+// HandleSection let the plugin which own the section apply remote changes, the handler must save it
+func HandleSection(name string, handler SectionHandler) {
+	sectionHandlersMutex.Lock()
+	defer sectionHandlersMutex.Unlock()
+	sectionHandlers[name] = handler
+}
+
+// applySection set the config-section and return the diff against the current one
+// if dryRun is true, nothing will be changed
+// if pending is true, the plugin of the section wait for a confirm and call confirmed with the final result
+func applySection(name string, value map[string]interface{}, dryRun bool, confirmed func(err error)) (diff []config.DiffEntry, pending bool, err error) {
+
+	if name == "" {
+		return nil, false, fmt.Errorf("Section name is missing")
+	}
+	if protectedSections[name] {
+		return nil, false, fmt.Errorf("Section '%s' can not be changed remotely", name)
+	}
+	if value == nil {
+		return nil, false, fmt.Errorf("Value of section '%s' is missing", name)
+	}
+
+	curValue, _ := config.GetJSONObject(name)
+	diff = config.Diff(curValue, value)
+
+	if dryRun || len(diff) == 0 {
+		return diff, false, nil
+	}
+
+	sectionHandlersMutex.Lock()
+	handler := sectionHandlers[name]
+	sectionHandlersMutex.Unlock()
+	if handler != nil {
+		pending, err = handler(value, func(confirmErr error) {
+			if confirmErr != nil {
+				logging.Error("SECTION", fmt.Sprintf("Section '%s' was not confirmed: %s", name, confirmErr.Error()))
+			} else {
+				logging.Info("SECTION", fmt.Sprintf("Section '%s' confirmed", name))
+			}
+			confirmed(confirmErr)
+		})
+		if err != nil {
+			return nil, false, err
+		}
+		if pending {
+			logging.Info("SECTION", fmt.Sprintf("Section '%s' applied with %d changes, waiting for confirm", name, len(diff)))
+			return diff, true, nil
+		}
+		logging.Info("SECTION", fmt.Sprintf("Section '%s' applied with %d changes", name, len(diff)))
+		return diff, false, nil
+	}
+
+	config.SetJSONObject(name, value)
+	config.Save()
+
+	logging.Info("SECTION", fmt.Sprintf("Section '%s' changed with %d changes", name, len(diff)))
+
+	// inform all plugins on this node
+	plugin.Publish(config.NodeName, config.NodeName, "cfg", "sectionChanged", name)
+
+	return diff, false, nil
+}
+
+// startDistribution send the section to all nodes
+// the requester get an distributeStarted with the id and later the distributeReport
+func startDistribution(request *msgbus.Msg, distReq msgDistribute) error {
+
+	if distReq.Section == "" {
+		return fmt.Errorf("Section name is missing")
+	}
+	if protectedSections[distReq.Section] {
+		return fmt.Errorf("Section '%s' can not be distributed", distReq.Section)
+	}
+	if distReq.Selector != "" {
+		selectedNodes, err := nodes.Select(distReq.Selector)
+		if err != nil {
+			return err
+		}
+		for _, nodeName := range selectedNodes {
+			if !containsString(distReq.Nodes, nodeName) {
+				distReq.Nodes = append(distReq.Nodes, nodeName)
+			}
+		}
+	}
+	if len(distReq.Nodes) == 0 {
+		return fmt.Errorf("No target nodes given")
+	}
+
+	baseValue, err := config.GetJSONObject(distReq.Section)
+	if err != nil {
+		return err
+	}
+
+	if distReq.Timeout <= 0 {
+		distReq.Timeout = defaultTimeout
+	}
+	timeout := time.Second * time.Duration(distReq.Timeout)
+
+	newDist := distribution{
+		request: *request,
+		report: distributeReport{
+			ID:         tools.RandomString(8),
+			Section:    distReq.Section,
+			DryRun:     distReq.DryRun,
+			Accepted:   make([]string, 0),
+			Rejected:   make(map[string]string),
+			Pending:    make([]string, 0),
+			Confirming: make([]string, 0),
+			Diffs:      make(map[string][]config.DiffEntry),
+		},
+		pending:    make(map[string]bool),
+		confirming: make(map[string]bool),
+	}
+
+	// create the messages for every node
+	messages := make([]msgbus.Msg, 0)
+	for _, nodeName := range distReq.Nodes {
+
+		nodeValue := config.Merge(baseValue, distReq.Overrides[nodeName])
+
+		// our own node
+		if nodeName == config.NodeName {
+			result := msgSectionResult{ID: newDist.report.ID, Node: nodeName, Name: distReq.Section}
+			diff, pending, err := applySection(distReq.Section, nodeValue, distReq.DryRun, func(confirmErr error) {
+				if confirmErr != nil {
+					result.Error = confirmErr.Error()
+				}
+				onSectionResult(result, confirmErr == nil)
+			})
+			if err != nil {
+				newDist.report.Rejected[nodeName] = err.Error()
+				continue
+			}
+			if pending {
+				result.Diff = diff
+				newDist.pending[nodeName] = true
+				newDist.confirming[nodeName] = true
+				if timeout < time.Second*confirmTimeout {
+					timeout = time.Second * confirmTimeout
+				}
+				continue
+			}
+			newDist.report.Accepted = append(newDist.report.Accepted, nodeName)
+			newDist.report.Diffs[nodeName] = diff
+			continue
+		}
+
+		if _, err := nodes.GetNodeObject(nodeName); err != nil {
+			newDist.report.Rejected[nodeName] = err.Error()
+			continue
+		}
+
+		payloadBytes, err := json.Marshal(msgSection{
+			ID:     newDist.report.ID,
+			Name:   distReq.Section,
+			Value:  nodeValue,
+			DryRun: distReq.DryRun,
+		})
+		if err != nil {
+			newDist.report.Rejected[nodeName] = err.Error()
+			continue
+		}
+
+		newDist.pending[nodeName] = true
+		messages = append(messages, msgbus.Msg{
+			NodeSource: config.NodeName,
+			NodeTarget: nodeName,
+			Group:      "cfg",
+			Command:    "setSection",
+			Payload:    string(payloadBytes),
+		})
+	}
+
+	distributionsMutex.Lock()
+	distributions[newDist.report.ID] = &newDist
+	newDist.timer = time.AfterFunc(timeout, func() {
+		finishDistribution(newDist.report.ID)
+	})
+	distributionsMutex.Unlock()
+
+	logging.Info("DISTRIBUTE", fmt.Sprintf(
+		"[%s] Send section '%s' to %d nodes",
+		newDist.report.ID, distReq.Section, len(messages),
+	))
+
+	request.Answer(&plugin, "distributeStarted", newDist.report.ID)
+
+	// we publish from outside the bus-worker, so we dont block it
+	waitForOwnNode := len(newDist.confirming) > 0
+	go func() {
+		for _, curMessage := range messages {
+			plugin.PublishMsg(curMessage)
+		}
+		if len(messages) == 0 && !waitForOwnNode {
+			finishDistribution(newDist.report.ID)
+		}
+	}()
+
+	return nil
+}
+
+func containsString(list []string, value string) bool {
+	for _, curValue := range list {
+		if curValue == value {
+			return true
+		}
+	}
+	return false
+}
+
+// onSectionResult collect the answer of a single node
+func onSectionResult(result msgSectionResult, accepted bool) {
+
+	distributionsMutex.Lock()
+	curDist, ok := distributions[result.ID]
+	if !ok || !curDist.pending[result.Node] {
+		distributionsMutex.Unlock()
+		return
+	}
+
+	delete(curDist.pending, result.Node)
+	delete(curDist.confirming, result.Node)
+	if accepted {
+		curDist.report.Accepted = append(curDist.report.Accepted, result.Node)
+		curDist.report.Diffs[result.Node] = result.Diff
+	} else {
+		curDist.report.Rejected[result.Node] = result.Error
+	}
+	done := len(curDist.pending) == 0
+	distributionsMutex.Unlock()
+
+	if done {
+		finishDistribution(result.ID)
+	}
+}
+
+// onSectionPending remember that the node applied the section, but wait for a confirm
+// the distribution wait longer for the final result
+func onSectionPending(result msgSectionResult) {
+
+	distributionsMutex.Lock()
+	defer distributionsMutex.Unlock()
+
+	curDist, ok := distributions[result.ID]
+	if !ok || !curDist.pending[result.Node] || curDist.finished {
+		return
+	}
+
+	curDist.confirming[result.Node] = true
+	curDist.report.Diffs[result.Node] = result.Diff
+	curDist.timer.Reset(time.Second * confirmTimeout)
+}
+
+// finishDistribution send the report to the requester
+// nodes that not answered until now are reported as pending, nodes without a confirm as confirming
+func finishDistribution(id string) {
+
+	distributionsMutex.Lock()
+	curDist, ok := distributions[id]
+	if !ok || curDist.finished {
+		distributionsMutex.Unlock()
+		return
+	}
+	curDist.finished = true
+	curDist.timer.Stop()
+	delete(distributions, id)
+
+	for nodeName := range curDist.pending {
+		if curDist.confirming[nodeName] {
+			curDist.report.Confirming = append(curDist.report.Confirming, nodeName)
+			continue
+		}
+		curDist.report.Pending = append(curDist.report.Pending, nodeName)
+	}
+	distributionsMutex.Unlock()
+
+	reportBytes, err := json.Marshal(curDist.report)
+	if err != nil {
+		logging.Error("DISTRIBUTE", err.Error())
+		return
+	}
+
+	logging.Info("DISTRIBUTE", fmt.Sprintf(
+		"[%s] Finished: %d accepted, %d rejected, %d pending, %d confirming",
+		id, len(curDist.report.Accepted), len(curDist.report.Rejected), len(curDist.report.Pending), len(curDist.report.Confirming),
+	))
+	curDist.request.Answer(&plugin, "distributeReport", string(reportBytes))
+}
+
+// answerSectionResult send setSectionOk or, if err is set, setSectionFailed to the requester of setSection
+func answerSectionResult(request *msgbus.Msg, result msgSectionResult, err error) {
+
+	if err != nil {
+		result.Error = err.Error()
+	}
+
+	resultBytes, _ := json.Marshal(result)
+	if err != nil {
+		request.Answer(&plugin, "setSectionFailed", string(resultBytes))
+		return
+	}
+	request.Answer(&plugin, "setSectionOk", string(resultBytes))
+}
+
+func onMessage(message *msgbus.Msg, group, command, payload string) {
+
+	// answers from remote nodes
+	if command == "setSectionOk" || command == "setSectionFailed" || command == "setSectionPending" {
+
+		if message.NodeTarget != config.NodeName {
+			return
+		}
+
+		var result msgSectionResult
+		err := json.Unmarshal([]byte(payload), &result)
+		if err != nil {
+			logging.Error("RESULT", err.Error())
+			return
+		}
+
+		// we trust the source of the message, not the payload
+		result.Node = message.NodeSource
+		if command == "setSectionPending" {
+			onSectionPending(result)
+			return
+		}
+		onSectionResult(result, command == "setSectionOk")
+		return
+	}
+
+	// from here: only commands for THIS node
+	if message.NodeTarget != config.NodeName {
+		return
+	}
+
+	if command == "getSection" {
+
+		if protectedSections[payload] {
+			message.Answer(&plugin, "error", fmt.Sprintf("Section '%s' can not be read remotely", payload))
+			return
+		}
+
+		value, err := config.GetJSONObject(payload)
+		if err != nil {
+			message.Answer(&plugin, "error", err.Error())
+			return
+		}
+
+		sectionBytes, err := json.Marshal(msgSection{Name: payload, Value: value})
+		if err != nil {
+			message.Answer(&plugin, "error", err.Error())
+			return
+		}
+
+		message.Answer(&plugin, "section", string(sectionBytes))
+		return
+	}
+
+	if command == "setSection" {
+
+		var section msgSection
+		err := json.Unmarshal([]byte(payload), &section)
+		if err != nil {
+			message.Answer(&plugin, "error", err.Error())
+			return
+		}
+
+		result := msgSectionResult{
+			ID:   section.ID,
+			Node: config.NodeName,
+			Name: section.Name,
+		}
+
+		pending := false
+		if authorizedHub(message.NodeSource) {
+			request := *message
+			result.Diff, pending, err = applySection(section.Name, section.Value, section.DryRun, func(confirmErr error) {
+				answerSectionResult(&request, result, confirmErr)
+			})
+		} else {
+			err = fmt.Errorf("'%s' is not allowed to change sections on '%s'", message.NodeSource, config.NodeName)
+			logging.Error("SECTION", err.Error())
+		}
+
+		if pending {
+			resultBytes, _ := json.Marshal(result)
+			message.Answer(&plugin, "setSectionPending", string(resultBytes))
+			return
+		}
+		answerSectionResult(message, result, err)
+		return
+	}
+
+	if command == "distribute" {
+
+		// the sections are pushed as this node, so only we and our webclients can start it
+		if msgbus.AddressNode(message.NodeSource) != config.NodeName {
+			logging.Error("DISTRIBUTE", fmt.Sprintf("'%s' is not allowed to distribute sections from '%s'", message.NodeSource, config.NodeName))
+			message.Answer(&plugin, "error", fmt.Sprintf("Only '%s' can distribute its sections", config.NodeName))
+			return
+		}
+
+		var distReq msgDistribute
+		err := json.Unmarshal([]byte(payload), &distReq)
+		if err != nil {
+			message.Answer(&plugin, "error", err.Error())
+			return
+		}
+
+		err = startDistribution(message, distReq)
+		if err != nil {
+			message.Answer(&plugin, "error", err.Error())
+		}
+		return
+	}
+}
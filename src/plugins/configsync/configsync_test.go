@@ -0,0 +1,118 @@
+/*
+Copyright (C) 2019 by Martin Langlotz aka stackshadow
+
+This file is part of gopilot, an rewrite of the copilot-project in go
+
+gopilot is free software: you can redistribute it and/or modify
+it under the terms of the GNU Lesser General Public License as published by
+the Free Software Foundation, version 3 of this License
+
+gopilot is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License
+along with gopilot.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package pluginconfigsync
+
+import (
+	"core/clog"
+	"core/config"
+	"core/msgbus"
+	"core/nodes"
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// waitForAnswer return the first message of the group to target
+func waitForAnswer(t *testing.T, answers chan msgbus.Msg, target string) msgbus.Msg {
+	for {
+		select {
+		case message := <-answers:
+			if message.NodeTarget == target {
+				return message
+			}
+		case <-time.After(time.Second * 5):
+			t.Errorf("No answer to '%s'", target)
+			t.FailNow()
+		}
+	}
+}
+
+func TestDistribute(t *testing.T) {
+
+	clog.Init()
+	msgbus.MsgBusInit()
+	msgbus.PluginsInit()
+
+	config.ParseCmdLine()
+	config.Init()
+	config.ConfigPath = "/tmp"
+	config.NodeName = "synchub"
+	config.Read()
+	nodes.Init()
+
+	Init()
+
+	config.SetJSONObject("synctest", map[string]interface{}{"value": "hub"})
+	defer func() {
+		config.SetJSONObject("synctest", map[string]interface{}{})
+		config.Save()
+	}()
+
+	answers := make(chan msgbus.Msg, 10)
+	testPlugin := msgbus.NewPlugin("CFGSYNC_TEST")
+	testPlugin.Register()
+	testPlugin.ListenForGroup("cfg", func(message *msgbus.Msg, group, command, payload string) {
+		answers <- *message
+	})
+
+	// another node can not push our sections as us
+	testPlugin.Publish("evilnode", "synchub", "cfg", "distribute", "{\"section\":\"synctest\",\"nodes\":[\"synchub\"]}")
+	if message := waitForAnswer(t, answers, "evilnode"); message.Command != "error" {
+		t.Errorf("Distribute from a remote node should be rejected, but get %+v", message)
+	}
+
+	// our webclient can distribute
+	testPlugin.Publish("synchub/ws1", "synchub", "cfg", "distribute", "{\"section\":\"synctest\",\"nodes\":[\"synchub\"],\"dryRun\":true}")
+	if message := waitForAnswer(t, answers, "synchub/ws1"); message.Command != "distributeStarted" {
+		t.Errorf("Distribute from our webclient should be started, but get %+v", message)
+	}
+
+	// a plugin which wait for a confirm
+	confirms := make(chan func(err error), 1)
+	HandleSection("syncpending", func(value map[string]interface{}, confirmed func(err error)) (bool, error) {
+		confirms <- confirmed
+		return true, nil
+	})
+	config.SetJSONObject("syncpending", map[string]interface{}{"rules": "old"})
+
+	testPlugin.Publish("synchub/ws2", "synchub", "cfg", "setSection", "{\"id\":\"sect1\",\"name\":\"syncpending\",\"value\":{\"rules\":\"new\"}}")
+	if message := waitForAnswer(t, answers, "synchub/ws2"); message.Command != "setSectionPending" {
+		t.Errorf("Section should wait for the confirm, but get %+v", message)
+		t.FailNow()
+	}
+	(<-confirms)(nil)
+	if message := waitForAnswer(t, answers, "synchub/ws2"); message.Command != "setSectionOk" {
+		t.Errorf("Section should be confirmed, but get %+v", message)
+	}
+
+	// a rollback is reported as rejected
+	testPlugin.Publish("synchub/ws3", "synchub", "cfg", "distribute", "{\"section\":\"syncpending\",\"nodes\":[\"synchub\"],\"overrides\":{\"synchub\":{\"rules\":\"new\"}}}")
+	if message := waitForAnswer(t, answers, "synchub/ws3"); message.Command != "distributeStarted" {
+		t.Errorf("Distribute should be started, but get %+v", message)
+		t.FailNow()
+	}
+	(<-confirms)(fmt.Errorf("rolled back"))
+	message := waitForAnswer(t, answers, "synchub/ws3")
+	var report distributeReport
+	json.Unmarshal([]byte(message.Payload), &report)
+	if message.Command != "distributeReport" || report.Rejected["synchub"] != "rolled back" || len(report.Accepted) != 0 {
+		t.Errorf("Rollback should be rejected, but get %+v", message)
+	}
+}
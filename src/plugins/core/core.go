@@ -24,12 +24,23 @@ import (
 	"core/msgbus"
 	"core/nodes"
 	"encoding/json"
-
 	"fmt"
 )
 
 var logging clog.Logger
 var corePlugin msgbus.Plugin
+var fanoutPlugin msgbus.Plugin
+
+type msgNodeTag struct {
+	Name  string `json:"name"`
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+type msgGroup struct {
+	Name     string `json:"name"`
+	Selector string `json:"selector"`
+}
 
 func Init() {
 	logging = clog.New("CORE")
@@ -38,6 +49,36 @@ func Init() {
 	corePlugin = msgbus.NewPlugin("Core")
 	corePlugin.Register()
 	corePlugin.ListenForGroup("co", onMessage)
+
+	// we use an own plugin for the fanout, so the copies also reach the core-plugin
+	fanoutPlugin = msgbus.NewPlugin("Fanout")
+	fanoutPlugin.Register()
+	fanoutPlugin.ListenForGroup("", onFanoutMessage)
+}
+
+// onFanoutMessage send a copy of every message with a selector as target to all matching nodes
+func onFanoutMessage(message *msgbus.Msg, group, command, payload string) {
+
+	if !nodes.IsSelector(message.NodeTarget) {
+		return
+	}
+
+	nodeNames, err := nodes.Select(message.NodeTarget)
+	if err != nil {
+		message.Answer(&fanoutPlugin, "error", err.Error())
+		return
+	}
+
+	logging.Debug("FANOUT", fmt.Sprintf("'%s' select %d nodes", message.NodeTarget, len(nodeNames)))
+
+	// we publish from outside the bus-worker, so we dont block it
+	messageCopy := *message
+	go func() {
+		for _, nodeName := range nodeNames {
+			messageCopy.NodeTarget = nodeName
+			fanoutPlugin.PublishMsg(messageCopy)
+		}
+	}()
 }
 
 func onMessage(message *msgbus.Msg, group, command, payload string) {
@@ -55,27 +96,17 @@ func onMessage(message *msgbus.Msg, group, command, payload string) {
 
 	if command == "getNodes" {
 
-		nodes.IterateNodes(func(nodeName string, jsonNode nodes.JSONNodeType, jsonNodeInterfaced map[string]interface{}) {
-
-			var requested bool
-			var accepted bool
+		nodes.IterateNodes(func(node nodes.Node) {
 
-			if jsonNodeInterfaced["PeerCertSignatureReq"] != "" {
-				requested = true
-				accepted = false
-			}
-			if jsonNodeInterfaced["PeerCertSignature"] != "" {
-				requested = false
-				accepted = true
+			nodeBytes, err := json.Marshal(map[string]nodes.NodeInfo{
+				node.Name: node.Info(),
+			})
+			if err != nil {
+				logging.Error("getNodes", err.Error())
+				return
 			}
 
-			message.Answer(&corePlugin, "node",
-				fmt.Sprintf(
-					"{\"%s\":{ \"host\":\"%s\", \"port\":%d, \"type\":%d, \"req\": %t, \"acc\": %t } }",
-					nodeName, jsonNode.Host, jsonNode.Port, jsonNode.Type, requested, accepted,
-				),
-			)
-
+			message.Answer(&corePlugin, "node", string(nodeBytes))
 		})
 
 		message.Answer(&corePlugin, "nodeEnd", "")
@@ -111,4 +142,92 @@ func onMessage(message *msgbus.Msg, group, command, payload string) {
 		message.Answer(&corePlugin, "pong", "")
 		return
 	}
+
+	if command == "nodeTagSet" || command == "nodeTagDelete" {
+
+		var nodeTag msgNodeTag
+		err := json.Unmarshal([]byte(payload), &nodeTag)
+		if err != nil {
+			message.Answer(&corePlugin, "error", err.Error())
+			return
+		}
+
+		var node nodes.Node
+		if command == "nodeTagSet" {
+			node, err = nodes.SetTag(nodeTag.Name, nodeTag.Key, nodeTag.Value)
+		} else {
+			node, err = nodes.DeleteTag(nodeTag.Name, nodeTag.Key)
+		}
+		if err != nil {
+			message.Answer(&corePlugin, "error", err.Error())
+			return
+		}
+
+		nodeBytes, err := json.Marshal(map[string]nodes.NodeInfo{
+			node.Name: node.Info(),
+		})
+		if err != nil {
+			message.Answer(&corePlugin, "error", err.Error())
+			return
+		}
+
+		message.Answer(&corePlugin, command+"Ok", string(nodeBytes))
+		return
+	}
+
+	if command == "getGroups" {
+
+		groupsBytes, err := json.Marshal(nodes.GetGroups())
+		if err != nil {
+			message.Answer(&corePlugin, "error", err.Error())
+			return
+		}
+
+		message.Answer(&corePlugin, "groups", string(groupsBytes))
+		return
+	}
+
+	if command == "groupSet" {
+
+		var group msgGroup
+		err := json.Unmarshal([]byte(payload), &group)
+		if err != nil {
+			message.Answer(&corePlugin, "error", err.Error())
+			return
+		}
+
+		err = nodes.SetGroup(group.Name, group.Selector)
+		if err != nil {
+			message.Answer(&corePlugin, "error", err.Error())
+			return
+		}
+
+		message.Answer(&corePlugin, "groupSetOk", group.Name)
+		return
+	}
+
+	if command == "groupDelete" {
+		nodes.DeleteGroup(payload)
+		message.Answer(&corePlugin, "groupDeleteOk", payload)
+		return
+	}
+
+	// return all node-names which match the selector inside the payload
+	if command == "selectNodes" {
+
+		nodeNames, err := nodes.Select(payload)
+		if err != nil {
+			message.Answer(&corePlugin, "error", err.Error())
+			return
+		}
+
+		nodeNamesBytes, err := json.Marshal(nodeNames)
+		if err != nil {
+			message.Answer(&corePlugin, "error", err.Error())
+			return
+		}
+
+		message.Answer(&corePlugin, "selectedNodes", string(nodeNamesBytes))
+		return
+	}
 }
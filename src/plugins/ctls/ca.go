@@ -0,0 +1,763 @@
+/*
+Copyright (C) 2019 by Martin Langlotz aka stackshadow
+
+This file is part of gopilot, an rewrite of the copilot-project in go
+
+gopilot is free software: you can redistribute it and/or modify
+it under the terms of the GNU Lesser General Public License as published by
+the Free Software Foundation, version 3 of this License
+
+gopilot is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License
+along with gopilot.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package pluginctls
+
+/*
+Optional CA-mode: one node hold the CA-key and sign the certificates of all other nodes.
+Every node that has a ca.crt inside the configpath accept peers with a certificate signed by this CA,
+without an manual accept of every pair.
+
+On the CA-node ( once ):
+-caInit                         create ca.key and ca.crt and sign our own certificate
+
+On the node that should be enrolled:
+tls/caEnroll     <caNode>       send a signing-request to the CA-node
+-> tls/caEnrollStarted <caNode>
+
+On the CA-node:
+tls/caRequested  <node>         ( published when a request arrive )
+tls/caGetRequests               -> tls/caRequests ["nodea","nodeb"]
+tls/caSign       <node>         sign the request, send the certificate to the node -> tls/caSignOk <node>
+tls/caRevoke     <node>         put the serials of all certificates of the node on the deny list -> tls/caRevokeOk ["serial",..]
+
+On the enrolled node:
+tls/caInstalled  <caNode>       ( published when the certificate was installed, it is used for new connections )
+The CA is only installed, if the pinned certificate of the CA-node is signed by it.
+
+caEnroll, caGetRequests, caSign and caRevoke are only accepted from this node and its webclients.
+
+The deny list is the config-section "caRevoked" ( serial -> node ).
+The CA-node send it as revocation-list signed by the CA to all connected nodes with a certificate of the CA,
+after every caRevoke and when such a node connect:
+tls/caRevokedList <PEM of the X509 CRL>
+Other nodes add the serials to their deny list, if the list is signed by the CA they trust.
+*/
+
+import (
+	"bytes"
+	"core/msgbus"
+	"crypto"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"time"
+)
+
+type msgCACert struct {
+	Cert string `json:"cert"` // PEM of the signed node certificate
+	CA   string `json:"ca"`   // PEM of the CA certificate
+}
+
+// options
+var caInit bool
+var caRequired bool
+
+// return the key and crt of the CA
+func (curInstance *instance) getCAPath() (string, string) {
+	return curInstance.config.Path() + "/ca.key", curInstance.config.Path() + "/ca.crt"
+}
+
+// localCertificate load the key pair of this node, it is loaded for every new connection
+// so a new certificate is used without restart
+func (curInstance *instance) localCertificate() (*tls.Certificate, error) {
+	keyFileName, certFileName := curInstance.getKeyPairPath(curInstance.config.NodeName())
+
+	keyPair, err := tls.LoadX509KeyPair(certFileName, keyFileName)
+	if err != nil {
+		return nil, err
+	}
+	return &keyPair, nil
+}
+
+// readCertificatePEM parse the first certificate inside certBytes
+func readCertificatePEM(certBytes []byte) (*x509.Certificate, error) {
+	certBlock, _ := pem.Decode(certBytes)
+	if certBlock == nil || certBlock.Type != "CERTIFICATE" {
+		return nil, fmt.Errorf("No certificate found")
+	}
+	return x509.ParseCertificate(certBlock.Bytes)
+}
+
+// loadCA return the CA-certificate, if this node run in CA-mode
+func (curInstance *instance) loadCA() (*x509.Certificate, error) {
+	_, caCertFileName := curInstance.getCAPath()
+
+	caBytes, err := ioutil.ReadFile(caCertFileName)
+	if err != nil {
+		return nil, err
+	}
+	return readCertificatePEM(caBytes)
+}
+
+// CreateCA create the CA-key and -certificate, if not exist
+// our own certificate is replaced by one signed from the CA
+func CreateCA() error {
+	return defaultInstance.CreateCA()
+}
+
+// CreateCA create the CA-key and -certificate, if not exist
+// our own certificate is replaced by one signed from the CA
+func (curInstance *instance) CreateCA() error {
+
+	caKeyFileName, caCertFileName := curInstance.getCAPath()
+
+	if _, err := os.Stat(caKeyFileName); err == nil {
+		return nil
+	}
+
+	subject, err := ParseSubject(certSubject, curInstance.config.NodeName()+" CA")
+	if err != nil {
+		return err
+	}
+
+	key, err := generateKey(certKeyType)
+	if err != nil {
+		return err
+	}
+
+	serialNumber, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	template := x509.Certificate{
+		SerialNumber:          serialNumber,
+		Subject:               subject,
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(certLifetime),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+
+	caBytes, err := x509.CreateCertificate(rand.Reader, &template, &template, key.Public(), key)
+	if err != nil {
+		return err
+	}
+
+	err = writeKey(caKeyFileName, key)
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(caCertFileName, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caBytes}), 0644)
+	if err != nil {
+		return err
+	}
+
+	curInstance.logging.Info("CA", "CA created", "subject", subject.String())
+
+	// sign our own key
+	nodeKeyFileName, nodeCertFileName := curInstance.getKeyPairPath(curInstance.config.NodeName())
+	nodeKey, err := readKey(nodeKeyFileName)
+	if err != nil {
+		return err
+	}
+	certBytes, _, err := curInstance.caSign(curInstance.config.NodeName(), nodeKey.Public())
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(nodeCertFileName, certBytes, 0644)
+}
+
+// caSign create a certificate for nodeName signed by our CA
+// it return the certificate as PEM and the serial as hex
+func (curInstance *instance) caSign(nodeName string, publicKey crypto.PublicKey) ([]byte, string, error) {
+
+	caKeyFileName, _ := curInstance.getCAPath()
+	caKey, err := readKey(caKeyFileName)
+	if err != nil {
+		return nil, "", err
+	}
+	caCert, err := curInstance.loadCA()
+	if err != nil {
+		return nil, "", err
+	}
+
+	serialNumber, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, "", err
+	}
+
+	subject := caCert.Subject
+	subject.CommonName = nodeName
+
+	now := time.Now()
+	template := x509.Certificate{
+		SerialNumber: serialNumber,
+		Subject: pkix.Name{
+			Country:            subject.Country,
+			Province:           subject.Province,
+			Locality:           subject.Locality,
+			Organization:       subject.Organization,
+			OrganizationalUnit: subject.OrganizationalUnit,
+			CommonName:         nodeName,
+		},
+		DNSNames:              []string{nodeName},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(certLifetime),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+	}
+	if template.NotAfter.After(caCert.NotAfter) {
+		template.NotAfter = caCert.NotAfter
+	}
+
+	certBytes, err := x509.CreateCertificate(rand.Reader, &template, caCert, publicKey, caKey)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certBytes}), serialNumber.Text(16), nil
+}
+
+// caVerify return nil, if peerCert is signed by our CA
+func (curInstance *instance) caVerify(peerCert *x509.Certificate) error {
+
+	caCert, err := curInstance.loadCA()
+	if err != nil {
+		return err
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(caCert)
+
+	_, err = peerCert.Verify(x509.VerifyOptions{
+		Roots:     roots,
+		KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
+	})
+	return err
+}
+
+// caRevoked return true, if the serial of peerCert is on the deny list
+func (curInstance *instance) caRevoked(peerCert *x509.Certificate) bool {
+	revoked, err := curInstance.config.GetJSONObject("caRevoked")
+	if err != nil {
+		return false
+	}
+	_, isRevoked := revoked[peerCert.SerialNumber.Text(16)]
+	return isRevoked
+}
+
+// getCASection return the section with requests and issued certificates of the CA-node
+// issued contains the list of serials per node
+func (curInstance *instance) getCASection() (map[string]interface{}, map[string]interface{}, map[string]interface{}) {
+
+	caSection, err := curInstance.config.GetJSONObject("ca")
+	if err != nil {
+		caSection = make(map[string]interface{})
+	}
+
+	requests, ok := caSection["requests"].(map[string]interface{})
+	if !ok {
+		requests = make(map[string]interface{})
+		caSection["requests"] = requests
+	}
+	issued, ok := caSection["issued"].(map[string]interface{})
+	if !ok {
+		issued = make(map[string]interface{})
+		caSection["issued"] = issued
+	}
+
+	return caSection, requests, issued
+}
+
+// createSigningRequest create a signing-request as PEM for the key of nodeName
+func (curInstance *instance) createSigningRequest(nodeName string) (string, error) {
+
+	keyFileName, _ := curInstance.getKeyPairPath(nodeName)
+	key, err := readKey(keyFileName)
+	if err != nil {
+		return "", err
+	}
+
+	subject, err := ParseSubject(certSubject, nodeName)
+	if err != nil {
+		return "", err
+	}
+
+	csrBytes, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{Subject: subject}, key)
+	if err != nil {
+		return "", err
+	}
+
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: csrBytes})), nil
+}
+
+// caEnroll send a signing-request for our key to caNode
+func (curInstance *instance) caEnroll(caNode string) error {
+
+	csrPEM, err := curInstance.createSigningRequest(curInstance.config.NodeName())
+	if err != nil {
+		return err
+	}
+
+	curInstance.caEnrollMutex.Lock()
+	curInstance.caEnrollNode = caNode
+	curInstance.caEnrollMutex.Unlock()
+
+	curInstance.logging.Info("CA", fmt.Sprintf("Send signing-request to '%s'", caNode))
+	go curInstance.plugin.Publish(curInstance.config.NodeName(), caNode, "tls", "caRequest", csrPEM)
+
+	return nil
+}
+
+// caOnRequest save the signing-request of nodeName, it must be signed with caSign
+func (curInstance *instance) caOnRequest(nodeName, csrPEM string) error {
+
+	caKeyFileName, _ := curInstance.getCAPath()
+	if _, err := os.Stat(caKeyFileName); err != nil {
+		return fmt.Errorf("'%s' is not a CA-node", curInstance.config.NodeName())
+	}
+
+	csrBlock, _ := pem.Decode([]byte(csrPEM))
+	if csrBlock == nil || csrBlock.Type != "CERTIFICATE REQUEST" {
+		return fmt.Errorf("No signing-request found")
+	}
+	csr, err := x509.ParseCertificateRequest(csrBlock.Bytes)
+	if err != nil {
+		return err
+	}
+	if err := csr.CheckSignature(); err != nil {
+		return err
+	}
+	if csr.Subject.CommonName != nodeName {
+		return fmt.Errorf("Signing-request for '%s' was sent from '%s'", csr.Subject.CommonName, nodeName)
+	}
+
+	caSection, requests, _ := curInstance.getCASection()
+	requests[nodeName] = csrPEM
+	curInstance.config.SetJSONObject("ca", caSection)
+	curInstance.config.Save()
+
+	curInstance.logging.Info("CA", fmt.Sprintf("Signing-request from '%s' saved", nodeName))
+	return nil
+}
+
+// caSignRequest sign the saved request of nodeName and return the message for the node
+func (curInstance *instance) caSignRequest(nodeName string) (msgCACert, error) {
+
+	var caCertMsg msgCACert
+
+	caSection, requests, issued := curInstance.getCASection()
+	csrPEM, ok := requests[nodeName].(string)
+	if !ok {
+		return caCertMsg, fmt.Errorf("No signing-request of '%s'", nodeName)
+	}
+
+	csrBlock, _ := pem.Decode([]byte(csrPEM))
+	if csrBlock == nil {
+		return caCertMsg, fmt.Errorf("No signing-request found")
+	}
+	csr, err := x509.ParseCertificateRequest(csrBlock.Bytes)
+	if err != nil {
+		return caCertMsg, err
+	}
+
+	certBytes, serial, err := curInstance.caSign(nodeName, csr.PublicKey)
+	if err != nil {
+		return caCertMsg, err
+	}
+
+	_, caCertFileName := curInstance.getCAPath()
+	caBytes, err := ioutil.ReadFile(caCertFileName)
+	if err != nil {
+		return caCertMsg, err
+	}
+
+	delete(requests, nodeName)
+	serials := issuedSerials(issued, nodeName)
+	issued[nodeName] = append(serials, serial)
+	curInstance.config.SetJSONObject("ca", caSection)
+	curInstance.config.Save()
+
+	curInstance.logging.Info("CA", fmt.Sprintf("Certificate for '%s' signed", nodeName), "serial", serial)
+
+	caCertMsg.Cert = string(certBytes)
+	caCertMsg.CA = string(caBytes)
+	return caCertMsg, nil
+}
+
+// issuedSerials return the serials of all certificates issued for nodeName
+// older versions saved only the last serial
+func issuedSerials(issued map[string]interface{}, nodeName string) []string {
+
+	serials := make([]string, 0)
+	switch value := issued[nodeName].(type) {
+	case string:
+		serials = append(serials, value)
+	case []interface{}:
+		for _, serial := range value {
+			if serialString, ok := serial.(string); ok {
+				serials = append(serials, serialString)
+			}
+		}
+	case []string:
+		serials = append(serials, value...)
+	}
+
+	return serials
+}
+
+// caRevoke put all issued certificates of nodeName on the deny list and return the serials
+func (curInstance *instance) caRevoke(nodeName string) ([]string, error) {
+
+	_, _, issued := curInstance.getCASection()
+	serials := issuedSerials(issued, nodeName)
+	if len(serials) == 0 {
+		return nil, fmt.Errorf("No certificate was issued for '%s'", nodeName)
+	}
+
+	revoked, err := curInstance.config.GetJSONObject("caRevoked")
+	if err != nil {
+		revoked = make(map[string]interface{})
+	}
+	for _, serial := range serials {
+		revoked[serial] = nodeName
+	}
+	curInstance.config.SetJSONObject("caRevoked", revoked)
+	curInstance.config.Save()
+
+	curInstance.logging.Info("CA", fmt.Sprintf("Certificates of '%s' revoked", nodeName), "serials", serials)
+	return serials, nil
+}
+
+// caCheckNode return an error, if the pinned certificate of caNode is not signed by caCert
+func (curInstance *instance) caCheckNode(caNode string, caCert *x509.Certificate) error {
+
+	node, err := curInstance.nodes.Get(caNode)
+	if err != nil {
+		return err
+	}
+	if node.PeerFingerprint == "" {
+		return fmt.Errorf("The certificate of '%s' is not pinned, we dont trust its CA", caNode)
+	}
+
+	curSession := curInstance.getSession(caNode)
+	if curSession == nil || Fingerprint(curSession.currentPeerCert()) != node.PeerFingerprint {
+		return fmt.Errorf("No session with the pinned certificate of '%s'", caNode)
+	}
+	if err := curSession.currentPeerCert().CheckSignatureFrom(caCert); err != nil {
+		return fmt.Errorf("The certificate of '%s' is not signed by its CA: %s", caNode, err.Error())
+	}
+
+	return nil
+}
+
+// caRevokedList return the deny list as CRL signed by our CA
+func (curInstance *instance) caRevokedList() (string, error) {
+
+	caKeyFileName, _ := curInstance.getCAPath()
+	caKey, err := readKey(caKeyFileName)
+	if err != nil {
+		return "", err
+	}
+	caCert, err := curInstance.loadCA()
+	if err != nil {
+		return "", err
+	}
+
+	revoked, err := curInstance.config.GetJSONObject("caRevoked")
+	if err != nil {
+		revoked = make(map[string]interface{})
+	}
+
+	now := time.Now()
+	template := x509.RevocationList{
+		Number:     big.NewInt(now.UnixNano()),
+		ThisUpdate: now,
+		NextUpdate: now.Add(certLifetime),
+	}
+	for serial := range revoked {
+		serialNumber, ok := new(big.Int).SetString(serial, 16)
+		if !ok {
+			continue
+		}
+		template.RevokedCertificateEntries = append(template.RevokedCertificateEntries, x509.RevocationListEntry{
+			SerialNumber:   serialNumber,
+			RevocationTime: now,
+		})
+	}
+
+	crlBytes, err := x509.CreateRevocationList(rand.Reader, &template, caCert, caKey)
+	if err != nil {
+		return "", err
+	}
+
+	return string(pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: crlBytes})), nil
+}
+
+// caSendRevokedList send the deny list to nodeName, if it use a certificate of our CA
+func (curInstance *instance) caSendRevokedList(nodeName string, peerCert *x509.Certificate) {
+
+	caKeyFileName, _ := curInstance.getCAPath()
+	if _, err := os.Stat(caKeyFileName); err != nil {
+		return
+	}
+	if curInstance.caVerify(peerCert) != nil {
+		return
+	}
+
+	crlPEM, err := curInstance.caRevokedList()
+	if err != nil {
+		curInstance.logging.Error("CA", err.Error())
+		return
+	}
+	curInstance.plugin.Publish(curInstance.config.NodeName(), nodeName, "tls", "caRevokedList", crlPEM)
+}
+
+// caInstallRevokedList add the serials of the CRL to our deny list, it must be signed by our CA
+func (curInstance *instance) caInstallRevokedList(crlPEM string) (int, error) {
+
+	crlBlock, _ := pem.Decode([]byte(crlPEM))
+	if crlBlock == nil || crlBlock.Type != "X509 CRL" {
+		return 0, fmt.Errorf("No revocation-list found")
+	}
+	crl, err := x509.ParseRevocationList(crlBlock.Bytes)
+	if err != nil {
+		return 0, err
+	}
+
+	caCert, err := curInstance.loadCA()
+	if err != nil {
+		return 0, err
+	}
+	if err := crl.CheckSignatureFrom(caCert); err != nil {
+		return 0, fmt.Errorf("Revocation-list is not signed by our CA: %s", err.Error())
+	}
+
+	revoked, err := curInstance.config.GetJSONObject("caRevoked")
+	if err != nil {
+		revoked = make(map[string]interface{})
+	}
+	added := 0
+	for _, entry := range crl.RevokedCertificateEntries {
+		serial := entry.SerialNumber.Text(16)
+		if _, ok := revoked[serial]; ok {
+			continue
+		}
+		revoked[serial] = ""
+		added++
+	}
+	if added == 0 {
+		return 0, nil
+	}
+	curInstance.config.SetJSONObject("caRevoked", revoked)
+	curInstance.config.Save()
+
+	return added, nil
+}
+
+// caInstall check and save the certificate we get from the CA-node
+func (curInstance *instance) caInstall(caNode string, caCertMsg msgCACert) error {
+
+	curInstance.caEnrollMutex.Lock()
+	expectedCANode := curInstance.caEnrollNode
+	curInstance.caEnrollMutex.Unlock()
+	if expectedCANode == "" || expectedCANode != caNode {
+		return fmt.Errorf("We dont requested a certificate from '%s'", caNode)
+	}
+
+	caCert, err := readCertificatePEM([]byte(caCertMsg.CA))
+	if err != nil {
+		return err
+	}
+	if !caCert.IsCA {
+		return fmt.Errorf("Certificate of '%s' is not a CA", caNode)
+	}
+
+	// if we already trust a CA, it must be the same
+	// otherwise the CA-node must use a certificate of this CA
+	if currentCA, err := curInstance.loadCA(); err == nil {
+		if !bytes.Equal(currentCA.Raw, caCert.Raw) {
+			return fmt.Errorf("We already trust another CA")
+		}
+	} else if err := curInstance.caCheckNode(caNode, caCert); err != nil {
+		return err
+	}
+
+	nodeCert, err := readCertificatePEM([]byte(caCertMsg.Cert))
+	if err != nil {
+		return err
+	}
+	if err := nodeCert.CheckSignatureFrom(caCert); err != nil {
+		return err
+	}
+
+	// the certificate must be for our key
+	keyFileName, certFileName := curInstance.getKeyPairPath(curInstance.config.NodeName())
+	keyBytes, err := ioutil.ReadFile(keyFileName)
+	if err != nil {
+		return err
+	}
+	if _, err := tls.X509KeyPair([]byte(caCertMsg.Cert), keyBytes); err != nil {
+		return err
+	}
+
+	_, caCertFileName := curInstance.getCAPath()
+	if err := ioutil.WriteFile(caCertFileName, []byte(caCertMsg.CA), 0644); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(certFileName, []byte(caCertMsg.Cert), 0644); err != nil {
+		return err
+	}
+
+	curInstance.caEnrollMutex.Lock()
+	curInstance.caEnrollNode = ""
+	curInstance.caEnrollMutex.Unlock()
+
+	curInstance.logging.Info("CA", fmt.Sprintf("Certificate signed by '%s' installed", caNode), "ca", caCert.Subject.String())
+	return nil
+}
+
+// onCAMessage handle all ca-commands, return true if the command was handled
+func (curInstance *instance) onCAMessage(message *msgbus.Msg, command, payload string) bool {
+
+	if command == "caEnroll" {
+		if message.NodeTarget != curInstance.config.NodeName() {
+			return true
+		}
+		if curInstance.remoteDenied(message, command) {
+			return true
+		}
+		err := curInstance.caEnroll(payload)
+		if err != nil {
+			message.Answer(&curInstance.plugin, "error", err.Error())
+			return true
+		}
+		message.Answer(&curInstance.plugin, "caEnrollStarted", payload)
+		return true
+	}
+
+	if command == "caRequest" {
+		if message.NodeTarget != curInstance.config.NodeName() {
+			return true
+		}
+		err := curInstance.caOnRequest(message.NodeSource, payload)
+		if err != nil {
+			curInstance.logging.Error("CA", err.Error())
+			message.Answer(&curInstance.plugin, "error", err.Error())
+			return true
+		}
+		curInstance.plugin.Publish(curInstance.config.NodeName(), curInstance.config.NodeName(), "tls", "caRequested", message.NodeSource)
+		return true
+	}
+
+	if command == "caGetRequests" {
+		if message.NodeTarget != curInstance.config.NodeName() {
+			return true
+		}
+		if curInstance.remoteDenied(message, command) {
+			return true
+		}
+		_, requests, _ := curInstance.getCASection()
+		requestNames := make([]string, 0)
+		for nodeName := range requests {
+			requestNames = append(requestNames, nodeName)
+		}
+		requestBytes, _ := json.Marshal(requestNames)
+		message.Answer(&curInstance.plugin, "caRequests", string(requestBytes))
+		return true
+	}
+
+	if command == "caSign" {
+		if message.NodeTarget != curInstance.config.NodeName() {
+			return true
+		}
+		if curInstance.remoteDenied(message, command) {
+			return true
+		}
+		caCertMsg, err := curInstance.caSignRequest(payload)
+		if err != nil {
+			message.Answer(&curInstance.plugin, "error", err.Error())
+			return true
+		}
+		caCertBytes, _ := json.Marshal(caCertMsg)
+
+		message.Answer(&curInstance.plugin, "caSignOk", payload)
+		go curInstance.plugin.Publish(curInstance.config.NodeName(), payload, "tls", "caCert", string(caCertBytes))
+		return true
+	}
+
+	if command == "caRevoke" {
+		if message.NodeTarget != curInstance.config.NodeName() {
+			return true
+		}
+		if curInstance.remoteDenied(message, command) {
+			return true
+		}
+		serials, err := curInstance.caRevoke(payload)
+		if err != nil {
+			message.Answer(&curInstance.plugin, "error", err.Error())
+			return true
+		}
+		serialBytes, _ := json.Marshal(serials)
+		message.Answer(&curInstance.plugin, "caRevokeOk", string(serialBytes))
+
+		for _, curSession := range curInstance.getSessions() {
+			go curInstance.caSendRevokedList(curSession.remoteNodeName, curSession.currentPeerCert())
+		}
+		return true
+	}
+
+	if command == "caRevokedList" {
+		if message.NodeTarget != curInstance.config.NodeName() {
+			return true
+		}
+		added, err := curInstance.caInstallRevokedList(payload)
+		if err != nil {
+			curInstance.logging.Error("CA", err.Error(), "node", message.NodeSource)
+			return true
+		}
+		if added > 0 {
+			curInstance.logging.Info("CA", fmt.Sprintf("%d serials added to the deny list", added), "node", message.NodeSource)
+		}
+		return true
+	}
+
+	if command == "caCert" {
+		if message.NodeTarget != curInstance.config.NodeName() {
+			return true
+		}
+
+		var caCertMsg msgCACert
+		err := json.Unmarshal([]byte(payload), &caCertMsg)
+		if err == nil {
+			err = curInstance.caInstall(message.NodeSource, caCertMsg)
+		}
+		if err != nil {
+			curInstance.logging.Error("CA", err.Error())
+			return true
+		}
+		curInstance.plugin.Publish(curInstance.config.NodeName(), curInstance.config.NodeName(), "tls", "caInstalled", message.NodeSource)
+		return true
+	}
+
+	return false
+}
@@ -19,13 +19,9 @@ along with gopilot.  If not, see <http://www.gnu.org/licenses/>.
 package pluginctls
 
 /*
-## Key considerations for algorithm "RSA" ≥ 2048-bit
-openssl genrsa -out server.key 2048
-
-# Key considerations for algorithm "ECDSA" ≥ secp384r1
-# List ECDSA the supported curves (openssl ecparam -list_curves)
+Key and certificate are created on startup inside the configpath ( see keypair.go ),
+an existing key created with openssl is also used:
 openssl ecparam -genkey -name secp384r1 -out server.key
-
 openssl req -new -x509 -sha256 -key server.key -out server.crt -days 3650
 
 Testclient:
@@ -36,7 +32,6 @@ openssl x509 -noout -text -in cerfile.cer
 
 */
 import (
-	"core/clog"
 	"core/config"
 	"core/msgbus"
 	"core/nodes"
@@ -51,7 +46,6 @@ import (
 	"fmt"
 	"net"
 	"os"
-	"os/exec"
 	"strconv"
 	"time"
 )
@@ -63,11 +57,7 @@ var remoteNodeName string // connect to remote node
 var remoteNodeHost string // the remote host
 var remoteAcceptNode string
 var remoteRejectNode string // we will forget for this nodeName the sharedSecret, and TLS-Keys
-
-// private vars
-var plugin msgbus.Plugin
-var logging clog.Logger
-var sessionNo int
+var showFingerprint bool    // print our fingerprint and exit
 
 // ParseCmdLine read the command line parameter and save the values to local vars
 func ParseCmdLine() {
@@ -75,40 +65,132 @@ func ParseCmdLine() {
 	flag.StringVar(&newNode, "newNode", "", "name - Use this on the server to allow an node for an incoming connection")
 	flag.StringVar(&remoteNodeName, "remoteNodeName", "", "name - Connect to an remote node, this need also remoteNodeHost")
 	flag.StringVar(&remoteNodeHost, "remoteNodeHost", "", "hostname:port - Connection information for remote node")
+	flag.StringVar(&remoteNodeURL, "remoteNodeURL", "", "ws(s)://host/node - Connect to the remote node over a websocket, instead of remoteNodeHost")
+	flag.StringVar(&remoteNodeProxy, "remoteNodeProxy", "", "http://[user:password@]host:port - HTTP-proxy for remoteNodeURL, default from HTTPS_PROXY")
+	flag.BoolVar(&reverseDial, "reverseDial", false, "With newNode: we connect to the new node, it is still managed by us. With remoteNodeName: the remote node connect to us, it still manage us")
+	flag.DurationVar(&pendingExpiry, "nodeReq.expiry", time.Hour*72, "Remove requests of nodes which are not accepted in this time, 0 keep them forever")
+	flag.IntVar(&pendingRateLimit, "nodeReq.rateLimit", 5, "Maximum count of new node requests from a single IP inside nodeReq.rateWindow, 0 disable the limit")
+	flag.DurationVar(&pendingRateWindow, "nodeReq.rateWindow", time.Minute*10, "Time window for nodeReq.rateLimit")
+	flag.StringVar(&tlsMinVersion, "tls.minVersion", "1.2", "Minimum TLS-version of node connections: 1.2 or 1.3")
+	flag.StringVar(&tlsCiphers, "tls.ciphers", "", "Comma separated list of allowed cipher suites for TLS 1.2, empty use secure defaults")
+	flag.StringVar(&tlsCurves, "tls.curves", "", "Comma separated list of curves: P256, P384, P521, X25519, empty use defaults")
+	flag.BoolVar(&websocketNodes, "websocket.nodes", false, "Accept other nodes on the websocket-server of the webclient ( path /node )")
 	flag.StringVar(&remoteAcceptNode, "acceptNode", "", "nodename - Accept an hash-request")
+	flag.StringVar(&newToken, "newToken", "", "pattern - Print a single-use token for nodes matching the pattern ( like web-* ) and exit")
+	flag.DurationVar(&tokenTTL, "tokenTTL", time.Hour, "Lifetime of a new token")
+	flag.StringVar(&joinToken, "joinToken", "", "token - Join the remoteNodeName with this token, without an accept on the remote node")
+	flag.BoolVar(&showFingerprint, "fingerprint", false, "Print the fingerprint of this node and exit, compare it with the requested fingerprint before -acceptNode")
 	flag.StringVar(&remoteRejectNode, "rejectNode", "", "nodename - We forget all keys and secrets for this nodeName")
+	flag.DurationVar(&heartbeatInterval, "heartbeatInterval", time.Second*15, "Send a heartbeat to connected nodes in this interval, 0 disable it")
+	flag.IntVar(&heartbeatMiss, "heartbeatMiss", 3, "Close the connection after this count of missing heartbeat answers, at least 1")
+	flag.StringVar(&certSubject, "cert.subject", defaultCertSubject, "Subject of new certificates, the CN is always the node name")
+	flag.StringVar(&certKeyType, "cert.keyType", "ecdsa-p384", "Type of new keys: ecdsa-p256, ecdsa-p384, ecdsa-p521, rsa-2048 or rsa-4096")
+	flag.DurationVar(&certLifetime, "cert.lifetime", time.Hour*24*3650, "Lifetime of new certificates")
+	flag.DurationVar(&reconnectInitialDelay, "reconnect.initialDelay", time.Second, "Wait this time after the first failed connect to a client-node, at least 1s")
+	flag.DurationVar(&reconnectMaxDelay, "reconnect.maxDelay", time.Minute*5, "The delay between connects is doubled until it reach this")
+	flag.Float64Var(&reconnectJitter, "reconnect.jitter", 0.2, "Change the delay randomly by this fraction ( 0.0 - 1.0 )")
+	flag.IntVar(&reconnectMaxAttempts, "reconnect.maxAttempts", 0, "Give up after this count of failed connects, 0 try forever")
+	flag.IntVar(&maxFrameSize, "maxFrameSize", 1024*1024, "Maximum size in bytes of a message between nodes")
+	flag.BoolVar(&compression, "compression", true, "Offer deflate-compression of messages to other nodes")
+	flag.IntVar(&compressionThreshold, "compression.threshold", 1024, "Compress only messages with at least this size in bytes")
+	flag.DurationVar(&rekeyInterval, "rekeyInterval", 0, "Create a new shared secret for every incoming session in this interval, 0 disable it")
+	flag.BoolVar(&caInit, "caInit", false, "Create a CA on this node, which can sign the certificates of other nodes")
+	flag.BoolVar(&caRequired, "caRequired", false, "Only accept nodes with a certificate signed by our CA")
 }
 
 // Init the ctls-plugin
 func Init() {
 
-	logging = clog.New("TLS")
+	// check the tls-settings
+	if err := parseTLSOptions(tlsMinVersion, tlsCiphers, tlsCurves); err != nil {
+		defaultInstance.logging.Error("TLS", err.Error())
+		os.Exit(-1)
+	}
+	if heartbeatMiss < 1 {
+		defaultInstance.logging.Error("HEARTBEAT", "heartbeatMiss must be at least 1")
+		os.Exit(-1)
+	}
+	if reconnectInitialDelay < minReconnectDelay {
+		defaultInstance.logging.Error("RECONNECT", fmt.Sprintf("reconnect.initialDelay must be at least %s", minReconnectDelay))
+		os.Exit(-1)
+	}
 
 	// create key pair
 	CreateKeyPair(config.NodeName)
 
+	// print our fingerprint
+	if showFingerprint {
+		fingerprint, err := LocalFingerprint()
+		if err != nil {
+			defaultInstance.logging.Error("FINGERPRINT", err.Error())
+			os.Exit(-1)
+		}
+		fmt.Println(fingerprint)
+		os.Exit(0)
+	}
+
+	// create the CA
+	if caInit {
+		if err := CreateCA(); err != nil {
+			defaultInstance.logging.Error("CA", err.Error())
+			os.Exit(-1)
+		}
+	}
+
 	// enable the tls-server
 	if serverAdress != "" {
 
 		host, portString, err := net.SplitHostPort(serverAdress)
 		if err != nil {
-			logging.Error("serverAdress", fmt.Sprintf("remoteNode '%s': %s", serverAdress, err.Error()))
+			defaultInstance.logging.Error("serverAdress", fmt.Sprintf("remoteNode '%s': %s", serverAdress, err.Error()))
 			os.Exit(-1)
 		}
 		port, err := strconv.Atoi(portString)
 		if err != nil {
-			logging.Error("serverAdress", fmt.Sprintf("Can not convert port-string to int: %s", err.Error()))
+			defaultInstance.logging.Error("serverAdress", fmt.Sprintf("Can not convert port-string to int: %s", err.Error()))
 			os.Exit(-1)
 		}
 
-		logging.Info("serverAdress", fmt.Sprintf("Serve an TLS-Server on '%s': ", serverAdress))
+		defaultInstance.logging.Info("serverAdress", fmt.Sprintf("Serve an TLS-Server on '%s': ", serverAdress))
 
-		nodes.SaveData(config.NodeName, nodes.NodeTypeServer, host, port)
+		myNode := nodes.GetOrNew(config.NodeName)
+		myNode.Type = nodes.NodeTypeServer
+		myNode.Host = host
+		myNode.Port = port
+		nodes.Save(myNode)
 	}
 
 	// create a newNode-Config
 	if newNode != "" {
-		nodes.SaveData(newNode, nodes.NodeTypeIncoming, "", 0)
+		incomingNode := nodes.GetOrNew(newNode)
+		incomingNode.Type = nodes.NodeTypeIncoming
+		incomingNode.ReverseDial = reverseDial
+		nodes.Save(incomingNode)
+	}
+
+	// we connect to an remote-node over a websocket
+	if remoteNodeName != "" && remoteNodeURL != "" {
+
+		if _, err := parseNodeURL(remoteNodeURL); err != nil {
+			defaultInstance.logging.Error("NODE", err.Error())
+			os.Exit(-1)
+		}
+		if remoteNodeProxy != "" {
+			if _, err := parseProxyURL(remoteNodeProxy); err != nil {
+				defaultInstance.logging.Error("NODE", err.Error())
+				os.Exit(-1)
+			}
+		}
+
+		remoteNode := nodes.GetOrNew(remoteNodeName)
+		remoteNode.Type = nodes.NodeTypeClient
+		remoteNode.ReverseDial = reverseDial
+		remoteNode.URL = remoteNodeURL
+		remoteNode.Proxy = remoteNodeProxy
+		if joinToken != "" {
+			remoteNode.EnrollToken = joinToken
+		}
+		nodes.Save(remoteNode)
 	}
 
 	// we connect to an remote-node
@@ -117,97 +199,71 @@ func Init() {
 		// get host and port
 		host, portString, err := net.SplitHostPort(remoteNodeHost)
 		if err != nil {
-			logging.Error("NODE", fmt.Sprintf("remoteNode '%s': %s", remoteNodeHost, err.Error()))
+			defaultInstance.logging.Error("NODE", fmt.Sprintf("remoteNode '%s': %s", remoteNodeHost, err.Error()))
 			os.Exit(-1)
 		}
 		port, err := strconv.Atoi(portString)
 		if err != nil {
-			logging.Error("NODE", fmt.Sprintf("Can not convert port-string to int: %s", err.Error()))
+			defaultInstance.logging.Error("NODE", fmt.Sprintf("Can not convert port-string to int: %s", err.Error()))
 			os.Exit(-1)
 		}
 
 		// set nodeName
-		nodes.SaveData(remoteNodeName, nodes.NodeTypeClient, host, port)
+		remoteNode := nodes.GetOrNew(remoteNodeName)
+		remoteNode.Type = nodes.NodeTypeClient
+		remoteNode.ReverseDial = reverseDial
+		remoteNode.Host = host
+		remoteNode.Port = port
+		remoteNode.URL = ""
+		if joinToken != "" {
+			remoteNode.EnrollToken = joinToken
+		}
+		nodes.Save(remoteNode)
+	}
+
+	// create a token
+	if newToken != "" {
+		createdToken, err := CreateToken(newToken, tokenTTL)
+		if err != nil {
+			defaultInstance.logging.Error("ENROLL", err.Error())
+			os.Exit(-1)
+		}
+		fmt.Println(createdToken.Token)
+		os.Exit(0)
 	}
 
 	// we accept an requested node
 	if remoteAcceptNode != "" {
-		peerCertAcceptReqCert(remoteAcceptNode)
+		defaultInstance.peerCertAcceptReqCert(remoteAcceptNode)
 		os.Exit(0)
 	}
 
 	// we forget all secrets for this node
 	if remoteRejectNode != "" {
-		peerCertReject(remoteRejectNode)
+		defaultInstance.peerCertReject(remoteRejectNode)
 		os.Exit(0)
 	}
 
 	// because we can changed the nodes prev, reload config
 	config.Read()
 
-	// register plugin on messagebus
-	plugin = msgbus.NewPlugin("TLS")
-	plugin.Register()
-	plugin.ListenForGroup("tls", onMessage)
-
-	// okay, get server-config
-	nodes.IterateNodes(func(nodeName string, jsonNode nodes.JSONNodeType, jsonNodeInterfaced map[string]interface{}) {
-
-		if int(jsonNode.Type) == nodes.NodeTypeServer {
-			go serve(fmt.Sprintf("%s:%d", jsonNode.Host, int(jsonNode.Port)))
-		}
-
-		if int(jsonNode.Type) == nodes.NodeTypeClient {
-			go connect(fmt.Sprintf("%s:%d", jsonNode.Host, int(jsonNode.Port)))
-		}
-	})
+	// nodes can also connect over the websocket-server
+	if websocketNodes {
+		defaultInstance.serveWebsocket()
+	}
 
+	defaultInstance.start()
 }
 
 // return the key and crt
-func getKeyPairPath(nodeName string) (string, string) {
+func (curInstance *instance) getKeyPairPath(nodeName string) (string, string) {
 
-	key := config.ConfigPath + "/" + nodeName + ".key"
-	cert := config.ConfigPath + "/" + nodeName + ".crt"
+	key := curInstance.config.Path() + "/" + nodeName + ".key"
+	cert := curInstance.config.Path() + "/" + nodeName + ".crt"
 
 	return key, cert
 }
 
-// CreateKeyPair create a certificate and key inside the configpath
-func CreateKeyPair(nodeName string) error {
-
-	keyFileName, certFileName := getKeyPairPath(config.NodeName)
-
-	if _, err := os.Stat(keyFileName); os.IsNotExist(err) {
-		cmdKey := exec.Command("openssl", "ecparam", "-genkey", "-name", "secp384r1",
-			"-out", keyFileName,
-		)
-		logging.Info("CREATEKEY", fmt.Sprintf("Create %s.key", nodeName))
-		errKey := cmdKey.Run()
-		if errKey != nil {
-			logging.Error("CREATEKEY", fmt.Sprintf("%s", errKey))
-			return errKey
-		}
-	}
-
-	if _, err := os.Stat(certFileName); os.IsNotExist(err) {
-		cmdCRT := exec.Command("openssl", "req", "-new", "-x509", "-sha256",
-			"-key", keyFileName,
-			"-out", certFileName,
-			"-days", "3650",
-			"-subj", "/C=DE/ST=UNKNOWN/L=UNKNOWN/O=COPILOTD/OU=DAEMON/CN="+nodeName,
-		)
-		logging.Info("CREATEKEY", fmt.Sprintf("Create %s.crt with %s", nodeName, cmdCRT.Args))
-		errCRT := cmdCRT.Run()
-		if errCRT != nil {
-			logging.Error("CREATEKEY", fmt.Sprintf("%s", errCRT))
-			return errCRT
-		}
-	}
-
-	return nil
-}
-
 // GenerateRandomBytes returns securely generated random bytes.
 // It will return an error if the system's secure random
 // number generator fails to function correctly, in which
@@ -232,195 +288,287 @@ func ComputeHmac256(message string, secret string) string {
 }
 
 // Accept requested Cert for an node
-func peerCertAcceptReqCert(nodeName string) error {
+func (curInstance *instance) peerCertAcceptReqCert(nodeName string) error {
 
-	nodeObject, err := nodes.GetNodeObject(nodeName)
+	node, err := curInstance.nodes.Get(nodeName)
 	if err != nil {
-		logging.Error("CLIENT", err.Error())
+		curInstance.logging.Error("CLIENT", err.Error())
 		return err
 	}
 
 	// already exist, do nothing
-	if nodeObject["peerCertSignature"] != nil {
-		logging.Error("CLIENT", fmt.Sprintf(
+	if node.PeerFingerprint != "" || node.PeerCertSignature != "" {
+		curInstance.logging.Error("CLIENT", fmt.Sprintf(
 			"Can not overwrite an already accepted key",
 		))
 		return errors.New("Can not overwrite an already accepted key")
 	}
 
 	// no req-key exist, do nothing
-	if nodeObject["peerCertSignatureReq"] == nil {
-		logging.Error("CLIENT", fmt.Sprintf(
+	if node.PeerFingerprintReq == "" {
+		curInstance.logging.Error("CLIENT", fmt.Sprintf(
 			"No key requested",
 		))
 		return errors.New("No key requested")
 	}
 
 	// set the peer
-	nodeObject["peerCertSignature"] = nodeObject["peerCertSignatureReq"]
-	delete(nodeObject, "peerCertSignatureReq")
-	nodes.SaveNodeObject(nodeName, nodeObject)
+	node.PeerFingerprint = node.PeerFingerprintReq
+	node.PeerFingerprintReq = ""
+	node.PeerRequest = nil
+	curInstance.nodes.Save(node)
 
-	logging.Info("CLIENT", fmt.Sprintf("Accept requested key for node"))
+	curInstance.logging.Info("CLIENT", fmt.Sprintf("Accept requested key for node '%s' with fingerprint %s", nodeName, node.PeerFingerprint))
 
 	return nil
 }
 
 // delete Certificate-Signatures and shared secret for this node
-func peerCertReject(nodeName string) error {
+func (curInstance *instance) peerCertReject(nodeName string) error {
 
-	nodeObject, err := nodes.GetNodeObject(nodeName)
+	node, err := curInstance.nodes.Get(nodeName)
 	if err != nil {
-		logging.Error("CLIENT", err.Error())
+		curInstance.logging.Error("CLIENT", err.Error())
 		return err
 	}
 
-	delete(nodeObject, "peerCertSignature")
-	delete(nodeObject, "peerCertSignatureReq")
-	delete(nodeObject, "sharedSecret")
+	node.PeerFingerprint = ""
+	node.PeerFingerprintReq = ""
+	node.PeerCertSignature = ""
+	node.PeerCertSignatureReq = ""
+	node.PeerRequest = nil
+	node.PeerFingerprintPrev = ""
+	node.SharedSecret = ""
+	node.SharedSecretNext = ""
+	node.SharedSecretPrev = ""
 
-	logging.Info("CLIENT", fmt.Sprintf("Remove all keys for '%s'", nodeName))
-	nodes.SaveNodeObject(nodeName, nodeObject)
+	curInstance.logging.Info("CLIENT", fmt.Sprintf("Remove all keys for '%s'", nodeName))
+	curInstance.nodes.Save(node)
 
 	return nil
 }
 
-func serve(serverString string) {
-
-	keyFileName, certFileName := getKeyPairPath(config.NodeName)
+func (curInstance *instance) serve(serverString string) {
 
-	cer, err := tls.LoadX509KeyPair(
-		certFileName,
-		keyFileName,
-	)
+	_, err := curInstance.localCertificate()
 	if err != nil {
-		logging.Error("SERVER", err.Error())
+		curInstance.logging.Error("SERVER", err.Error())
 		return
 	}
 
-	config := &tls.Config{
-		Certificates: []tls.Certificate{cer},
-		ClientAuth:   tls.RequireAnyClientCert,
-	}
-
-	logging.Info("SERVER", fmt.Sprintf("Start serve on %s", serverString))
+	curInstance.logging.Info("SERVER", fmt.Sprintf("Start serve on %s", serverString))
 
-	ln, err := tls.Listen("tcp", serverString, config)
+	ln, err := tls.Listen("tcp", serverString, curInstance.serverTLSConfig())
 	if err != nil {
-		logging.Error("SERVER", err.Error())
+		curInstance.logging.Error("SERVER", err.Error())
 		return
 	}
+
+	curInstance.acceptSessions(ln)
+}
+
+// acceptSessions start an incoming session for every connection on ln, until the instance is stopped
+func (curInstance *instance) acceptSessions(ln net.Listener) {
+
+	curInstance.listenersMutex.Lock()
+	curInstance.listeners = append(curInstance.listeners, ln)
+	curInstance.listenersMutex.Unlock()
 	defer ln.Close()
 
 	for {
 		conn, err := ln.Accept()
 		if err != nil {
-			logging.Error("SERVER", err.Error())
+			if curInstance.stopped() {
+				return
+			}
+			curInstance.logging.Error("SERVER", err.Error())
 			continue
 		}
 
-		go NewSession(
-			fmt.Sprintf("%d", sessionNo),
+		go curInstance.NewSession(
+			curInstance.nextSessionNo(),
 			nodes.NodeTypeIncoming, conn,
 		)
+	}
+
+}
+
+// addSession remember an established session
+func (curInstance *instance) addSession(curSession *tlsSession) {
+	curInstance.sessionsMutex.Lock()
+	curInstance.sessions[curSession.remoteNodeName] = curSession
+	curInstance.sessionsMutex.Unlock()
+}
 
-		sessionNo++
+// removeSession forget the session, if it is still the current one for the remote node
+func (curInstance *instance) removeSession(curSession *tlsSession) {
+	curInstance.sessionsMutex.Lock()
+	if curInstance.sessions[curSession.remoteNodeName] == curSession {
+		delete(curInstance.sessions, curSession.remoteNodeName)
 	}
+	curInstance.sessionsMutex.Unlock()
+}
 
+// getSession return the established session to nodeName or nil
+func (curInstance *instance) getSession(nodeName string) *tlsSession {
+	curInstance.sessionsMutex.Lock()
+	defer curInstance.sessionsMutex.Unlock()
+	return curInstance.sessions[nodeName]
 }
 
-func connect(clientString string) {
+// getSessions return all established sessions
+func (curInstance *instance) getSessions() []*tlsSession {
+	curInstance.sessionsMutex.Lock()
+	defer curInstance.sessionsMutex.Unlock()
 
-	keyFileName, certFileName := getKeyPairPath(config.NodeName)
+	curSessions := make([]*tlsSession, 0, len(curInstance.sessions))
+	for _, curSession := range curInstance.sessions {
+		curSessions = append(curSessions, curSession)
+	}
+	return curSessions
+}
 
-	cer, err := tls.LoadX509KeyPair(
-		certFileName,
-		keyFileName,
-	)
-	if err != nil {
-		logging.Error("CONNECT", err.Error())
+// connectNode start the connection to node, if we not already connect to it
+func (curInstance *instance) connectNode(node nodes.Node) {
+
+	curInstance.connectingMutex.Lock()
+	defer curInstance.connectingMutex.Unlock()
+
+	if curInstance.connecting[node.Name] {
 		return
 	}
+	curInstance.connecting[node.Name] = true
 
-	config := &tls.Config{
-		Certificates:       []tls.Certificate{cer},
-		ClientAuth:         tls.RequireAnyClientCert,
-		InsecureSkipVerify: true,
-	}
+	go curInstance.connect(node.Name)
+}
 
-	for {
-		logging.Info("CONNECT", fmt.Sprintf("Try to connect to %s", clientString))
-		conn, err := tls.Dial("tcp", clientString, config)
-		if err != nil {
-			logging.Error("CONNECT", fmt.Sprintf("Failed to connect: %s", err.Error()))
-			time.Sleep(time.Second * 10)
-			continue
-		}
+type msgNodeAdd struct {
+	Name string `json:"name"`
+	Host string `json:"host"`
+	Port int    `json:"port"`
+}
 
-		NewSession(
-			fmt.Sprintf("%d", sessionNo),
-			nodes.NodeTypeClient, conn,
-		)
+// decodeNodeAdd return the node of an nodeAdd-payload
+func decodeNodeAdd(payload string) (msgNodeAdd, error) {
 
-		conn.Close()
-		time.Sleep(time.Second * 10)
+	var newNode msgNodeAdd
+	err := json.Unmarshal([]byte(payload), &newNode)
+	if err != nil {
+		return msgNodeAdd{}, err
+	}
+	if newNode.Name == "" {
+		return msgNodeAdd{}, fmt.Errorf("name is needed")
+	}
+	if newNode.Port < 0 || newNode.Port > 65535 {
+		return msgNodeAdd{}, fmt.Errorf("Invalid port %d", newNode.Port)
 	}
 
+	return newNode, nil
 }
 
-func onMessage(message *msgbus.Msg, group, command, payload string) {
+func (curInstance *instance) onMessage(message *msgbus.Msg, group, command, payload string) {
+
+	if curInstance.onCAMessage(message, command, payload) {
+		return
+	}
 
 	if command == "nodeAccept" {
-		err := peerCertAcceptReqCert(payload)
-		if err == nil {
-			message.Answer(&plugin, "nodeAcceptOk", payload)
-		} else {
-			message.Answer(&plugin, "error", err.Error())
+		if curInstance.remoteDenied(message, command) {
+			return
+		}
+		err := curInstance.peerCertAcceptReqCert(payload)
+		if err != nil {
+			message.Answer(&curInstance.plugin, "error", err.Error())
+			return
 		}
 
+		record, err := curInstance.nodeRecord(payload)
+		if err != nil {
+			message.Answer(&curInstance.plugin, "error", err.Error())
+			return
+		}
+		message.Answer(&curInstance.plugin, "nodeAcceptOk", record)
 		return
 	}
 
 	if command == "nodeReject" {
-		err := peerCertReject(payload)
-		if err == nil {
-			message.Answer(&plugin, "nodeRejectOk", payload)
-		} else {
-			message.Answer(&plugin, "error", err.Error())
+		if curInstance.remoteDenied(message, command) {
+			return
+		}
+		err := curInstance.peerCertReject(payload)
+		if err != nil {
+			message.Answer(&curInstance.plugin, "error", err.Error())
+			return
 		}
 
+		record, err := curInstance.nodeRecord(payload)
+		if err != nil {
+			message.Answer(&curInstance.plugin, "error", err.Error())
+			return
+		}
+		message.Answer(&curInstance.plugin, "nodeRejectOk", record)
+		return
+	}
+
+	if curInstance.onPendingMessage(message, command, payload) {
 		return
 	}
 
 	if command == "nodeAdd" { // this add per default an incoming-node-type
 
-		// get new node
-		type msgNodeAdd struct {
-			Name string `json:"name"`
-			Host string `json:"host"`
-			Port int    `json:"port"`
-		}
-		var newNode msgNodeAdd
-		err := json.Unmarshal([]byte(payload), &newNode)
+		newNode, err := decodeNodeAdd(payload)
 		if err != nil {
-			fmt.Println("error: ", err)
+			message.Answer(&curInstance.plugin, "error", err.Error())
 			return
 		}
 
-		nodes.SaveData(
-			newNode.Name,
-			nodes.NodeTypeIncoming,
-			newNode.Host,
-			newNode.Port,
-		)
+		node := curInstance.nodes.GetOrNew(newNode.Name)
+		node.Type = nodes.NodeTypeIncoming
+		node.Host = newNode.Host
+		node.Port = newNode.Port
+		curInstance.nodes.Save(node)
 
-		message.Answer(&plugin, "nodeAddOk", newNode.Name)
+		message.Answer(&curInstance.plugin, "nodeAddOk", newNode.Name)
 		return
 	}
 
 	if command == "nodeDelete" {
-		nodes.Delete(payload)
-		message.Answer(&plugin, "nodeDeleteOk", payload)
+		curInstance.nodes.Delete(payload)
+		message.Answer(&curInstance.plugin, "nodeDeleteOk", payload)
+		return
+	}
+
+	if curInstance.onTokenMessage(message, command, payload) {
+		return
+	}
+
+	if curInstance.onRotateMessage(message, command, payload) {
+		return
+	}
+
+	if curInstance.onReconnectMessage(message, command, payload) {
+		return
+	}
+
+	if curInstance.onReverseMessage(message, command, payload) {
+		return
+	}
+
+	// connect to an client-node which was added after start
+	if command == "nodeConnect" {
+
+		node, err := curInstance.nodes.Get(payload)
+		if err != nil {
+			message.Answer(&curInstance.plugin, "error", err.Error())
+			return
+		}
+		if !node.DialOut() {
+			message.Answer(&curInstance.plugin, "error", fmt.Sprintf("Node '%s' connect to us, we dont connect to it", payload))
+			return
+		}
+
+		curInstance.connectNode(node)
+		message.Answer(&curInstance.plugin, "nodeConnectOk", payload)
 		return
 	}
 
@@ -20,6 +20,24 @@ package pluginctls
 
 import "testing"
 import "fmt"
+import "time"
+import "core/config"
+import "core/nodes"
+import "core/msgbus"
+import "core/clog"
+import "bufio"
+import "net"
+import "bytes"
+import "strings"
+import "crypto/ecdsa"
+import "encoding/json"
+import "crypto/tls"
+import "io/ioutil"
+import "os"
+import "io"
+import "net/http"
+import "net/http/httptest"
+import "sync/atomic"
 
 func TestHMAC(t *testing.T) {
 
@@ -34,3 +52,1477 @@ func TestHMAC(t *testing.T) {
 	fmt.Println("Test OK: ", hash)
 
 }
+
+func TestHeartbeatLatency(t *testing.T) {
+
+	// remote clock is 100ms ahead, every direction need 5ms, remote need 2ms to answer
+	start := time.Unix(1000, 0)
+	pong := heartbeatPayload{
+		Send:    start.UnixNano(),
+		Receive: start.Add(105 * time.Millisecond).UnixNano(),
+		Answer:  start.Add(107 * time.Millisecond).UnixNano(),
+	}
+
+	rtt, offset := heartbeatLatency(pong, start.Add(12*time.Millisecond))
+	if rtt != 10*time.Millisecond {
+		t.Errorf("RTT should be 10ms but is %s", rtt)
+		t.FailNow()
+	}
+	if offset != 100*time.Millisecond {
+		t.Errorf("Offset should be 100ms but is %s", offset)
+		t.FailNow()
+	}
+}
+
+func TestCreateKeyPair(t *testing.T) {
+
+	curInstance := newTestInstance("nodea")
+	defer os.RemoveAll(curInstance.config.Path())
+
+	certSubject = "/C=DE/O=TEST/OU=UNIT"
+	certKeyType = "ecdsa-p256"
+	certLifetime = time.Hour
+
+	err := curInstance.CreateKeyPair("nodea")
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+
+	keyFileName, certFileName := curInstance.getKeyPairPath("nodea")
+	keyInfo, err := os.Stat(keyFileName)
+	if err != nil || keyInfo.Mode().Perm() != 0600 {
+		t.Errorf("Key file should have mode 0600: %v", err)
+	}
+
+	keyPair, err := tls.LoadX509KeyPair(certFileName, keyFileName)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	if _, ok := keyPair.PrivateKey.(*ecdsa.PrivateKey); !ok {
+		t.Errorf("Key should be ecdsa, but is %T", keyPair.PrivateKey)
+	}
+
+	cert, err := curInstance.loadCertificate("nodea")
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	if cert.Subject.CommonName != "nodea" || cert.Subject.Organization[0] != "TEST" {
+		t.Errorf("Subject is wrong: %s", cert.Subject)
+	}
+	if cert.NotAfter.After(time.Now().Add(time.Hour)) {
+		t.Errorf("Lifetime is wrong: %s", cert.NotAfter)
+	}
+
+	// a missing certificate is created with the existing key
+	fingerprint := Fingerprint(cert)
+	os.Remove(certFileName)
+	curInstance.CreateKeyPair("nodea")
+	cert, err = curInstance.loadCertificate("nodea")
+	if err != nil || Fingerprint(cert) != fingerprint {
+		t.Errorf("Certificate should use the existing key: %v", err)
+	}
+
+	if _, err := ParseSubject("/C=DE/XX=YY", "nodea"); err == nil {
+		t.Error("Unknown subject key should fail")
+	}
+}
+
+func TestCA(t *testing.T) {
+
+	curInstance := newTestInstance("canode")
+	defer os.RemoveAll(curInstance.config.Path())
+
+	certSubject = "/O=TEST"
+	certKeyType = "ecdsa-p256"
+	certLifetime = time.Hour
+
+	curInstance.CreateKeyPair("canode")
+	curInstance.CreateKeyPair("nodeb")
+
+	// not in CA-mode
+	nodebCert, _ := curInstance.loadCertificate("nodeb")
+	if curInstance.caVerify(nodebCert) == nil {
+		t.Error("Without CA no certificate should be verified")
+	}
+
+	err := curInstance.CreateCA()
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+
+	// our own certificate is signed
+	canodeCert, _ := curInstance.loadCertificate("canode")
+	if err := curInstance.caVerify(canodeCert); err != nil {
+		t.Errorf("Own certificate should be signed by the CA: %s", err)
+	}
+	if curInstance.caVerify(nodebCert) == nil {
+		t.Error("Self-signed certificate should not be verified")
+	}
+
+	// the request must come from the node inside the CN
+	csrPEM, err := curInstance.createSigningRequest("nodeb")
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	if curInstance.caOnRequest("nodec", csrPEM) == nil {
+		t.Error("Request from another node should fail")
+	}
+	if err := curInstance.caOnRequest("nodeb", csrPEM); err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+
+	caCertMsg, err := curInstance.caSignRequest("nodeb")
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	signedCert, err := readCertificatePEM([]byte(caCertMsg.Cert))
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	if err := curInstance.caVerify(signedCert); err != nil {
+		t.Errorf("Signed certificate should be verified: %s", err)
+	}
+	if Fingerprint(signedCert) != Fingerprint(nodebCert) {
+		t.Error("Signed certificate should use the key of the node")
+	}
+
+	// a node without the pinned CA-node dont install the certificate
+	nodeB := newTestInstance("nodeb")
+	defer os.RemoveAll(nodeB.config.Path())
+	nodeB.caEnrollNode = "canode"
+	caNode := nodeB.nodes.GetOrNew("canode")
+	nodeB.nodes.Save(caNode)
+	if nodeB.caInstall("canode", caCertMsg) == nil {
+		t.Error("CA of a not pinned node should not be installed")
+	}
+
+	// a second certificate for the same node
+	curInstance.caOnRequest("nodeb", csrPEM)
+	secondMsg, err := curInstance.caSignRequest("nodeb")
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	secondCert, _ := readCertificatePEM([]byte(secondMsg.Cert))
+
+	// revoke all certificates of the node
+	if curInstance.caRevoked(signedCert) || curInstance.caRevoked(secondCert) {
+		t.Error("Certificate should not be revoked")
+	}
+	if serials, err := curInstance.caRevoke("nodeb"); err != nil || len(serials) != 2 {
+		t.Errorf("Both certificates should be revoked: %v %v", serials, err)
+	}
+	if !curInstance.caRevoked(signedCert) || !curInstance.caRevoked(secondCert) {
+		t.Error("Certificate should be revoked")
+	}
+
+	// other nodes get the deny list signed by the CA
+	crlPEM, err := curInstance.caRevokedList()
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	if _, err := nodeB.caInstallRevokedList(crlPEM); err == nil {
+		t.Error("Revocation-list should not be installed without the CA")
+	}
+	_, caCertFileName := curInstance.getCAPath()
+	_, nodeBCAFileName := nodeB.getCAPath()
+	caBytes, _ := ioutil.ReadFile(caCertFileName)
+	ioutil.WriteFile(nodeBCAFileName, caBytes, 0644)
+	if added, err := nodeB.caInstallRevokedList(crlPEM); err != nil || added != 2 {
+		t.Errorf("Revocation-list should be installed: %d %v", added, err)
+	}
+	if !nodeB.caRevoked(signedCert) || !nodeB.caRevoked(secondCert) {
+		t.Error("Certificate should be revoked on other nodes")
+	}
+	if _, err := nodeB.caInstallRevokedList(strings.Replace(crlPEM, "X509 CRL", "CERTIFICATE", -1)); err == nil {
+		t.Error("Invalid revocation-list should fail")
+	}
+}
+
+func TestPinFingerprint(t *testing.T) {
+
+	curInstance := newTestInstance("nodea")
+	defer os.RemoveAll(curInstance.config.Path())
+
+	certSubject = "/O=TEST"
+	certKeyType = "ecdsa-p256"
+	certLifetime = time.Hour
+	curInstance.CreateKeyPair("nodeb")
+	peerCert, _ := curInstance.loadCertificate("nodeb")
+
+	incomingNode := curInstance.nodes.GetOrNew("nodeb")
+	incomingNode.Type = nodes.NodeTypeIncoming
+	curInstance.nodes.Save(incomingNode)
+
+	curSession := tlsSession{instance: curInstance, remoteNodeName: "nodeb", nodeType: nodes.NodeTypeIncoming}
+
+	// unknown key is requested
+	if curSession.peerCertCheck(peerCert) != certCheckReq {
+		t.Error("Unknown key should be requested")
+	}
+	node, _ := curInstance.nodes.Get("nodeb")
+	if node.PeerFingerprintReq != Fingerprint(peerCert) {
+		t.Errorf("Requested fingerprint is wrong: %s", node.PeerFingerprintReq)
+	}
+
+	// accepted key
+	if err := curInstance.peerCertAcceptReqCert("nodeb"); err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	if curSession.peerCertCheck(peerCert) != certCheckOk {
+		t.Error("Accepted key should be ok")
+	}
+
+	// a new certificate with the same key is still accepted
+	_, certFileName := curInstance.getKeyPairPath("nodeb")
+	os.Remove(certFileName)
+	curInstance.CreateKeyPair("nodeb")
+	newPeerCert, _ := curInstance.loadCertificate("nodeb")
+	if curSession.peerCertCheck(newPeerCert) != certCheckOk {
+		t.Error("Re-issued certificate should be ok")
+	}
+
+	// an old pinned signature is migrated
+	node, _ = curInstance.nodes.Get("nodeb")
+	node.PeerFingerprint = ""
+	node.PeerCertSignature = fmt.Sprintf("%x", newPeerCert.Signature)
+	curInstance.nodes.Save(node)
+	if curSession.peerCertCheck(newPeerCert) != certCheckOk {
+		t.Error("Pinned signature should be ok")
+	}
+	node, _ = curInstance.nodes.Get("nodeb")
+	if node.PeerFingerprint != Fingerprint(newPeerCert) || node.PeerCertSignature != "" {
+		t.Error("Pinned signature should be replaced by the fingerprint")
+	}
+
+	// the pin is used instead of an old announcement of discovery
+	node.DiscoveredFingerprint = "AB:CD"
+	curInstance.nodes.Save(node)
+	if curSession.peerCertCheck(newPeerCert) != certCheckOk || curInstance.checkPeerPin(newPeerCert, "nodeb") != nil {
+		t.Error("Pinned fingerprint should be used instead of the discovered one")
+	}
+}
+
+func TestEnrollToken(t *testing.T) {
+
+	curInstance := newTestInstance("nodea")
+	defer os.RemoveAll(curInstance.config.Path())
+
+	if _, err := curInstance.CreateToken("[", time.Hour); err == nil {
+		t.Error("Invalid pattern should fail")
+	}
+
+	webToken, err := curInstance.CreateToken("web-*", time.Hour)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	// a ttl <= 0 create a token for one hour, so we let it expire
+	expiredToken, _ := curInstance.CreateToken("*", -time.Hour)
+	enrollSection, tokens := curInstance.getEnrollSection()
+	tokens[tokenHash(expiredToken.Token)] = enrollToken{ID: expiredToken.ID, Pattern: "*", Expires: time.Now().Add(-time.Minute).Unix()}
+	curInstance.config.SetJSONObject("enroll", enrollSection)
+
+	if len(curInstance.ListTokens()) != 1 || curInstance.ListTokens()[0].Token != "" {
+		t.Errorf("Only one token without secret should be listed: %+v", curInstance.ListTokens())
+	}
+
+	if _, err := curInstance.consumeToken(webToken.Token, "db-1"); err == nil {
+		t.Error("Token should not be valid for db-1")
+	}
+	if _, err := curInstance.consumeToken(expiredToken.Token, "web-1"); err == nil {
+		t.Error("Expired token should not be valid")
+	}
+	if usedToken, err := curInstance.consumeToken(webToken.Token, "web-1"); err != nil || usedToken.ID != webToken.ID {
+		t.Errorf("Token should be valid for web-1: %v", err)
+	}
+	if _, err := curInstance.consumeToken(webToken.Token, "web-2"); err == nil {
+		t.Error("Token should only be used once")
+	}
+
+	secondToken, _ := curInstance.CreateToken("", time.Hour)
+	if curInstance.DeleteToken(secondToken.ID) != nil || len(curInstance.ListTokens()) != 0 {
+		t.Error("Token should be deleted")
+	}
+
+	// a token dont replace the key of a known node
+	certKeyType = "ecdsa-p256"
+	certLifetime = time.Hour
+	maxFrameSize = 1024 * 1024
+	curInstance.CreateKeyPair("web-2")
+	peerCert, _ := curInstance.loadCertificate("web-2")
+	knownNode := curInstance.nodes.GetOrNew("web-2")
+	knownNode.Type = nodes.NodeTypeIncoming
+	knownNode.PeerFingerprint = "AB:CD"
+	curInstance.nodes.Save(knownNode)
+
+	thirdToken, _ := curInstance.CreateToken("web-*", time.Hour)
+	enroll := func(nodeName string) bool {
+		clientConn, serverConn := net.Pipe()
+		defer clientConn.Close()
+		defer serverConn.Close()
+		go func() {
+			frameBytes, _, _ := encodeFrame(&msgbus.Msg{NodeSource: nodeName, NodeTarget: "nodea", Group: "challange", Command: "enrollToken", Payload: thirdToken.Token}, true, 0)
+			clientConn.Write(frameBytes)
+		}()
+		curSession := tlsSession{instance: curInstance, logging: clog.New("TEST"), remoteNodeName: nodeName,
+			conn: serverConn, reader: bufio.NewReader(serverConn), plugin: curInstance.bus.NewPlugin("TEST")}
+		return curSession.enrollWithToken(peerCert)
+	}
+	if enroll("web-2") {
+		t.Error("Token should not replace the key of a known node")
+	}
+	if node, _ := curInstance.nodes.Get("web-2"); node.PeerFingerprint != "AB:CD" || len(curInstance.ListTokens()) != 1 {
+		t.Error("Known node and token should not be changed")
+	}
+
+	knownNode.PeerFingerprint = ""
+	curInstance.nodes.Save(knownNode)
+	if !enroll("web-2") {
+		t.Error("Incoming node without a key should be enrolled")
+	}
+	if node, _ := curInstance.nodes.Get("web-2"); node.PeerFingerprint != Fingerprint(peerCert) || len(curInstance.ListTokens()) != 0 {
+		t.Error("Key of the node should be accepted and the token used")
+	}
+}
+
+func TestRotateCert(t *testing.T) {
+
+	curInstance := newTestInstance("nodea")
+	defer os.RemoveAll(curInstance.config.Path())
+
+	certSubject = "/O=TEST"
+	certKeyType = "ecdsa-p256"
+	certLifetime = time.Hour
+	curInstance.CreateKeyPair("nodea")
+	curInstance.CreateKeyPair("nodeb")
+	currentCert, _ := curInstance.loadCertificate("nodea")
+	otherCert, _ := curInstance.loadCertificate("nodeb")
+
+	newCertMsg, fingerprint, err := curInstance.createRotationCert()
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	if fingerprint == Fingerprint(currentCert) {
+		t.Error("Rotation should create a new key")
+	}
+
+	newCert, err := verifyRotationCert("nodea", currentCert, newCertMsg)
+	if err != nil || Fingerprint(newCert) != fingerprint {
+		t.Errorf("New certificate should be verified: %v", err)
+	}
+	if _, err := verifyRotationCert("nodea", otherCert, newCertMsg); err == nil {
+		t.Error("New certificate should only be verified with the current key")
+	}
+	if _, err := verifyRotationCert("nodeb", currentCert, newCertMsg); err == nil {
+		t.Error("New certificate should only be valid for nodea")
+	}
+
+	// the old certificate is used until the rotation is finished
+	if activeCert, _ := curInstance.loadCertificate("nodea"); Fingerprint(activeCert) != Fingerprint(currentCert) {
+		t.Error("Old certificate should be active")
+	}
+	if err := curInstance.activateRotationCert(); err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	if activeCert, _ := curInstance.loadCertificate("nodea"); Fingerprint(activeCert) != fingerprint {
+		t.Error("New certificate should be active")
+	}
+	if _, err := curInstance.localCertificate(); err != nil {
+		t.Errorf("New key pair should be loadable: %s", err)
+	}
+
+	// the key is restored, when the certificate can not be replaced
+	if _, _, err := curInstance.createRotationCert(); err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	_, certFileName := curInstance.getKeyPairPath("nodea")
+	os.Remove(certFileName + ".new")
+	os.Mkdir(certFileName+".new", 0700)
+	if err := curInstance.activateRotationCert(); err == nil {
+		t.Error("Activation should fail, if the certificate can not be replaced")
+	}
+	if activeCert, _ := curInstance.loadCertificate("nodea"); Fingerprint(activeCert) != fingerprint {
+		t.Error("Current certificate should stay active")
+	}
+	if _, err := curInstance.localCertificate(); err != nil {
+		t.Errorf("Current key pair should stay loadable: %s", err)
+	}
+	curInstance.dropRotationCert()
+}
+
+func TestRotatePin(t *testing.T) {
+
+	certSubject = "/O=TEST"
+	certKeyType = "ecdsa-p256"
+	certLifetime = time.Hour
+
+	nodeA := newTestInstance("nodea")
+	defer os.RemoveAll(nodeA.config.Path())
+	hub := newTestInstance("hub")
+	defer os.RemoveAll(hub.config.Path())
+
+	nodeA.CreateKeyPair("nodea")
+	currentCert, _ := nodeA.loadCertificate("nodea")
+
+	node := hub.nodes.GetOrNew("nodea")
+	node.Type = nodes.NodeTypeIncoming
+	node.PeerFingerprint = Fingerprint(currentCert)
+	hub.nodes.Save(node)
+
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	go io.Copy(ioutil.Discard, serverConn)
+	curSession := tlsSession{instance: hub, logging: clog.New("TEST"), remoteNodeName: "nodea", peerCert: currentCert, conn: clientConn}
+
+	for _, command := range []string{"certAborted", "certActive"} {
+		newCertMsg, fingerprint, err := nodeA.createRotationCert()
+		if err != nil {
+			t.Error(err)
+			t.FailNow()
+		}
+		newCert, _ := readCertificatePEM([]byte(newCertMsg.Cert))
+		newCertBytes, _ := json.Marshal(newCertMsg)
+
+		// both certificates are accepted until the rotation is finished
+		curSession.rotateOnMessage(&msgbus.Msg{Group: "rotate", Command: "newCert", Payload: string(newCertBytes)})
+		node, _ = hub.nodes.Get("nodea")
+		if node.PeerFingerprint != fingerprint || node.PeerFingerprintPrev != Fingerprint(currentCert) {
+			t.Errorf("Pin is wrong after newCert: %+v", node)
+		}
+		if hub.checkPeerPin(currentCert, "nodea") != nil || hub.checkPeerPin(newCert, "nodea") != nil {
+			t.Error("Both certificates should be accepted during the rotation")
+		}
+
+		curSession.rotateOnMessage(&msgbus.Msg{Group: "rotate", Command: command, Payload: fingerprint})
+		node, _ = hub.nodes.Get("nodea")
+		if node.PeerFingerprintPrev != "" {
+			t.Errorf("Previous pin should be removed after %s", command)
+		}
+
+		if command == "certAborted" {
+			if node.PeerFingerprint != Fingerprint(currentCert) || hub.checkPeerPin(newCert, "nodea") == nil {
+				t.Error("Old pin should be restored")
+			}
+			nodeA.dropRotationCert()
+			continue
+		}
+		if node.PeerFingerprint != fingerprint || hub.checkPeerPin(currentCert, "nodea") == nil || Fingerprint(curSession.currentPeerCert()) != fingerprint {
+			t.Error("Only the new certificate should be accepted")
+		}
+	}
+
+	// a certificate of the CA is not replaced by a self-signed one
+	nodeA.CreateCA()
+	if _, _, err := nodeA.createRotationCert(); err != nil {
+		t.Errorf("CA-node should sign its new certificate: %s", err)
+	}
+	_, certFileName := nodeA.getKeyPairPath("nodea")
+	newCertBytes, _ := ioutil.ReadFile(certFileName + ".new")
+	newCert, _ := readCertificatePEM(newCertBytes)
+	if newCert == nil || nodeA.caVerify(newCert) != nil {
+		t.Error("New certificate should be signed by the CA")
+	}
+	keyFileName, _ := nodeA.getCAPath()
+	os.Remove(keyFileName)
+	if _, _, err := nodeA.createRotationCert(); err == nil {
+		t.Error("Without the CA-key the certificate should not be rotated")
+	}
+}
+
+func TestHeartbeatMiss(t *testing.T) {
+
+	curInstance := newTestInstance("nodea")
+	defer os.RemoveAll(curInstance.config.Path())
+
+	heartbeatInterval = time.Millisecond * 20
+	heartbeatMiss = 1
+	maxFrameSize = 1024 * 1024
+	defer func() { heartbeatInterval = 0 }()
+
+	// the remote node read our pings, but never answer
+	localConn, remoteConn := net.Pipe()
+	defer remoteConn.Close()
+	go io.Copy(ioutil.Discard, remoteConn)
+
+	curSession := &tlsSession{instance: curInstance, logging: clog.New("TEST"), remoteNodeName: "nodeb",
+		conn: localConn, reader: bufio.NewReader(localConn), plugin: curInstance.bus.NewPlugin("TEST"), heartbeatSupported: true}
+
+	done := make(chan bool)
+	go func() {
+		curSession.heartbeatRun(make(chan bool))
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second * 5):
+		t.Error("Session without any pong should be closed")
+	}
+}
+
+func TestBackoffDelay(t *testing.T) {
+
+	policy := nodes.ReconnectPolicy{InitialDelay: 1, MaxDelay: 60, Jitter: 0.5}
+
+	// random = 0.5 means no jitter
+	expected := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second}
+	for attempt, delay := range expected {
+		if curDelay := backoffDelay(policy, attempt, 0.5); curDelay != delay {
+			t.Errorf("Delay of attempt %d should be %s but is %s", attempt, delay, curDelay)
+		}
+	}
+	if curDelay := backoffDelay(policy, 20, 0.5); curDelay != time.Minute {
+		t.Errorf("Delay should be limited to one minute, but is %s", curDelay)
+	}
+
+	// without maxDelay the delay should not overflow
+	if curDelay := backoffDelay(nodes.ReconnectPolicy{InitialDelay: 1}, 2000, 0.5); curDelay < 0 {
+		t.Errorf("Delay without maxDelay overflow to %s", curDelay)
+	}
+
+	// jitter
+	if curDelay := backoffDelay(policy, 2, 0); curDelay != 2*time.Second {
+		t.Errorf("Delay with minimum jitter should be 2s, but is %s", curDelay)
+	}
+	if curDelay := backoffDelay(policy, 2, 1); curDelay != 6*time.Second {
+		t.Errorf("Delay with maximum jitter should be 6s, but is %s", curDelay)
+	}
+
+	// a delay of zero would dial in a tight loop
+	if curDelay := backoffDelay(nodes.ReconnectPolicy{Jitter: 1}, 0, 0); curDelay != minReconnectDelay {
+		t.Errorf("Delay should be at least %s, but is %s", minReconnectDelay, curDelay)
+	}
+	if _, err := decodeReconnectSet("{\"name\":\"nodea\",\"policy\":{\"initialDelay\":0}}"); err == nil {
+		t.Error("Policy without initialDelay should be rejected")
+	}
+
+	// the node policy win over the defaults
+	reconnectInitialDelay = time.Second * 3
+	node := nodes.Node{Name: "nodea"}
+	if reconnectPolicy(node).InitialDelay != 3 {
+		t.Error("Default policy should be used")
+	}
+	node.Reconnect = &policy
+	if reconnectPolicy(node).InitialDelay != 1 {
+		t.Error("Node policy should be used")
+	}
+}
+
+func TestFraming(t *testing.T) {
+
+	maxFrameSize = 90
+	message := msgbus.Msg{NodeSource: "nodea", NodeTarget: "nodeb", Group: "grp", Command: "cmd", Payload: "line1\nline2"}
+
+	var stream bytes.Buffer
+	legacyBytes, _, _ := encodeFrame(&message, false, 0)
+	frameBytes, _, _ := encodeFrame(&message, true, 0)
+	if frameBytes[0] != frameVersion1 || bytes.Count(legacyBytes, []byte("\n")) != 1 {
+		t.Error("Encoding is wrong")
+	}
+
+	// legacy, frame, too big frame, too big legacy, frame
+	stream.Write(legacyBytes)
+	stream.Write(frameBytes)
+	stream.Write([]byte{frameVersion1, 0, 0, 0, 100})
+	stream.Write(make([]byte, 100))
+	stream.WriteString("{" + strings.Repeat("x", 100) + "}\n")
+	stream.Write(frameBytes)
+
+	bigMessage := message
+	bigMessage.Payload = strings.Repeat("x", 100)
+	if _, _, err := encodeFrame(&bigMessage, true, 0); err != errFrameTooBig {
+		t.Error("Too big message should not be encoded")
+	}
+
+	reader := bufio.NewReaderSize(&stream, 16)
+	expected := []error{nil, nil, errFrameTooBig, errFrameTooBig, nil}
+	for index, expectedErr := range expected {
+		data, _, err := readFrame(reader, maxFrameSize)
+		if err != expectedErr {
+			t.Errorf("Frame %d: error should be %v but is %v", index, expectedErr, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+
+		var readMessage wireMsg
+		if err := json.Unmarshal(data, &readMessage); err != nil || readMessage.Msg != message {
+			t.Errorf("Frame %d: message is wrong: %s", index, string(data))
+		}
+		if index == 0 && readMessage.Frame != frameVersion1 {
+			t.Error("Legacy message should announce frames")
+		}
+	}
+}
+
+func TestMessageSource(t *testing.T) {
+
+	maxFrameSize = 1024
+	var stream bytes.Buffer
+	for _, source := range []string{"nodea", "nodea/ws1", "nodeb", "nodeb/ws1"} {
+		frameBytes, _, _ := encodeFrame(&msgbus.Msg{NodeSource: source, NodeTarget: "hub", Group: "grp", Command: "cmd"}, true, 0)
+		stream.Write(frameBytes)
+	}
+	content := stream.Bytes()
+
+	curSession := tlsSession{logging: clog.New("TEST"), remoteNodeName: "nodea"}
+	for _, relayAllowed := range []bool{false, true} {
+		curSession.relayAllowed = relayAllowed
+		curSession.reader = bufio.NewReader(bytes.NewReader(content))
+
+		expected := []string{"nodea", "nodea/ws1", "nodea", "nodea"}
+		if relayAllowed {
+			expected = []string{"nodea", "nodea/ws1", "nodeb", "nodeb/ws1"}
+		}
+		for _, expectedSource := range expected {
+			message, err := curSession.readMsg()
+			if err != nil || message.NodeSource != expectedSource {
+				t.Errorf("Source should be '%s' but is '%s' ( relay %v )", expectedSource, message.NodeSource, relayAllowed)
+			}
+		}
+	}
+}
+
+func FuzzReadFrame(f *testing.F) {
+
+	message := msgbus.Msg{NodeSource: "nodea", NodeTarget: "nodeb", Group: "grp", Command: "cmd", Payload: strings.Repeat("payload", 10)}
+	legacyBytes, _, _ := encodeFrame(&message, false, 0)
+	frameBytes, _, _ := encodeFrame(&message, true, 0)
+	deflateBytes, _, _ := encodeFrame(&message, true, 1)
+
+	f.Add(legacyBytes)
+	f.Add(frameBytes)
+	f.Add(deflateBytes)
+	f.Add([]byte{frameVersion1, 0xff, 0xff, 0xff, 0xff})
+	f.Add([]byte{frameDeflate, 0, 0, 0, 2, 0xff, 0xff})
+
+	maxSize := 90
+	f.Fuzz(func(t *testing.T, stream []byte) {
+
+		reader := bufio.NewReaderSize(bytes.NewReader(stream), 16)
+		for {
+			data, wireSize, err := readFrame(reader, maxSize)
+			if err == errFrameTooBig || err == errFrameInvalid {
+				continue
+			}
+			if err != nil {
+				return
+			}
+			if len(data) > maxSize || wireSize > len(stream) {
+				t.Fatalf("Frame of %d bytes ( %d on the wire ) is read", len(data), wireSize)
+			}
+		}
+	})
+}
+
+func FuzzPayloadDecoders(f *testing.F) {
+
+	f.Add("{\"name\":\"nodea\",\"host\":\"localhost\",\"port\":4444,\"token\":\"abc\",\"ttl\":60}")
+	f.Add("{\"name\":\"nodea\",\"policy\":{\"initialDelay\":1,\"jitter\":2}}")
+	f.Add("{\"name\":\"nodea\",\"reverseDial\":true}")
+	f.Add("{\"port\":-1,\"ttl\":-1}")
+
+	f.Fuzz(func(t *testing.T, payload string) {
+
+		if newNode, err := decodeNodeAdd(payload); err == nil && (newNode.Name == "" || newNode.Port < 0 || newNode.Port > 65535) {
+			t.Errorf("nodeAdd is invalid: %+v", newNode)
+		}
+		if joinReq, err := decodeNodeJoin(payload); err == nil && (joinReq.Name == "" || joinReq.Token == "" || joinReq.Port < 0 || joinReq.Port > 65535) {
+			t.Errorf("nodeJoin is invalid: %+v", joinReq)
+		}
+		if tokenReq, err := decodeTokenCreate(payload); err == nil && (tokenReq.TTL < 0 || tokenReq.TTL > maxTokenTTL) {
+			t.Errorf("tokenCreate is invalid: %+v", tokenReq)
+		}
+		if reconnectReq, err := decodeReconnectSet(payload); err == nil {
+			if reconnectReq.Name == "" {
+				t.Errorf("nodeReconnectSet is invalid: %+v", reconnectReq)
+			}
+			if reconnectReq.Policy != nil && backoffDelay(*reconnectReq.Policy, 100, 1) < 0 {
+				t.Errorf("Policy %+v create a negative delay", *reconnectReq.Policy)
+			}
+		}
+		if reverseReq, err := decodeReverseDial(payload); err == nil && reverseReq.Name == "" {
+			t.Errorf("nodeReverseDialSet is invalid: %+v", reverseReq)
+		}
+	})
+}
+
+func TestCompression(t *testing.T) {
+
+	maxFrameSize = 1024 * 1024
+	message := msgbus.Msg{NodeSource: "nodea", NodeTarget: "nodeb", Group: "grp", Command: "cmd", Payload: strings.Repeat("compress me ", 200)}
+
+	// small messages stay uncompressed
+	frameBytes, _, _ := encodeFrame(&message, true, 1024*1024)
+	if frameBytes[0] != frameVersion1 {
+		t.Error("Message below the threshold should not be compressed")
+	}
+
+	frameBytes, jsonSize, err := encodeFrame(&message, true, 1024)
+	if err != nil || frameBytes[0] != frameDeflate || len(frameBytes) >= jsonSize {
+		t.Errorf("Message should be compressed: %d -> %d bytes", jsonSize, len(frameBytes))
+	}
+
+	data, wireSize, err := readFrame(bufio.NewReader(bytes.NewReader(frameBytes)), maxFrameSize)
+	if err != nil || wireSize != len(frameBytes) || len(data) != jsonSize {
+		t.Errorf("Compressed frame can not be read: %v", err)
+	}
+	var readMessage msgbus.Msg
+	if err := json.Unmarshal(data, &readMessage); err != nil || readMessage != message {
+		t.Error("Message is wrong after decompression")
+	}
+
+	// a bomb which inflate above maxFrameSize
+	maxFrameSize = 1024
+	if _, _, err := readFrame(bufio.NewReader(bytes.NewReader(frameBytes)), maxFrameSize); err != errFrameTooBig {
+		t.Errorf("Inflated message should be too big, but error is %v", err)
+	}
+
+	// garbage
+	garbage := []byte{frameDeflate, 0, 0, 0, 4, 0xff, 0xff, 0xff, 0xff}
+	if _, _, err := readFrame(bufio.NewReader(bytes.NewReader(garbage)), maxFrameSize); err != errFrameInvalid {
+		t.Errorf("Invalid deflate data should be detected, but error is %v", err)
+	}
+}
+
+func TestHello(t *testing.T) {
+
+	options := negotiateOptions([]string{"framing", "compression"}, []string{"signing", "framing"})
+	if len(options) != 1 || options[0] != "framing" {
+		t.Errorf("Options are wrong: %v", options)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	defer listener.Close()
+
+	clientConn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	defer clientConn.Close()
+	serverConn, err := listener.Accept()
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	defer serverConn.Close()
+
+	clientInstance := newTestInstance("client")
+	defer os.RemoveAll(clientInstance.config.Path())
+	serverInstance := newTestInstance("server")
+	defer os.RemoveAll(serverInstance.config.Path())
+
+	maxFrameSize = 1024 * 1024
+	SetVersion("abc1234", "2019-01-01")
+	clientSession := &tlsSession{instance: clientInstance, conn: clientConn, reader: bufio.NewReader(clientConn), remoteNodeName: "server"}
+	serverSession := &tlsSession{instance: serverInstance, conn: serverConn, reader: bufio.NewReader(serverConn), remoteNodeName: "client"}
+
+	result := make(chan bool)
+	go func() {
+		result <- clientSession.handleHello()
+	}()
+	if !serverSession.handleHello() || !<-result {
+		t.Error("Hello should be successful")
+		t.FailNow()
+	}
+
+	if serverSession.remoteCapabilities.Protocol != protocolVersion || serverSession.remoteCapabilities.Version != "abc1234" || !serverSession.hasOption(featureFraming) {
+		t.Errorf("Remote capabilities are wrong: %+v", serverSession.remoteCapabilities)
+	}
+	if !clientSession.framing || !serverSession.framing {
+		t.Error("Both sessions should use frames")
+	}
+
+	// after the hello, messages are sent as frames
+	go clientSession.writeData("client", "server", "grp", "cmd", "payload")
+	message, err := serverSession.readMsg()
+	if err != nil || message.Payload != "payload" {
+		t.Errorf("Message after hello is wrong: %v %+v", err, message)
+	}
+}
+
+func TestWebsocket(t *testing.T) {
+
+	curInstance := newTestInstance("nodea")
+	defer os.RemoveAll(curInstance.config.Path())
+	certKeyType = "ecdsa-p256"
+	curInstance.CreateKeyPair("nodea")
+
+	if _, err := parseNodeURL("https://hub/node"); err == nil {
+		t.Error("Only ws:// and wss:// should be allowed")
+	}
+	if _, err := parseProxyURL("proxy:3128"); err == nil {
+		t.Error("Proxy without scheme should fail")
+	}
+
+	// the hub echo every line inside the tls-session
+	hub := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := websocketUpgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		conn := tls.Server(newWsConn(ws), curInstance.serverTLSConfig())
+		defer conn.Close()
+
+		reader := bufio.NewReader(conn)
+		for {
+			line, err := reader.ReadBytes('\n')
+			if err != nil {
+				return
+			}
+			conn.Write(line)
+		}
+	}))
+	defer hub.Close()
+
+	// a proxy which only allow CONNECT
+	var connects int32
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "CONNECT" {
+			http.Error(w, "only CONNECT", http.StatusMethodNotAllowed)
+			return
+		}
+		atomic.AddInt32(&connects, 1)
+
+		target, err := net.Dial("tcp", r.Host)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		client, _, _ := w.(http.Hijacker).Hijack()
+		client.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+		go io.Copy(target, client)
+		io.Copy(client, target)
+		client.Close()
+		target.Close()
+	}))
+	defer proxy.Close()
+
+	tlsConfig := &tls.Config{
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return curInstance.localCertificate()
+		},
+		InsecureSkipVerify: true,
+	}
+	node := nodes.Node{
+		Name:  "hub",
+		URL:   "ws" + strings.TrimPrefix(hub.URL, "http") + websocketPath,
+		Proxy: proxy.URL,
+	}
+
+	conn, err := dialWebsocket(node, tlsConfig)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	defer conn.Close()
+
+	if atomic.LoadInt32(&connects) != 1 {
+		t.Error("Connection should use the proxy")
+	}
+	if len(conn.(*tls.Conn).ConnectionState().PeerCertificates) == 0 {
+		t.Error("Hub should send its certificate")
+	}
+
+	// bigger than a single websocket-message
+	bigLine := strings.Repeat("x", 100000) + "\n"
+	reader := bufio.NewReader(conn)
+	for _, line := range []string{"hello\n", bigLine} {
+		conn.Write([]byte(line))
+		answer, err := reader.ReadString('\n')
+		if err != nil || answer != line {
+			t.Errorf("Echo is wrong: %v", err)
+		}
+	}
+
+	// without the proxy
+	node.Proxy = ""
+	os.Unsetenv("HTTP_PROXY")
+	directConn, err := dialWebsocket(node, tlsConfig)
+	if err != nil {
+		t.Error(err)
+	} else {
+		directConn.Close()
+	}
+	if atomic.LoadInt32(&connects) != 1 {
+		t.Error("Connection should not use the proxy")
+	}
+}
+
+func TestReverseDial(t *testing.T) {
+
+	curInstance := newTestInstance("hub")
+	defer os.RemoveAll(curInstance.config.Path())
+
+	certKeyType = "ecdsa-p256"
+	curInstance.CreateKeyPair("edgenode")
+	peerCert, _ := curInstance.loadCertificate("edgenode")
+
+	// the hub manage the node, normally the node connect to the hub
+	edgeNode := curInstance.nodes.GetOrNew("edgenode")
+	edgeNode.Type = nodes.NodeTypeIncoming
+	edgeNode.PeerFingerprint = Fingerprint(peerCert)
+	curInstance.nodes.Save(edgeNode)
+
+	node, err := curInstance.setReverseDial("edgenode", true)
+	if err != nil || !node.DialOut() || node.Type != nodes.NodeTypeIncoming || node.IsHub() {
+		t.Errorf("Hub should connect to the node and keep its role: %v %+v", err, node)
+	}
+
+	// the hub connect to the node and accept it with its pinned key
+	curSession := tlsSession{instance: curInstance, remoteNodeName: "edgenode", nodeType: nodes.NodeTypeClient}
+	if curSession.peerCertCheck(peerCert) != certCheckOk {
+		t.Error("Outgoing connection to a reverse-dial node should be accepted")
+	}
+
+	if node, _ := curInstance.setReverseDial("edgenode", false); node.DialOut() {
+		t.Error("Hub should wait for the node again")
+	}
+
+	serverNode := curInstance.nodes.GetOrNew("hub")
+	serverNode.Type = nodes.NodeTypeServer
+	curInstance.nodes.Save(serverNode)
+	if _, err := curInstance.setReverseDial("hub", true); err == nil {
+		t.Error("A server-node can not be reversed")
+	}
+}
+
+func TestPendingNodes(t *testing.T) {
+
+	curInstance := newTestInstance("hub")
+	defer os.RemoveAll(curInstance.config.Path())
+
+	certSubject = "/O=TEST"
+	certKeyType = "ecdsa-p256"
+	pendingExpiry = time.Hour
+	pendingRateLimit = 1
+	pendingRateWindow = time.Minute
+
+	for _, nodeName := range []string{"nodeb", "nodec"} {
+		curInstance.CreateKeyPair(nodeName)
+		incomingNode := curInstance.nodes.GetOrNew(nodeName)
+		incomingNode.Type = nodes.NodeTypeIncoming
+		curInstance.nodes.Save(incomingNode)
+	}
+	certB, _ := curInstance.loadCertificate("nodeb")
+	certC, _ := curInstance.loadCertificate("nodec")
+
+	sessionB := tlsSession{instance: curInstance, remoteNodeName: "nodeb", nodeType: nodes.NodeTypeIncoming, remoteAddr: "10.0.0.2:1000"}
+	sessionC := tlsSession{instance: curInstance, remoteNodeName: "nodec", nodeType: nodes.NodeTypeIncoming, remoteAddr: "10.0.0.2:1001"}
+
+	if sessionB.peerCertCheck(certB) != certCheckReq {
+		t.Error("Unknown key should be requested")
+	}
+	node, _ := curInstance.nodes.Get("nodeb")
+	firstTime := node.PeerRequest.Time
+
+	// a reconnect is not a new request, but a second node from the same ip is
+	if sessionB.peerCertCheck(certB) != certCheckReq {
+		t.Error("Reconnect of a requesting node should not be limited")
+	}
+	if sessionC.peerCertCheck(certC) != certCheckMisMatch {
+		t.Error("Second request from the same ip should be limited")
+	}
+
+	// unknown nodes are not saved, but count anyway
+	sessionUnknown := tlsSession{instance: curInstance, remoteNodeName: "unknown", nodeType: nodes.NodeTypeIncoming, remoteAddr: "10.0.0.3:1000"}
+	if sessionUnknown.peerCertCheck(certC) != certCheckUnknown {
+		t.Error("First unknown node from an ip should be checked")
+	}
+	if sessionUnknown.peerCertCheck(certC) != certCheckMisMatch {
+		t.Error("Second unknown node from the same ip should be limited")
+	}
+
+	pending := curInstance.pendingNodes()
+	if len(pending) != 1 || pending[0].Node != "nodeb" || pending[0].RemoteAddr != "10.0.0.2:1000" ||
+		pending[0].Subject != certB.Subject.String() || !pending[0].Time.Equal(firstTime) || pending[0].Expires == nil {
+		t.Errorf("Pending nodes are wrong: %+v", pending)
+	}
+
+	if expired := curInstance.expirePending(time.Now()); len(expired) != 0 {
+		t.Errorf("Nothing should expire now: %v", expired)
+	}
+	if expired := curInstance.expirePending(time.Now().Add(time.Hour * 2)); len(expired) != 1 || expired[0] != "nodeb" {
+		t.Errorf("Request should expire: %v", expired)
+	}
+	node, _ = curInstance.nodes.Get("nodeb")
+	if node.PeerFingerprintReq != "" || node.PeerRequest != nil || len(curInstance.pendingNodes()) != 0 {
+		t.Error("Expired request should be removed")
+	}
+
+	// approve answer with the full record
+	sessionB.peerCertCheck(certB)
+	curInstance.peerCertAcceptReqCert("nodeb")
+	record, err := curInstance.nodeRecord("nodeb")
+	var info map[string]nodes.NodeInfo
+	if err != nil || json.Unmarshal([]byte(record), &info) != nil ||
+		info["nodeb"].PeerFingerprint != Fingerprint(certB) || info["nodeb"].PeerRequest != nil {
+		t.Errorf("Record is wrong: %s", record)
+	}
+}
+
+func TestVerifyPeer(t *testing.T) {
+
+	for _, invalid := range [][]string{{"1.1", "", ""}, {"1.2", "TLS_RSA_WITH_RC4_128_SHA", ""}, {"1.2", "", "P128"}} {
+		if err := parseTLSOptions(invalid[0], invalid[1], invalid[2]); err == nil {
+			t.Errorf("TLS-options %v should be invalid", invalid)
+		}
+	}
+	if err := parseTLSOptions("1.3", "TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384", "x25519, P384"); err != nil {
+		t.Error(err)
+	}
+	if config := baseTLSConfig(); config.MinVersion != tls.VersionTLS13 || len(config.CipherSuites) != 1 || len(config.CurvePreferences) != 2 {
+		t.Errorf("TLS-config is wrong: %+v", config)
+	}
+	defer parseTLSOptions("1.2", "", "")
+
+	curInstance := newTestInstance("nodea")
+	defer os.RemoveAll(curInstance.config.Path())
+
+	certKeyType = "ecdsa-p256"
+	curInstance.CreateKeyPair("nodea")
+	curInstance.CreateKeyPair("nodeb")
+	certA, _ := curInstance.loadCertificate("nodea")
+	certB, _ := curInstance.loadCertificate("nodeb")
+
+	pinnedNode := curInstance.nodes.GetOrNew("nodeb")
+	pinnedNode.Type = nodes.NodeTypeClient
+	pinnedNode.PeerFingerprint = Fingerprint(certA)
+	curInstance.nodes.Save(pinnedNode)
+
+	if curInstance.checkPeerPin(certB, "nodeb") == nil {
+		t.Error("Wrong fingerprint should be rejected")
+	}
+	if curInstance.checkPeerPin(certA, "nodeb") == nil {
+		t.Error("Certificate of another node should be rejected")
+	}
+	if curInstance.checkPeerPin(certA, "") != nil {
+		t.Error("Unknown incoming node should pass the handshake")
+	}
+	if curInstance.checkPeerPin(certA, "unknown") == nil {
+		t.Error("Unknown node we connect to should be rejected")
+	}
+
+	// we connect to nodeb, but get the certificate of nodea
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	defer serverConn.Close()
+	go tls.Server(serverConn, curInstance.serverTLSConfig()).Handshake()
+	if err := tls.Client(clientConn, curInstance.clientTLSConfig("nodeb")).Handshake(); err == nil {
+		t.Error("Handshake should fail")
+	}
+}
+
+func TestRemoteAdmin(t *testing.T) {
+
+	hub := newTestInstance("hub")
+	defer os.RemoveAll(hub.config.Path())
+	hub.start()
+	defer hub.stop()
+
+	answers := make(chan msgbus.Msg, 10)
+	testPlugin := hub.bus.NewPlugin("TEST")
+	testPlugin.Register()
+	testPlugin.ListenForGroup("tls", func(message *msgbus.Msg, group, command, payload string) {
+		if message.NodeTarget != "hub" {
+			answers <- *message
+		}
+	})
+	readAnswer := func(target string) msgbus.Msg {
+		select {
+		case message := <-answers:
+			if message.NodeTarget != target {
+				t.Errorf("Answer should be sent to '%s': %+v", target, message)
+			}
+			return message
+		case <-time.After(time.Second * 5):
+			t.Errorf("No answer to '%s'", target)
+			t.FailNow()
+		}
+		return msgbus.Msg{}
+	}
+
+	// administrative commands from other nodes are denied
+	commands := map[string]string{
+		"tokenCreate":        "{\"pattern\":\"web-*\",\"ttl\":60}",
+		"tokenList":          "",
+		"tokenDelete":        "unknown",
+		"nodeJoin":           "{\"name\":\"evilhub\",\"host\":\"127.0.0.1\",\"port\":4444,\"token\":\"secret\"}",
+		"caEnroll":           "evilnode",
+		"caGetRequests":      "",
+		"caSign":             "evilnode",
+		"caRevoke":           "hub",
+		"rotateCert":         "",
+		"rekey":              "nodeb",
+		"getPendingNodes":    "",
+		"nodeAccept":         "nodeb",
+		"nodeReject":         "nodeb",
+		"nodeReconnectSet":   "{\"name\":\"nodeb\",\"policy\":null}",
+		"nodeReverseDialSet": "{\"name\":\"nodeb\",\"reverseDial\":true}",
+	}
+	for command, payload := range commands {
+		testPlugin.Publish("evilnode", "hub", "tls", command, payload)
+		if message := readAnswer("evilnode"); message.Command != "error" {
+			t.Errorf("'%s' from another node should be denied, but get %+v", command, message)
+		}
+	}
+	if len(hub.ListTokens()) != 0 {
+		t.Error("Another node should not create tokens")
+	}
+	if _, err := hub.nodes.Get("evilhub"); err == nil {
+		t.Error("Another node should not let us join a hub")
+	}
+
+	// our webclient can use them
+	testPlugin.Publish("hub/ws1", "hub", "tls", "tokenCreate", commands["tokenCreate"])
+	if message := readAnswer("hub/ws1"); message.Command != "tokenCreateOk" {
+		t.Errorf("Token should be created for our webclient, but get %+v", message)
+	}
+}
+
+// newTestInstance create a node with its own config-dir, nodes and messagebus
+// the config-dir must be removed with os.RemoveAll(testInstance.config.Path())
+func newTestInstance(nodeName string) *instance {
+	configPath, _ := ioutil.TempDir("", "ctls"+nodeName)
+
+	nodeConfig := config.New(nodeName, configPath)
+	testInstance := newInstance(nodeConfig, nodes.NewRegistry(nodeConfig), msgbus.New())
+	testInstance.logging = clog.New("TLS-" + nodeName)
+	testInstance.nodes.Init()
+
+	return testInstance
+}
+
+// startTestInstance start the node with a tls-server on a random loopback-port and return its address
+func startTestInstance(t *testing.T, testInstance *instance) (string, int) {
+
+	if err := testInstance.CreateKeyPair(testInstance.config.NodeName()); err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", testInstance.serverTLSConfig())
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+
+	testInstance.start()
+	go testInstance.acceptSessions(listener)
+
+	address := listener.Addr().(*net.TCPAddr)
+	return address.IP.String(), address.Port
+}
+
+// connectTestInstance let testInstance connect to the node on host:port, the token is optional
+func connectTestInstance(testInstance *instance, nodeName, host string, port int, token string) {
+	node := testInstance.nodes.GetOrNew(nodeName)
+	node.Type = nodes.NodeTypeClient
+	node.Host = host
+	node.Port = port
+	node.EnrollToken = token
+	testInstance.nodes.Save(node)
+
+	testInstance.connectNode(node)
+}
+
+// waitFor wait until check return true
+func waitFor(t *testing.T, what string, check func() bool) {
+	for timeout := time.Now().Add(time.Second * 20); time.Now().Before(timeout); {
+		if check() {
+			return
+		}
+		time.Sleep(time.Millisecond * 20)
+	}
+	t.Errorf("Timeout while waiting for %s", what)
+	t.FailNow()
+}
+
+// connected return true if both nodes have an established session to each other
+func connected(first, second *instance) bool {
+	return first.getSession(second.config.NodeName()) != nil && second.getSession(first.config.NodeName()) != nil
+}
+
+func TestNetwork(t *testing.T) {
+
+	certSubject = "/O=TEST"
+	certKeyType = "ecdsa-p256"
+	certLifetime = time.Hour
+	maxFrameSize = 1024 * 1024
+	pendingRateLimit = 0
+	minReconnectDelay = time.Millisecond * 50
+	reconnectInitialDelay = time.Millisecond * 50
+	reconnectMaxDelay = time.Millisecond * 200
+	reconnectMaxAttempts = 0
+
+	// the hub is the CA, nodea join with a token, nodec must be accepted
+	hub := newTestInstance("hub")
+	defer os.RemoveAll(hub.config.Path())
+	nodeA := newTestInstance("nodea")
+	defer os.RemoveAll(nodeA.config.Path())
+	nodeC := newTestInstance("nodec")
+	defer os.RemoveAll(nodeC.config.Path())
+
+	hub.CreateKeyPair("hub")
+	if err := hub.CreateCA(); err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	hubHost, hubPort := startTestInstance(t, hub)
+	defer hub.stop()
+	startTestInstance(t, nodeA)
+	defer nodeA.stop()
+	nodeCHost, nodeCPort := startTestInstance(t, nodeC)
+	defer nodeC.stop()
+
+	// a plugin on every bus, to send messages like other plugins
+	testPlugins := make(map[*instance]*msgbus.Plugin)
+	for _, testInstance := range []*instance{hub, nodeA, nodeC} {
+		testPlugin := testInstance.bus.NewPlugin("TEST")
+		testPlugin.Register()
+		testPlugins[testInstance] = &testPlugin
+	}
+
+	// nodec receive the relayed messages
+	received := make(chan msgbus.Msg, 10)
+	testPlugins[nodeC].ListenForGroup("test", func(message *msgbus.Msg, group, command, payload string) {
+		received <- *message
+	})
+
+	t.Run("Join with a token", func(t *testing.T) {
+		token, err := hub.CreateToken("node*", time.Hour)
+		if err != nil {
+			t.Error(err)
+			t.FailNow()
+		}
+
+		connectTestInstance(nodeA, "hub", hubHost, hubPort, token.Token)
+		waitFor(t, "nodea joined the hub", func() bool { return connected(hub, nodeA) })
+
+		node, _ := hub.nodes.Get("nodea")
+		localFingerprint, _ := nodeA.LocalFingerprint()
+		if node.Type != nodes.NodeTypeIncoming || node.PeerFingerprint != localFingerprint || node.SharedSecret == "" {
+			t.Errorf("Hub should know nodea: %+v", node)
+		}
+		if state := hub.nodes.GetState("nodea"); !state.Connected || state.Direction != nodes.DirectionIncoming {
+			t.Errorf("State on the hub is wrong: %+v", state)
+		}
+		if _, err := hub.consumeToken(token.Token, "node2"); err == nil {
+			t.Error("Token should be used")
+		}
+	})
+
+	t.Run("Accept a requested node", func(t *testing.T) {
+		incomingNode := hub.nodes.GetOrNew("nodec")
+		incomingNode.Type = nodes.NodeTypeIncoming
+		hub.nodes.Save(incomingNode)
+
+		connectTestInstance(nodeC, "hub", hubHost, hubPort, "")
+		waitFor(t, "request of nodec", func() bool {
+			node, _ := hub.nodes.Get("nodec")
+			return node.PeerFingerprintReq != ""
+		})
+		if connected(hub, nodeC) {
+			t.Error("Requested node should not be connected")
+		}
+
+		if err := hub.peerCertAcceptReqCert("nodec"); err != nil {
+			t.Error(err)
+			t.FailNow()
+		}
+		waitFor(t, "nodec connected to the hub", func() bool { return connected(hub, nodeC) })
+	})
+
+	t.Run("Relay over the hub", func(t *testing.T) {
+		testPlugins[nodeA].Publish("nodea", "nodec", "test", "ping", "hello nodec")
+
+		select {
+		case message := <-received:
+			if message.NodeSource != "nodea" || message.NodeTarget != "nodec" || message.Payload != "hello nodec" {
+				t.Errorf("Relayed message is wrong: %+v", message)
+			}
+		case <-time.After(time.Second * 10):
+			t.Error("Message was not relayed")
+			t.FailNow()
+		}
+	})
+
+	t.Run("Reconnect after a lost connection", func(t *testing.T) {
+		lostSession := hub.getSession("nodea")
+		lostSession.conn.Close()
+
+		waitFor(t, "nodea reconnected", func() bool {
+			curSession := hub.getSession("nodea")
+			return curSession != nil && curSession != lostSession && connected(hub, nodeA)
+		})
+	})
+
+	t.Run("Rekey with a lost confirm", func(t *testing.T) {
+		if hub.getSession("nodea").rekey() == nil {
+			t.Error("Only the node which connect should create a new secret")
+		}
+
+		oldNode, _ := nodeA.nodes.Get("hub")
+		if err := nodeA.getSession("hub").rekey(); err != nil {
+			t.Error(err)
+			t.FailNow()
+		}
+		waitFor(t, "new secret on both nodes", func() bool {
+			clientNode, _ := nodeA.nodes.Get("hub")
+			serverNode, _ := hub.nodes.Get("nodea")
+			return clientNode.SharedSecretNext == "" && clientNode.SharedSecret != oldNode.SharedSecret &&
+				clientNode.SharedSecret == serverNode.SharedSecret && serverNode.SharedSecretPrev == oldNode.SharedSecret
+		})
+
+		// nodea dont get the confirm, so it still use the old secret
+		clientNode, _ := nodeA.nodes.Get("hub")
+		newSecret := clientNode.SharedSecret
+		clientNode.SharedSecretNext = newSecret
+		clientNode.SharedSecret = oldNode.SharedSecret
+		nodeA.nodes.Save(clientNode)
+
+		for reconnect := 0; reconnect < 2; reconnect++ {
+			lostSession := hub.getSession("nodea")
+			lostSession.conn.Close()
+			waitFor(t, "nodea reconnected", func() bool {
+				curSession := hub.getSession("nodea")
+				return curSession != nil && curSession != lostSession && connected(hub, nodeA)
+			})
+		}
+		clientNode, _ = nodeA.nodes.Get("hub")
+		serverNode, _ := hub.nodes.Get("nodea")
+		if clientNode.SharedSecret != newSecret || clientNode.SharedSecretNext != "" ||
+			serverNode.SharedSecret != newSecret || serverNode.SharedSecretPrev != "" {
+			t.Errorf("Both nodes should use the new secret: %+v %+v", clientNode, serverNode)
+		}
+	})
+
+	t.Run("Rotate a certificate", func(t *testing.T) {
+		oldFingerprint, _ := nodeC.LocalFingerprint()
+
+		reports := make(chan msgbus.Msg, 1)
+		testPlugins[nodeC].ListenForGroup("tls", func(message *msgbus.Msg, group, command, payload string) {
+			if command == "rotateCertReport" {
+				reports <- *message
+			}
+		})
+		testPlugins[nodeC].Publish("nodec", "nodec", "tls", "rotateCert", "")
+
+		var report rotateReport
+		select {
+		case message := <-reports:
+			json.Unmarshal([]byte(message.Payload), &report)
+		case <-time.After(time.Second * 20):
+			t.Error("No report of the rotation")
+			t.FailNow()
+		}
+		newFingerprint, _ := nodeC.LocalFingerprint()
+		if !report.Activated || newFingerprint == oldFingerprint || report.Fingerprint != newFingerprint {
+			t.Errorf("New certificate should be active: %+v", report)
+		}
+		waitFor(t, "hub pinned the new certificate", func() bool {
+			node, _ := hub.nodes.Get("nodec")
+			return node.PeerFingerprint == newFingerprint && node.PeerFingerprintPrev == ""
+		})
+
+		// the next connection use the new certificate
+		hub.getSession("nodec").conn.Close()
+		waitFor(t, "nodec reconnected with the new certificate", func() bool {
+			curSession := hub.getSession("nodec")
+			return curSession != nil && Fingerprint(curSession.currentPeerCert()) == newFingerprint
+		})
+	})
+
+	t.Run("Revoke a certificate", func(t *testing.T) {
+
+		// nodea get a certificate from the CA
+		testPlugins[nodeA].Publish("nodea", "nodea", "tls", "caEnroll", "hub")
+		waitFor(t, "signing-request of nodea", func() bool {
+			_, requests, _ := hub.getCASection()
+			return requests["nodea"] != nil
+		})
+		testPlugins[hub].Publish("hub", "hub", "tls", "caSign", "nodea")
+		waitFor(t, "certificate of nodea signed by the CA", func() bool {
+			nodeCert, err := nodeA.loadCertificate("nodea")
+			return err == nil && hub.caVerify(nodeCert) == nil
+		})
+
+		// the signed certificate is used for the next connection
+		hub.getSession("nodea").conn.Close()
+		waitFor(t, "nodea reconnected with the signed certificate", func() bool {
+			curSession := hub.getSession("nodea")
+			return curSession != nil && hub.caVerify(curSession.peerCert) == nil
+		})
+
+		if _, err := hub.caRevoke("nodea"); err != nil {
+			t.Error(err)
+			t.FailNow()
+		}
+		hub.getSession("nodea").conn.Close()
+		waitFor(t, "failed reconnects of nodea", func() bool {
+			nodeA.connectStatesMutex.Lock()
+			defer nodeA.connectStatesMutex.Unlock()
+			return nodeA.connectStates["hub"].Attempt >= 3
+		})
+		if hub.getSession("nodea") != nil {
+			t.Error("Revoked node should not be connected")
+		}
+
+		// other nodes are not affected
+		if !connected(hub, nodeC) {
+			t.Error("nodec should still be connected")
+		}
+	})
+
+	t.Run("Reverse dial keep the roles", func(t *testing.T) {
+
+		// nodec wait for the hub, the hub connect to nodec
+		if _, err := nodeC.setReverseDial("hub", true); err != nil {
+			t.Error(err)
+			t.FailNow()
+		}
+		hub.nodes.Update("nodec", func(node *nodes.Node) bool {
+			node.Host = nodeCHost
+			node.Port = nodeCPort
+			return true
+		})
+		node, err := hub.setReverseDial("nodec", true)
+		if err != nil {
+			t.Error(err)
+			t.FailNow()
+		}
+		hub.getSession("nodec").conn.Close()
+		hub.connectNode(node)
+
+		waitFor(t, "hub connected to nodec", func() bool {
+			return connected(hub, nodeC) && hub.nodes.GetState("nodec").Direction == nodes.DirectionOutgoing
+		})
+
+		// only the hub can relay and change config-sections of nodec
+		if hubNode, _ := nodeC.nodes.Get("hub"); !hubNode.IsHub() || !nodeC.getSession("hub").relayAllowed {
+			t.Errorf("nodec should trust the hub: %+v", hubNode)
+		}
+		if nodeCNode, _ := hub.nodes.Get("nodec"); nodeCNode.IsHub() || hub.getSession("nodec").relayAllowed {
+			t.Errorf("The hub should not trust nodec: %+v", nodeCNode)
+		}
+	})
+}
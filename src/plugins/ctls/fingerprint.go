@@ -0,0 +1,76 @@
+/*
+Copyright (C) 2019 by Martin Langlotz aka stackshadow
+
+This file is part of gopilot, an rewrite of the copilot-project in go
+
+gopilot is free software: you can redistribute it and/or modify
+it under the terms of the GNU Lesser General Public License as published by
+the Free Software Foundation, version 3 of this License
+
+gopilot is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License
+along with gopilot.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package pluginctls
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// Fingerprint return the sha256 of the public key of the certificate as hex ( AB:CD:... )
+// The fingerprint dont change, when the certificate is re-issued with the same key
+func Fingerprint(cert *x509.Certificate) string {
+
+	hash := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+
+	hexBytes := make([]string, len(hash))
+	for index, curByte := range hash {
+		hexBytes[index] = fmt.Sprintf("%02X", curByte)
+	}
+
+	return strings.Join(hexBytes, ":")
+}
+
+// LocalFingerprint return the fingerprint of the certificate of this node
+func LocalFingerprint() (string, error) {
+	return defaultInstance.LocalFingerprint()
+}
+
+// LocalFingerprint return the fingerprint of the certificate of this node
+func (curInstance *instance) LocalFingerprint() (string, error) {
+
+	cert, err := curInstance.loadCertificate(curInstance.config.NodeName())
+	if err != nil {
+		return "", err
+	}
+
+	return Fingerprint(cert), nil
+}
+
+// loadCertificate read the certificate of nodeName from the config path
+func (curInstance *instance) loadCertificate(nodeName string) (*x509.Certificate, error) {
+
+	_, certFileName := curInstance.getKeyPairPath(nodeName)
+
+	certBytes, err := ioutil.ReadFile(certFileName)
+	if err != nil {
+		return nil, err
+	}
+
+	certBlock, _ := pem.Decode(certBytes)
+	if certBlock == nil || certBlock.Type != "CERTIFICATE" {
+		return nil, fmt.Errorf("No certificate found in '%s'", certFileName)
+	}
+
+	return x509.ParseCertificate(certBlock.Bytes)
+}
@@ -0,0 +1,285 @@
+/*
+Copyright (C) 2019 by Martin Langlotz aka stackshadow
+
+This file is part of gopilot, an rewrite of the copilot-project in go
+
+gopilot is free software: you can redistribute it and/or modify
+it under the terms of the GNU Lesser General Public License as published by
+the Free Software Foundation, version 3 of this License
+
+gopilot is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License
+along with gopilot.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package pluginctls
+
+/*
+Framing of the messages between two nodes
+
+legacy:  one json-message per line, terminated by '\n'
+v1:      [0x01][length as uint32 big endian][json-message]
+deflate: [0x02][length as uint32 big endian][json-message compressed with deflate]
+
+Deflate is only used, if both nodes negotiated the "deflate"-feature in the hello
+and the message is bigger than -compression.threshold.
+
+Every legacy-message contains "f":1 to tell the remote node, that we can read frames.
+When the remote node told us the same, we only write frames.
+The reader detect the format of every message by its first byte, so both formats can be mixed.
+
+Messages bigger than -maxFrameSize are dropped and answered with tls/protocolError,
+the same happen for messages which are not valid json or have no group or command.
+
+The source of a received message is always the remote node ( or one of its clients ),
+only the node we joined can relay messages of other nodes.
+*/
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"core/msgbus"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+const frameVersion1 byte = 0x01
+const frameDeflate byte = 0x02
+const frameHeaderSize = 5
+
+// options
+var maxFrameSize int
+var compression bool
+var compressionThreshold int
+
+// wireMsg is a message as it is send between nodes
+type wireMsg struct {
+	msgbus.Msg
+	Frame byte `json:"f,omitempty"` // the highest frame version the sender can read
+}
+
+var errFrameTooBig = errors.New("Message is too big")
+var errFrameInvalid = errors.New("Message can not be decompressed")
+
+// encodeFrame return the bytes to send for message and the size of the uncompressed json
+// if compressThreshold is > 0, messages with at least this size are compressed
+func encodeFrame(message *msgbus.Msg, framing bool, compressThreshold int) ([]byte, int, error) {
+
+	if !framing {
+		jsonBytes, err := json.Marshal(wireMsg{Msg: *message, Frame: frameVersion1})
+		if err != nil {
+			return nil, 0, err
+		}
+		return append(jsonBytes, '\n'), len(jsonBytes), nil
+	}
+
+	jsonBytes, err := json.Marshal(message)
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(jsonBytes) > maxFrameSize {
+		return nil, 0, errFrameTooBig
+	}
+
+	frameType := frameVersion1
+	frameData := jsonBytes
+
+	if compressThreshold > 0 && len(jsonBytes) >= compressThreshold {
+		var compressed bytes.Buffer
+		writer, _ := flate.NewWriter(&compressed, flate.DefaultCompression)
+		writer.Write(jsonBytes)
+		writer.Close()
+
+		// only if it is worth it
+		if compressed.Len() < len(jsonBytes) {
+			frameType = frameDeflate
+			frameData = compressed.Bytes()
+		}
+	}
+
+	frameBytes := make([]byte, frameHeaderSize, frameHeaderSize+len(frameData))
+	frameBytes[0] = frameType
+	binary.BigEndian.PutUint32(frameBytes[1:], uint32(len(frameData)))
+	return append(frameBytes, frameData...), len(jsonBytes), nil
+}
+
+// readFrame read the next message from reader, in legacy or frame format
+// it return the json and the count of bytes read from the connection
+// a message bigger than maxSize is skipped and errFrameTooBig returned, so the next message can be read
+func readFrame(reader *bufio.Reader, maxSize int) ([]byte, int, error) {
+
+	firstByte, err := reader.Peek(1)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if firstByte[0] == frameVersion1 || firstByte[0] == frameDeflate {
+		header := make([]byte, frameHeaderSize)
+		if _, err := io.ReadFull(reader, header); err != nil {
+			return nil, 0, err
+		}
+
+		length := int64(binary.BigEndian.Uint32(header[1:]))
+		wireSize := frameHeaderSize + int(length)
+		if length > int64(maxSize) {
+			if _, err := io.CopyN(ioutil.Discard, reader, length); err != nil {
+				return nil, 0, err
+			}
+			return nil, wireSize, errFrameTooBig
+		}
+
+		frameBytes := make([]byte, length)
+		if _, err := io.ReadFull(reader, frameBytes); err != nil {
+			return nil, 0, err
+		}
+
+		if header[0] == frameDeflate {
+			// we never inflate more than maxSize
+			inflater := flate.NewReader(bytes.NewReader(frameBytes))
+			jsonBytes, err := ioutil.ReadAll(io.LimitReader(inflater, int64(maxSize)+1))
+			inflater.Close()
+			if err != nil {
+				return nil, wireSize, errFrameInvalid
+			}
+			if len(jsonBytes) > maxSize {
+				return nil, wireSize, errFrameTooBig
+			}
+			return jsonBytes, wireSize, nil
+		}
+
+		return frameBytes, wireSize, nil
+	}
+
+	// legacy, we read until the newline but keep only maxSize bytes
+	var line []byte
+	wireSize := 0
+	tooBig := false
+	for {
+		part, err := reader.ReadSlice('\n')
+		wireSize += len(part)
+		if len(line)+len(part) > maxSize+1 {
+			tooBig = true
+		} else {
+			line = append(line, part...)
+		}
+
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		break
+	}
+
+	if tooBig {
+		return nil, wireSize, errFrameTooBig
+	}
+	return line[:len(line)-1], wireSize, nil
+}
+
+// readMsg read the next valid message from the remote node
+// invalid messages are answered with an protocolError and skipped
+func (curSession *tlsSession) readMsg() (msgbus.Msg, error) {
+
+	for {
+		frameBytes, wireSize, err := readFrame(curSession.reader, maxFrameSize)
+		curSession.addTraffic(0, 0, len(frameBytes), wireSize)
+		if err == errFrameTooBig {
+			curSession.protocolError(fmt.Sprintf("Message is bigger than %d bytes", maxFrameSize))
+			continue
+		}
+		if err == errFrameInvalid {
+			curSession.protocolError(err.Error())
+			continue
+		}
+		if err != nil {
+			curSession.logging.Error("readMsg", err.Error())
+			return msgbus.Msg{}, err
+		}
+		curSession.logging.Debug("readMsg", string(frameBytes))
+
+		var newMessage wireMsg
+		err = json.Unmarshal(frameBytes, &newMessage)
+		if err != nil {
+			curSession.protocolError(fmt.Sprintf("Message is not valid: %s", err.Error()))
+			continue
+		}
+		if newMessage.Group == "" || newMessage.Command == "" {
+			curSession.protocolError("Message without group or command")
+			continue
+		}
+
+		// a node can only send in its own name, only the node we joined can relay messages of others
+		if !curSession.relayAllowed && msgbus.AddressNode(newMessage.NodeSource) != curSession.remoteNodeName {
+			newMessage.NodeSource = curSession.remoteNodeName
+		}
+
+		// the remote node can read frames
+		if newMessage.Frame >= frameVersion1 {
+			curSession.writeMutex.Lock()
+			if !curSession.framing {
+				curSession.logging.Debug("readMsg", "Remote node can read frames, switch to frame format")
+			}
+			curSession.framing = true
+			curSession.writeMutex.Unlock()
+		}
+
+		return newMessage.Msg, nil
+	}
+}
+
+// protocolError log the error and tell it the remote node
+func (curSession *tlsSession) protocolError(errorMessage string) {
+	curSession.logging.Error("PROTOCOL", errorMessage, "node", curSession.remoteNodeName)
+	curSession.writeData(curSession.instance.config.NodeName(), curSession.remoteNodeName, "tls", "protocolError", errorMessage)
+}
+
+// addTraffic count the bytes of the session, before and after compression
+// after startTrafficReport() the counters are copied to the runtime-state of the node
+func (curSession *tlsSession) addTraffic(sent, sentWire, received, receivedWire int) {
+	curSession.trafficMutex.Lock()
+	curSession.traffic.Sent += int64(sent)
+	curSession.traffic.SentWire += int64(sentWire)
+	curSession.traffic.Received += int64(received)
+	curSession.traffic.ReceivedWire += int64(receivedWire)
+	traffic := curSession.traffic
+	report := curSession.trafficReport
+	curSession.trafficMutex.Unlock()
+
+	if report {
+		curSession.instance.nodes.SetTraffic(curSession.remoteNodeName, traffic)
+	}
+}
+
+// startTrafficReport copy the counters to the runtime-state of the node from now on
+// we only do this for authenticated nodes
+func (curSession *tlsSession) startTrafficReport() {
+	curSession.trafficMutex.Lock()
+	curSession.trafficReport = true
+	traffic := curSession.traffic
+	curSession.trafficMutex.Unlock()
+
+	curSession.instance.nodes.SetTraffic(curSession.remoteNodeName, traffic)
+}
+
+// logTraffic write the counters of the session to the log
+func (curSession *tlsSession) logTraffic() {
+	curSession.trafficMutex.Lock()
+	traffic := curSession.traffic
+	curSession.trafficMutex.Unlock()
+
+	curSession.logging.Info("TRAFFIC", fmt.Sprintf(
+		"%s: sent %d bytes ( %d on the wire ), received %d bytes ( %d on the wire )",
+		curSession.remoteNodeName, traffic.Sent, traffic.SentWire, traffic.Received, traffic.ReceivedWire,
+	))
+}
@@ -0,0 +1,161 @@
+/*
+Copyright (C) 2019 by Martin Langlotz aka stackshadow
+
+This file is part of gopilot, an rewrite of the copilot-project in go
+
+gopilot is free software: you can redistribute it and/or modify
+it under the terms of the GNU Lesser General Public License as published by
+the Free Software Foundation, version 3 of this License
+
+gopilot is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License
+along with gopilot.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package pluginctls
+
+import (
+	"core/msgbus"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// options
+var heartbeatInterval time.Duration // send a ping every interval, 0 disable heartbeats
+var heartbeatMiss int               // after this count of missed pongs, the session is dead, at least 1
+
+type heartbeatPayload struct {
+	Send    int64 `json:"t0"` // ping send ( local clock of the sender )
+	Receive int64 `json:"t1"` // ping received ( remote clock )
+	Answer  int64 `json:"t2"` // pong send ( remote clock )
+}
+
+type msgNodeLatency struct {
+	Node        string  `json:"node"`
+	RTT         float64 `json:"rtt"`         // in milliseconds
+	ClockOffset float64 `json:"clockOffset"` // in milliseconds
+}
+
+// heartbeatLatency calculate the round-trip-time and the clock-offset of the remote node
+// pongReceived is the time ( local clock ) when the pong arrived
+func heartbeatLatency(pong heartbeatPayload, pongReceived time.Time) (time.Duration, time.Duration) {
+
+	t0 := pong.Send
+	t1 := pong.Receive
+	t2 := pong.Answer
+	t3 := pongReceived.UnixNano()
+
+	rtt := time.Duration((t3 - t0) - (t2 - t1))
+	offset := time.Duration(((t1 - t0) + (t2 - t3)) / 2)
+
+	return rtt, offset
+}
+
+// heartbeatRun send pings until stop is closed
+// if the remote node dont answer heartbeatMiss times, the connection will be closed
+func (curSession *tlsSession) heartbeatRun(stop chan bool) {
+
+	if heartbeatInterval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(heartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		curSession.heartbeatMutex.Lock()
+		missed := curSession.heartbeatMissed
+		supported := curSession.heartbeatSupported
+		curSession.heartbeatMissed++
+		curSession.heartbeatMutex.Unlock()
+
+		// older nodes dont answer to pings, so we only check nodes with hello or which already answered once
+		// the misses are counted from the first ping
+		if supported && missed >= heartbeatMiss {
+			curSession.logging.Error("HEARTBEAT", fmt.Sprintf(
+				"No answer from '%s' for %d heartbeats, close connection",
+				curSession.remoteNodeName, missed,
+			))
+			curSession.plugin.Publish(curSession.instance.config.NodeName(), curSession.instance.config.NodeName(), "tls", "nodeUnreachable", curSession.remoteNodeName)
+			curSession.conn.Close()
+			return
+		}
+
+		payloadBytes, _ := json.Marshal(heartbeatPayload{Send: time.Now().UnixNano()})
+		err := curSession.writeData(
+			curSession.instance.config.NodeName(), curSession.remoteNodeName,
+			"heartbeat", "ping", string(payloadBytes),
+		)
+		if err != nil {
+			curSession.logging.Error("HEARTBEAT", err.Error())
+			curSession.conn.Close()
+			return
+		}
+	}
+}
+
+// heartbeatAlive is called for every message we get from the remote node
+func (curSession *tlsSession) heartbeatAlive() {
+	curSession.heartbeatMutex.Lock()
+	curSession.heartbeatMissed = 0
+	curSession.heartbeatMutex.Unlock()
+}
+
+// heartbeatOnMessage handle ping and pong from the remote node
+// received is the time when the message was read from the connection
+func (curSession *tlsSession) heartbeatOnMessage(message *msgbus.Msg, received time.Time) {
+
+	var payload heartbeatPayload
+	err := json.Unmarshal([]byte(message.Payload), &payload)
+	if err != nil {
+		curSession.logging.Error("HEARTBEAT", err.Error())
+		return
+	}
+
+	if message.Command == "ping" {
+		payload.Receive = received.UnixNano()
+		payload.Answer = time.Now().UnixNano()
+
+		payloadBytes, _ := json.Marshal(payload)
+		err := curSession.writeData(
+			curSession.instance.config.NodeName(), curSession.remoteNodeName,
+			"heartbeat", "pong", string(payloadBytes),
+		)
+		if err != nil {
+			curSession.logging.Error("HEARTBEAT", err.Error())
+		}
+		return
+	}
+
+	if message.Command == "pong" {
+
+		curSession.heartbeatMutex.Lock()
+		curSession.heartbeatSupported = true
+		curSession.heartbeatMutex.Unlock()
+
+		rtt, offset := heartbeatLatency(payload, received)
+		curSession.instance.nodes.SetRTT(curSession.remoteNodeName, rtt)
+		curSession.instance.nodes.SetClockOffset(curSession.remoteNodeName, offset)
+
+		curSession.logging.Debug("HEARTBEAT", fmt.Sprintf("RTT: %s Offset: %s", rtt, offset))
+
+		latencyBytes, _ := json.Marshal(msgNodeLatency{
+			Node:        curSession.remoteNodeName,
+			RTT:         float64(rtt) / float64(time.Millisecond),
+			ClockOffset: float64(offset) / float64(time.Millisecond),
+		})
+		curSession.plugin.Publish(curSession.instance.config.NodeName(), curSession.instance.config.NodeName(), "tls", "nodeLatency", string(latencyBytes))
+		return
+	}
+}
@@ -0,0 +1,182 @@
+/*
+Copyright (C) 2019 by Martin Langlotz aka stackshadow
+
+This file is part of gopilot, an rewrite of the copilot-project in go
+
+gopilot is free software: you can redistribute it and/or modify
+it under the terms of the GNU Lesser General Public License as published by
+the Free Software Foundation, version 3 of this License
+
+gopilot is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License
+along with gopilot.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package pluginctls
+
+/*
+Hello exchange after the TLS-handshake
+
+Nodes that support the hello announce the ALPN-protocol "gopilot/2" inside the TLS-handshake.
+Only if both nodes agreed on it, both send directly after the handshake:
+hello/hello {"protocol":2, "version":"<git-version>", "date":"..", "plugins":["CORE","TLS",..], "features":["deflate","framing"]}
+
+Features that both nodes have are used for the session ( options ).
+With "deflate" messages bigger than -compression.threshold are compressed, if this saves bytes.
+The capabilities and options of the remote node are saved in the runtime-state of the node ( co/getNodes ).
+Older nodes dont announce the ALPN-protocol, with them we use the protocol without hello.
+The version and date are set by main with SetVersion.
+Signing of single messages is not implemented yet, so the feature "signing" is not announced.
+*/
+
+import (
+	"core/nodes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+const protocolVersion = 2
+const alpnProtocol = "gopilot/2"
+const helloTimeout = time.Second * 10
+
+// the build of this node, announced inside the hello
+var buildVersion string
+var buildDate string
+
+// SetVersion set the build-version and -date of this node
+func SetVersion(version, date string) {
+	buildVersion = version
+	buildDate = date
+}
+
+const (
+	featureFraming = "framing"
+	featureDeflate = "deflate"
+)
+
+// localFeatures return the features this node support
+func localFeatures() []string {
+	if compression {
+		return []string{featureDeflate, featureFraming}
+	}
+	return []string{featureFraming}
+}
+
+// localCapabilities return what we announce inside the hello
+func (curInstance *instance) localCapabilities() nodes.Capabilities {
+
+	plugins := make([]string, 0)
+	for _, pluginName := range curInstance.bus.PluginNames() {
+		if strings.HasPrefix(pluginName, "SESSION-") {
+			continue
+		}
+		plugins = append(plugins, pluginName)
+	}
+
+	return nodes.Capabilities{
+		Protocol: protocolVersion,
+		Version:  buildVersion,
+		Date:     buildDate,
+		Plugins:  plugins,
+		Features: localFeatures(),
+	}
+}
+
+// negotiateOptions return the features which both nodes support, sorted
+func negotiateOptions(localFeatures, remoteFeatures []string) []string {
+
+	options := make([]string, 0)
+	for _, localFeature := range localFeatures {
+		for _, remoteFeature := range remoteFeatures {
+			if localFeature == remoteFeature {
+				options = append(options, localFeature)
+				break
+			}
+		}
+	}
+	sort.Strings(options)
+
+	return options
+}
+
+// handleHello send our hello and read the hello of the remote node
+func (curSession *tlsSession) handleHello() bool {
+
+	helloBytes, _ := json.Marshal(curSession.instance.localCapabilities())
+	err := curSession.writeData(curSession.instance.config.NodeName(), curSession.remoteNodeName, "hello", "hello", string(helloBytes))
+	if err != nil {
+		curSession.logging.Error("HELLO", err.Error())
+		return false
+	}
+
+	curSession.conn.SetReadDeadline(time.Now().Add(helloTimeout))
+	message, err := curSession.readMsg()
+	curSession.conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		return false
+	}
+	if message.Group != "hello" || message.Command != "hello" {
+		curSession.logging.Error("HELLO", fmt.Sprintf("We expect the hello, but we get '%s/%s'", message.Group, message.Command))
+		return false
+	}
+
+	var remoteCapabilities nodes.Capabilities
+	err = json.Unmarshal([]byte(message.Payload), &remoteCapabilities)
+	if err != nil {
+		curSession.logging.Error("HELLO", err.Error())
+		return false
+	}
+	if remoteCapabilities.Protocol < protocolVersion {
+		curSession.logging.Error("HELLO", fmt.Sprintf("Protocol %d of remote node is not supported", remoteCapabilities.Protocol))
+		return false
+	}
+
+	curSession.remoteCapabilities = remoteCapabilities
+	curSession.options = negotiateOptions(localFeatures(), remoteCapabilities.Features)
+	curSession.applyOptions()
+
+	// every node with a hello answer to heartbeats
+	curSession.heartbeatMutex.Lock()
+	curSession.heartbeatSupported = true
+	curSession.heartbeatMutex.Unlock()
+
+	curSession.logging.Info("HELLO", fmt.Sprintf("'%s' run version %s", curSession.remoteNodeName, remoteCapabilities.Version),
+		"protocol", remoteCapabilities.Protocol, "options", strings.Join(curSession.options, ","),
+	)
+	return true
+}
+
+// hasOption return true if both nodes use the feature in this session
+func (curSession *tlsSession) hasOption(feature string) bool {
+	for _, option := range curSession.options {
+		if option == feature {
+			return true
+		}
+	}
+	return false
+}
+
+// applyOptions switch the session to the negotiated options
+func (curSession *tlsSession) applyOptions() {
+	curSession.writeMutex.Lock()
+	defer curSession.writeMutex.Unlock()
+
+	if curSession.hasOption(featureFraming) {
+		curSession.framing = true
+
+		// compressed messages only exist inside frames
+		if curSession.hasOption(featureDeflate) {
+			curSession.compressThreshold = compressionThreshold
+			if curSession.compressThreshold < 1 {
+				curSession.compressThreshold = 1
+			}
+		}
+	}
+}
@@ -0,0 +1,166 @@
+/*
+Copyright (C) 2019 by Martin Langlotz aka stackshadow
+
+This file is part of gopilot, an rewrite of the copilot-project in go
+
+gopilot is free software: you can redistribute it and/or modify
+it under the terms of the GNU Lesser General Public License as published by
+the Free Software Foundation, version 3 of this License
+
+gopilot is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License
+along with gopilot.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package pluginctls
+
+/*
+Every node inside this process is an instance with its own config, nodes, messagebus and sessions.
+
+The process run the defaultInstance, which use the Default-objects of the core packages.
+Tests start more instances with newInstance(), so several nodes can talk to each other inside one process.
+The options from the command line are shared by all instances.
+*/
+
+import (
+	"core/clog"
+	"core/config"
+	"core/msgbus"
+	"core/nodes"
+	"fmt"
+	"net"
+	"sync"
+)
+
+type instance struct {
+	config *config.Config
+	nodes  *nodes.Registry
+	bus    *msgbus.Bus
+
+	plugin  msgbus.Plugin
+	logging clog.Logger
+
+	sessionNo      int
+	sessionNoMutex sync.Mutex
+
+	// nodes we already try to connect to
+	connecting      map[string]bool
+	connectingMutex sync.Mutex
+
+	// established sessions by remote node name
+	sessions      map[string]*tlsSession
+	sessionsMutex sync.Mutex
+
+	connectStates      map[string]msgConnectState
+	connectStatesMutex sync.Mutex
+
+	// new requests per source ip
+	pendingRates      map[string]*pendingRate
+	pendingRatesMutex sync.Mutex
+
+	caEnrollMutex sync.Mutex
+	caEnrollNode  string // we only accept a certificate from the CA-node we asked
+
+	rotationMutex sync.Mutex
+	rotation      *certRotation // only one rotation can run
+
+	enrollMutex sync.Mutex
+
+	// stop() close done and all listeners
+	done           chan struct{}
+	listeners      []net.Listener
+	listenersMutex sync.Mutex
+}
+
+// the instance of this process
+var defaultInstance = newInstance(config.Default, nodes.Default, msgbus.Default)
+
+// newInstance create an instance which is not started
+func newInstance(nodeConfig *config.Config, nodeRegistry *nodes.Registry, bus *msgbus.Bus) *instance {
+	return &instance{
+		config:        nodeConfig,
+		nodes:         nodeRegistry,
+		bus:           bus,
+		logging:       clog.New("TLS"),
+		connecting:    make(map[string]bool),
+		sessions:      make(map[string]*tlsSession),
+		connectStates: make(map[string]msgConnectState),
+		pendingRates:  make(map[string]*pendingRate),
+		done:          make(chan struct{}),
+	}
+}
+
+// start register the instance on its messagebus, serve and connect to the nodes of its config
+func (curInstance *instance) start() {
+
+	// register plugin on messagebus
+	curInstance.plugin = curInstance.bus.NewPlugin("TLS")
+	curInstance.plugin.Register()
+	curInstance.plugin.ListenForGroup("tls", curInstance.onMessage)
+
+	// remove stale requests
+	go curInstance.pendingExpireRun()
+
+	// okay, get server-config
+	curInstance.nodes.IterateNodes(func(node nodes.Node) {
+
+		if node.Type == nodes.NodeTypeServer {
+			go curInstance.serve(net.JoinHostPort(node.Host, fmt.Sprint(node.Port)))
+		}
+
+		if node.DialOut() {
+			curInstance.connectNode(node)
+		}
+	})
+}
+
+// stop close all listeners and sessions, reconnects are not started anymore
+func (curInstance *instance) stop() {
+	close(curInstance.done)
+
+	curInstance.listenersMutex.Lock()
+	for _, listener := range curInstance.listeners {
+		listener.Close()
+	}
+	curInstance.listenersMutex.Unlock()
+
+	for _, curSession := range curInstance.getSessions() {
+		curSession.conn.Close()
+	}
+}
+
+// stopped return true after stop()
+func (curInstance *instance) stopped() bool {
+	select {
+	case <-curInstance.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// remoteDenied return true and answer with an error, if the message come from another node
+// administrative commands are only accepted from this node and its webclients
+func (curInstance *instance) remoteDenied(message *msgbus.Msg, command string) bool {
+
+	if msgbus.AddressNode(message.NodeSource) == curInstance.config.NodeName() {
+		return false
+	}
+
+	curInstance.logging.Error("DENIED", fmt.Sprintf("'%s' is not allowed to send '%s'", message.NodeSource, command))
+	message.Answer(&curInstance.plugin, "error", fmt.Sprintf("'%s' is only accepted from '%s'", command, curInstance.config.NodeName()))
+	return true
+}
+
+// nextSessionNo return the number for a new session
+func (curInstance *instance) nextSessionNo() string {
+	curInstance.sessionNoMutex.Lock()
+	defer curInstance.sessionNoMutex.Unlock()
+
+	curInstance.sessionNo++
+	return fmt.Sprintf("%d", curInstance.sessionNo)
+}
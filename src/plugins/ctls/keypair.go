@@ -0,0 +1,262 @@
+/*
+Copyright (C) 2019 by Martin Langlotz aka stackshadow
+
+This file is part of gopilot, an rewrite of the copilot-project in go
+
+gopilot is free software: you can redistribute it and/or modify
+it under the terms of the GNU Lesser General Public License as published by
+the Free Software Foundation, version 3 of this License
+
+gopilot is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License
+along with gopilot.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package pluginctls
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"strings"
+	"time"
+)
+
+// options
+var certSubject string
+var certKeyType string
+var certLifetime time.Duration
+
+const defaultCertSubject = "/C=DE/ST=UNKNOWN/L=UNKNOWN/O=COPILOTD/OU=DAEMON"
+
+// ParseSubject convert an openssl-like subject ( /C=DE/O=COPILOTD/OU=DAEMON ) to an pkix.Name
+// The CN is always set to the node name
+func ParseSubject(subject, nodeName string) (pkix.Name, error) {
+
+	name := pkix.Name{CommonName: nodeName}
+
+	for _, part := range strings.Split(subject, "/") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		keyValue := strings.SplitN(part, "=", 2)
+		if len(keyValue) != 2 {
+			return name, fmt.Errorf("Subject part '%s' is not key=value", part)
+		}
+		value := strings.TrimSpace(keyValue[1])
+
+		switch strings.ToUpper(strings.TrimSpace(keyValue[0])) {
+		case "C":
+			name.Country = append(name.Country, value)
+		case "ST":
+			name.Province = append(name.Province, value)
+		case "L":
+			name.Locality = append(name.Locality, value)
+		case "O":
+			name.Organization = append(name.Organization, value)
+		case "OU":
+			name.OrganizationalUnit = append(name.OrganizationalUnit, value)
+		case "CN":
+			// the CN is our node name
+		default:
+			return name, fmt.Errorf("Unknown subject key '%s'", keyValue[0])
+		}
+	}
+
+	return name, nil
+}
+
+// generateKey create a new private key, keyType can be ecdsa-p256, ecdsa-p384, ecdsa-p521, rsa-2048 or rsa-4096
+func generateKey(keyType string) (crypto.Signer, error) {
+	switch strings.ToLower(keyType) {
+	case "ecdsa-p256":
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case "ecdsa-p384":
+		return ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	case "ecdsa-p521":
+		return ecdsa.GenerateKey(elliptic.P521(), rand.Reader)
+	case "rsa-2048":
+		return rsa.GenerateKey(rand.Reader, 2048)
+	case "rsa-4096":
+		return rsa.GenerateKey(rand.Reader, 4096)
+	}
+	return nil, fmt.Errorf("Unknown key type '%s'", keyType)
+}
+
+// writeKey save the private key as PEM, only the owner can read it
+func writeKey(keyFileName string, key crypto.Signer) error {
+
+	var keyBlock pem.Block
+
+	switch privateKey := key.(type) {
+	case *ecdsa.PrivateKey:
+		keyBytes, err := x509.MarshalECPrivateKey(privateKey)
+		if err != nil {
+			return err
+		}
+		keyBlock = pem.Block{Type: "EC PRIVATE KEY", Bytes: keyBytes}
+	case *rsa.PrivateKey:
+		keyBlock = pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(privateKey)}
+	default:
+		return fmt.Errorf("Unsupported key %T", key)
+	}
+
+	keyFile, err := os.OpenFile(keyFileName, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+
+	err = pem.Encode(keyFile, &keyBlock)
+	if err != nil {
+		keyFile.Close()
+		os.Remove(keyFileName)
+		return err
+	}
+
+	return keyFile.Close()
+}
+
+// readKey load an private key, this also read keys created by openssl
+func readKey(keyFileName string) (crypto.Signer, error) {
+
+	keyBytes, err := ioutil.ReadFile(keyFileName)
+	if err != nil {
+		return nil, err
+	}
+
+	// openssl ecparam write an "EC PARAMETERS"-block before the key
+	for {
+		var keyBlock *pem.Block
+		keyBlock, keyBytes = pem.Decode(keyBytes)
+		if keyBlock == nil {
+			break
+		}
+
+		switch keyBlock.Type {
+		case "EC PRIVATE KEY":
+			return x509.ParseECPrivateKey(keyBlock.Bytes)
+		case "RSA PRIVATE KEY":
+			return x509.ParsePKCS1PrivateKey(keyBlock.Bytes)
+		case "PRIVATE KEY":
+			key, err := x509.ParsePKCS8PrivateKey(keyBlock.Bytes)
+			if err != nil {
+				return nil, err
+			}
+			signer, ok := key.(crypto.Signer)
+			if !ok {
+				return nil, fmt.Errorf("Unsupported key %T in '%s'", key, keyFileName)
+			}
+			return signer, nil
+		}
+	}
+
+	return nil, fmt.Errorf("No private key found in '%s'", keyFileName)
+}
+
+// createCertificate create a self-signed certificate for key
+func createCertificate(certFileName string, key crypto.Signer, subject pkix.Name, lifetime time.Duration) error {
+
+	serialNumber, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+
+	keyUsage := x509.KeyUsageDigitalSignature
+	if _, isRSA := key.(*rsa.PrivateKey); isRSA {
+		keyUsage |= x509.KeyUsageKeyEncipherment
+	}
+
+	now := time.Now()
+	template := x509.Certificate{
+		SerialNumber:          serialNumber,
+		Subject:               subject,
+		DNSNames:              []string{subject.CommonName},
+		NotBefore:             now.Add(-time.Hour), // allow a bit of clock skew
+		NotAfter:              now.Add(lifetime),
+		KeyUsage:              keyUsage,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+	}
+
+	certBytes, err := x509.CreateCertificate(rand.Reader, &template, &template, key.Public(), key)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(certFileName, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certBytes}), 0644)
+}
+
+// CreateKeyPair create a certificate and key for nodeName inside the configpath
+// Existing files are kept, a missing certificate is created for the existing key
+func CreateKeyPair(nodeName string) error {
+	return defaultInstance.CreateKeyPair(nodeName)
+}
+
+// CreateKeyPair create a certificate and key for nodeName inside the configpath
+// Existing files are kept, a missing certificate is created for the existing key
+func (curInstance *instance) CreateKeyPair(nodeName string) error {
+
+	keyFileName, certFileName := curInstance.getKeyPairPath(nodeName)
+
+	subject, err := ParseSubject(certSubject, nodeName)
+	if err != nil {
+		curInstance.logging.Error("CREATEKEY", err.Error())
+		return err
+	}
+
+	var key crypto.Signer
+
+	if keyInfo, err := os.Stat(keyFileName); os.IsNotExist(err) {
+		curInstance.logging.Info("CREATEKEY", fmt.Sprintf("Create %s.key", nodeName), "type", certKeyType)
+
+		key, err = generateKey(certKeyType)
+		if err != nil {
+			curInstance.logging.Error("CREATEKEY", err.Error())
+			return err
+		}
+
+		err = writeKey(keyFileName, key)
+		if err != nil {
+			curInstance.logging.Error("CREATEKEY", err.Error())
+			return err
+		}
+	} else if err == nil && keyInfo.Mode().Perm()&0077 != 0 {
+		curInstance.logging.Info("CREATEKEY", fmt.Sprintf("%s.key is readable by others, fix the permissions", nodeName), "mode", keyInfo.Mode().Perm())
+		os.Chmod(keyFileName, 0600)
+	}
+
+	if _, err := os.Stat(certFileName); os.IsNotExist(err) {
+
+		if key == nil {
+			key, err = readKey(keyFileName)
+			if err != nil {
+				curInstance.logging.Error("CREATEKEY", err.Error())
+				return err
+			}
+		}
+
+		curInstance.logging.Info("CREATEKEY", fmt.Sprintf("Create %s.crt", nodeName), "subject", subject.String(), "lifetime", certLifetime)
+		err = createCertificate(certFileName, key, subject, certLifetime)
+		if err != nil {
+			curInstance.logging.Error("CREATEKEY", err.Error())
+			return err
+		}
+	}
+
+	return nil
+}
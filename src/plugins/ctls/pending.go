@@ -0,0 +1,255 @@
+/*
+Copyright (C) 2019 by Martin Langlotz aka stackshadow
+
+This file is part of gopilot, an rewrite of the copilot-project in go
+
+gopilot is free software: you can redistribute it and/or modify
+it under the terms of the GNU Lesser General Public License as published by
+the Free Software Foundation, version 3 of this License
+
+gopilot is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License
+along with gopilot.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package pluginctls
+
+/*
+Pending requests of nodes, whose key is not accepted yet
+
+When a node with an unknown key connect to us, the fingerprint is saved as request and
+tls/nodeReq {"node":"nodeb", "fingerprint":"AB:CD:..", "remoteAddr":"10.0.0.2:53211"} is published.
+
+tls/getPendingNodes
+-> tls/pendingNodes [{"node":"nodeb", "fingerprint":"AB:CD:..", "remoteAddr":"..", "time":"..", "subject":"..", "issuer":"..", "notAfter":"..", "expires":".."}]
+
+Requests older than -nodeReq.expiry are removed:
+-> tls/nodeReqExpired nodeb
+
+A single IP can create only -nodeReq.rateLimit new requests in -nodeReq.rateWindow,
+other connections with unknown keys are closed. This count all connections with an unknown key,
+also of unknown nodes that are never saved as request.
+
+tls/nodeAccept and tls/nodeReject answer with the node-record like co/getNodes: {"nodeb":{...}}
+getPendingNodes, nodeAccept and nodeReject are only accepted from this node and its webclients.
+*/
+
+import (
+	"core/msgbus"
+	"core/nodes"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"net"
+	"sort"
+	"time"
+)
+
+// options
+var pendingExpiry time.Duration
+var pendingRateLimit int
+var pendingRateWindow time.Duration
+
+const pendingExpireInterval = time.Minute
+
+type msgPendingNode struct {
+	Node        string `json:"node"`
+	Fingerprint string `json:"fingerprint"`
+	nodes.NodeRequest
+	Expires *time.Time `json:"expires,omitempty"` // not set, if requests dont expire
+}
+
+// new requests per source ip
+type pendingRate struct {
+	windowStart time.Time
+	count       int
+}
+
+// pendingAllowed return true, if the remoteAddr can create a new request now
+func (curInstance *instance) pendingAllowed(remoteAddr string, now time.Time) bool {
+
+	if pendingRateLimit <= 0 {
+		return true
+	}
+
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+
+	curInstance.pendingRatesMutex.Lock()
+	defer curInstance.pendingRatesMutex.Unlock()
+
+	rate, ok := curInstance.pendingRates[host]
+	if !ok || now.Sub(rate.windowStart) >= pendingRateWindow {
+		rate = &pendingRate{windowStart: now}
+		curInstance.pendingRates[host] = rate
+	}
+	if rate.count >= pendingRateLimit {
+		return false
+	}
+	rate.count++
+
+	return true
+}
+
+// newPendingRequest return the details of the request of peerCert
+// a request with the same fingerprint keep its time, so it expire anyway
+func newPendingRequest(node nodes.Node, peerCert *x509.Certificate, remoteAddr string, now time.Time) *nodes.NodeRequest {
+
+	request := nodes.NodeRequest{
+		RemoteAddr: remoteAddr,
+		Time:       now,
+		Subject:    peerCert.Subject.String(),
+		Issuer:     peerCert.Issuer.String(),
+		NotAfter:   peerCert.NotAfter,
+	}
+	if node.PeerRequest != nil && node.PeerFingerprintReq == Fingerprint(peerCert) {
+		request.Time = node.PeerRequest.Time
+	}
+
+	return &request
+}
+
+// pendingNodes return all requests, the oldest first
+func (curInstance *instance) pendingNodes() []msgPendingNode {
+
+	pending := make([]msgPendingNode, 0)
+	curInstance.nodes.IterateNodes(func(node nodes.Node) {
+		if node.PeerFingerprintReq == "" {
+			return
+		}
+
+		pendingNode := msgPendingNode{
+			Node:        node.Name,
+			Fingerprint: node.PeerFingerprintReq,
+		}
+		if node.PeerRequest != nil {
+			pendingNode.NodeRequest = *node.PeerRequest
+			if pendingExpiry > 0 {
+				expires := node.PeerRequest.Time.Add(pendingExpiry)
+				pendingNode.Expires = &expires
+			}
+		}
+		pending = append(pending, pendingNode)
+	})
+
+	sort.Slice(pending, func(i, j int) bool {
+		return pending[i].Time.Before(pending[j].Time)
+	})
+
+	return pending
+}
+
+// expirePending remove all requests older than pendingExpiry and return the node names
+// requests of older versions have no time, they expire pendingExpiry after the first check
+func (curInstance *instance) expirePending(now time.Time) []string {
+
+	expired := make([]string, 0)
+	if pendingExpiry <= 0 {
+		return expired
+	}
+
+	// only collect the names, the nodes can be changed until we save them
+	candidates := make([]string, 0)
+	curInstance.nodes.IterateNodes(func(node nodes.Node) {
+		if node.PeerFingerprintReq != "" {
+			candidates = append(candidates, node.Name)
+		}
+	})
+
+	for _, nodeName := range candidates {
+		curInstance.nodes.Update(nodeName, func(node *nodes.Node) bool {
+			if node.PeerFingerprintReq == "" {
+				return false
+			}
+
+			if node.PeerRequest == nil {
+				node.PeerRequest = &nodes.NodeRequest{Time: now}
+				return true
+			}
+
+			if now.Sub(node.PeerRequest.Time) < pendingExpiry {
+				return false
+			}
+
+			node.PeerFingerprintReq = ""
+			node.PeerCertSignatureReq = ""
+			node.PeerRequest = nil
+			expired = append(expired, node.Name)
+			return true
+		})
+	}
+
+	// forget old rate-windows
+	curInstance.pendingRatesMutex.Lock()
+	for host, rate := range curInstance.pendingRates {
+		if now.Sub(rate.windowStart) >= pendingRateWindow {
+			delete(curInstance.pendingRates, host)
+		}
+	}
+	curInstance.pendingRatesMutex.Unlock()
+
+	return expired
+}
+
+// pendingExpireRun remove stale requests until the instance is stopped
+func (curInstance *instance) pendingExpireRun() {
+	for {
+		for _, nodeName := range curInstance.expirePending(time.Now()) {
+			curInstance.logging.Info("PENDING", fmt.Sprintf("Request of '%s' expired", nodeName))
+			curInstance.plugin.Publish(curInstance.config.NodeName(), curInstance.config.NodeName(), "tls", "nodeReqExpired", nodeName)
+		}
+
+		select {
+		case <-curInstance.done:
+			return
+		case <-time.After(pendingExpireInterval):
+		}
+	}
+}
+
+// nodeRecord return the node as json like co/getNodes
+func (curInstance *instance) nodeRecord(nodeName string) (string, error) {
+
+	node, err := curInstance.nodes.Get(nodeName)
+	if err != nil {
+		return "", err
+	}
+
+	recordBytes, err := json.Marshal(map[string]nodes.NodeInfo{
+		node.Name: curInstance.nodes.Info(node),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return string(recordBytes), nil
+}
+
+// onPendingMessage handle all commands for pending requests, return true if the command was handled
+func (curInstance *instance) onPendingMessage(message *msgbus.Msg, command, payload string) bool {
+
+	if command != "getPendingNodes" {
+		return false
+	}
+	if message.NodeTarget != curInstance.config.NodeName() {
+		return true
+	}
+	if curInstance.remoteDenied(message, command) {
+		return true
+	}
+
+	pendingBytes, err := json.Marshal(curInstance.pendingNodes())
+	if err != nil {
+		message.Answer(&curInstance.plugin, "error", err.Error())
+		return true
+	}
+
+	message.Answer(&curInstance.plugin, "pendingNodes", string(pendingBytes))
+	return true
+}
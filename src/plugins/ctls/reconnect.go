@@ -0,0 +1,283 @@
+/*
+Copyright (C) 2019 by Martin Langlotz aka stackshadow
+
+This file is part of gopilot, an rewrite of the copilot-project in go
+
+gopilot is free software: you can redistribute it and/or modify
+it under the terms of the GNU Lesser General Public License as published by
+the Free Software Foundation, version 3 of this License
+
+gopilot is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License
+along with gopilot.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package pluginctls
+
+/*
+Reconnect to client-nodes with exponential backoff
+
+The policy can be set per node inside the config ( nodes/<name>/reconnect ) or with
+tls/nodeReconnectSet {"name":"nodea", "policy":{"initialDelay":1, "maxDelay":300, "jitter":0.2, "maxAttempts":0}}
+-> tls/nodeReconnectSetOk <name>
+A policy of null use the defaults from the command line again.
+The initialDelay must be at least one second, shorter delays ( also by the jitter ) are raised to one second.
+nodeReconnectSet is only accepted from this node and its webclients.
+
+Events for the UI:
+tls/connectState {"node":"nodea", "state":"connecting", "attempt":1}
+tls/connectState {"node":"nodea", "state":"connected"}
+tls/connectState {"node":"nodea", "state":"backoff", "attempt":2, "next":"2019-..", "error":".."}
+tls/connectState {"node":"nodea", "state":"gaveUp", "attempt":10, "error":".."}
+tls/getConnectStates -> tls/connectStates {"nodea":{...}}
+*/
+
+import (
+	"core/msgbus"
+	"core/nodes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/rand"
+	"net"
+	"strconv"
+	"time"
+)
+
+const (
+	connectStateConnecting = "connecting"
+	connectStateConnected  = "connected"
+	connectStateBackoff    = "backoff"
+	connectStateGaveUp     = "gaveUp"
+	connectStateStopped    = "stopped"
+)
+
+type msgConnectState struct {
+	Node    string     `json:"node"`
+	State   string     `json:"state"`
+	Attempt int        `json:"attempt,omitempty"`
+	Next    *time.Time `json:"next,omitempty"` // only for backoff
+	Error   string     `json:"error,omitempty"`
+}
+
+// options
+var reconnectInitialDelay time.Duration
+var reconnectMaxDelay time.Duration
+var reconnectJitter float64
+var reconnectMaxAttempts int
+
+const connectTimeout = time.Second * 10
+
+// the shortest delay between two connects, without it a failing node is dialed in a tight loop
+var minReconnectDelay = time.Second
+
+// reconnectPolicy return the policy of the node or the defaults
+func reconnectPolicy(node nodes.Node) nodes.ReconnectPolicy {
+	if node.Reconnect != nil {
+		return *node.Reconnect
+	}
+	return nodes.ReconnectPolicy{
+		InitialDelay: reconnectInitialDelay.Seconds(),
+		MaxDelay:     reconnectMaxDelay.Seconds(),
+		Jitter:       reconnectJitter,
+		MaxAttempts:  reconnectMaxAttempts,
+	}
+}
+
+// the biggest delay, which fit into a time.Duration
+const maxBackoffSeconds = float64(math.MaxInt64/int64(time.Second)) - 1
+
+// backoffDelay return the delay after failedAttempts failed attempts
+// random is a value between 0.0 and 1.0, the delay is changed by +/- jitter
+func backoffDelay(policy nodes.ReconnectPolicy, failedAttempts int, random float64) time.Duration {
+
+	delay := policy.InitialDelay * math.Pow(2, float64(failedAttempts))
+	if policy.MaxDelay > 0 && delay > policy.MaxDelay {
+		delay = policy.MaxDelay
+	}
+
+	jitter := math.Min(math.Max(policy.Jitter, 0), 1)
+	delay = delay * (1 + jitter*(2*random-1))
+
+	if delay < minReconnectDelay.Seconds() {
+		delay = minReconnectDelay.Seconds()
+	}
+	// without a maxDelay the delay can grow bigger than a time.Duration
+	if delay > maxBackoffSeconds {
+		delay = maxBackoffSeconds
+	}
+	return time.Duration(delay * float64(time.Second))
+}
+
+// publishConnectState remember the state and inform the UI
+func (curInstance *instance) publishConnectState(newState msgConnectState) {
+
+	curInstance.connectStatesMutex.Lock()
+	curInstance.connectStates[newState.Node] = newState
+	curInstance.connectStatesMutex.Unlock()
+
+	stateBytes, _ := json.Marshal(newState)
+	curInstance.plugin.Publish(curInstance.config.NodeName(), curInstance.config.NodeName(), "tls", "connectState", string(stateBytes))
+}
+
+// connect to the client-node nodeName until we give up or the node is not a client anymore
+func (curInstance *instance) connect(nodeName string) {
+
+	defer func() {
+		curInstance.connectingMutex.Lock()
+		delete(curInstance.connecting, nodeName)
+		curInstance.connectingMutex.Unlock()
+	}()
+
+	_, err := curInstance.localCertificate()
+	if err != nil {
+		curInstance.logging.Error("CONNECT", err.Error())
+		return
+	}
+
+	tlsConfig := curInstance.clientTLSConfig(nodeName)
+	dialer := &net.Dialer{Timeout: connectTimeout}
+
+	failedAttempts := 0
+	for {
+
+		// the node can be changed or deleted in the meantime
+		node, err := curInstance.nodes.Get(nodeName)
+		if err != nil || !node.DialOut() {
+			curInstance.logging.Info("CONNECT", fmt.Sprintf("We dont connect to '%s' anymore, stop connecting", nodeName))
+			curInstance.publishConnectState(msgConnectState{Node: nodeName, State: connectStateStopped})
+			return
+		}
+		clientString := net.JoinHostPort(node.Host, strconv.Itoa(node.Port))
+		if node.URL != "" {
+			clientString = node.URL
+		}
+
+		curInstance.publishConnectState(msgConnectState{Node: nodeName, State: connectStateConnecting, Attempt: failedAttempts + 1})
+		curInstance.logging.Info("CONNECT", fmt.Sprintf("Try to connect to %s", clientString), "node", nodeName, "attempt", failedAttempts+1)
+
+		var errorMessage string
+		var conn net.Conn
+		if node.URL != "" {
+			conn, err = dialWebsocket(node, tlsConfig)
+		} else {
+			conn, err = tls.DialWithDialer(dialer, "tcp", clientString, tlsConfig)
+		}
+		if err != nil {
+			errorMessage = err.Error()
+			curInstance.logging.Error("CONNECT", fmt.Sprintf("Failed to connect: %s", errorMessage), "node", nodeName)
+		} else {
+			established := curInstance.NewSession(
+				curInstance.nextSessionNo(),
+				nodes.NodeTypeClient, conn,
+			)
+			conn.Close()
+
+			if established {
+				failedAttempts = 0
+			} else {
+				errorMessage = "Session was not established"
+			}
+		}
+
+		policy := reconnectPolicy(node)
+		if errorMessage != "" {
+			failedAttempts++
+
+			if policy.MaxAttempts > 0 && failedAttempts >= policy.MaxAttempts {
+				curInstance.logging.Error("CONNECT", fmt.Sprintf("Give up connecting to '%s' after %d attempts", nodeName, failedAttempts))
+				curInstance.publishConnectState(msgConnectState{
+					Node: nodeName, State: connectStateGaveUp, Attempt: failedAttempts, Error: errorMessage,
+				})
+				return
+			}
+		}
+
+		delay := backoffDelay(policy, failedAttempts, rand.Float64())
+		next := time.Now().Add(delay)
+		curInstance.publishConnectState(msgConnectState{
+			Node: nodeName, State: connectStateBackoff, Attempt: failedAttempts + 1, Next: &next, Error: errorMessage,
+		})
+
+		select {
+		case <-curInstance.done:
+			return
+		case <-time.After(delay):
+		}
+	}
+}
+
+type msgReconnectSet struct {
+	Name   string                 `json:"name"`
+	Policy *nodes.ReconnectPolicy `json:"policy"`
+}
+
+// decodeReconnectSet return the request of an nodeReconnectSet-payload
+func decodeReconnectSet(payload string) (msgReconnectSet, error) {
+
+	var reconnectReq msgReconnectSet
+	err := json.Unmarshal([]byte(payload), &reconnectReq)
+	if err != nil {
+		return msgReconnectSet{}, err
+	}
+	if reconnectReq.Name == "" {
+		return msgReconnectSet{}, fmt.Errorf("name is needed")
+	}
+	if reconnectReq.Policy != nil && (reconnectReq.Policy.InitialDelay < minReconnectDelay.Seconds() || reconnectReq.Policy.MaxDelay < 0 ||
+		reconnectReq.Policy.Jitter < 0 || reconnectReq.Policy.Jitter > 1 || reconnectReq.Policy.MaxAttempts < 0) {
+		return msgReconnectSet{}, fmt.Errorf("Invalid reconnect policy")
+	}
+
+	return reconnectReq, nil
+}
+
+// onReconnectMessage handle all reconnect-commands, return true if the command was handled
+func (curInstance *instance) onReconnectMessage(message *msgbus.Msg, command, payload string) bool {
+
+	if command != "nodeReconnectSet" && command != "getConnectStates" {
+		return false
+	}
+	if message.NodeTarget != curInstance.config.NodeName() {
+		return true
+	}
+
+	if command == "nodeReconnectSet" {
+		if curInstance.remoteDenied(message, command) {
+			return true
+		}
+
+		reconnectReq, err := decodeReconnectSet(payload)
+		if err != nil {
+			message.Answer(&curInstance.plugin, "error", err.Error())
+			return true
+		}
+
+		node, err := curInstance.nodes.Get(reconnectReq.Name)
+		if err != nil {
+			message.Answer(&curInstance.plugin, "error", err.Error())
+			return true
+		}
+
+		node.Reconnect = reconnectReq.Policy
+		curInstance.nodes.Save(node)
+
+		message.Answer(&curInstance.plugin, "nodeReconnectSetOk", reconnectReq.Name)
+		return true
+	}
+
+	if command == "getConnectStates" {
+		curInstance.connectStatesMutex.Lock()
+		statesBytes, _ := json.Marshal(curInstance.connectStates)
+		curInstance.connectStatesMutex.Unlock()
+
+		message.Answer(&curInstance.plugin, "connectStates", string(statesBytes))
+		return true
+	}
+
+	return false
+}
@@ -0,0 +1,131 @@
+/*
+Copyright (C) 2019 by Martin Langlotz aka stackshadow
+
+This file is part of gopilot, an rewrite of the copilot-project in go
+
+gopilot is free software: you can redistribute it and/or modify
+it under the terms of the GNU Lesser General Public License as published by
+the Free Software Foundation, version 3 of this License
+
+gopilot is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License
+along with gopilot.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package pluginctls
+
+/*
+Reverse-dial: the direction of the connection is independent of the role of the node
+
+Normally a node connect to its hub ( a client-node ) and the hub wait for its incoming-nodes.
+If the hub can not be reached by the node, for example because the hub is behind NAT,
+the hub connect to the node instead. The session is used in both directions and the roles stay the same:
+only the hub can relay messages and change config-sections of the node.
+
+On the hub ( the host and port of the node are set with tls/nodeAdd ):
+copilotg -newNode edgenode -reverseDial
+On the node:
+copilotg -serverAdress edgenode:4444 -remoteNodeName hub -remoteNodeHost hub:4444 -reverseDial
+
+An existing node can be switched:
+tls/nodeReverseDialSet {"name":"natnode", "reverseDial":true}
+-> tls/nodeReverseDialSetOk natnode
+nodeReverseDialSet is only accepted from this node and its webclients.
+
+The route of the current session is shown in co/getNodes as state.direction ( outgoing / incoming ) and state.remoteAddr
+*/
+
+import (
+	"core/msgbus"
+	"core/nodes"
+	"encoding/json"
+	"fmt"
+)
+
+// options
+var reverseDial bool // newNode or remoteNodeName connect in the other direction
+
+type msgReverseDial struct {
+	Name        string `json:"name"`
+	ReverseDial bool   `json:"reverseDial"`
+}
+
+// decodeReverseDial return the request of an nodeReverseDialSet-payload
+func decodeReverseDial(payload string) (msgReverseDial, error) {
+
+	var reverseReq msgReverseDial
+	err := json.Unmarshal([]byte(payload), &reverseReq)
+	if err != nil {
+		return msgReverseDial{}, err
+	}
+	if reverseReq.Name == "" {
+		return msgReverseDial{}, fmt.Errorf("name is needed")
+	}
+
+	return reverseReq, nil
+}
+
+// setReverseDial change the direction of the connection to the node and return the changed node
+// the type of the node is not changed
+func (curInstance *instance) setReverseDial(nodeName string, reverse bool) (nodes.Node, error) {
+
+	node, err := curInstance.nodes.Get(nodeName)
+	if err != nil {
+		return node, err
+	}
+	if node.Type != nodes.NodeTypeClient && node.Type != nodes.NodeTypeIncoming {
+		return node, fmt.Errorf("Node '%s' is not a client- or incoming-node", nodeName)
+	}
+
+	node.ReverseDial = reverse
+	err = curInstance.nodes.Save(node)
+	if err != nil {
+		return node, err
+	}
+
+	if node.DialOut() {
+		curInstance.logging.Info("REVERSE", fmt.Sprintf("We connect to '%s'", nodeName))
+	} else {
+		curInstance.logging.Info("REVERSE", fmt.Sprintf("We wait for '%s' to connect to us", nodeName))
+	}
+
+	return node, nil
+}
+
+// onReverseMessage handle all reverse-dial-commands, return true if the command was handled
+func (curInstance *instance) onReverseMessage(message *msgbus.Msg, command, payload string) bool {
+
+	if command != "nodeReverseDialSet" {
+		return false
+	}
+	if message.NodeTarget != curInstance.config.NodeName() {
+		return true
+	}
+	if curInstance.remoteDenied(message, command) {
+		return true
+	}
+
+	reverseReq, err := decodeReverseDial(payload)
+	if err != nil {
+		message.Answer(&curInstance.plugin, "error", err.Error())
+		return true
+	}
+
+	node, err := curInstance.setReverseDial(reverseReq.Name, reverseReq.ReverseDial)
+	if err != nil {
+		message.Answer(&curInstance.plugin, "error", err.Error())
+		return true
+	}
+
+	// a running connect-loop stop by itself, when we dont dial anymore
+	if node.DialOut() {
+		curInstance.connectNode(node)
+	}
+
+	message.Answer(&curInstance.plugin, "nodeReverseDialSetOk", reverseReq.Name)
+	return true
+}
@@ -0,0 +1,648 @@
+/*
+Copyright (C) 2019 by Martin Langlotz aka stackshadow
+
+This file is part of gopilot, an rewrite of the copilot-project in go
+
+gopilot is free software: you can redistribute it and/or modify
+it under the terms of the GNU Lesser General Public License as published by
+the Free Software Foundation, version 3 of this License
+
+gopilot is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License
+along with gopilot.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package pluginctls
+
+/*
+Rotation of the certificate and the shared secret over established sessions
+
+tls/rotateCert                  create a new key and certificate, announce it to all connected nodes
+-> tls/rotateCertStarted <fingerprint>
+-> tls/rotateCertReport  {"fingerprint":"..", "activated":true, "updated":[..], "failed":{"node":"error"}, "offline":[..]}
+
+The new certificate is signed with our current key, so connected nodes can update their pin.
+They accept the old fingerprint too, until we activate the new certificate.
+The new certificate is only activated, if all connected nodes accepted it, otherwise it is dropped.
+Nodes which are offline must accept the new fingerprint manually ( -rejectNode / -acceptNode ).
+A certificate signed by the CA is only replaced by a new one of the CA, a node without the CA-key must use tls/caEnroll.
+
+tls/rekey <node>                create a new shared secret for the connection to node -> tls/rekeyStarted <node>
+tls/nodeRekeyed <node>          ( published when the remote node saved the new secret )
+-rekeyInterval 24h              the node which connect create a new secret in this interval
+
+rotateCert and rekey are only accepted from this node and its webclients.
+
+Only the node which connect create a new secret, so both nodes never send one at the same time.
+It keep the new secret as "sharedSecretNext" until the remote node confirm it, the remote node
+keep the old one as "sharedSecretPrev" until it is not used anymore. If the connection break between
+newSecret and newSecretSaved, the next challange accept the old and the new secret.
+
+Inside a session ( group "rotate", never published to the bus ):
+newCert   {"cert":"<PEM>", "proof":"<base64>"}  -> newCertOk <fingerprint> / newCertFailed <error>
+certActive  <fingerprint>                        the new certificate is used, the old fingerprint is not accepted anymore
+certAborted <fingerprint>                        the old certificate is still used, restore the old pin
+newSecret <secret>                               -> newSecretSaved
+*/
+
+import (
+	"core/msgbus"
+	"core/nodes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"time"
+)
+
+type msgNewCert struct {
+	Cert  string `json:"cert"`  // PEM of the new certificate
+	Proof string `json:"proof"` // sha256 of the new certificate, signed with the current key
+}
+
+type rotateReport struct {
+	Fingerprint string            `json:"fingerprint"`
+	Activated   bool              `json:"activated"`
+	Updated     []string          `json:"updated"`
+	Failed      map[string]string `json:"failed"`
+	Offline     []string          `json:"offline"`
+}
+
+type certRotation struct {
+	request msgbus.Msg // the message which start the rotation, we answer to it
+	report  rotateReport
+	pending map[string]bool
+	done    chan bool
+}
+
+// options
+var rekeyInterval time.Duration
+
+const rotateTimeout = time.Second * 10
+
+// proofAlgorithm return the signature algorithm for the proof of a key
+func proofAlgorithm(publicKey crypto.PublicKey) (x509.SignatureAlgorithm, error) {
+	switch publicKey.(type) {
+	case *ecdsa.PublicKey:
+		return x509.ECDSAWithSHA256, nil
+	case *rsa.PublicKey:
+		return x509.SHA256WithRSA, nil
+	}
+	return x509.UnknownSignatureAlgorithm, fmt.Errorf("Unsupported key %T", publicKey)
+}
+
+// createRotationCert create a new key and certificate next to the current one ( .new )
+// and return the message for the other nodes
+func (curInstance *instance) createRotationCert() (msgNewCert, string, error) {
+
+	var newCertMsg msgNewCert
+
+	keyFileName, certFileName := curInstance.getKeyPairPath(curInstance.config.NodeName())
+	newKeyFileName, newCertFileName := keyFileName+".new", certFileName+".new"
+
+	currentKey, err := readKey(keyFileName)
+	if err != nil {
+		return newCertMsg, "", err
+	}
+	currentCert, err := curInstance.loadCertificate(curInstance.config.NodeName())
+	if err != nil {
+		return newCertMsg, "", err
+	}
+
+	// a certificate of the CA is replaced by a new one of the CA
+	caSigned := curInstance.caVerify(currentCert) == nil
+	caKeyFileName, _ := curInstance.getCAPath()
+	if _, err := os.Stat(caKeyFileName); caSigned && err != nil {
+		return newCertMsg, "", fmt.Errorf("Our certificate is signed by the CA, get a new one with tls/caEnroll")
+	}
+
+	subject, err := ParseSubject(certSubject, curInstance.config.NodeName())
+	if err != nil {
+		return newCertMsg, "", err
+	}
+
+	newKey, err := generateKey(certKeyType)
+	if err != nil {
+		return newCertMsg, "", err
+	}
+
+	os.Remove(newKeyFileName)
+	if err := writeKey(newKeyFileName, newKey); err != nil {
+		return newCertMsg, "", err
+	}
+	if caSigned {
+		certBytes, _, err := curInstance.caSign(curInstance.config.NodeName(), newKey.Public())
+		if err != nil {
+			return newCertMsg, "", err
+		}
+		if err := ioutil.WriteFile(newCertFileName, certBytes, 0644); err != nil {
+			return newCertMsg, "", err
+		}
+	} else if err := createCertificate(newCertFileName, newKey, subject, certLifetime); err != nil {
+		return newCertMsg, "", err
+	}
+
+	newCertBytes, err := ioutil.ReadFile(newCertFileName)
+	if err != nil {
+		return newCertMsg, "", err
+	}
+	newCert, err := readCertificatePEM(newCertBytes)
+	if err != nil {
+		return newCertMsg, "", err
+	}
+
+	digest := sha256.Sum256(newCert.Raw)
+	proof, err := currentKey.Sign(rand.Reader, digest[:], crypto.SHA256)
+	if err != nil {
+		return newCertMsg, "", err
+	}
+
+	newCertMsg.Cert = string(newCertBytes)
+	newCertMsg.Proof = base64.StdEncoding.EncodeToString(proof)
+	return newCertMsg, Fingerprint(newCert), nil
+}
+
+// verifyRotationCert check that the new certificate of nodeName is signed with the key of currentCert
+func verifyRotationCert(nodeName string, currentCert *x509.Certificate, newCertMsg msgNewCert) (*x509.Certificate, error) {
+
+	newCert, err := readCertificatePEM([]byte(newCertMsg.Cert))
+	if err != nil {
+		return nil, err
+	}
+	if newCert.Subject.CommonName != nodeName {
+		return nil, fmt.Errorf("New certificate is for '%s' and not for '%s'", newCert.Subject.CommonName, nodeName)
+	}
+
+	proof, err := base64.StdEncoding.DecodeString(newCertMsg.Proof)
+	if err != nil {
+		return nil, err
+	}
+	algorithm, err := proofAlgorithm(currentCert.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	if err := currentCert.CheckSignature(algorithm, newCert.Raw, proof); err != nil {
+		return nil, fmt.Errorf("New certificate is not signed with the current key: %s", err.Error())
+	}
+
+	return newCert, nil
+}
+
+// activateRotationCert replace our key and certificate with the new one
+// the old key is restored, if the certificate can not be replaced, so key and certificate always match
+func (curInstance *instance) activateRotationCert() error {
+	keyFileName, certFileName := curInstance.getKeyPairPath(curInstance.config.NodeName())
+
+	for _, fileName := range []string{keyFileName + ".new", certFileName + ".new"} {
+		if _, err := os.Stat(fileName); err != nil {
+			return err
+		}
+	}
+
+	if err := os.Rename(keyFileName, keyFileName+".old"); err != nil {
+		return err
+	}
+	if err := os.Rename(keyFileName+".new", keyFileName); err != nil {
+		os.Rename(keyFileName+".old", keyFileName)
+		return err
+	}
+	if err := os.Rename(certFileName+".new", certFileName); err != nil {
+		os.Rename(keyFileName, keyFileName+".new")
+		os.Rename(keyFileName+".old", keyFileName)
+		return err
+	}
+	os.Remove(keyFileName + ".old")
+	return nil
+}
+
+// dropRotationCert remove the new key and certificate, the current one stay active
+func (curInstance *instance) dropRotationCert() {
+	keyFileName, certFileName := curInstance.getKeyPairPath(curInstance.config.NodeName())
+
+	os.Remove(keyFileName + ".new")
+	os.Remove(certFileName + ".new")
+}
+
+// rotateCert start the rotation of our certificate
+func (curInstance *instance) rotateCert(request *msgbus.Msg) error {
+
+	curInstance.rotationMutex.Lock()
+	if curInstance.rotation != nil {
+		curInstance.rotationMutex.Unlock()
+		return fmt.Errorf("A rotation is already running")
+	}
+
+	newCertMsg, fingerprint, err := curInstance.createRotationCert()
+	if err != nil {
+		curInstance.rotationMutex.Unlock()
+		return err
+	}
+
+	newRotation := certRotation{
+		request: *request,
+		report: rotateReport{
+			Fingerprint: fingerprint,
+			Updated:     make([]string, 0),
+			Failed:      make(map[string]string),
+			Offline:     make([]string, 0),
+		},
+		pending: make(map[string]bool),
+		done:    make(chan bool),
+	}
+
+	connectedSessions := curInstance.getSessions()
+	for _, curSession := range connectedSessions {
+		newRotation.pending[curSession.remoteNodeName] = true
+	}
+
+	// nodes we know, but which are not connected
+	curInstance.nodes.IterateNodes(func(node nodes.Node) {
+		if node.Name == curInstance.config.NodeName() || newRotation.pending[node.Name] {
+			return
+		}
+		if node.PeerFingerprint != "" || node.PeerCertSignature != "" {
+			newRotation.report.Offline = append(newRotation.report.Offline, node.Name)
+		}
+	})
+	sort.Strings(newRotation.report.Offline)
+
+	curInstance.rotation = &newRotation
+	curInstance.rotationMutex.Unlock()
+
+	curInstance.logging.Info("ROTATE", fmt.Sprintf("Announce new certificate to %d nodes", len(connectedSessions)), "fingerprint", fingerprint)
+	request.Answer(&curInstance.plugin, "rotateCertStarted", fingerprint)
+
+	newCertBytes, _ := json.Marshal(newCertMsg)
+	go func() {
+		for _, curSession := range connectedSessions {
+			err := curSession.writeData(curInstance.config.NodeName(), curSession.remoteNodeName, "rotate", "newCert", string(newCertBytes))
+			if err != nil {
+				curInstance.rotateCertAck(curSession.remoteNodeName, false, err.Error())
+			}
+		}
+		if len(connectedSessions) == 0 {
+			close(newRotation.done)
+		}
+
+		select {
+		case <-newRotation.done:
+		case <-time.After(rotateTimeout):
+		}
+		curInstance.finishRotation()
+	}()
+
+	return nil
+}
+
+// rotateCertAck is called when a node answered to our new certificate
+func (curInstance *instance) rotateCertAck(nodeName string, ok bool, errorMessage string) {
+	curInstance.rotationMutex.Lock()
+	defer curInstance.rotationMutex.Unlock()
+
+	if curInstance.rotation == nil || !curInstance.rotation.pending[nodeName] {
+		return
+	}
+	delete(curInstance.rotation.pending, nodeName)
+
+	if ok {
+		curInstance.rotation.report.Updated = append(curInstance.rotation.report.Updated, nodeName)
+	} else {
+		curInstance.rotation.report.Failed[nodeName] = errorMessage
+	}
+
+	if len(curInstance.rotation.pending) == 0 {
+		close(curInstance.rotation.done)
+	}
+}
+
+// finishRotation activate the new certificate, if all connected nodes accepted it, and send the report
+func (curInstance *instance) finishRotation() {
+
+	curInstance.rotationMutex.Lock()
+	curRotation := curInstance.rotation
+	curInstance.rotation = nil
+	curInstance.rotationMutex.Unlock()
+
+	for nodeName := range curRotation.pending {
+		curRotation.report.Failed[nodeName] = "No answer"
+	}
+	sort.Strings(curRotation.report.Updated)
+
+	// the updated nodes restore their old pin, when we dont activate the new certificate
+	command := "certAborted"
+	if len(curRotation.report.Failed) == 0 {
+		err := curInstance.activateRotationCert()
+		if err != nil {
+			curInstance.logging.Error("ROTATE", err.Error())
+			curRotation.report.Failed[curInstance.config.NodeName()] = err.Error()
+		} else {
+			curRotation.report.Activated = true
+			command = "certActive"
+		}
+	}
+	if !curRotation.report.Activated {
+		curInstance.dropRotationCert()
+	}
+
+	for _, nodeName := range curRotation.report.Updated {
+		if curSession := curInstance.getSession(nodeName); curSession != nil {
+			curSession.writeData(curInstance.config.NodeName(), nodeName, "rotate", command, curRotation.report.Fingerprint)
+		}
+	}
+
+	if curRotation.report.Activated {
+		curInstance.logging.Info("ROTATE", fmt.Sprintf(
+			"New certificate active: %d updated, %d offline",
+			len(curRotation.report.Updated), len(curRotation.report.Offline),
+		), "fingerprint", curRotation.report.Fingerprint)
+	} else {
+		curInstance.logging.Error("ROTATE", fmt.Sprintf(
+			"New certificate dropped: %d updated, %d failed",
+			len(curRotation.report.Updated), len(curRotation.report.Failed),
+		), "fingerprint", curRotation.report.Fingerprint)
+	}
+
+	reportBytes, _ := json.Marshal(curRotation.report)
+	curRotation.request.Answer(&curInstance.plugin, "rotateCertReport", string(reportBytes))
+}
+
+// currentPeerCert return the certificate of the remote node, it change with a rotation
+func (curSession *tlsSession) currentPeerCert() *x509.Certificate {
+	curSession.rotateMutex.Lock()
+	defer curSession.rotateMutex.Unlock()
+	return curSession.peerCert
+}
+
+// rekey send a new shared secret to the remote node, it is used when the remote node confirm it
+func (curSession *tlsSession) rekey() error {
+
+	if curSession.nodeType != nodes.NodeTypeClient {
+		return fmt.Errorf("Only the node which connect to '%s' can create a new secret", curSession.remoteNodeName)
+	}
+
+	randomBytes, err := GenerateRandomBytes(32)
+	if err != nil {
+		return err
+	}
+	newSecret := base64.StdEncoding.EncodeToString(randomBytes)
+
+	// the last new secret must be confirmed, otherwise we dont know which secret the remote node use
+	unconfirmed := false
+	err = curSession.instance.nodes.Update(curSession.remoteNodeName, func(node *nodes.Node) bool {
+		if node.SharedSecretNext != "" {
+			unconfirmed = true
+			return false
+		}
+		node.SharedSecretNext = newSecret
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	if unconfirmed {
+		return fmt.Errorf("The last new secret for '%s' is not confirmed", curSession.remoteNodeName)
+	}
+
+	curSession.logging.Info("REKEY", fmt.Sprintf("Send new shared secret to '%s'", curSession.remoteNodeName))
+	return curSession.writeData(curSession.instance.config.NodeName(), curSession.remoteNodeName, "rotate", "newSecret", newSecret)
+}
+
+// rekeyRun create a new shared secret every rekeyInterval until stop is closed
+func (curSession *tlsSession) rekeyRun(stop chan bool) {
+
+	if rekeyInterval <= 0 || curSession.nodeType != nodes.NodeTypeClient {
+		return
+	}
+
+	ticker := time.NewTicker(rekeyInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		if err := curSession.rekey(); err != nil {
+			curSession.logging.Error("REKEY", err.Error())
+		}
+	}
+}
+
+// rotateOnMessage handle the rotate-messages of the remote node
+func (curSession *tlsSession) rotateOnMessage(message *msgbus.Msg) {
+
+	if message.Command == "newCert" {
+
+		var newCertMsg msgNewCert
+		err := json.Unmarshal([]byte(message.Payload), &newCertMsg)
+
+		var newCert *x509.Certificate
+		if err == nil {
+			newCert, err = verifyRotationCert(curSession.remoteNodeName, curSession.peerCert, newCertMsg)
+		}
+		if err != nil {
+			curSession.logging.Error("ROTATE", err.Error())
+			curSession.writeData(curSession.instance.config.NodeName(), curSession.remoteNodeName, "rotate", "newCertFailed", err.Error())
+			return
+		}
+
+		node, err := curSession.instance.nodes.Get(curSession.remoteNodeName)
+		if err != nil {
+			curSession.writeData(curSession.instance.config.NodeName(), curSession.remoteNodeName, "rotate", "newCertFailed", err.Error())
+			return
+		}
+		// the certificate of this session stay valid, until the remote node activate the new one
+		node.PeerFingerprintPrev = Fingerprint(curSession.peerCert)
+		node.PeerFingerprint = Fingerprint(newCert)
+		node.PeerCertSignature = ""
+		node.DiscoveredFingerprint = "" // the pin replace the announced fingerprint
+		curSession.instance.nodes.Save(node)
+
+		curSession.rotateMutex.Lock()
+		curSession.rotatedPeerCert = newCert
+		curSession.rotateMutex.Unlock()
+
+		curSession.logging.Info("ROTATE", fmt.Sprintf("'%s' announced a new certificate", curSession.remoteNodeName), "fingerprint", node.PeerFingerprint)
+		curSession.writeData(curSession.instance.config.NodeName(), curSession.remoteNodeName, "rotate", "newCertOk", node.PeerFingerprint)
+		return
+	}
+
+	if message.Command == "certActive" || message.Command == "certAborted" {
+
+		curSession.rotateMutex.Lock()
+		newCert := curSession.rotatedPeerCert
+		curSession.rotatedPeerCert = nil
+		curSession.rotateMutex.Unlock()
+		if newCert == nil || Fingerprint(newCert) != message.Payload {
+			return
+		}
+
+		err := curSession.instance.nodes.Update(curSession.remoteNodeName, func(node *nodes.Node) bool {
+			if node.PeerFingerprint != message.Payload {
+				return false
+			}
+			if message.Command == "certAborted" {
+				node.PeerFingerprint = node.PeerFingerprintPrev
+			}
+			node.PeerFingerprintPrev = ""
+			return true
+		})
+		if err != nil {
+			curSession.logging.Error("ROTATE", err.Error())
+			return
+		}
+
+		if message.Command == "certAborted" {
+			curSession.logging.Error("ROTATE", fmt.Sprintf("'%s' dropped the new certificate", curSession.remoteNodeName), "fingerprint", message.Payload)
+			return
+		}
+
+		// the next rotation is signed with the new key
+		curSession.rotateMutex.Lock()
+		curSession.peerCert = newCert
+		curSession.rotateMutex.Unlock()
+		curSession.logging.Info("ROTATE", fmt.Sprintf("'%s' use a new certificate", curSession.remoteNodeName), "fingerprint", message.Payload)
+		return
+	}
+
+	if message.Command == "newCertOk" || message.Command == "newCertFailed" {
+		curSession.instance.rotateCertAck(curSession.remoteNodeName, message.Command == "newCertOk", message.Payload)
+		return
+	}
+
+	if message.Command == "newSecret" {
+
+		if curSession.nodeType == nodes.NodeTypeClient || message.Payload == "" {
+			curSession.logging.Error("REKEY", fmt.Sprintf("'%s' is not allowed to send a new secret", curSession.remoteNodeName))
+			return
+		}
+
+		// the remote node can still use the old secret, until it get our confirm
+		err := curSession.instance.nodes.Update(curSession.remoteNodeName, func(node *nodes.Node) bool {
+			node.SharedSecretPrev = node.SharedSecret
+			node.SharedSecret = message.Payload
+			return true
+		})
+		if err != nil {
+			return
+		}
+
+		curSession.logging.Info("REKEY", fmt.Sprintf("New shared secret from '%s' saved", curSession.remoteNodeName))
+		curSession.writeData(curSession.instance.config.NodeName(), curSession.remoteNodeName, "rotate", "newSecretSaved", "")
+		curSession.plugin.Publish(curSession.instance.config.NodeName(), curSession.instance.config.NodeName(), "tls", "nodeRekeyed", curSession.remoteNodeName)
+		return
+	}
+
+	if message.Command == "newSecretSaved" {
+
+		confirmed := false
+		curSession.instance.nodes.Update(curSession.remoteNodeName, func(node *nodes.Node) bool {
+			if node.SharedSecretNext == "" {
+				return false
+			}
+			node.SharedSecret = node.SharedSecretNext
+			node.SharedSecretNext = ""
+			confirmed = true
+			return true
+		})
+		if !confirmed {
+			return
+		}
+
+		curSession.logging.Info("REKEY", fmt.Sprintf("'%s' saved the new shared secret", curSession.remoteNodeName))
+		curSession.plugin.Publish(curSession.instance.config.NodeName(), curSession.instance.config.NodeName(), "tls", "nodeRekeyed", curSession.remoteNodeName)
+		return
+	}
+}
+
+// checkChallange return true, if response is the answer to our challange with a secret of the remote node
+// after a broken rekey the secrets are corrected, so both nodes use the same secret again
+func (curSession *tlsSession) checkChallange(response string) bool {
+
+	matched := false
+	err := curSession.instance.nodes.Update(curSession.remoteNodeName, func(node *nodes.Node) bool {
+
+		// our new secret never arrived, or the remote node use its new secret now
+		if response == ComputeHmac256(curSession.myChallange, node.SharedSecret) {
+			matched = true
+			changed := node.SharedSecretNext != "" || node.SharedSecretPrev != ""
+			node.SharedSecretNext = ""
+			node.SharedSecretPrev = ""
+			return changed
+		}
+
+		// the remote node saved our new secret, but the confirm was lost
+		if node.SharedSecretNext != "" && response == ComputeHmac256(curSession.myChallange, node.SharedSecretNext) {
+			matched = true
+			node.SharedSecret = node.SharedSecretNext
+			node.SharedSecretNext = ""
+			return true
+		}
+
+		// the remote node dont know, that we saved its new secret
+		if node.SharedSecretPrev != "" && response == ComputeHmac256(curSession.myChallange, node.SharedSecretPrev) {
+			matched = true
+		}
+
+		return false
+	})
+	if err != nil {
+		curSession.logging.Error("CHALLANGE", err.Error())
+		return false
+	}
+
+	return matched
+}
+
+// onRotateMessage handle all rotate-commands from the bus, return true if the command was handled
+func (curInstance *instance) onRotateMessage(message *msgbus.Msg, command, payload string) bool {
+
+	if command != "rotateCert" && command != "rekey" {
+		return false
+	}
+	if message.NodeTarget != curInstance.config.NodeName() {
+		return true
+	}
+	if curInstance.remoteDenied(message, command) {
+		return true
+	}
+
+	if command == "rotateCert" {
+		err := curInstance.rotateCert(message)
+		if err != nil {
+			message.Answer(&curInstance.plugin, "error", err.Error())
+		}
+		return true
+	}
+
+	if command == "rekey" {
+		curSession := curInstance.getSession(payload)
+		if curSession == nil {
+			message.Answer(&curInstance.plugin, "error", fmt.Sprintf("Node '%s' is not connected", payload))
+			return true
+		}
+		err := curSession.rekey()
+		if err != nil {
+			message.Answer(&curInstance.plugin, "error", err.Error())
+			return true
+		}
+		message.Answer(&curInstance.plugin, "rekeyStarted", payload)
+		return true
+	}
+
+	return false
+}
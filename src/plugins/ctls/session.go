@@ -21,57 +21,82 @@ package pluginctls
 import (
 	"bufio"
 	"core/clog"
-	"core/config"
 	"core/msgbus"
 	"core/nodes"
 	"crypto/tls"
+	"crypto/x509"
 	"encoding/base64"
+	"encoding/json"
 	"fmt"
 	"net"
-	"strings"
+	"sync"
+	"time"
 )
 
+// msgNodeReq is published when an unknown key connect to us
+type msgNodeReq struct {
+	Node        string `json:"node"`
+	Fingerprint string `json:"fingerprint"` // compare it with -fingerprint on the remote node before accept
+	RemoteAddr  string `json:"remoteAddr"`
+}
+
 type tlsSession struct {
+	instance       *instance // the node of this session
 	logging        clog.Logger
 	plugin         msgbus.Plugin
 	conn           net.Conn
+	remoteAddr     string
 	remoteNodeName string
 	nodeType       int
 	myChallange    string
+	peerCert       *x509.Certificate // changed by a rotation, other goroutines use currentPeerCert()
+	established    bool
+	relayAllowed   bool // the remote node is our hub, it can send messages of other nodes
+
+	remoteCapabilities nodes.Capabilities // only set if the remote node sent a hello
+	options            []string           // negotiated features
+
+	rotateMutex     sync.Mutex
+	rotatedPeerCert *x509.Certificate // new certificate of the remote node, until it activate it
+
+	reader     *bufio.Reader
+	writeMutex sync.Mutex
+	framing    bool // the remote node can read frames, protected by writeMutex
+
+	compressThreshold int // compress messages with at least this size, 0 disable it, protected by writeMutex
+
+	trafficMutex  sync.Mutex
+	traffic       nodes.Traffic
+	trafficReport bool // copy the traffic to the runtime-state of the node
+
+	heartbeatMutex     sync.Mutex
+	heartbeatMissed    int
+	heartbeatSupported bool
+}
+
+// NewSession handle the connection until it is closed
+// it return true, if the session was established ( certificate and challange ok )
+func NewSession(sessionNo string, nodeType int, connection net.Conn) bool {
+	return defaultInstance.NewSession(sessionNo, nodeType, connection)
 }
 
-func NewSession(sessionNo string, nodeType int, connection net.Conn) {
+// NewSession handle the connection until it is closed
+// it return true, if the session was established ( certificate and challange ok )
+func (curInstance *instance) NewSession(sessionNo string, nodeType int, connection net.Conn) bool {
 	var newSession tlsSession
 
+	newSession.instance = curInstance
 	newSession.logging = clog.New("SESSION-" + sessionNo)
-	newSession.plugin = msgbus.NewPlugin("SESSION-" + sessionNo)
+	newSession.plugin = curInstance.bus.NewPlugin("SESSION-" + sessionNo)
 	newSession.plugin.Register()
 	newSession.conn = connection
+	newSession.remoteAddr = connection.RemoteAddr().String()
+	newSession.reader = bufio.NewReader(connection)
 	newSession.nodeType = nodeType
 
 	newSession.handleClient()
 
-	return
-}
-
-func (curSession *tlsSession) readMsg(bufReader *bufio.Reader) (msgbus.Msg, error) {
-
-	var newMessage msgbus.Msg
-
-	for {
-		msgString, err := bufReader.ReadString('\n')
-		if err != nil {
-			curSession.logging.Error("readMsg", err.Error())
-			return newMessage, err
-		}
-		msgString = strings.TrimSuffix(msgString, "\n")
-		curSession.logging.Debug("readMsg", msgString)
-
-		newMessage, _ := msgbus.FromJsonString(string(msgString))
-
-		return newMessage, nil
-	}
-
+	return newSession.established
 }
 
 func (curSession *tlsSession) writeData(src, trg, grp, cmd, payload string) error {
@@ -89,18 +114,30 @@ func (curSession *tlsSession) writeData(src, trg, grp, cmd, payload string) erro
 
 func (curSession *tlsSession) writeMsg(message *msgbus.Msg) error {
 
-	jsonByteArray, err := message.ToJsonByteArray()
+	curSession.writeMutex.Lock()
+	defer curSession.writeMutex.Unlock()
+
+	jsonByteArray, jsonSize, err := encodeFrame(message, curSession.framing, curSession.compressThreshold)
 	if err != nil {
 		return err
 	}
-	jsonByteArray = append(jsonByteArray, '\n')
+
+	// a write to a dead connection should not block forever
+	if heartbeatInterval > 0 {
+		curSession.conn.SetWriteDeadline(time.Now().Add(heartbeatInterval * time.Duration(heartbeatMiss+1)))
+	}
 
 	_, err = curSession.conn.Write(jsonByteArray)
 	if err != nil {
 		return err
 	}
+	curSession.addTraffic(jsonSize, len(jsonByteArray), 0, 0)
 
-	curSession.logging.Debug("writeMsg", string(jsonByteArray))
+	if jsonByteArray[0] == frameDeflate {
+		curSession.logging.Debug("writeMsg", fmt.Sprintf("%s/%s compressed from %d to %d bytes", message.Group, message.Command, jsonSize, len(jsonByteArray)))
+	} else {
+		curSession.logging.Debug("writeMsg", string(jsonByteArray))
+	}
 	return nil
 }
 
@@ -138,15 +175,36 @@ func (curSession *tlsSession) handleClient() {
 		return
 	}
 	peerCert := state.PeerCertificates[0]
+	curSession.peerCert = peerCert
 
 	// remode-node-name
 	curSession.remoteNodeName = peerCert.Subject.CommonName
 	curSession.logging.Debug("handleClient", fmt.Sprintf("RemodeNodeName: %s", curSession.remoteNodeName))
 
+	// newer nodes exchange a hello
+	if state.NegotiatedProtocol == alpnProtocol {
+		if !curSession.handleHello() {
+			return
+		}
+	}
+
 	// check certificate
-	peerCertCheckResult := curSession.peerCertCheck(peerCert.Signature)
+	peerCertCheckResult := curSession.peerCertCheck(peerCert)
+
+	// an unknown client can join with a token
+	if peerCertCheckResult == certCheckReq || peerCertCheckResult == certCheckUnknown {
+		if curSession.enrollWithToken(peerCert) {
+			peerCertCheckResult = certCheckOk
+		}
+	}
+
 	if peerCertCheckResult == certCheckReq {
-		curSession.plugin.Publish(config.NodeName, config.NodeName, "tls", "nodeReq", peerCert.Subject.CommonName)
+		reqBytes, _ := json.Marshal(msgNodeReq{
+			Node:        peerCert.Subject.CommonName,
+			Fingerprint: Fingerprint(peerCert),
+			RemoteAddr:  curSession.remoteAddr,
+		})
+		curSession.plugin.Publish(curSession.instance.config.NodeName(), curSession.instance.config.NodeName(), "tls", "nodeReq", string(reqBytes))
 		return
 	}
 	if peerCertCheckResult != certCheckOk {
@@ -160,23 +218,55 @@ func (curSession *tlsSession) handleClient() {
 	}
 
 	// successfully connected
-	curSession.plugin.Publish(config.NodeName, config.NodeName, "tls", "nodeConnected", curSession.remoteNodeName)
-	defer curSession.plugin.Publish(config.NodeName, config.NodeName, "tls", "nodeDisconnect", curSession.remoteNodeName)
+	if node, err := curSession.instance.nodes.Get(curSession.remoteNodeName); err == nil {
+		curSession.relayAllowed = node.IsHub()
+	}
+	generation := curSession.instance.nodes.SetConnected(curSession.remoteNodeName)
+	defer curSession.instance.nodes.SetDisconnected(curSession.remoteNodeName, generation)
+	if curSession.remoteCapabilities.Protocol > 0 {
+		curSession.instance.nodes.SetCapabilities(curSession.remoteNodeName, curSession.remoteCapabilities, curSession.options)
+	}
+	if curSession.nodeType == nodes.NodeTypeClient {
+		curSession.instance.nodes.SetRoute(curSession.remoteNodeName, nodes.DirectionOutgoing, curSession.conn.RemoteAddr().String())
+	} else {
+		curSession.instance.nodes.SetRoute(curSession.remoteNodeName, nodes.DirectionIncoming, curSession.conn.RemoteAddr().String())
+	}
+	curSession.startTrafficReport()
+	defer curSession.logTraffic()
+	curSession.plugin.Publish(curSession.instance.config.NodeName(), curSession.instance.config.NodeName(), "tls", "nodeConnected", curSession.remoteNodeName)
+	defer curSession.plugin.Publish(curSession.instance.config.NodeName(), curSession.instance.config.NodeName(), "tls", "nodeDisconnect", curSession.remoteNodeName)
 	curSession.plugin.ListenForGroup("", curSession.onMessage)
 
-	r := bufio.NewReader(curSession.conn)
+	curSession.established = true
+	curSession.instance.addSession(curSession)
+	defer curSession.instance.removeSession(curSession)
+	if curSession.nodeType == nodes.NodeTypeClient {
+		curSession.instance.publishConnectState(msgConnectState{Node: curSession.remoteNodeName, State: connectStateConnected})
+	}
+	go curSession.instance.caSendRevokedList(curSession.remoteNodeName, curSession.peerCert)
+
+	// check if the remote node is alive
+	stopHeartbeat := make(chan bool)
+	defer close(stopHeartbeat)
+	go curSession.heartbeatRun(stopHeartbeat)
+	go curSession.rekeyRun(stopHeartbeat)
+
 	for {
-		msg, err := r.ReadString('\n')
+		curMessage, err := curSession.readMsg()
 		if err != nil {
-			curSession.logging.Error("handleClient", err.Error())
 			return
 		}
-		msg = strings.TrimSuffix(msg, "\n")
+		received := time.Now()
+		curSession.instance.nodes.Touch(curSession.remoteNodeName)
+		curSession.heartbeatAlive()
 
-		// convert to Msg
-		curMessage, err := msgbus.FromJsonString(string(msg))
-		if err != nil {
-			curSession.logging.Error("handleClient", err.Error())
+		// heartbeats and rotations are only for this session
+		if curMessage.Group == "heartbeat" {
+			curSession.heartbeatOnMessage(&curMessage, received)
+			continue
+		}
+		if curMessage.Group == "rotate" {
+			curSession.rotateOnMessage(&curMessage)
 			continue
 		}
 
@@ -193,63 +283,176 @@ const certCheckErr int = -2
 const certCheckMisMatch int = -1
 const certCheckOk int = 0
 const certCheckReq int = 1
+const certCheckUnknown int = 2
+
+func (curSession *tlsSession) peerCertCheck(peerCert *x509.Certificate) int {
+
+	peerCertSignature := peerCert.Signature
+
+	if curSession.instance.caRevoked(peerCert) {
+		curSession.instance.logging.Error("CLIENT", fmt.Sprintf(
+			"Peer Certificate of '%s' with serial %s is revoked",
+			curSession.remoteNodeName, peerCert.SerialNumber.Text(16),
+		))
+		return certCheckMisMatch
+	}
 
-func (curSession *tlsSession) peerCertCheck(peerCertSignature []byte) int {
+	// signed by our CA, we dont need to pin the certificate
+	caErr := curSession.instance.caVerify(peerCert)
+	if caErr == nil {
+		return curSession.peerCertCheckCA(peerCert)
+	}
+	if caRequired {
+		curSession.instance.logging.Error("CLIENT", fmt.Sprintf(
+			"Peer Certificate of '%s' is not signed by our CA: %s",
+			curSession.remoteNodeName, caErr.Error(),
+		))
+		return certCheckMisMatch
+	}
 
-	nodeObject, err := nodes.GetNodeObject(curSession.remoteNodeName)
+	node, err := curSession.instance.nodes.Get(curSession.remoteNodeName)
 	if err != nil {
-		logging.Error("CLIENT", err.Error())
+		curSession.instance.logging.Error("CLIENT", err.Error())
+		if curSession.nodeType == nodes.NodeTypeIncoming {
+			// unknown nodes are not saved, but count to the requests of the remote
+			if !curSession.instance.pendingAllowed(curSession.remoteAddr, time.Now()) {
+				curSession.instance.logging.Error("CLIENT", fmt.Sprintf(
+					"Too many requests from %s, ignore the unknown node '%s'",
+					curSession.remoteAddr, curSession.remoteNodeName,
+				))
+				return certCheckMisMatch
+			}
+			return certCheckUnknown
+		}
 		return certCheckErr
 	}
 
-	// no cert signature present
+	// the node was found by discovery, so we know which key it must have, until we pinned it
+	if node.PeerFingerprint == "" && node.DiscoveredFingerprint != "" && node.DiscoveredFingerprint != Fingerprint(peerCert) {
+		curSession.instance.logging.Error("CLIENT", fmt.Sprintf(
+			"Peer Certificate of '%s' has fingerprint %s, but discovery announced %s",
+			curSession.remoteNodeName, Fingerprint(peerCert), node.DiscoveredFingerprint,
+		))
+		return certCheckMisMatch
+	}
+
+	peerFingerprint := Fingerprint(peerCert)
+
+	// migrate a pinned signature of older versions, the key is the same as long as the signature match
+	if node.PeerFingerprint == "" && node.PeerCertSignature != "" &&
+		node.PeerCertSignature == fmt.Sprintf("%x", peerCertSignature) {
+
+		curSession.instance.logging.Info("CLIENT", fmt.Sprintf(
+			"Replace pinned signature of '%s' with fingerprint %s",
+			curSession.remoteNodeName, peerFingerprint,
+		))
+		node.PeerFingerprint = peerFingerprint
+		node.PeerCertSignature = ""
+		node.PeerCertSignatureReq = ""
+		curSession.instance.nodes.Save(node)
+	}
+
+	// no fingerprint present
 	// as server we save it to
 	// as client we "cherry pick"
-	if nodeObject["peerCertSignature"] == nil {
+	if node.PeerFingerprint == "" && node.PeerCertSignature == "" {
 
 		if curSession.nodeType == nodes.NodeTypeIncoming {
 
-			logging.Info("CLIENT", fmt.Sprintf(
-				"Peer Certificate missing for '%s', save it to requested keys. Signature: %x",
-				curSession.remoteNodeName, peerCertSignature),
+			// a new request, not only a reconnect of the requesting node
+			if node.PeerFingerprintReq != peerFingerprint && !curSession.instance.pendingAllowed(curSession.remoteAddr, time.Now()) {
+				curSession.instance.logging.Error("CLIENT", fmt.Sprintf(
+					"Too many requests from %s, ignore the request for '%s'",
+					curSession.remoteAddr, curSession.remoteNodeName,
+				))
+				return certCheckMisMatch
+			}
+
+			curSession.instance.logging.Info("CLIENT", fmt.Sprintf(
+				"Peer Certificate missing for '%s', save it to requested keys. Fingerprint: %s",
+				curSession.remoteNodeName, peerFingerprint),
 			)
 
-			nodeObject["peerCertSignatureReq"] = fmt.Sprintf("%x", peerCertSignature)
-			nodes.SaveNodeObject(curSession.remoteNodeName, nodeObject)
+			node.PeerRequest = newPendingRequest(node, peerCert, curSession.remoteAddr, time.Now())
+			node.PeerFingerprintReq = peerFingerprint
+			node.PeerCertSignatureReq = ""
+			curSession.instance.nodes.Save(node)
 			return certCheckReq
 		}
 
 		if curSession.nodeType == nodes.NodeTypeClient {
 
-			logging.Info("CLIENT", fmt.Sprintf(
-				"Cherry pick Signature: %x for '%s'",
-				peerCertSignature, curSession.remoteNodeName),
+			curSession.instance.logging.Info("CLIENT", fmt.Sprintf(
+				"Cherry pick Fingerprint: %s for '%s'",
+				peerFingerprint, curSession.remoteNodeName),
 			)
 
-			nodeObject["peerCertSignature"] = fmt.Sprintf("%x", peerCertSignature)
-			nodes.SaveNodeObject(curSession.remoteNodeName, nodeObject)
+			node.PeerFingerprint = peerFingerprint
+			curSession.instance.nodes.Save(node)
 			return certCheckOk
 		}
 
 	}
 
-	// cert of remote-node is present, check it against tls-cert
-	if nodeObject["peerCertSignature"] != fmt.Sprintf("%x", peerCertSignature) {
-		logging.Error("CLIENT", fmt.Sprintf("Peer Certificate '%x' not accepted for this node", peerCertSignature))
+	// the remote node rotated its certificate, but dont activated it yet
+	if node.PeerFingerprintPrev != "" && node.PeerFingerprintPrev == peerFingerprint {
+		curSession.instance.logging.Info("CLIENT", "Peer Certificate before the rotation accepted", "fingerprint", peerFingerprint)
+		return certCheckOk
+	}
+
+	// key of remote-node is present, check it against tls-cert
+	if node.PeerFingerprint != peerFingerprint {
+		curSession.instance.logging.Error("CLIENT", fmt.Sprintf("Peer Certificate with fingerprint %s not accepted for this node", peerFingerprint))
+		return certCheckMisMatch
+	}
+
+	// the new certificate is used, so the rotation is finished
+	if node.PeerFingerprintPrev != "" {
+		node.PeerFingerprintPrev = ""
+		curSession.instance.nodes.Save(node)
+	}
+	curSession.instance.logging.Info("CLIENT", "Peer Certificate accepted")
+
+	return certCheckOk
+}
+
+// peerCertCheckCA accept a node with a certificate signed by our CA
+// an unknown node that connect to us is created
+func (curSession *tlsSession) peerCertCheckCA(peerCert *x509.Certificate) int {
+
+	node, err := curSession.instance.nodes.Get(curSession.remoteNodeName)
+	if err != nil {
+		if curSession.nodeType != nodes.NodeTypeIncoming {
+			curSession.instance.logging.Error("CLIENT", err.Error())
+			return certCheckErr
+		}
+		node = curSession.instance.nodes.GetOrNew(curSession.remoteNodeName)
+		node.Type = nodes.NodeTypeIncoming
+		curSession.instance.nodes.Save(node)
+	}
+
+	if node.DiscoveredFingerprint != "" && node.DiscoveredFingerprint != Fingerprint(peerCert) {
+		curSession.instance.logging.Error("CLIENT", fmt.Sprintf(
+			"Peer Certificate of '%s' has fingerprint %s, but discovery announced %s",
+			curSession.remoteNodeName, Fingerprint(peerCert), node.DiscoveredFingerprint,
+		))
 		return certCheckMisMatch
 	}
-	logging.Info("CLIENT", "Peer Certificate accepted")
 
+	curSession.instance.logging.Info("CLIENT", fmt.Sprintf("Peer Certificate of '%s' signed by our CA", curSession.remoteNodeName))
 	return certCheckOk
 }
 
 func (curSession *tlsSession) handleChallange() bool {
 
-	nodeObject, err := nodes.GetNodeObject(curSession.remoteNodeName)
-	bufReader := bufio.NewReader(curSession.conn)
+	node, err := curSession.instance.nodes.Get(curSession.remoteNodeName)
+	if err != nil {
+		curSession.logging.Error("CHALLANGE", err.Error())
+		return false
+	}
 
 	// no shared secret
-	if nodeObject["sharedSecret"] == nil {
+	if node.SharedSecret == "" {
 
 		// is this an incoming connection -> send "newSecret" command
 		if curSession.nodeType == nodes.NodeTypeIncoming {
@@ -260,8 +463,8 @@ func (curSession *tlsSession) handleChallange() bool {
 			}
 			randomString := base64.StdEncoding.EncodeToString(randomBytes)
 
-			nodeObject["sharedSecret"] = randomString
-			nodes.SaveNodeObject(curSession.remoteNodeName, nodeObject)
+			node.SharedSecret = randomString
+			curSession.instance.nodes.Save(node)
 
 			curSession.logging.Error("CHALLANGE", fmt.Sprintf(
 				"New SharedSecret generated %s, send it to client",
@@ -269,7 +472,7 @@ func (curSession *tlsSession) handleChallange() bool {
 			))
 
 			err = curSession.writeData(
-				config.NodeName, curSession.remoteNodeName,
+				curSession.instance.config.NodeName(), curSession.remoteNodeName,
 				"challange", "newSecret", randomString,
 			)
 			if err != nil {
@@ -278,7 +481,7 @@ func (curSession *tlsSession) handleChallange() bool {
 			}
 
 			// wait for respond
-			message, err := curSession.readMsg(bufReader)
+			message, err := curSession.readMsg()
 			if err != nil {
 				return false
 			}
@@ -295,8 +498,20 @@ func (curSession *tlsSession) handleChallange() bool {
 		// we wait for "newSecret" command
 		if curSession.nodeType == nodes.NodeTypeClient {
 
+			// we have a token to join the server
+			if node.EnrollToken != "" {
+				err = curSession.writeData(
+					curSession.instance.config.NodeName(), curSession.remoteNodeName,
+					"challange", "enrollToken", node.EnrollToken,
+				)
+				if err != nil {
+					curSession.logging.Error("CHALLANGE", err.Error())
+					return false
+				}
+			}
+
 			// wait for newSecret
-			message, err := curSession.readMsg(bufReader)
+			message, err := curSession.readMsg()
 			if err != nil {
 				return false
 			}
@@ -308,12 +523,13 @@ func (curSession *tlsSession) handleChallange() bool {
 				return false
 			}
 
-			nodeObject["sharedSecret"] = message.Payload
-			nodes.SaveNodeObject(curSession.remoteNodeName, nodeObject)
+			node.SharedSecret = message.Payload
+			node.EnrollToken = ""
+			curSession.instance.nodes.Save(node)
 
 			// answer
 			err = curSession.writeData(
-				config.NodeName, curSession.remoteNodeName,
+				curSession.instance.config.NodeName(), curSession.remoteNodeName,
 				"challange", "newSecretSaved", "",
 			)
 			if err != nil {
@@ -326,8 +542,7 @@ func (curSession *tlsSession) handleChallange() bool {
 	}
 
 	// get shared secret
-	var sharedSecret string
-	sharedSecret = nodeObject["sharedSecret"].(string)
+	sharedSecret := node.SharedSecret
 
 	// create random bytes and remember
 	randomMessageBytes, err := GenerateRandomBytes(32)
@@ -336,8 +551,10 @@ func (curSession *tlsSession) handleChallange() bool {
 	}
 	curSession.myChallange = base64.StdEncoding.EncodeToString(randomMessageBytes)
 
+	// we measure the time until we get the response
+	challangeSend := time.Now()
 	err = curSession.writeData(
-		config.NodeName, curSession.remoteNodeName,
+		curSession.instance.config.NodeName(), curSession.remoteNodeName,
 		"challange", "challangeRequest", curSession.myChallange,
 	)
 	if err != nil {
@@ -351,7 +568,7 @@ func (curSession *tlsSession) handleChallange() bool {
 	))
 
 	for {
-		message, err := curSession.readMsg(bufReader)
+		message, err := curSession.readMsg()
 		if err != nil {
 			return false
 		}
@@ -361,7 +578,7 @@ func (curSession *tlsSession) handleChallange() bool {
 			challangeResponse := ComputeHmac256(message.Payload, sharedSecret)
 
 			err := curSession.writeData(
-				config.NodeName, curSession.remoteNodeName,
+				curSession.instance.config.NodeName(), curSession.remoteNodeName,
 				"challange", "challangeResponse", challangeResponse,
 			)
 			if err != nil {
@@ -376,12 +593,14 @@ func (curSession *tlsSession) handleChallange() bool {
 
 			challangeResponse := ComputeHmac256(curSession.myChallange, sharedSecret)
 
-			if challangeResponse == message.Payload {
+			if curSession.checkChallange(message.Payload) {
 				curSession.logging.Info(
 					"CHALLANGE",
 					fmt.Sprintf("Challange ok"),
 				)
 
+				curSession.instance.nodes.SetRTT(curSession.remoteNodeName, time.Since(challangeSend))
+
 				return true
 			}
 
@@ -401,14 +620,19 @@ func (curSession *tlsSession) handleChallange() bool {
 
 func (curSession *tlsSession) onMessage(message *msgbus.Msg, group, command, payload string) {
 
-	// messages to us, will not sended
-	if message.NodeTarget == config.NodeName {
+	// messages to us or to our clients, will not sended
+	if msgbus.AddressNode(message.NodeTarget) == curSession.instance.config.NodeName() {
 		curSession.logging.Debug("onMessage", fmt.Sprintf(
 			"I will not send out messages, which are dedicated to me",
 		))
 		return
 	}
 
+	// selectors are resolved by the fanout on this node
+	if nodes.IsSelector(message.NodeTarget) {
+		return
+	}
+
 	// only message to remoteNodeName will be sended
 	if /* message.NodeTarget != curSession.remoteNodeName || */ len(message.NodeTarget) == 0 {
 		curSession.logging.Debug("onMessage", fmt.Sprintf(
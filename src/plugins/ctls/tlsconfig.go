@@ -0,0 +1,229 @@
+/*
+Copyright (C) 2019 by Martin Langlotz aka stackshadow
+
+This file is part of gopilot, an rewrite of the copilot-project in go
+
+gopilot is free software: you can redistribute it and/or modify
+it under the terms of the GNU Lesser General Public License as published by
+the Free Software Foundation, version 3 of this License
+
+gopilot is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License
+along with gopilot.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package pluginctls
+
+/*
+TLS-settings of node connections
+
+-tls.minVersion  1.2 or 1.3
+-tls.ciphers     comma separated names like TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384, only used for TLS 1.2
+                 only secure cipher suites are allowed, empty use the defaults of go
+-tls.curves      comma separated list of P256, P384, P521 and X25519, empty use the defaults of go
+
+The certificates of the nodes are self-signed, so the normal chain-verification is disabled.
+Instead the pins are checked inside the handshake ( VerifyPeerCertificate ), an untrusted peer
+is rejected before any message is exchanged:
+- revoked certificates are rejected
+- certificates signed by our CA are accepted, with -caRequired only them
+- the fingerprint must match the pinned or by discovery announced fingerprint
+- when we connect to a node, the CN must be the name of the node
+
+Unknown nodes and nodes without a pin pass the handshake, they can request an accept or join with a token.
+*/
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// options
+var tlsMinVersion string
+var tlsCiphers string
+var tlsCurves string
+
+// the parsed options
+var tlsMinVersionID uint16 = tls.VersionTLS12
+var tlsCipherIDs []uint16
+var tlsCurveIDs []tls.CurveID
+
+var tlsVersions = map[string]uint16{
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+var tlsCurveNames = map[string]tls.CurveID{
+	"P256":   tls.CurveP256,
+	"P384":   tls.CurveP384,
+	"P521":   tls.CurveP521,
+	"X25519": tls.X25519,
+}
+
+// parseTLSOptions check the tls-options and remember them for new connections
+func parseTLSOptions(minVersion, ciphers, curves string) error {
+
+	versionID, ok := tlsVersions[minVersion]
+	if !ok {
+		return fmt.Errorf("TLS-version '%s' is not supported, use 1.2 or 1.3", minVersion)
+	}
+
+	cipherIDs := make([]uint16, 0)
+	for _, cipherName := range splitList(ciphers) {
+		cipherID, ok := secureCipherSuite(cipherName)
+		if !ok {
+			return fmt.Errorf("Cipher suite '%s' is unknown or insecure", cipherName)
+		}
+		cipherIDs = append(cipherIDs, cipherID)
+	}
+
+	curveIDs := make([]tls.CurveID, 0)
+	for _, curveName := range splitList(curves) {
+		curveID, ok := tlsCurveNames[strings.ToUpper(curveName)]
+		if !ok {
+			return fmt.Errorf("Curve '%s' is unknown, use P256, P384, P521 or X25519", curveName)
+		}
+		curveIDs = append(curveIDs, curveID)
+	}
+
+	tlsMinVersionID = versionID
+	tlsCipherIDs = nil
+	if len(cipherIDs) > 0 {
+		tlsCipherIDs = cipherIDs
+	}
+	tlsCurveIDs = nil
+	if len(curveIDs) > 0 {
+		tlsCurveIDs = curveIDs
+	}
+
+	return nil
+}
+
+// splitList split a comma separated list and remove empty entries
+func splitList(list string) []string {
+	entries := make([]string, 0)
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry != "" {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+// secureCipherSuite return the id of the cipher suite, if it is not insecure
+func secureCipherSuite(cipherName string) (uint16, bool) {
+	for _, suite := range tls.CipherSuites() {
+		if suite.Name == cipherName {
+			return suite.ID, true
+		}
+	}
+	return 0, false
+}
+
+// baseTLSConfig return a tls-config with our settings
+func baseTLSConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion:       tlsMinVersionID,
+		CipherSuites:     tlsCipherIDs,
+		CurvePreferences: tlsCurveIDs,
+		NextProtos:       []string{alpnProtocol},
+	}
+}
+
+// serverTLSConfig return the tls-config for incoming connections
+func (curInstance *instance) serverTLSConfig() *tls.Config {
+	config := baseTLSConfig()
+	config.GetCertificate = func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+		return curInstance.localCertificate()
+	}
+	config.ClientAuth = tls.RequireAnyClientCert
+	config.VerifyPeerCertificate = curInstance.verifyPeer("")
+	return config
+}
+
+// clientTLSConfig return the tls-config to connect to nodeName
+func (curInstance *instance) clientTLSConfig(nodeName string) *tls.Config {
+	config := baseTLSConfig()
+	config.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+		return curInstance.localCertificate()
+	}
+	// the certificates are self-signed, verifyPeer check the pin instead
+	config.InsecureSkipVerify = true
+	config.VerifyPeerCertificate = curInstance.verifyPeer(nodeName)
+	return config
+}
+
+// verifyPeer return the function which check the peer certificate inside the handshake
+// expectedNode is the node we connect to, empty for incoming connections
+func (curInstance *instance) verifyPeer(expectedNode string) func([][]byte, [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+
+		if len(rawCerts) == 0 {
+			return errors.New("Missing peer certificate")
+		}
+		peerCert, err := x509.ParseCertificate(rawCerts[0])
+		if err != nil {
+			return err
+		}
+
+		err = curInstance.checkPeerPin(peerCert, expectedNode)
+		if err != nil {
+			curInstance.logging.Error("VERIFY", err.Error())
+		}
+		return err
+	}
+}
+
+// checkPeerPin check the certificate against the pins without changing anything
+// the full check with requests and cherry picking is done by peerCertCheck after the handshake
+func (curInstance *instance) checkPeerPin(peerCert *x509.Certificate, expectedNode string) error {
+
+	nodeName := peerCert.Subject.CommonName
+	if nodeName == "" {
+		return errors.New("Peer certificate has no CN")
+	}
+	if expectedNode != "" && nodeName != expectedNode {
+		return fmt.Errorf("Peer certificate is for '%s', but we connect to '%s'", nodeName, expectedNode)
+	}
+
+	if curInstance.caRevoked(peerCert) {
+		return fmt.Errorf("Peer certificate of '%s' with serial %s is revoked", nodeName, peerCert.SerialNumber.Text(16))
+	}
+	caErr := curInstance.caVerify(peerCert)
+	if caErr == nil {
+		return nil
+	}
+	if caRequired {
+		return fmt.Errorf("Peer certificate of '%s' is not signed by our CA: %s", nodeName, caErr.Error())
+	}
+
+	node, err := curInstance.nodes.Get(nodeName)
+	if err != nil {
+		// unknown nodes can request an accept or join with a token
+		if expectedNode == "" {
+			return nil
+		}
+		return err
+	}
+
+	fingerprint := Fingerprint(peerCert)
+	if node.PeerFingerprint == "" && node.DiscoveredFingerprint != "" && node.DiscoveredFingerprint != fingerprint {
+		return fmt.Errorf("Peer certificate of '%s' has fingerprint %s, but discovery announced %s", nodeName, fingerprint, node.DiscoveredFingerprint)
+	}
+	if node.PeerFingerprint != "" && node.PeerFingerprint != fingerprint && node.PeerFingerprintPrev != fingerprint {
+		return fmt.Errorf("Peer certificate of '%s' has fingerprint %s, but %s is pinned", nodeName, fingerprint, node.PeerFingerprint)
+	}
+	if node.PeerFingerprint == "" && node.PeerCertSignature != "" && node.PeerCertSignature != fmt.Sprintf("%x", peerCert.Signature) {
+		return fmt.Errorf("Peer certificate of '%s' dont match the pinned signature", nodeName)
+	}
+
+	return nil
+}
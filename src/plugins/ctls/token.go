@@ -0,0 +1,452 @@
+/*
+Copyright (C) 2019 by Martin Langlotz aka stackshadow
+
+This file is part of gopilot, an rewrite of the copilot-project in go
+
+gopilot is free software: you can redistribute it and/or modify
+it under the terms of the GNU Lesser General Public License as published by
+the Free Software Foundation, version 3 of this License
+
+gopilot is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License
+along with gopilot.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package pluginctls
+
+/*
+One-time enrollment tokens, a client with a valid token is accepted without -acceptNode
+
+On the server:
+-newToken "web-*"                                    print a new token and exit ( -tokenTTL set the lifetime )
+tls/tokenCreate  {"pattern":"web-*", "ttl":3600}    -> tls/tokenCreateOk {"id":"..", "token":"..", "pattern":"web-*", "expires":..}
+tls/tokenList                                       -> tls/tokens [{"id":"..", "pattern":"web-*", "expires":..}]
+tls/tokenDelete  <id>                               -> tls/tokenDeleteOk <id>
+tls/nodeEnrolled {"node":"web-1", "fingerprint":"..", "token":"<id>"}  ( published when a node joined with a token )
+
+On the client:
+-remoteNodeName server -remoteNodeHost host:port -joinToken <token>
+tls/nodeJoin     {"name":"server", "host":"host", "port":4444, "token":".."}  -> tls/nodeJoinOk <name>
+
+All commands are only accepted from this node and its webclients.
+The server only save the sha256 of the token. Every usage is written to the audit-list of the config-section "enroll".
+A token can only create unknown nodes or accept the key of an incoming node without a pinned key,
+it never replace the key of an existing node.
+*/
+
+import (
+	"core/msgbus"
+	"core/nodes"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"path"
+	"sort"
+	"time"
+)
+
+type enrollToken struct {
+	ID      string `json:"id"`
+	Token   string `json:"token,omitempty"` // only set when the token is created
+	Pattern string `json:"pattern"`         // allowed node names, like web-*
+	Expires int64  `json:"expires"`         // unix time
+}
+
+type enrollAuditEntry struct {
+	Time        int64  `json:"time"`
+	Node        string `json:"node"`
+	Fingerprint string `json:"fingerprint"`
+	Token       string `json:"token"` // id of the token
+	Remote      string `json:"remote"`
+	Result      string `json:"result"`
+}
+
+type msgNodeEnrolled struct {
+	Node        string `json:"node"`
+	Fingerprint string `json:"fingerprint"`
+	Token       string `json:"token"`
+}
+
+// options
+var newToken string
+var tokenTTL time.Duration
+var joinToken string
+
+const enrollTokenTimeout = time.Second * 5
+const maxAuditEntries = 100
+
+// tokenHash return the sha256 of the token as hex, only this is saved
+func tokenHash(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
+
+// getEnrollSection return the config section and its tokens, the enrollMutex must be locked
+func (curInstance *instance) getEnrollSection() (map[string]interface{}, map[string]interface{}) {
+
+	enrollSection, err := curInstance.config.GetJSONObject("enroll")
+	if err != nil {
+		enrollSection = make(map[string]interface{})
+	}
+
+	tokens, ok := enrollSection["tokens"].(map[string]interface{})
+	if !ok {
+		tokens = make(map[string]interface{})
+		enrollSection["tokens"] = tokens
+	}
+
+	return enrollSection, tokens
+}
+
+// tokenFromObject convert a saved token
+func tokenFromObject(tokenObject interface{}) (enrollToken, error) {
+	var token enrollToken
+
+	tokenBytes, err := json.Marshal(tokenObject)
+	if err != nil {
+		return token, err
+	}
+	err = json.Unmarshal(tokenBytes, &token)
+	return token, err
+}
+
+// CreateToken create a new single-use token for nodes matching pattern
+func CreateToken(pattern string, ttl time.Duration) (enrollToken, error) {
+	return defaultInstance.CreateToken(pattern, ttl)
+}
+
+// CreateToken create a new single-use token for nodes matching pattern
+func (curInstance *instance) CreateToken(pattern string, ttl time.Duration) (enrollToken, error) {
+
+	if pattern == "" {
+		pattern = "*"
+	}
+	if _, err := path.Match(pattern, ""); err != nil {
+		return enrollToken{}, fmt.Errorf("Invalid pattern '%s': %s", pattern, err.Error())
+	}
+	if ttl <= 0 {
+		ttl = time.Hour
+	}
+
+	randomBytes, err := GenerateRandomBytes(32)
+	if err != nil {
+		return enrollToken{}, err
+	}
+	tokenString := base64.RawURLEncoding.EncodeToString(randomBytes)
+	hash := tokenHash(tokenString)
+
+	createdToken := enrollToken{
+		ID:      hash[:8],
+		Pattern: pattern,
+		Expires: time.Now().Add(ttl).Unix(),
+	}
+
+	curInstance.enrollMutex.Lock()
+	enrollSection, tokens := curInstance.getEnrollSection()
+	tokens[hash] = createdToken
+	curInstance.config.SetJSONObject("enroll", enrollSection)
+	curInstance.config.Save()
+	curInstance.enrollMutex.Unlock()
+
+	curInstance.logging.Info("ENROLL", "Token created", "token", createdToken.ID, "pattern", pattern, "expires", time.Unix(createdToken.Expires, 0))
+
+	createdToken.Token = tokenString
+	return createdToken, nil
+}
+
+// ListTokens return all tokens that are not expired, sorted by expiry
+func ListTokens() []enrollToken {
+	return defaultInstance.ListTokens()
+}
+
+// ListTokens return all tokens that are not expired, sorted by expiry
+func (curInstance *instance) ListTokens() []enrollToken {
+
+	curInstance.enrollMutex.Lock()
+	defer curInstance.enrollMutex.Unlock()
+
+	_, tokens := curInstance.getEnrollSection()
+
+	tokenList := make([]enrollToken, 0)
+	for _, tokenObject := range tokens {
+		token, err := tokenFromObject(tokenObject)
+		if err != nil || time.Now().Unix() > token.Expires {
+			continue
+		}
+		tokenList = append(tokenList, token)
+	}
+
+	sort.Slice(tokenList, func(i, j int) bool {
+		return tokenList[i].Expires < tokenList[j].Expires
+	})
+
+	return tokenList
+}
+
+// DeleteToken remove the token with id
+func DeleteToken(id string) error {
+	return defaultInstance.DeleteToken(id)
+}
+
+// DeleteToken remove the token with id
+func (curInstance *instance) DeleteToken(id string) error {
+
+	curInstance.enrollMutex.Lock()
+	defer curInstance.enrollMutex.Unlock()
+
+	enrollSection, tokens := curInstance.getEnrollSection()
+	for hash, tokenObject := range tokens {
+		token, err := tokenFromObject(tokenObject)
+		if err == nil && token.ID == id {
+			delete(tokens, hash)
+			curInstance.config.SetJSONObject("enroll", enrollSection)
+			curInstance.config.Save()
+			return nil
+		}
+	}
+
+	return fmt.Errorf("Token '%s' not found", id)
+}
+
+// consumeToken check the token for nodeName and remove it, a token can only used once
+// expired tokens are removed too
+func (curInstance *instance) consumeToken(tokenString, nodeName string) (enrollToken, error) {
+
+	curInstance.enrollMutex.Lock()
+	defer curInstance.enrollMutex.Unlock()
+
+	enrollSection, tokens := curInstance.getEnrollSection()
+	defer func() {
+		curInstance.config.SetJSONObject("enroll", enrollSection)
+		curInstance.config.Save()
+	}()
+
+	// cleanup
+	for hash, tokenObject := range tokens {
+		token, err := tokenFromObject(tokenObject)
+		if err != nil || time.Now().Unix() > token.Expires {
+			delete(tokens, hash)
+		}
+	}
+
+	hash := tokenHash(tokenString)
+	tokenObject, ok := tokens[hash]
+	if !ok {
+		return enrollToken{}, fmt.Errorf("Token is unknown or expired")
+	}
+	token, _ := tokenFromObject(tokenObject)
+
+	if match, _ := path.Match(token.Pattern, nodeName); !match {
+		return token, fmt.Errorf("Token '%s' is not valid for node '%s'", token.ID, nodeName)
+	}
+
+	delete(tokens, hash)
+	return token, nil
+}
+
+// enrollAudit append an entry to the audit-list
+func (curInstance *instance) enrollAudit(entry enrollAuditEntry) {
+
+	curInstance.logging.Info("ENROLL", fmt.Sprintf("Enrollment of '%s': %s", entry.Node, entry.Result),
+		"token", entry.Token, "fingerprint", entry.Fingerprint, "remote", entry.Remote,
+	)
+
+	curInstance.enrollMutex.Lock()
+	defer curInstance.enrollMutex.Unlock()
+
+	enrollSection, _ := curInstance.getEnrollSection()
+	audit, _ := enrollSection["audit"].([]interface{})
+	audit = append(audit, entry)
+	if len(audit) > maxAuditEntries {
+		audit = audit[len(audit)-maxAuditEntries:]
+	}
+	enrollSection["audit"] = audit
+
+	curInstance.config.SetJSONObject("enroll", enrollSection)
+	curInstance.config.Save()
+}
+
+// enrollWithToken wait a short time for a token of an unknown client
+// if the token is valid, the node is created and its fingerprint is accepted
+func (curSession *tlsSession) enrollWithToken(peerCert *x509.Certificate) bool {
+
+	curSession.conn.SetReadDeadline(time.Now().Add(enrollTokenTimeout))
+	message, err := curSession.readMsg()
+	curSession.conn.SetReadDeadline(time.Time{})
+	if err != nil || message.Group != "challange" || message.Command != "enrollToken" {
+		return false
+	}
+
+	auditEntry := enrollAuditEntry{
+		Time:        time.Now().Unix(),
+		Node:        curSession.remoteNodeName,
+		Fingerprint: Fingerprint(peerCert),
+		Remote:      curSession.conn.RemoteAddr().String(),
+	}
+
+	// existing nodes keep their key
+	if node, err := curSession.instance.nodes.Get(curSession.remoteNodeName); err == nil {
+		if node.Type != nodes.NodeTypeIncoming || node.PeerFingerprint != "" || node.PeerCertSignature != "" {
+			auditEntry.Result = fmt.Sprintf("Node '%s' already exist", curSession.remoteNodeName)
+			curSession.instance.enrollAudit(auditEntry)
+			return false
+		}
+	}
+
+	token, err := curSession.instance.consumeToken(message.Payload, curSession.remoteNodeName)
+	auditEntry.Token = token.ID
+	if err != nil {
+		auditEntry.Result = err.Error()
+		curSession.instance.enrollAudit(auditEntry)
+		return false
+	}
+
+	node := curSession.instance.nodes.GetOrNew(curSession.remoteNodeName)
+	node.Type = nodes.NodeTypeIncoming
+	node.PeerFingerprint = auditEntry.Fingerprint
+	node.PeerFingerprintReq = ""
+	node.PeerCertSignature = ""
+	node.PeerCertSignatureReq = ""
+	node.SharedSecret = ""
+	curSession.instance.nodes.Save(node)
+
+	auditEntry.Result = "accepted"
+	curSession.instance.enrollAudit(auditEntry)
+
+	enrolledBytes, _ := json.Marshal(msgNodeEnrolled{
+		Node:        auditEntry.Node,
+		Fingerprint: auditEntry.Fingerprint,
+		Token:       auditEntry.Token,
+	})
+	curSession.plugin.Publish(curSession.instance.config.NodeName(), curSession.instance.config.NodeName(), "tls", "nodeEnrolled", string(enrolledBytes))
+
+	return true
+}
+
+type msgTokenCreate struct {
+	Pattern string `json:"pattern"`
+	TTL     int    `json:"ttl"` // in seconds
+}
+
+// tokens can not live longer
+const maxTokenTTL = 365 * 24 * 60 * 60
+
+// decodeTokenCreate return the request of an tokenCreate-payload
+func decodeTokenCreate(payload string) (msgTokenCreate, error) {
+
+	var tokenReq msgTokenCreate
+	err := json.Unmarshal([]byte(payload), &tokenReq)
+	if err != nil {
+		return msgTokenCreate{}, err
+	}
+	if tokenReq.TTL < 0 || tokenReq.TTL > maxTokenTTL {
+		return msgTokenCreate{}, fmt.Errorf("ttl must be between 0 and %d seconds", maxTokenTTL)
+	}
+
+	return tokenReq, nil
+}
+
+type msgNodeJoin struct {
+	Name  string `json:"name"`
+	Host  string `json:"host"`
+	Port  int    `json:"port"`
+	Token string `json:"token"`
+}
+
+// decodeNodeJoin return the request of an nodeJoin-payload
+func decodeNodeJoin(payload string) (msgNodeJoin, error) {
+
+	var joinReq msgNodeJoin
+	err := json.Unmarshal([]byte(payload), &joinReq)
+	if err != nil {
+		return msgNodeJoin{}, err
+	}
+	if joinReq.Name == "" || joinReq.Host == "" || joinReq.Token == "" {
+		return msgNodeJoin{}, fmt.Errorf("name, host and token are needed")
+	}
+	if joinReq.Port < 0 || joinReq.Port > 65535 {
+		return msgNodeJoin{}, fmt.Errorf("Invalid port %d", joinReq.Port)
+	}
+
+	return joinReq, nil
+}
+
+// onTokenMessage handle all token-commands, return true if the command was handled
+func (curInstance *instance) onTokenMessage(message *msgbus.Msg, command, payload string) bool {
+
+	if command != "tokenCreate" && command != "tokenList" && command != "tokenDelete" && command != "nodeJoin" {
+		return false
+	}
+	if message.NodeTarget != curInstance.config.NodeName() {
+		return true
+	}
+	if curInstance.remoteDenied(message, command) {
+		return true
+	}
+
+	if command == "tokenCreate" {
+
+		tokenReq, err := decodeTokenCreate(payload)
+		if err != nil {
+			message.Answer(&curInstance.plugin, "error", err.Error())
+			return true
+		}
+
+		createdToken, err := curInstance.CreateToken(tokenReq.Pattern, time.Second*time.Duration(tokenReq.TTL))
+		if err != nil {
+			message.Answer(&curInstance.plugin, "error", err.Error())
+			return true
+		}
+
+		tokenBytes, _ := json.Marshal(createdToken)
+		message.Answer(&curInstance.plugin, "tokenCreateOk", string(tokenBytes))
+		return true
+	}
+
+	if command == "tokenList" {
+		tokensBytes, _ := json.Marshal(curInstance.ListTokens())
+		message.Answer(&curInstance.plugin, "tokens", string(tokensBytes))
+		return true
+	}
+
+	if command == "tokenDelete" {
+		err := curInstance.DeleteToken(payload)
+		if err != nil {
+			message.Answer(&curInstance.plugin, "error", err.Error())
+			return true
+		}
+		message.Answer(&curInstance.plugin, "tokenDeleteOk", payload)
+		return true
+	}
+
+	if command == "nodeJoin" {
+
+		joinReq, err := decodeNodeJoin(payload)
+		if err != nil {
+			message.Answer(&curInstance.plugin, "error", err.Error())
+			return true
+		}
+
+		node := curInstance.nodes.GetOrNew(joinReq.Name)
+		node.Type = nodes.NodeTypeClient
+		node.Host = joinReq.Host
+		if joinReq.Port > 0 {
+			node.Port = joinReq.Port
+		}
+		node.EnrollToken = joinReq.Token
+		curInstance.nodes.Save(node)
+
+		curInstance.connectNode(node)
+		message.Answer(&curInstance.plugin, "nodeJoinOk", joinReq.Name)
+		return true
+	}
+
+	return false
+}
@@ -0,0 +1,236 @@
+/*
+Copyright (C) 2019 by Martin Langlotz aka stackshadow
+
+This file is part of gopilot, an rewrite of the copilot-project in go
+
+gopilot is free software: you can redistribute it and/or modify
+it under the terms of the GNU Lesser General Public License as published by
+the Free Software Foundation, version 3 of this License
+
+gopilot is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License
+along with gopilot.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package pluginctls
+
+/*
+Node connections over a websocket, for networks which only allow outbound HTTP(S)
+
+The hub accept nodes on the http-server of the webclient-plugin with -websocket.nodes:
+copilotg -websocket -websocket.addr 0.0.0.0:443 -websocket.nodes
+
+The client connect with an url instead of host:port, optional through an HTTP-proxy with CONNECT:
+copilotg -remoteNodeName hub -remoteNodeURL wss://hub.example.com/node -remoteNodeProxy http://proxy:3128
+
+If no proxy is set for the node, HTTPS_PROXY / HTTP_PROXY from the environment are used.
+Inside the websocket the normal TLS-session runs ( certificate, fingerprint and challange ),
+every TLS-record is send as binary websocket-message.
+*/
+
+import (
+	"core/nodes"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const websocketPath = "/node"
+
+// options
+var websocketNodes bool    // accept nodes on the websocket-server
+var remoteNodeURL string   // connect to the remote node over a websocket
+var remoteNodeProxy string // the http-proxy for remoteNodeURL
+
+var websocketUpgrader = websocket.Upgrader{
+	Subprotocols: []string{alpnProtocol},
+}
+
+// wsConn is a net.Conn over a websocket, so we can run a TLS-session inside of it
+type wsConn struct {
+	ws     *websocket.Conn
+	reader io.Reader // the current binary message
+}
+
+func newWsConn(ws *websocket.Conn) *wsConn {
+	return &wsConn{ws: ws}
+}
+
+func (conn *wsConn) Read(data []byte) (int, error) {
+	for {
+		if conn.reader == nil {
+			messageType, reader, err := conn.ws.NextReader()
+			if err != nil {
+				if websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+					return 0, io.EOF
+				}
+				return 0, err
+			}
+			if messageType != websocket.BinaryMessage {
+				continue
+			}
+			conn.reader = reader
+		}
+
+		count, err := conn.reader.Read(data)
+		if err == io.EOF {
+			conn.reader = nil
+			if count == 0 {
+				continue
+			}
+			err = nil
+		}
+		return count, err
+	}
+}
+
+func (conn *wsConn) Write(data []byte) (int, error) {
+	err := conn.ws.WriteMessage(websocket.BinaryMessage, data)
+	if err != nil {
+		return 0, err
+	}
+	return len(data), nil
+}
+
+func (conn *wsConn) Close() error {
+	conn.ws.WriteControl(
+		websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""),
+		time.Now().Add(time.Second),
+	)
+	return conn.ws.Close()
+}
+
+func (conn *wsConn) LocalAddr() net.Addr {
+	return conn.ws.LocalAddr()
+}
+
+func (conn *wsConn) RemoteAddr() net.Addr {
+	return conn.ws.RemoteAddr()
+}
+
+func (conn *wsConn) SetDeadline(deadline time.Time) error {
+	if err := conn.ws.SetReadDeadline(deadline); err != nil {
+		return err
+	}
+	return conn.ws.SetWriteDeadline(deadline)
+}
+
+func (conn *wsConn) SetReadDeadline(deadline time.Time) error {
+	return conn.ws.SetReadDeadline(deadline)
+}
+
+func (conn *wsConn) SetWriteDeadline(deadline time.Time) error {
+	return conn.ws.SetWriteDeadline(deadline)
+}
+
+// parseNodeURL check that the url can be used for a websocket-connection
+func parseNodeURL(nodeURL string) (*url.URL, error) {
+
+	parsedURL, err := url.Parse(nodeURL)
+	if err != nil {
+		return nil, err
+	}
+	if parsedURL.Scheme != "ws" && parsedURL.Scheme != "wss" {
+		return nil, fmt.Errorf("Url '%s' must start with ws:// or wss://", nodeURL)
+	}
+	if parsedURL.Host == "" {
+		return nil, fmt.Errorf("Url '%s' has no host", nodeURL)
+	}
+
+	return parsedURL, nil
+}
+
+// parseProxyURL check the url of an http-proxy
+func parseProxyURL(proxyURL string) (*url.URL, error) {
+
+	parsedURL, err := url.Parse(proxyURL)
+	if err != nil {
+		return nil, err
+	}
+	if parsedURL.Scheme != "http" || parsedURL.Host == "" {
+		return nil, fmt.Errorf("Proxy '%s' must look like http://host:port", proxyURL)
+	}
+
+	return parsedURL, nil
+}
+
+// serveWebsocket register the websocket-endpoint for nodes on the http-server of the webclient
+func (curInstance *instance) serveWebsocket() {
+	curInstance.logging.Info("SERVER", fmt.Sprintf("Accept nodes over websocket on %s", websocketPath))
+	http.HandleFunc(websocketPath, curInstance.onWebsocketNode)
+}
+
+// onWebsocketNode run an incoming session inside the websocket
+func (curInstance *instance) onWebsocketNode(w http.ResponseWriter, r *http.Request) {
+
+	_, err := curInstance.localCertificate()
+	if err != nil {
+		curInstance.logging.Error("SERVER", err.Error())
+		http.Error(w, "Server not ready", http.StatusServiceUnavailable)
+		return
+	}
+
+	ws, err := websocketUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		curInstance.logging.Error("SERVER", fmt.Sprintf("Websocket upgrade from %s failed: %s", r.RemoteAddr, err.Error()))
+		return
+	}
+
+	curInstance.NewSession(
+		curInstance.nextSessionNo(),
+		nodes.NodeTypeIncoming, tls.Server(newWsConn(ws), curInstance.serverTLSConfig()),
+	)
+}
+
+// dialWebsocket connect to the websocket of the node and start the TLS-client inside of it
+func dialWebsocket(node nodes.Node, tlsConfig *tls.Config) (net.Conn, error) {
+
+	nodeURL, err := parseNodeURL(node.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	dialer := websocket.Dialer{
+		Proxy:            http.ProxyFromEnvironment,
+		HandshakeTimeout: connectTimeout,
+		Subprotocols:     []string{alpnProtocol},
+	}
+	if node.Proxy != "" {
+		proxyURL, err := parseProxyURL(node.Proxy)
+		if err != nil {
+			return nil, err
+		}
+		dialer.Proxy = http.ProxyURL(proxyURL)
+	}
+
+	ws, response, err := dialer.Dial(nodeURL.String(), nil)
+	if err != nil {
+		if response != nil {
+			return nil, fmt.Errorf("%s ( HTTP %s )", err.Error(), response.Status)
+		}
+		return nil, err
+	}
+
+	conn := tls.Client(newWsConn(ws), tlsConfig)
+
+	// the handshake is done inside the session, but should not hang forever
+	conn.SetDeadline(time.Now().Add(connectTimeout))
+	if err := conn.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+
+	return conn, nil
+}
@@ -0,0 +1,393 @@
+/*
+Copyright (C) 2019 by Martin Langlotz aka stackshadow
+
+This file is part of gopilot, an rewrite of the copilot-project in go
+
+gopilot is free software: you can redistribute it and/or modify
+it under the terms of the GNU Lesser General Public License as published by
+the Free Software Foundation, version 3 of this License
+
+gopilot is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License
+along with gopilot.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package plugindiscovery
+
+/*
+Nodes announce themselves over UDP multicast on the local segment:
+{"name":"nodea", "host":"192.168.1.10", "port":4444, "fingerprint":"AB:CD:..."}
+
+Unknown nodes are saved as pending nodes ( type undefined with discoveredFingerprint ) and can be approved:
+disc/getDiscovered                            -> disc/discovered {"<name>":{...}} for every pending node, then disc/discoveredEnd
+disc/approve  {"name":"nodea", "type":2}      -> disc/approveOk    ( type is client(2) or incoming(3), default depend on the announced port )
+disc/reject   nodea                           -> disc/rejectOk
+Events:
+disc/nodeDiscovered {"name":"nodea", ...}
+
+If discovery.addr is not a multicast address, we use plain UDP ( for example to test on the loopback interface )
+*/
+
+import (
+	"core/clog"
+	"core/config"
+	"core/msgbus"
+	"core/nodes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net"
+	"plugins/ctls"
+	"time"
+)
+
+type announcement struct {
+	Name        string `json:"name"`
+	Host        string `json:"host"`
+	Port        int    `json:"port"` // 0 if the node dont serve an TLS-Server
+	Fingerprint string `json:"fingerprint"`
+}
+
+type msgApprove struct {
+	Name string `json:"name"`
+	Type int    `json:"type"`
+}
+
+// options
+var discoveryEnabled bool
+var discoveryAddr string
+var discoveryInterface string
+var discoveryInterval time.Duration
+
+// private vars
+var plugin msgbus.Plugin
+var logging clog.Logger
+
+// we dont save more pending nodes, so nobody can flood our config
+const maxPendingNodes = 64
+
+// max size of an announcement
+const maxAnnouncementSize = 1024
+
+// ParseCmdLine read the command line parameter and save the values to local vars
+func ParseCmdLine() {
+	flag.BoolVar(&discoveryEnabled, "discovery", false, "Announce this node and discover other nodes on the local network")
+	flag.StringVar(&discoveryAddr, "discovery.addr", "239.255.42.42:4445", "host:port - Multicast-Group for discovery")
+	flag.StringVar(&discoveryInterface, "discovery.iface", "", "Network interface for discovery ( default: all )")
+	flag.DurationVar(&discoveryInterval, "discovery.interval", time.Second*30, "Announce this node in this interval")
+}
+
+// Init the discovery-plugin
+func Init() {
+
+	logging = clog.New("DISC")
+
+	// register plugin on messagebus
+	plugin = msgbus.NewPlugin("DISC")
+	plugin.Register()
+	plugin.ListenForGroup("disc", onMessage)
+
+	if discoveryEnabled == false {
+		return
+	}
+
+	groupAddr, err := net.ResolveUDPAddr("udp4", discoveryAddr)
+	if err != nil {
+		logging.Error("INIT", err.Error())
+		return
+	}
+
+	var iface *net.Interface
+	if discoveryInterface != "" {
+		iface, err = net.InterfaceByName(discoveryInterface)
+		if err != nil {
+			logging.Error("INIT", err.Error())
+			return
+		}
+	}
+
+	conn, err := listen(groupAddr, iface)
+	if err != nil {
+		logging.Error("INIT", err.Error())
+		return
+	}
+
+	logging.Info("INIT", fmt.Sprintf("Discovery on %s", groupAddr.String()))
+	go receive(conn)
+	go announceRun(groupAddr)
+}
+
+// listen on the multicast-group, or on an plain udp-address
+func listen(groupAddr *net.UDPAddr, iface *net.Interface) (*net.UDPConn, error) {
+	if groupAddr.IP.IsMulticast() {
+		return net.ListenMulticastUDP("udp4", iface, groupAddr)
+	}
+	return net.ListenUDP("udp4", groupAddr)
+}
+
+// ownAnnouncement create the announcement of this node
+func ownAnnouncement() (announcement, error) {
+
+	fingerprint, err := pluginctls.LocalFingerprint()
+	if err != nil {
+		return announcement{}, err
+	}
+
+	newAnnouncement := announcement{
+		Name:        config.NodeName,
+		Fingerprint: fingerprint,
+	}
+
+	// only a server has an endpoint
+	myNode, err := nodes.Get(config.NodeName)
+	if err == nil && myNode.Type == nodes.NodeTypeServer {
+		newAnnouncement.Host = myNode.Host
+		newAnnouncement.Port = myNode.Port
+	}
+
+	return newAnnouncement, nil
+}
+
+// announceRun send our announcement in every interval
+func announceRun(groupAddr *net.UDPAddr) {
+	for {
+		err := announce(groupAddr)
+		if err != nil {
+			logging.Error("ANNOUNCE", err.Error())
+		}
+		time.Sleep(discoveryInterval)
+	}
+}
+
+// announce send a single announcement
+func announce(groupAddr *net.UDPAddr) error {
+
+	newAnnouncement, err := ownAnnouncement()
+	if err != nil {
+		return err
+	}
+
+	announcementBytes, err := json.Marshal(newAnnouncement)
+	if err != nil {
+		return err
+	}
+
+	conn, err := net.DialUDP("udp4", nil, groupAddr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.Write(announcementBytes)
+	return err
+}
+
+// receive read announcements until the connection is closed
+func receive(conn *net.UDPConn) {
+	defer conn.Close()
+
+	buffer := make([]byte, maxAnnouncementSize)
+	for {
+		length, srcAddr, err := conn.ReadFromUDP(buffer)
+		if err != nil {
+			logging.Error("RECEIVE", err.Error())
+			return
+		}
+
+		err = handleAnnouncement(buffer[:length], srcAddr)
+		if err != nil {
+			logging.Debug("RECEIVE", fmt.Sprintf("%s: %s", srcAddr.String(), err.Error()))
+		}
+	}
+}
+
+// handleAnnouncement save an announced node as pending node
+func handleAnnouncement(data []byte, srcAddr *net.UDPAddr) error {
+
+	var newAnnouncement announcement
+	err := json.Unmarshal(data, &newAnnouncement)
+	if err != nil {
+		return err
+	}
+
+	if newAnnouncement.Name == "" || newAnnouncement.Fingerprint == "" {
+		return fmt.Errorf("Announcement without name or fingerprint")
+	}
+	if newAnnouncement.Port < 0 || newAnnouncement.Port > 65535 {
+		return fmt.Errorf("Port %d is invalid", newAnnouncement.Port)
+	}
+
+	// thats we
+	if newAnnouncement.Name == config.NodeName {
+		return nil
+	}
+
+	// the host is not usable from outside, use the source of the packet
+	hostIP := net.ParseIP(newAnnouncement.Host)
+	if newAnnouncement.Host == "" || (hostIP != nil && (hostIP.IsUnspecified() || hostIP.IsLoopback())) {
+		newAnnouncement.Host = srcAddr.IP.String()
+	}
+
+	node, err := nodes.Get(newAnnouncement.Name)
+	if err == nil {
+
+		// we only update pending nodes, all other nodes are managed by the admin
+		if !node.IsPendingDiscovered() {
+			return nil
+		}
+
+		// nothing changed
+		if node.Host == newAnnouncement.Host && node.Port == newAnnouncement.Port &&
+			node.DiscoveredFingerprint == newAnnouncement.Fingerprint {
+			return nil
+		}
+
+	} else {
+
+		if countPending() >= maxPendingNodes {
+			return fmt.Errorf("Too many pending nodes, ignore '%s'", newAnnouncement.Name)
+		}
+
+		node = nodes.GetOrNew(newAnnouncement.Name)
+	}
+
+	node.Type = nodes.NodeTypeUndefined
+	node.Host = newAnnouncement.Host
+	node.Port = newAnnouncement.Port
+	node.DiscoveredFingerprint = newAnnouncement.Fingerprint
+	err = nodes.Save(node)
+	if err != nil {
+		return err
+	}
+
+	logging.Info("RECEIVE", fmt.Sprintf(
+		"Discovered node '%s' on %s:%d with fingerprint %s",
+		node.Name, node.Host, node.Port, node.DiscoveredFingerprint,
+	))
+
+	announcementBytes, _ := json.Marshal(newAnnouncement)
+	plugin.Publish(config.NodeName, config.NodeName, "disc", "nodeDiscovered", string(announcementBytes))
+
+	return nil
+}
+
+func countPending() int {
+	count := 0
+	nodes.IterateNodes(func(node nodes.Node) {
+		if node.IsPendingDiscovered() {
+			count++
+		}
+	})
+	return count
+}
+
+// approve turn a pending node into a client- or incoming-node
+func approve(approveReq msgApprove) (nodes.Node, error) {
+
+	node, err := nodes.Get(approveReq.Name)
+	if err != nil {
+		return node, err
+	}
+	if !node.IsPendingDiscovered() {
+		return node, fmt.Errorf("Node '%s' is not a discovered node", approveReq.Name)
+	}
+
+	if approveReq.Type == nodes.NodeTypeUndefined {
+		approveReq.Type = nodes.NodeTypeIncoming
+		if node.Port > 0 {
+			approveReq.Type = nodes.NodeTypeClient
+		}
+	}
+
+	if approveReq.Type != nodes.NodeTypeClient && approveReq.Type != nodes.NodeTypeIncoming {
+		return node, fmt.Errorf("Type %d is not allowed", approveReq.Type)
+	}
+	if approveReq.Type == nodes.NodeTypeClient && node.Port == 0 {
+		return node, fmt.Errorf("Node '%s' dont announce a TLS-Server", approveReq.Name)
+	}
+
+	node.Type = approveReq.Type
+	err = nodes.Save(node)
+	if err != nil {
+		return node, err
+	}
+
+	logging.Info("APPROVE", fmt.Sprintf("Node '%s' approved as type %d", node.Name, node.Type))
+
+	return node, nil
+}
+
+func onMessage(message *msgbus.Msg, group, command, payload string) {
+
+	// from here: only commands for THIS node
+	if message.NodeTarget != config.NodeName {
+		return
+	}
+
+	if command == "getDiscovered" {
+
+		nodes.IterateNodes(func(node nodes.Node) {
+			if !node.IsPendingDiscovered() {
+				return
+			}
+
+			nodeBytes, err := json.Marshal(map[string]nodes.NodeInfo{
+				node.Name: node.Info(),
+			})
+			if err != nil {
+				logging.Error("getDiscovered", err.Error())
+				return
+			}
+
+			message.Answer(&plugin, "discovered", string(nodeBytes))
+		})
+
+		message.Answer(&plugin, "discoveredEnd", "")
+		return
+	}
+
+	if command == "approve" {
+
+		var approveReq msgApprove
+		err := json.Unmarshal([]byte(payload), &approveReq)
+		if err != nil {
+			message.Answer(&plugin, "error", err.Error())
+			return
+		}
+
+		node, err := approve(approveReq)
+		if err != nil {
+			message.Answer(&plugin, "error", err.Error())
+			return
+		}
+
+		// we connect to it
+		if node.DialOut() {
+			plugin.Publish(config.NodeName, config.NodeName, "tls", "nodeConnect", node.Name)
+		}
+
+		message.Answer(&plugin, "approveOk", node.Name)
+		return
+	}
+
+	if command == "reject" {
+
+		node, err := nodes.Get(payload)
+		if err != nil {
+			message.Answer(&plugin, "error", err.Error())
+			return
+		}
+		if !node.IsPendingDiscovered() {
+			message.Answer(&plugin, "error", fmt.Sprintf("Node '%s' is not a discovered node", payload))
+			return
+		}
+
+		nodes.Delete(payload)
+		message.Answer(&plugin, "rejectOk", payload)
+		return
+	}
+}
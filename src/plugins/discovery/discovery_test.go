@@ -0,0 +1,117 @@
+/*
+Copyright (C) 2019 by Martin Langlotz aka stackshadow
+
+This file is part of gopilot, an rewrite of the copilot-project in go
+
+gopilot is free software: you can redistribute it and/or modify
+it under the terms of the GNU Lesser General Public License as published by
+the Free Software Foundation, version 3 of this License
+
+gopilot is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License
+along with gopilot.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package plugindiscovery
+
+import (
+	"core/clog"
+	"core/config"
+	"core/msgbus"
+	"core/nodes"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestDiscoveryOnLoopback(t *testing.T) {
+
+	clog.Init()
+	msgbus.MsgBusInit()
+	msgbus.PluginsInit()
+
+	config.ParseCmdLine()
+	config.Init()
+	config.ConfigPath = "/tmp"
+	config.NodeName = "discoveryhub"
+	config.Read()
+	nodes.Init()
+
+	Init()
+
+	// listen on the loopback
+	conn, err := listen(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0}, nil)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	go receive(conn)
+	defer conn.Close()
+
+	sender, err := net.DialUDP("udp4", nil, conn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	defer sender.Close()
+
+	sender.Write([]byte("{\"name\":\"discoveryhub\",\"port\":4444,\"fingerprint\":\"AA:BB\"}"))
+	sender.Write([]byte("{\"name\":\"nofingerprint\",\"port\":4444}"))
+	sender.Write([]byte("no json"))
+	sender.Write([]byte("{\"name\":\"discoverednode\",\"host\":\"0.0.0.0\",\"port\":4444,\"fingerprint\":\"AA:BB\"}"))
+	defer nodes.Delete("discoverednode")
+
+	// wait for the node
+	var node nodes.Node
+	for try := 0; try < 20; try++ {
+		node, err = nodes.Get("discoverednode")
+		if err == nil {
+			break
+		}
+		time.Sleep(time.Millisecond * 50)
+	}
+	if err != nil {
+		t.Error("Node was not discovered")
+		t.FailNow()
+	}
+
+	if !node.IsPendingDiscovered() || node.Host != "127.0.0.1" || node.Port != 4444 || node.DiscoveredFingerprint != "AA:BB" {
+		t.Errorf("Discovered node is wrong: %+v", node)
+		t.FailNow()
+	}
+
+	if myNode, err := nodes.Get("discoveryhub"); err == nil && myNode.IsPendingDiscovered() {
+		t.Error("We should not discover ourselfe")
+		t.FailNow()
+	}
+	if _, err := nodes.Get("nofingerprint"); err == nil {
+		t.Error("Announcements without fingerprint should be ignored")
+		t.FailNow()
+	}
+
+	// approve it
+	node, err = approve(msgApprove{Name: "discoverednode"})
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	if node.Type != nodes.NodeTypeClient || node.IsPendingDiscovered() {
+		t.Errorf("Approved node is wrong: %+v", node)
+		t.FailNow()
+	}
+
+	// approved nodes are not changed by announcements
+	if err := handleAnnouncement([]byte("{\"name\":\"discoverednode\",\"port\":5555,\"fingerprint\":\"CC:DD\"}"), &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}); err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	node, _ = nodes.Get("discoverednode")
+	if node.Port != 4444 || node.DiscoveredFingerprint != "AA:BB" {
+		t.Errorf("Approved node was changed: %+v", node)
+		t.FailNow()
+	}
+}
@@ -0,0 +1,258 @@
+/*
+Copyright (C) 2019 by Martin Langlotz aka stackshadow
+
+This file is part of gopilot, an rewrite of the copilot-project in go
+
+gopilot is free software: you can redistribute it and/or modify
+it under the terms of the GNU Lesser General Public License as published by
+the Free Software Foundation, version 3 of this License
+
+gopilot is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License
+along with gopilot.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package pluginlogstream
+
+/*
+Read the log of a node over the bus:
+
+log/get          {"level":"info", "prefix":"LDAP", "limit":100}   -> log/entries [{...},{...}]
+log/subscribe    {"level":"error", "prefix":"SESSION-*", "ttl":300} -> log/subscribeOk, then log/entry {...} for every new entry
+log/unsubscribe                                                    -> log/unsubscribeOk
+
+A subscription ends after ttl seconds, subscribe again to extend it.
+*/
+
+import (
+	"core/clog"
+	"core/config"
+	"core/msgbus"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+)
+
+type msgLogFilter struct {
+	Level  string `json:"level"`
+	Prefix string `json:"prefix"`
+	Limit  int    `json:"limit"` // only for get
+	TTL    int    `json:"ttl"`   // only for subscribe, in seconds
+}
+
+type msgLogEntry struct {
+	Node   string                 `json:"node"`
+	Time   time.Time              `json:"time"`
+	Level  string                 `json:"level"`
+	Prefix string                 `json:"prefix"`
+	Group  string                 `json:"group"`
+	Msg    string                 `json:"msg"`
+	Fields map[string]interface{} `json:"fields,omitempty"`
+}
+
+type subscription struct {
+	node    string // the node which get the entrys
+	filter  clog.Filter
+	expires time.Time
+}
+
+// the debug-output of these prefixes is created by the streaming itselfe, we never send it
+var selfTracingPrefixes = []string{"BUS", "SESSION-*", "WS", "LOG"}
+
+const defaultTTL = 300
+const maxTTL = 3600
+const queueSize = 256
+
+// private vars
+var plugin msgbus.Plugin
+var logging clog.Logger
+
+var subscriptions map[string]*subscription
+var subscriptionsMutex sync.Mutex
+
+var entryQueue chan clog.Entry
+
+// Init the logstream-plugin
+func Init() {
+	logging = clog.New("LOG")
+
+	subscriptions = make(map[string]*subscription)
+	entryQueue = make(chan clog.Entry, queueSize)
+
+	clog.AddHook(onLogEntry)
+	go stream()
+
+	// register plugin on messagebus
+	plugin = msgbus.NewPlugin("LOG")
+	plugin.Register()
+	plugin.ListenForGroup("log", onMessage)
+}
+
+// onLogEntry is called by clog, it must not block
+func onLogEntry(newEntry clog.Entry) {
+
+	if newEntry.Prefix == "LOG" {
+		return
+	}
+	if newEntry.Level == clog.LevelDebug {
+		for _, pattern := range selfTracingPrefixes {
+			if clog.MatchPrefix(pattern, newEntry.Prefix) {
+				return
+			}
+		}
+	}
+
+	// drop the entry if the queue is full
+	select {
+	case entryQueue <- newEntry:
+	default:
+	}
+}
+
+// stream send every entry to all matching subscriptions
+func stream() {
+	for newEntry := range entryQueue {
+
+		subscriptionsMutex.Lock()
+		targets := make([]string, 0)
+		for nodeName, curSubscription := range subscriptions {
+			if time.Now().After(curSubscription.expires) {
+				delete(subscriptions, nodeName)
+				continue
+			}
+			if curSubscription.filter.Match(&newEntry) {
+				targets = append(targets, curSubscription.node)
+			}
+		}
+		subscriptionsMutex.Unlock()
+
+		if len(targets) == 0 {
+			continue
+		}
+
+		entryBytes, err := json.Marshal(toMsgLogEntry(newEntry))
+		if err != nil {
+			continue
+		}
+
+		for _, target := range targets {
+			plugin.Publish(config.NodeName, target, "log", "entry", string(entryBytes))
+		}
+	}
+}
+
+func toMsgLogEntry(curEntry clog.Entry) msgLogEntry {
+	newEntry := msgLogEntry{
+		Node:   config.NodeName,
+		Time:   curEntry.Time,
+		Level:  curEntry.Level.String(),
+		Prefix: curEntry.Prefix,
+		Group:  curEntry.Group,
+		Msg:    curEntry.Message,
+	}
+	if len(curEntry.Fields) > 0 {
+		newEntry.Fields = curEntry.FieldMap()
+	}
+	return newEntry
+}
+
+// parseFilter read the filter from the payload, an empty payload match all entrys with level info
+func parseFilter(payload string) (msgLogFilter, clog.Filter, error) {
+
+	var logFilter msgLogFilter
+	filter := clog.Filter{Level: clog.LevelInfo}
+
+	if payload == "" {
+		return logFilter, filter, nil
+	}
+
+	err := json.Unmarshal([]byte(payload), &logFilter)
+	if err != nil {
+		return logFilter, filter, err
+	}
+
+	if logFilter.Level != "" {
+		filter.Level, err = clog.ParseLevel(logFilter.Level)
+		if err != nil {
+			return logFilter, filter, err
+		}
+	}
+	filter.Prefix = logFilter.Prefix
+
+	return logFilter, filter, nil
+}
+
+func onMessage(message *msgbus.Msg, group, command, payload string) {
+
+	// from here: only commands for THIS node
+	if message.NodeTarget != config.NodeName {
+		return
+	}
+
+	if command == "get" {
+
+		logFilter, filter, err := parseFilter(payload)
+		if err != nil {
+			message.Answer(&plugin, "error", err.Error())
+			return
+		}
+
+		msgEntrys := make([]msgLogEntry, 0)
+		for _, curEntry := range clog.History(filter, logFilter.Limit) {
+			msgEntrys = append(msgEntrys, toMsgLogEntry(curEntry))
+		}
+
+		entrysBytes, err := json.Marshal(msgEntrys)
+		if err != nil {
+			message.Answer(&plugin, "error", err.Error())
+			return
+		}
+
+		message.Answer(&plugin, "entries", string(entrysBytes))
+		return
+	}
+
+	if command == "subscribe" {
+
+		logFilter, filter, err := parseFilter(payload)
+		if err != nil {
+			message.Answer(&plugin, "error", err.Error())
+			return
+		}
+
+		if logFilter.TTL <= 0 {
+			logFilter.TTL = defaultTTL
+		}
+		if logFilter.TTL > maxTTL {
+			logFilter.TTL = maxTTL
+		}
+
+		subscriptionsMutex.Lock()
+		subscriptions[message.NodeSource] = &subscription{
+			node:    message.NodeSource,
+			filter:  filter,
+			expires: time.Now().Add(time.Second * time.Duration(logFilter.TTL)),
+		}
+		subscriptionsMutex.Unlock()
+
+		logging.Info("SUBSCRIBE", fmt.Sprintf("'%s' subscribed for %d seconds", message.NodeSource, logFilter.TTL))
+		message.Answer(&plugin, "subscribeOk", "")
+		return
+	}
+
+	if command == "unsubscribe" {
+
+		subscriptionsMutex.Lock()
+		delete(subscriptions, message.NodeSource)
+		subscriptionsMutex.Unlock()
+
+		logging.Info("SUBSCRIBE", fmt.Sprintf("'%s' unsubscribed", message.NodeSource))
+		message.Answer(&plugin, "unsubscribeOk", "")
+		return
+	}
+}
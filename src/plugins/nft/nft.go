@@ -25,6 +25,7 @@ import (
 	"encoding/json"
 	"flag"
 	"fmt"
+	"plugins/configsync"
 	"time"
 )
 
@@ -59,6 +60,9 @@ var nftConfig nftJSONConfig
 var nftSkipApplyRules bool
 var applyTimer *time.Timer
 
+// the result of remote rules ( configsync ) is sent after nft/confirm, nft/confirmCancel or the rollback
+var sectionConfirmed func(err error)
+
 /*
 ParseCmdLine read the cmd-line arguments and set global values from it
 */
@@ -74,10 +78,16 @@ func Init() {
 	logging = clog.New("NFT")
 
 	// load from config
-	nftConfig, _ = loadFromConfig()
+	var err error
+	nftConfig, err = loadFromConfig()
+	if err != nil {
+		logging.Error("Init", err.Error())
+	}
 
 	if nftSkipApplyRules == false {
-		nftConfig.applyAll()
+		if err := nftConfig.applyAll(); err != nil {
+			logging.Error("Init", err.Error())
+		}
 	}
 
 	/*
@@ -120,15 +130,35 @@ func Init() {
 	plugin = msgbus.NewPlugin("NFT")
 	plugin.Register()
 	plugin.ListenForGroup("nft", onMessage)
+
+	// remote changes of our section are applied with the confirm-timer
+	pluginconfigsync.HandleSection("nft", onSectionSet)
 }
 
 func loadFromConfig() (nftJSONConfig, error) {
 
-	needToSave := false
-
 	// get the config
 	var jsonObject map[string]interface{}
 	jsonObject, _ = config.GetJSONObject("nft")
+
+	jsonConfig, needToSave, err := configFromObject(jsonObject)
+	if err != nil {
+		return jsonConfig, err
+	}
+
+	// save it ?
+	if needToSave == true {
+		jsonConfig.saveConfig()
+	}
+
+	return jsonConfig, nil
+}
+
+// configFromObject return the rules of the config-section jsonObject
+// needToSave is true, if missing tables or chains was added
+func configFromObject(jsonObject map[string]interface{}) (nftJSONConfig, bool, error) {
+
+	needToSave := false
 	if jsonObject == nil {
 		jsonObject = make(map[string]interface{})
 		needToSave = true
@@ -141,14 +171,14 @@ func loadFromConfig() (nftJSONConfig, error) {
 	jsonString, err := json.Marshal(jsonObject)
 	if err != nil {
 		logging.Error("Marshal", err.Error())
-		return jsonConfig, err
+		return jsonConfig, false, err
 	}
 
 	// string -> struct
 	err = json.Unmarshal([]byte(jsonString), &jsonConfig)
 	if err != nil {
 		logging.Error("Unmarshal", err.Error())
-		return jsonConfig, err
+		return jsonConfig, false, err
 	}
 
 	if len(jsonConfig.Tables) == 0 {
@@ -184,11 +214,6 @@ func loadFromConfig() (nftJSONConfig, error) {
 		needToSave = true
 	}
 
-	// save it ?
-	if needToSave == true {
-		jsonConfig.saveConfig()
-	}
-
 	// because the name and ids are keys inside the json, we need to at this missing infos in the structs
 	for tableName, table := range jsonConfig.Tables {
 
@@ -211,7 +236,7 @@ func loadFromConfig() (nftJSONConfig, error) {
 		}
 	}
 
-	return jsonConfig, nil
+	return jsonConfig, needToSave, nil
 }
 
 func (nftconfig *nftJSONConfig) saveConfig() error {
@@ -276,30 +301,129 @@ func (config *nftJSONConfig) applyAll() error {
 	return nil
 }
 
+// applyWithTimer apply the rules of nftConfig, they are saved with nft/confirm
+// if no confirm arrive within 20 seconds, the saved rules are applied again and onRollback is called
+func applyWithTimer(onRollback func()) error {
+
+	err := nftConfig.applyAll()
+	if err != nil {
+		return err
+	}
+
+	applyTimer = time.AfterFunc(time.Second*20, func() {
+		logging.Error("apply", "No confirm after 20 seconds, load last confirmed rules")
+
+		// load saved rules
+		rollback()
+
+		applyTimer = nil
+		onRollback()
+	})
+
+	return nil
+}
+
+// rollback load and apply the saved rules
+func rollback() error {
+
+	savedConfig, err := loadFromConfig()
+	if err != nil {
+		logging.Error("rollback", err.Error())
+		return err
+	}
+	nftConfig = savedConfig
+
+	err = nftConfig.applyAll()
+	if err != nil {
+		logging.Error("rollback", err.Error())
+	}
+	return err
+}
+
+// onSectionSet apply the rules we get from another node ( for example by configsync )
+// like nft/apply they must be confirmed with nft/confirm, otherwise the saved rules are restored
+// the change is pending, confirmed is called after the confirm or the rollback
+func onSectionSet(value map[string]interface{}, confirmed func(err error)) (bool, error) {
+
+	if applyTimer != nil {
+		return false, fmt.Errorf("Timer is active, you must confirm the current change, or wait until the timer is finished")
+	}
+
+	newConfig, _, err := configFromObject(value)
+	if err != nil {
+		return false, err
+	}
+
+	logging.Info("sectionSet", "Apply rules from remote, waiting for confirm")
+	nftConfig = newConfig
+	err = applyWithTimer(func() {
+		plugin.Publish(config.NodeName, config.NodeName, "nft", "confirmTimeout", "")
+		sectionResult(fmt.Errorf("No confirm after 20 seconds, the rules are rolled back"))
+	})
+	if err != nil {
+		rollback()
+		return false, err
+	}
+
+	sectionConfirmed = confirmed
+	return true, nil
+}
+
+// sectionResult send the result of remote rules, if they wait for it
+func sectionResult(err error) {
+	if sectionConfirmed != nil {
+		sectionConfirmed(err)
+		sectionConfirmed = nil
+	}
+}
+
+// decodeRule return the rule of an rule-payload
+func decodeRule(payload string) (nftJSONRule, error) {
+
+	var jsonRule nftJSONRule
+	err := json.Unmarshal([]byte(payload), &jsonRule)
+	if err != nil {
+		return nftJSONRule{}, err
+	}
+	if jsonRule.ChainName == "" {
+		return nftJSONRule{}, fmt.Errorf("chainName is needed")
+	}
+	if jsonRule.Position < 0 {
+		return nftJSONRule{}, fmt.Errorf("Invalid position %d", jsonRule.Position)
+	}
+
+	return jsonRule, nil
+}
+
+// ruleChain return the chain of our table with chainName
+func ruleChain(chainName string) (*nftChain, error) {
+
+	table, ok := nftConfig.Tables["tGopilot"]
+	if !ok {
+		return nil, fmt.Errorf("Table '%s' not found", "tGopilot")
+	}
+	chain, ok := table.Chains[chainName]
+	if !ok {
+		return nil, fmt.Errorf("Chain '%s' not found", chainName)
+	}
+
+	return chain, nil
+}
+
 func onMessage(message *msgbus.Msg, group, command, payload string) {
 
 	// If the timer is not finished, we can confirm from the ui
 	// which means that we dont kick out ourselfe :)
 	// also we can save the rules
 	if command == "apply" {
-		err := nftConfig.applyAll()
+		err := applyWithTimer(func() {
+			message.Answer(&plugin, "confirmOk", "")
+		})
 		if err != nil {
 			message.Answer(&plugin, "error", fmt.Sprintf("%s", err))
 			return
 		}
 
-		applyTimer = time.AfterFunc(time.Second*20, func() {
-			logging.Error("apply", "No confirm after 20 seconds, load last confirmed rules")
-
-			// load saved rules
-			nftConfig, _ = loadFromConfig()
-			nftConfig.applyAll()
-
-			applyTimer = nil
-			message.Answer(&plugin, "confirmOk", "")
-			return
-		})
-
 		message.Answer(&plugin, "confirmWait", "")
 		return
 	}
@@ -308,6 +432,7 @@ func onMessage(message *msgbus.Msg, group, command, payload string) {
 		if applyTimer != nil {
 			applyTimer.Stop()
 			nftConfig.saveConfig()
+			sectionResult(nil)
 		}
 
 		applyTimer = nil
@@ -323,10 +448,14 @@ func onMessage(message *msgbus.Msg, group, command, payload string) {
 		}
 
 		// reload and apply from config
-		nftConfig, _ = loadFromConfig()
-		nftConfig.applyAll()
+		err := rollback()
+		sectionResult(fmt.Errorf("The rules are canceled and rolled back"))
 
 		applyTimer = nil
+		if err != nil {
+			message.Answer(&plugin, "error", err.Error())
+			return
+		}
 		message.Answer(&plugin, "confirmCancelOk", "")
 		return
 	}
@@ -402,8 +531,7 @@ func onMessage(message *msgbus.Msg, group, command, payload string) {
 
 	if command == "updateRule" {
 
-		var jsonRule nftJSONRule
-		err := json.Unmarshal([]byte(payload), &jsonRule)
+		jsonRule, err := decodeRule(payload)
 		if err != nil {
 			message.Answer(&plugin, "error", err.Error())
 			return
@@ -461,87 +589,64 @@ func onMessage(message *msgbus.Msg, group, command, payload string) {
 
 	if command == "deleteRule" {
 
-		var jsonRule nftJSONRule
-		err := json.Unmarshal([]byte(payload), &jsonRule)
+		jsonRule, err := decodeRule(payload)
 		if err != nil {
 			message.Answer(&plugin, "error", err.Error())
 			return
 		}
 
-		// try to get the rule out from the table/chain
-		if table, ok := nftConfig.Tables["tGopilot"]; ok {
-			if chain, ok := table.Chains[jsonRule.ChainName]; ok {
-				chain.Rules = append(chain.Rules[:jsonRule.Position-1], chain.Rules[jsonRule.Position:]...)
-				message.Answer(&plugin, "deleteRuleOk", "")
-				return
-			}
+		chain, err := ruleChain(jsonRule.ChainName)
+		if err == nil {
+			err = chain.ruleDelete(jsonRule.Position)
+		}
+		if err != nil {
+			message.Answer(&plugin, "error", err.Error())
+			return
 		}
 
+		message.Answer(&plugin, "deleteRuleOk", "")
+		return
 	}
 
 	if command == "moveRuleUp" {
 
-		var jsonRule nftJSONRule
-		err := json.Unmarshal([]byte(payload), &jsonRule)
+		jsonRule, err := decodeRule(payload)
 		if err != nil {
 			message.Answer(&plugin, "error", err.Error())
 			return
 		}
 
-		// we can only move up, when the position is > 1
-		if jsonRule.Position <= 1 {
-			message.Answer(&plugin, "error", fmt.Sprintf("Can not move rule up"))
-			return
+		chain, err := ruleChain(jsonRule.ChainName)
+		if err == nil {
+			err = chain.ruleMove(jsonRule.Position, -1)
 		}
-
-		// try to get the rule out from the table/chain
-		if table, ok := nftConfig.Tables["tGopilot"]; ok {
-			if chain, ok := table.Chains[jsonRule.ChainName]; ok {
-
-				upperRule := chain.Rules[jsonRule.Position-2]
-				myRule := chain.Rules[jsonRule.Position-1]
-
-				chain.Rules[jsonRule.Position-2] = myRule
-				chain.Rules[jsonRule.Position-1] = upperRule
-
-				message.Answer(&plugin, "moveRuleUpOk", "")
-				return
-			}
+		if err != nil {
+			message.Answer(&plugin, "error", err.Error())
+			return
 		}
 
+		message.Answer(&plugin, "moveRuleUpOk", "")
 		return
 	}
 
 	if command == "moveRuleDown" {
 
-		var jsonRule nftJSONRule
-		err := json.Unmarshal([]byte(payload), &jsonRule)
+		jsonRule, err := decodeRule(payload)
 		if err != nil {
 			message.Answer(&plugin, "error", err.Error())
 			return
 		}
 
-		// try to get the rule out from the table/chain
-		if table, ok := nftConfig.Tables["tGopilot"]; ok {
-			if chain, ok := table.Chains[jsonRule.ChainName]; ok {
-
-				// we can only move up, when the position is > 1
-				if jsonRule.Position > len(chain.Rules) {
-					message.Answer(&plugin, "error", fmt.Sprintf("Can not move rule down"))
-					return
-				}
-
-				myRule := chain.Rules[jsonRule.Position-1]
-				nextRule := chain.Rules[jsonRule.Position]
-
-				chain.Rules[jsonRule.Position-1] = nextRule
-				chain.Rules[jsonRule.Position] = myRule
-
-				message.Answer(&plugin, "moveRuleDownOk", "")
-				return
-			}
+		chain, err := ruleChain(jsonRule.ChainName)
+		if err == nil {
+			err = chain.ruleMove(jsonRule.Position, 1)
+		}
+		if err != nil {
+			message.Answer(&plugin, "error", err.Error())
+			return
 		}
 
+		message.Answer(&plugin, "moveRuleDownOk", "")
 		return
 	}
 
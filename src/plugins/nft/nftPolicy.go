@@ -18,6 +18,11 @@ along with gopilot.  If not, see <http://www.gnu.org/licenses/>.
 
 package pluginnft
 
+import (
+	"encoding/json"
+	"fmt"
+)
+
 type nftPolicy int
 
 const (
@@ -36,5 +41,24 @@ func (policy nftPolicy) String() string {
 		"reject with tcp reset",
 	}
 
+	if policy < nftPolicyDrop || policy > nftPolicyRejectWithTCPReset {
+		return "unknown"
+	}
 	return names[policy]
 }
+
+// UnmarshalJSON accept only known policies
+func (policy *nftPolicy) UnmarshalJSON(data []byte) error {
+
+	var value int
+	err := json.Unmarshal(data, &value)
+	if err != nil {
+		return err
+	}
+	if nftPolicy(value) < nftPolicyDrop || nftPolicy(value) > nftPolicyRejectWithTCPReset {
+		return fmt.Errorf("Unknown policy %d", value)
+	}
+
+	*policy = nftPolicy(value)
+	return nil
+}
@@ -47,6 +47,38 @@ func (chain *nftChain) ruleNew(policy nftPolicy) *nftRule {
 	return &rule
 }
 
+// ruleDelete remove the rule at position, the position start with 1
+func (chain *nftChain) ruleDelete(position int) error {
+
+	if position < 1 || position > len(chain.Rules) {
+		return fmt.Errorf("Rule with position '%v' not found", position)
+	}
+
+	chain.Rules = append(chain.Rules[:position-1], chain.Rules[position:]...)
+	chain.ruleReindex()
+	return nil
+}
+
+// ruleMove swap the rule at position with the rule at position+offset, the position start with 1
+func (chain *nftChain) ruleMove(position int, offset int) error {
+
+	newPosition := position + offset
+	if position < 1 || position > len(chain.Rules) || newPosition < 1 || newPosition > len(chain.Rules) {
+		return fmt.Errorf("Can not move rule from position '%v' to '%v'", position, newPosition)
+	}
+
+	chain.Rules[position-1], chain.Rules[newPosition-1] = chain.Rules[newPosition-1], chain.Rules[position-1]
+	chain.ruleReindex()
+	return nil
+}
+
+// ruleReindex set the index of every rule to its place in the chain
+func (chain *nftChain) ruleReindex() {
+	for ruleIndex, rule := range chain.Rules {
+		rule.index = ruleIndex
+	}
+}
+
 func (rule *nftRule) statementAdd(statement []string) {
 
 	// append statement to array
@@ -0,0 +1,102 @@
+/*
+Copyright (C) 2019 by Martin Langlotz aka stackshadow
+
+This file is part of gopilot, an rewrite of the copilot-project in go
+
+gopilot is free software: you can redistribute it and/or modify
+it under the terms of the GNU Lesser General Public License as published by
+the Free Software Foundation, version 3 of this License
+
+gopilot is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License
+along with gopilot.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package pluginnft
+
+import (
+	"core/clog"
+	"testing"
+	"time"
+)
+
+func TestRuleMove(t *testing.T) {
+
+	table := tableNew("tTest", nftFAMILYIP)
+	table.chainNew("input", "input", nftPolicyAccept)
+	chain := table.Chains["input"]
+	first := chain.ruleNew(nftPolicyAccept)
+	second := chain.ruleNew(nftPolicyDrop)
+
+	if chain.ruleMove(1, -1) == nil || chain.ruleMove(2, 1) == nil || chain.ruleMove(0, 1) == nil {
+		t.Error("Rule should not move out of the chain")
+	}
+	if err := chain.ruleMove(1, 1); err != nil || chain.Rules[0] != second || chain.Rules[1] != first || first.index != 1 {
+		t.Error("Rule is not moved down")
+	}
+	if err := chain.ruleMove(2, -1); err != nil || chain.Rules[0] != first {
+		t.Error("Rule is not moved up")
+	}
+
+	if chain.ruleDelete(0) == nil || chain.ruleDelete(3) == nil {
+		t.Error("Rule outside the chain should not be deleted")
+	}
+	if err := chain.ruleDelete(1); err != nil || len(chain.Rules) != 1 || chain.Rules[0] != second || second.index != 0 {
+		t.Error("Rule is not deleted")
+	}
+}
+
+func TestSectionSet(t *testing.T) {
+
+	logging = clog.New("NFT")
+
+	if _, err := onSectionSet(map[string]interface{}{"tables": "invalid"}, func(error) {}); err == nil {
+		t.Error("Invalid rules should be rejected")
+	}
+
+	// a change which is not confirmed block remote changes
+	applyTimer = time.AfterFunc(time.Hour, func() {})
+	defer func() {
+		applyTimer.Stop()
+		applyTimer = nil
+	}()
+	if _, err := onSectionSet(map[string]interface{}{}, func(error) {}); err == nil {
+		t.Error("Rules should not be applied while the timer is active")
+	}
+
+	// the result of remote rules is sent only once
+	results := 0
+	sectionConfirmed = func(err error) {
+		results++
+	}
+	sectionResult(nil)
+	sectionResult(nil)
+	if results != 1 || sectionConfirmed != nil {
+		t.Errorf("Result should be sent once, but is sent %d times", results)
+	}
+}
+
+func FuzzDecodeRule(f *testing.F) {
+
+	f.Add("{\"chainName\":\"input\",\"position\":1,\"enabled\":true,\"policy\":1,\"statements\":[[\"tcp\",\"dport\",\"22\"]]}")
+	f.Add("{\"chainName\":\"input\",\"position\":0,\"policy\":7}")
+	f.Add("{\"chainName\":\"input\",\"position\":-1}")
+
+	f.Fuzz(func(t *testing.T, payload string) {
+
+		jsonRule, err := decodeRule(payload)
+		if err != nil {
+			return
+		}
+		if jsonRule.ChainName == "" || jsonRule.Position < 0 {
+			t.Errorf("Rule is invalid: %+v", jsonRule)
+		}
+		if jsonRule.Policy.String() == "unknown" {
+			t.Errorf("Policy %d is accepted", jsonRule.Policy)
+		}
+	})
+}
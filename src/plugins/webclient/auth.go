@@ -0,0 +1,239 @@
+/*
+Copyright (C) 2019 by Martin Langlotz aka stackshadow
+
+This file is part of gopilot, an rewrite of the copilot-project in go
+
+gopilot is free software: you can redistribute it and/or modify
+it under the terms of the GNU Lesser General Public License as published by
+the Free Software Foundation, version 3 of this License
+
+gopilot is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License
+along with gopilot.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package pluginwebclient
+
+/*
+Login-backends of the web client
+
+file: <configPath>/webusers.json with bcrypt-hashes, create users with
+      echo "password" | copilotg -webUserAdd alice -webUserRole admin
+ldap: search the user ( uid ) with the configured LDAP-connection and bind with its DN and the password
+      the role is taken from webusers.json ( an user without hash ) or -websocket.ldapRole
+
+webusers.json:
+{
+    "users": { "alice": { "hash": "$2a$10$...", "role": "admin" }, "bob": { "role": "viewer" } },
+    "roles": { "admin": [ "*" ], "viewer": [ "nodes/get*", "health/*" ] }
+}
+*/
+
+import (
+	"core/config"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"plugins/ldap"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/bcrypt"
+	"gopkg.in/ldap.v3"
+)
+
+var errLoginFailed = fmt.Errorf("Wrong user or password")
+
+// compared for unknown users, so they need the same time as known users
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("dummy"), bcrypt.DefaultCost)
+
+type webUser struct {
+	Hash string `json:"hash,omitempty"` // bcrypt, empty for users of other backends
+	Role string `json:"role"`
+}
+
+type webUsers struct {
+	Users map[string]webUser  `json:"users"`
+	Roles map[string][]string `json:"roles"` // rules like "group/command", see aclAllowed()
+}
+
+// authBackend check the password of an user and return its role
+type authBackend interface {
+	Authenticate(user, password string) (string, error)
+}
+
+// usersFile is the webusers.json inside the config-path
+type usersFile struct {
+	fileName string
+	mutex    sync.Mutex
+}
+
+// newBackends return the backends of the comma separated list, nil for "none"
+func newBackends(users *usersFile, backendList string) ([]authBackend, error) {
+
+	var backends []authBackend
+	for _, backendName := range strings.Split(backendList, ",") {
+		switch strings.TrimSpace(backendName) {
+		case "none":
+			return nil, nil
+		case "file":
+			backends = append(backends, users)
+		case "ldap":
+			backends = append(backends, ldapBackend{users: users})
+		default:
+			return nil, fmt.Errorf("Unknown login-backend '%s'", backendName)
+		}
+	}
+
+	return backends, nil
+}
+
+func newUsersFile(cfg *config.Config) *usersFile {
+	return &usersFile{fileName: cfg.Path() + "/webusers.json"}
+}
+
+// read the users and roles, a missing file contains no users and the role admin
+func (curFile *usersFile) read() (webUsers, error) {
+
+	users := webUsers{
+		Users: make(map[string]webUser),
+		Roles: map[string][]string{"admin": {"*"}},
+	}
+
+	fileBytes, err := ioutil.ReadFile(curFile.fileName)
+	if os.IsNotExist(err) {
+		return users, nil
+	}
+	if err != nil {
+		return users, err
+	}
+
+	err = json.Unmarshal(fileBytes, &users)
+	if err != nil {
+		return users, fmt.Errorf("%s: %s", curFile.fileName, err.Error())
+	}
+	return users, nil
+}
+
+// UserSet add or change the user with the password and role
+func (curFile *usersFile) UserSet(user, password, role string) error {
+
+	if user == "" || password == "" {
+		return fmt.Errorf("User and password are needed")
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+
+	curFile.mutex.Lock()
+	defer curFile.mutex.Unlock()
+
+	users, err := curFile.read()
+	if err != nil {
+		return err
+	}
+	if _, ok := users.Roles[role]; !ok {
+		return fmt.Errorf("Role '%s' dont exist", role)
+	}
+	users.Users[user] = webUser{Hash: string(hash), Role: role}
+
+	fileBytes, _ := json.MarshalIndent(users, "", "    ")
+	return ioutil.WriteFile(curFile.fileName, fileBytes, 0600)
+}
+
+// Authenticate check the password against the bcrypt-hash of the user
+func (curFile *usersFile) Authenticate(user, password string) (string, error) {
+
+	users, err := curFile.read()
+	if err != nil {
+		return "", err
+	}
+
+	curUser, ok := users.Users[user]
+	if !ok || curUser.Hash == "" {
+		bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+		return "", errLoginFailed
+	}
+	if bcrypt.CompareHashAndPassword([]byte(curUser.Hash), []byte(password)) != nil {
+		return "", errLoginFailed
+	}
+
+	return curUser.Role, nil
+}
+
+// roleRules return the rules of role
+func (curFile *usersFile) roleRules(role string) ([]string, error) {
+
+	users, err := curFile.read()
+	if err != nil {
+		return nil, err
+	}
+
+	rules, ok := users.Roles[role]
+	if !ok {
+		return nil, fmt.Errorf("Role '%s' dont exist", role)
+	}
+	return rules, nil
+}
+
+// ldapBackend bind with the user against the configured LDAP-directory
+type ldapBackend struct {
+	users *usersFile
+}
+
+// Authenticate search the DN of the user with the configured bind-DN and bind with it
+func (curBackend ldapBackend) Authenticate(user, password string) (string, error) {
+
+	// an empty password is an anonymous bind, which always work
+	if user == "" || password == "" {
+		return "", errLoginFailed
+	}
+
+	ldapConfig := pluginldap.GetLdapConfig()
+	conn, err := ldap.Dial("tcp", fmt.Sprintf("%s:%d", ldapConfig.Host, int(ldapConfig.Port)))
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	if err := conn.Bind(ldapConfig.BindDN, ldapConfig.Password); err != nil {
+		return "", err
+	}
+
+	result, err := conn.Search(ldap.NewSearchRequest(
+		ldapConfig.Namespace, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 2, 0, false,
+		fmt.Sprintf("(&(objectClass=inetOrgPerson)(uid=%s))", ldap.EscapeFilter(user)),
+		[]string{"dn"}, nil,
+	))
+	if err != nil {
+		return "", err
+	}
+	if len(result.Entries) != 1 {
+		return "", errLoginFailed
+	}
+
+	if err := conn.Bind(result.Entries[0].DN, password); err != nil {
+		return "", errLoginFailed
+	}
+
+	// the role of the user
+	users, err := curBackend.users.read()
+	if err != nil {
+		return "", err
+	}
+	// only entries without a password belong to ldap-users, a local user with the same name is another user
+	if curUser, ok := users.Users[user]; ok && curUser.Hash == "" {
+		return curUser.Role, nil
+	}
+	if ldapRole == "" {
+		return "", fmt.Errorf("User '%s' has no role", user)
+	}
+	return ldapRole, nil
+}
@@ -0,0 +1,181 @@
+/*
+Copyright (C) 2019 by Martin Langlotz aka stackshadow
+
+This file is part of gopilot, an rewrite of the copilot-project in go
+
+gopilot is free software: you can redistribute it and/or modify
+it under the terms of the GNU Lesser General Public License as published by
+the Free Software Foundation, version 3 of this License
+
+gopilot is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License
+along with gopilot.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package pluginwebclient
+
+import (
+	"core/msgbus"
+	"encoding/json"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// a client which can not read this count of messages is disconnected
+const clientQueueSize = 64
+
+// a client which need longer for a single message is disconnected
+const clientWriteTimeout = time.Second * 10
+
+// wsClient is a single websocket-connection
+// only the writer-goroutine write to the connection, everything else use send()
+type wsClient struct {
+	address string
+	conn    *websocket.Conn
+	session *webSession // the login of the user
+
+	queue     chan []byte
+	done      chan struct{}
+	closeOnce sync.Once
+
+	groupsMutex sync.Mutex
+	groups      map[string]bool // nil means all groups
+}
+
+// newClient create the client and start its writer
+func newClient(address string, conn *websocket.Conn, curSession *webSession) *wsClient {
+
+	newClient := &wsClient{
+		address: address,
+		conn:    conn,
+		session: curSession,
+		queue:   make(chan []byte, clientQueueSize),
+		done:    make(chan struct{}),
+	}
+
+	go newClient.writer()
+	return newClient
+}
+
+// writer send the queued messages to the browser
+// after close() it send the rest of the queue and close the connection
+func (curClient *wsClient) writer() {
+	defer curClient.conn.Close()
+
+	for {
+		select {
+		case data := <-curClient.queue:
+			curClient.conn.SetWriteDeadline(time.Now().Add(clientWriteTimeout))
+			if err := curClient.conn.WriteMessage(websocket.TextMessage, data); err != nil {
+				curClient.close()
+				return
+			}
+		case <-curClient.done:
+			curClient.conn.SetWriteDeadline(time.Now().Add(clientWriteTimeout))
+			for {
+				select {
+				case data := <-curClient.queue:
+					if curClient.conn.WriteMessage(websocket.TextMessage, data) != nil {
+						return
+					}
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// send queue a message for the client, it never block
+func (curClient *wsClient) send(data []byte) {
+	select {
+	case <-curClient.done:
+		return
+	default:
+	}
+
+	select {
+	case curClient.queue <- data:
+	default:
+		// the client is too slow, we dont block the bus because of it
+		curClient.close()
+	}
+}
+
+// sendGateway send a message of the gateway to the client
+func (curClient *wsClient) sendGateway(nodeName, command, payload string) {
+
+	message := msgbus.Msg{
+		NodeSource: nodeName,
+		NodeTarget: curClient.address,
+		Group:      "websocket",
+		Command:    command,
+		Payload:    payload,
+	}
+
+	jsonBytes, err := json.Marshal(message)
+	if err != nil {
+		return
+	}
+	curClient.send(jsonBytes)
+}
+
+// close the connection after the queued messages, the reader of the connection remove the client
+func (curClient *wsClient) close() {
+	curClient.closeOnce.Do(func() {
+		close(curClient.done)
+	})
+}
+
+// subscribed return true if the client want broadcasts of group
+func (curClient *wsClient) subscribed(group string) bool {
+	curClient.groupsMutex.Lock()
+	defer curClient.groupsMutex.Unlock()
+
+	return curClient.groups == nil || curClient.groups[group]
+}
+
+// subscribe set the groups of broadcasts the client want, "*" for all groups
+func (curClient *wsClient) subscribe(groupList string) string {
+	curClient.groupsMutex.Lock()
+	defer curClient.groupsMutex.Unlock()
+
+	curClient.groups = make(map[string]bool)
+	for _, group := range strings.Split(groupList, ",") {
+		group = strings.TrimSpace(group)
+		if group == "*" {
+			curClient.groups = nil
+			return "*"
+		}
+		if group != "" {
+			curClient.groups[group] = true
+		}
+	}
+
+	groups := make([]string, 0, len(curClient.groups))
+	for group := range curClient.groups {
+		groups = append(groups, group)
+	}
+	sort.Strings(groups)
+	return strings.Join(groups, ",")
+}
+
+// onGatewayMessage handle the messages of the client to the gateway
+func (curClient *wsClient) onGatewayMessage(nodeName string, message *msgbus.Msg) {
+
+	if message.Command == "subscribe" {
+		groups := curClient.subscribe(message.Payload)
+		curClient.sendGateway(nodeName, "subscribeOk", groups)
+		return
+	}
+
+	curClient.sendGateway(nodeName, "error", "Unknown command '"+message.Command+"'")
+}
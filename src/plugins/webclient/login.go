@@ -0,0 +1,265 @@
+/*
+Copyright (C) 2019 by Martin Langlotz aka stackshadow
+
+This file is part of gopilot, an rewrite of the copilot-project in go
+
+gopilot is free software: you can redistribute it and/or modify
+it under the terms of the GNU Lesser General Public License as published by
+the Free Software Foundation, version 3 of this License
+
+gopilot is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License
+along with gopilot.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package pluginwebclient
+
+/*
+Sessions of the web client
+
+POST /login   {"user":"alice","password":"secret"}
+              200 {"token":"...","user":"alice","role":"admin","expires":1700000000} and the cookie gopilot-session
+              401 if the login failed
+POST /logout  end the session of the cookie or the "Authorization: Bearer <token>"-header
+
+The websocket is only upgraded with a valid session from the cookie, the header or ?token=<token>.
+Sessions expire after -websocket.sessionTTL, the websockets of an expired session are closed with its next message.
+*/
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+)
+
+const sessionCookie = "gopilot-session"
+
+// webSession is a logged in user
+type webSession struct {
+	Token   string `json:"token"`
+	User    string `json:"user"`
+	Role    string `json:"role"`
+	Expires int64  `json:"expires"` // unix time
+
+	rules []string // the rules of the role at login
+}
+
+// expired return true if the session can not be used anymore
+func (curSession *webSession) expired() bool {
+	return time.Now().Unix() >= curSession.Expires
+}
+
+// aclAllowed return true if one of the rules allow the command inside group
+// a rule is "group/command" or "group" for all commands, both can contain patterns like "get*"
+func aclAllowed(rules []string, group, command string) bool {
+
+	for _, rule := range rules {
+		ruleGroup, ruleCommand := rule, "*"
+		if index := strings.Index(rule, "/"); index >= 0 {
+			ruleGroup, ruleCommand = rule[:index], rule[index+1:]
+		}
+
+		groupMatch, _ := path.Match(ruleGroup, group)
+		commandMatch, _ := path.Match(ruleCommand, command)
+		if groupMatch && commandMatch {
+			return true
+		}
+	}
+
+	return false
+}
+
+// aclAllowedGroup return true if the rules allow at least one command inside group
+func aclAllowedGroup(rules []string, group string) bool {
+	for _, rule := range rules {
+		ruleGroup := strings.SplitN(rule, "/", 2)[0]
+		if groupMatch, _ := path.Match(ruleGroup, group); groupMatch {
+			return true
+		}
+	}
+	return false
+}
+
+// login check the password with every backend and create a new session
+func (curCWs *pluginCWs) login(user, password string) (*webSession, error) {
+
+	var role string
+	err := errLoginFailed
+	for _, backend := range curCWs.backends {
+		role, err = backend.Authenticate(user, password)
+		if err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	rules, err := curCWs.users.roleRules(role)
+	if err != nil {
+		return nil, err
+	}
+
+	randomBytes := make([]byte, 32)
+	if _, err := rand.Read(randomBytes); err != nil {
+		return nil, err
+	}
+
+	newSession := &webSession{
+		Token:   base64.RawURLEncoding.EncodeToString(randomBytes),
+		User:    user,
+		Role:    role,
+		Expires: time.Now().Add(sessionTTL).Unix(),
+		rules:   rules,
+	}
+
+	curCWs.sessionsMutex.Lock()
+	for token, curSession := range curCWs.sessions {
+		if curSession.expired() {
+			delete(curCWs.sessions, token)
+		}
+	}
+	curCWs.sessions[newSession.Token] = newSession
+	curCWs.sessionsMutex.Unlock()
+
+	return newSession, nil
+}
+
+// session return the valid session of token or nil
+func (curCWs *pluginCWs) session(token string) *webSession {
+
+	// without backends everybody is admin
+	if curCWs.backends == nil {
+		return &webSession{User: "anonymous", Role: "admin", Expires: time.Now().Add(sessionTTL).Unix(), rules: []string{"*"}}
+	}
+
+	curCWs.sessionsMutex.Lock()
+	defer curCWs.sessionsMutex.Unlock()
+
+	curSession, ok := curCWs.sessions[token]
+	if !ok {
+		return nil
+	}
+	if curSession.expired() {
+		delete(curCWs.sessions, token)
+		return nil
+	}
+	return curSession
+}
+
+// sessionValid return true if the session is not expired or logged out
+func (curCWs *pluginCWs) sessionValid(curSession *webSession) bool {
+	if curCWs.backends == nil {
+		return true
+	}
+	return curCWs.session(curSession.Token) == curSession
+}
+
+// requestToken return the session-token of the request from the cookie, the header or the query
+func requestToken(r *http.Request) string {
+
+	if cookie, err := r.Cookie(sessionCookie); err == nil {
+		return cookie.Value
+	}
+	if authHeader := r.Header.Get("Authorization"); strings.HasPrefix(authHeader, "Bearer ") {
+		return strings.TrimPrefix(authHeader, "Bearer ")
+	}
+	return r.URL.Query().Get("token")
+}
+
+// onLogin handle POST /login
+func (curCWs *pluginCWs) onLogin(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "Only POST is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !curCWs.checkOrigin(r) {
+		http.Error(w, "Origin not allowed", http.StatusForbidden)
+		return
+	}
+
+	var loginReq struct {
+		User     string `json:"user"`
+		Password string `json:"password"`
+	}
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&loginReq)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	newSession, err := curCWs.login(loginReq.User, loginReq.Password)
+	if err != nil {
+		curCWs.logging.Error("LOGIN", fmt.Sprintf("Login of '%s' from %s failed: %s", loginReq.User, r.RemoteAddr, err.Error()))
+		http.Error(w, errLoginFailed.Error(), http.StatusUnauthorized)
+		return
+	}
+	curCWs.logging.Info("LOGIN", fmt.Sprintf("'%s' logged in from %s", newSession.User, r.RemoteAddr), "role", newSession.Role)
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    newSession.Token,
+		Path:     "/",
+		Expires:  time.Unix(newSession.Expires, 0),
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteStrictMode,
+	})
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(newSession)
+}
+
+// onLogout handle POST /logout
+func (curCWs *pluginCWs) onLogout(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "Only POST is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	token := requestToken(r)
+	curCWs.sessionsMutex.Lock()
+	delete(curCWs.sessions, token)
+	curCWs.sessionsMutex.Unlock()
+
+	// the websockets of the session are closed too
+	if token != "" {
+		curCWs.closeSession(token)
+	}
+
+	http.SetCookie(w, &http.Cookie{Name: sessionCookie, Value: "", Path: "/", MaxAge: -1})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// checkOrigin allow browsers only from -websocket.origins, without it only from the host of the websocket
+// requests without origin are not from a browser
+func (curCWs *pluginCWs) checkOrigin(r *http.Request) bool {
+
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+
+	if len(curCWs.origins) == 0 {
+		originURL, err := url.Parse(origin)
+		return err == nil && strings.EqualFold(originURL.Host, r.Host)
+	}
+
+	for _, allowedOrigin := range curCWs.origins {
+		if allowedOrigin == "*" || strings.EqualFold(allowedOrigin, origin) {
+			return true
+		}
+	}
+	return false
+}
@@ -18,22 +18,60 @@ along with gopilot.  If not, see <http://www.gnu.org/licenses/>.
 
 package pluginwebclient
 
+/*
+Gateway between the browsers and the bus
+
+Every websocket-connection is a client with its own address "nodeName/wsN".
+The gateway set this address as source of every message from the client,
+so answers of plugins and other nodes come back only to the client which asked.
+
+Messages for the gateway itself use the group "websocket":
+websocket/address        gateway -> client: the address of the client, send after connect
+websocket/subscribe      client -> gateway: comma separated list of groups, "*" for all groups ( default ), "" for none
+websocket/subscribeOk    gateway -> client: the groups of the client
+
+Messages which are not for a client ( like nodes/nodeUpdated ) are broadcasts,
+they are send to every client which subscribed the group.
+
+Only logged in users can connect ( see login.go ), the role of the user decide
+which messages the client can send and which broadcasts it get.
+Forbidden messages are answered with websocket/error.
+*/
+
 import (
+	"bufio"
 	"core/clog"
+	"core/config"
 	"core/msgbus"
 	"flag"
 	"fmt"
 	"log"
 	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/gorilla/websocket"
 )
 
 type pluginCWs struct {
 	logging clog.Logger
+	config  *config.Config
+
+	plugin   msgbus.Plugin
+	upgrader websocket.Upgrader
+
+	clientNo     int
+	clients      map[string]*wsClient
+	clientsMutex sync.Mutex
 
-	plugin msgbus.Plugin
-	conn   *websocket.Conn
+	users         *usersFile
+	backends      []authBackend // nil if everybody is admin
+	origins       []string
+	sessions      map[string]*webSession
+	sessionsMutex sync.Mutex
 }
 
 var startWebSocket bool
@@ -41,12 +79,15 @@ var webSocketAddr string
 var startWebServer bool
 var webServerRoot string
 var webServerAddr string
+var webAuth string
+var webOrigins string
+var sessionTTL time.Duration
+var ldapRole string
+var webUserAdd string
+var webUserRole string
 
-var upgrader = websocket.Upgrader{
-	CheckOrigin: func(r *http.Request) bool {
-		return true
-	},
-} // use default options
+// bigger messages close the connection
+const maxWebsocketMessageSize = 1024 * 1024
 
 func ParseCmdLine() {
 	flag.BoolVar(&startWebSocket, "websocket", false, "Enable Websocket-Server")
@@ -56,17 +97,38 @@ func ParseCmdLine() {
 	flag.StringVar(&webServerAddr, "webserver.addr", "localhost:9090", "Web-Server Adress for webinterface")
 	flag.StringVar(&webServerRoot, "webserver.root", "/app/www/gopilot", "Root directory of webfiles")
 
+	flag.StringVar(&webAuth, "websocket.auth", "file", "Comma separated login-backends: file ( webusers.json ), ldap or none ( everybody is admin )")
+	flag.StringVar(&webOrigins, "websocket.origins", "", "Comma separated origins of the webinterface like https://gopilot.example.com, * allow all, empty allow only the host of the websocket")
+	flag.DurationVar(&sessionTTL, "websocket.sessionTTL", time.Hour*12, "Lifetime of a login")
+	flag.StringVar(&ldapRole, "websocket.ldapRole", "", "Role of ldap-users which are not inside webusers.json, empty deny them")
+	flag.StringVar(&webUserAdd, "webUserAdd", "", "name - Add or change a web user with the password from stdin and exit")
+	flag.StringVar(&webUserRole, "webUserRole", "admin", "Role of the user for webUserAdd")
 }
 
-func Init() pluginCWs {
-	var newCWs pluginCWs
-	newCWs.logging = clog.New("WS")
+func Init() *pluginCWs {
+	newCWs, err := newGateway(config.Default, msgbus.Default)
+	if err != nil {
+		newCWs.logging.Error("LOGIN", err.Error())
+		os.Exit(-1)
+	}
 
-	if startWebSocket == true {
-		newCWs.plugin = msgbus.NewPlugin("Websocket")
-		newCWs.plugin.Register()
-		newCWs.plugin.ListenForGroup("", newCWs.onMessage)
+	// add a web user
+	if webUserAdd != "" {
+		password, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+		err := newCWs.users.UserSet(webUserAdd, strings.TrimRight(password, "\r\n"), webUserRole)
+		if err != nil {
+			newCWs.logging.Error("LOGIN", err.Error())
+			os.Exit(-1)
+		}
+		fmt.Printf("User '%s' with role '%s' saved\n", webUserAdd, webUserRole)
+		os.Exit(0)
+	}
 
+	if startWebSocket == true {
+		if newCWs.backends == nil {
+			newCWs.logging.Error("LOGIN", "Login is disabled, everybody who reach the websocket is admin")
+		}
+		newCWs.start()
 		go newCWs.serveWebsocket()
 	}
 
@@ -84,8 +146,38 @@ func Init() pluginCWs {
 	return newCWs
 }
 
+// newGateway create the gateway for the node of cfg on bus, start() connect it to the bus
+func newGateway(cfg *config.Config, bus *msgbus.Bus) (*pluginCWs, error) {
+	newCWs := &pluginCWs{
+		logging:  clog.New("WS"),
+		config:   cfg,
+		plugin:   bus.NewPlugin("Websocket"),
+		clients:  make(map[string]*wsClient),
+		users:    newUsersFile(cfg),
+		sessions: make(map[string]*webSession),
+	}
+	newCWs.upgrader.CheckOrigin = newCWs.checkOrigin
+
+	for _, origin := range strings.Split(webOrigins, ",") {
+		if origin = strings.TrimSpace(origin); origin != "" {
+			newCWs.origins = append(newCWs.origins, origin)
+		}
+	}
+
+	var err error
+	newCWs.backends, err = newBackends(newCWs.users, webAuth)
+	return newCWs, err
+}
+
+func (curCWs *pluginCWs) start() {
+	curCWs.plugin.Register()
+	curCWs.plugin.ListenForGroup("", curCWs.onMessage)
+}
+
 func (curCWs *pluginCWs) serveWebsocket() {
 	curCWs.logging.Info("WEBSOCKET", fmt.Sprintf("Start websocker-server on %s", webSocketAddr))
+	http.HandleFunc("/login", curCWs.onLogin)
+	http.HandleFunc("/logout", curCWs.onLogout)
 	http.HandleFunc("/echo-protocol", curCWs.onWebsocketMessage)
 	http.ListenAndServe(webSocketAddr, nil)
 }
@@ -99,33 +191,54 @@ func (curCWs *pluginCWs) serveWebserver() {
 
 func (curCWs *pluginCWs) onWebsocketMessage(w http.ResponseWriter, r *http.Request) {
 
-	var err error
-	curCWs.conn, err = upgrader.Upgrade(w, r, nil)
+	curSession := curCWs.session(requestToken(r))
+	if curSession == nil {
+		http.Error(w, "Login needed", http.StatusUnauthorized)
+		return
+	}
+
+	conn, err := curCWs.upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		log.Print("upgrade:", err)
 		return
 	}
-	defer curCWs.conn.Close()
+	conn.SetReadLimit(maxWebsocketMessageSize)
+
+	curClient := curCWs.clientAdd(conn, curSession)
+	defer curCWs.clientRemove(curClient)
+
+	curClient.sendGateway(curCWs.config.NodeName(), "address", curClient.address)
 
 	for {
-		messageType, message, err := curCWs.conn.ReadMessage()
+		messageType, message, err := conn.ReadMessage()
 		if err != nil {
-			log.Println("read:", err)
+			curCWs.logging.Debug("RECV", fmt.Sprintf("%s: %s", curClient.address, err.Error()))
+			break
+		}
+
+		if !curCWs.sessionValid(curSession) {
+			curClient.sendGateway(curCWs.config.NodeName(), "error", "Session expired")
 			break
 		}
 
-		if messageType == websocket.BinaryMessage {
-			log.Printf("We dont handle binary-messages yet")
+		curMessage, err := decodeWebsocketMessage(messageType, message)
+		if err != nil {
+			curCWs.logging.Error("RECV", err.Error())
 			continue
 		}
+		curCWs.logging.Debug("RECV", string(message))
 
-		if messageType == websocket.TextMessage {
-			curCWs.logging.Debug("RECV", string(message[:]))
+		// the client can not use the address of others
+		curMessage.NodeSource = curClient.address
+
+		if curMessage.Group == "websocket" {
+			curClient.onGatewayMessage(curCWs.config.NodeName(), &curMessage)
+			continue
 		}
 
-		curMessage, err := msgbus.FromJsonString(string(message))
-		if err != nil {
-			log.Println("error: ", err)
+		if !aclAllowed(curSession.rules, curMessage.Group, curMessage.Command) {
+			curCWs.logging.Error("ACL", fmt.Sprintf("'%s' with role '%s' is not allowed to send %s/%s", curSession.User, curSession.Role, curMessage.Group, curMessage.Command))
+			curClient.sendGateway(curCWs.config.NodeName(), "error", fmt.Sprintf("Access denied to %s/%s", curMessage.Group, curMessage.Command))
 			continue
 		}
 
@@ -134,21 +247,87 @@ func (curCWs *pluginCWs) onWebsocketMessage(w http.ResponseWriter, r *http.Reque
 	}
 }
 
+// decodeWebsocketMessage return the bus-message inside a websocket-message of the browser
+func decodeWebsocketMessage(messageType int, message []byte) (msgbus.Msg, error) {
+
+	if messageType != websocket.TextMessage {
+		return msgbus.Msg{}, fmt.Errorf("We dont handle binary-messages yet")
+	}
+
+	return msgbus.FromJsonString(string(message))
+}
+
+// clientAdd create a new client for conn with the next free address
+func (curCWs *pluginCWs) clientAdd(conn *websocket.Conn, curSession *webSession) *wsClient {
+
+	curCWs.clientsMutex.Lock()
+	curCWs.clientNo++
+	address := msgbus.ClientAddress(curCWs.config.NodeName(), "ws"+strconv.Itoa(curCWs.clientNo))
+	curClient := newClient(address, conn, curSession)
+	curCWs.clients[address] = curClient
+	curCWs.clientsMutex.Unlock()
+
+	curCWs.logging.Info("WEBSOCKET", fmt.Sprintf("Client '%s' of '%s' connected from %s", address, curSession.User, conn.RemoteAddr().String()))
+	return curClient
+}
+
+// clientRemove forget the client and close its connection
+func (curCWs *pluginCWs) clientRemove(curClient *wsClient) {
+
+	curCWs.clientsMutex.Lock()
+	delete(curCWs.clients, curClient.address)
+	curCWs.clientsMutex.Unlock()
+
+	curClient.close()
+	curCWs.logging.Info("WEBSOCKET", fmt.Sprintf("Client '%s' disconnected", curClient.address))
+}
+
+// onMessage send answers to the client which asked and broadcasts to every client which want the group
 func (curCWs *pluginCWs) onMessage(message *msgbus.Msg, group, command, payload string) {
-	if curCWs.conn == nil {
+
+	jsonBytes, err := message.ToJsonByteArray()
+	if err != nil {
+		curCWs.logging.Error("SEND", err.Error())
 		return
 	}
 
-	curCWs.logging.Info("WEBSOCKET", fmt.Sprintf("%s/%s", group, command))
+	curCWs.clientsMutex.Lock()
+	defer curCWs.clientsMutex.Unlock()
 
-	jsonString, err := message.ToJsonString()
-	if err != nil {
-		fmt.Println("error:", err)
+	if msgbus.IsClientAddress(message.NodeTarget) {
+		if curClient, ok := curCWs.clients[message.NodeTarget]; ok && curCWs.clientValid(curClient) {
+			curCWs.logging.Debug("SEND", fmt.Sprintf("%s: %s", curClient.address, string(jsonBytes)))
+			curClient.send(jsonBytes)
+		}
+		return
 	}
 
-	curCWs.logging.Debug("SEND", jsonString)
-	err = curCWs.conn.WriteMessage(websocket.TextMessage, []byte(jsonString))
-	if err != nil {
-		log.Println("write:", err)
+	for _, curClient := range curCWs.clients {
+		if curClient.subscribed(group) && aclAllowedGroup(curClient.session.rules, group) && curCWs.clientValid(curClient) {
+			curClient.send(jsonBytes)
+		}
+	}
+}
+
+// clientValid return true, if the session of the client is valid, otherwise the client is closed
+func (curCWs *pluginCWs) clientValid(curClient *wsClient) bool {
+	if curCWs.sessionValid(curClient.session) {
+		return true
+	}
+	curClient.sendGateway(curCWs.config.NodeName(), "error", "Session expired")
+	curClient.close()
+	return false
+}
+
+// closeSession close all clients of the session with token
+func (curCWs *pluginCWs) closeSession(token string) {
+	curCWs.clientsMutex.Lock()
+	defer curCWs.clientsMutex.Unlock()
+
+	for _, curClient := range curCWs.clients {
+		if curClient.session.Token == token {
+			curClient.sendGateway(curCWs.config.NodeName(), "error", "Logged out")
+			curClient.close()
+		}
 	}
 }
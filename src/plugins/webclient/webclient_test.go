@@ -0,0 +1,332 @@
+/*
+Copyright (C) 2019 by Martin Langlotz aka stackshadow
+
+This file is part of gopilot, an rewrite of the copilot-project in go
+
+gopilot is free software: you can redistribute it and/or modify
+it under the terms of the GNU Lesser General Public License as published by
+the Free Software Foundation, version 3 of this License
+
+gopilot is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Lesser General Public License for more details.
+
+You should have received a copy of the GNU Lesser General Public License
+along with gopilot.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package pluginwebclient
+
+import (
+	"core/config"
+	"core/msgbus"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// testClient connect to the gateway and return the connection and the address of the client
+func testClient(t *testing.T, url string, header http.Header) (*websocket.Conn, string) {
+
+	conn, _, err := websocket.DefaultDialer.Dial(url, header)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+
+	message := readTestMessage(t, conn)
+	if message.Group != "websocket" || message.Command != "address" || message.NodeTarget != message.Payload {
+		t.Errorf("First message should be the address, but is %+v", message)
+		t.FailNow()
+	}
+	return conn, message.Payload
+}
+
+func readTestMessage(t *testing.T, conn *websocket.Conn) msgbus.Msg {
+
+	conn.SetReadDeadline(time.Now().Add(time.Second * 5))
+	_, data, err := conn.ReadMessage()
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+
+	message, err := msgbus.FromJsonString(string(data))
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	return message
+}
+
+func TestGateway(t *testing.T) {
+
+	webAuth = "none"
+	bus := msgbus.New()
+	gateway, err := newGateway(config.New("nodea", ""), bus)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	gateway.start()
+
+	server := httptest.NewServer(http.HandlerFunc(gateway.onWebsocketMessage))
+	defer server.Close()
+	url := "ws" + strings.TrimPrefix(server.URL, "http")
+
+	// a plugin which answer every ping
+	responder := bus.NewPlugin("Responder")
+	responder.Register()
+	responder.ListenForGroup("test", func(message *msgbus.Msg, group, command, payload string) {
+		if command == "ping" {
+			message.Answer(&responder, "pong", payload)
+		}
+	})
+
+	firstConn, firstAddress := testClient(t, url, nil)
+	defer firstConn.Close()
+	secondConn, secondAddress := testClient(t, url, nil)
+	defer secondConn.Close()
+	if firstAddress == secondAddress || !strings.HasPrefix(firstAddress, "nodea/") {
+		t.Errorf("Addresses '%s' and '%s' are wrong", firstAddress, secondAddress)
+		t.FailNow()
+	}
+
+	// the second client only want broadcasts of tls
+	secondConn.WriteMessage(websocket.TextMessage, []byte("{\"g\":\"websocket\",\"c\":\"subscribe\",\"v\":\"tls, \"}"))
+	if message := readTestMessage(t, secondConn); message.Command != "subscribeOk" || message.Payload != "tls" {
+		t.Errorf("Subscribe failed: %+v", message)
+		t.FailNow()
+	}
+
+	// the answer go to the client which asked, also if it use the address of another client
+	firstConn.WriteMessage(websocket.TextMessage, []byte("{\"s\":\""+secondAddress+"\",\"t\":\"nodea\",\"g\":\"test\",\"c\":\"ping\",\"v\":\"1\"}"))
+	if message := readTestMessage(t, firstConn); message.Command != "pong" || message.NodeTarget != firstAddress {
+		t.Errorf("Answer is wrong: %+v", message)
+		t.FailNow()
+	}
+
+	// broadcasts
+	responder.Publish("nodea", "nodea", "nodes", "nodeUpdated", "")
+	responder.Publish("nodea", "nodea", "tls", "connectState", "")
+	for _, command := range []string{"nodeUpdated", "connectState"} {
+		if message := readTestMessage(t, firstConn); message.Command != command {
+			t.Errorf("First client should get %s, but get %+v", command, message)
+			t.FailNow()
+		}
+	}
+
+	// the second client get no answer of the first client and no broadcast of nodes
+	if message := readTestMessage(t, secondConn); message.Command != "connectState" {
+		t.Errorf("Second client should only get connectState, but get %+v", message)
+		t.FailNow()
+	}
+
+	// the gateway forget closed clients
+	firstConn.Close()
+	for timeout := time.Now().Add(time.Second * 5); time.Now().Before(timeout); time.Sleep(time.Millisecond * 20) {
+		gateway.clientsMutex.Lock()
+		count := len(gateway.clients)
+		gateway.clientsMutex.Unlock()
+		if count == 1 {
+			return
+		}
+	}
+	t.Error("Closed client is not removed")
+}
+
+func TestACL(t *testing.T) {
+
+	rules := []string{"nodes/get*", "health", "tls/tokenList"}
+	tests := []struct {
+		group, command string
+		allowed        bool
+	}{
+		{"nodes", "getNodes", true},
+		{"nodes", "nodeDelete", false},
+		{"health", "anything", true},
+		{"tls", "tokenList", true},
+		{"tls", "tokenCreate", false},
+		{"nft", "apply", false},
+	}
+	for _, test := range tests {
+		if aclAllowed(rules, test.group, test.command) != test.allowed {
+			t.Errorf("%s/%s should be allowed: %t", test.group, test.command, test.allowed)
+		}
+	}
+
+	if !aclAllowedGroup(rules, "tls") || aclAllowedGroup(rules, "nft") || !aclAllowedGroup([]string{"*"}, "nft") {
+		t.Error("aclAllowedGroup is wrong")
+	}
+}
+
+// testLogin return the session-token of user or the http-status if the login failed
+func testLogin(t *testing.T, url, user, password string) (string, int) {
+
+	body, _ := json.Marshal(map[string]string{"user": user, "password": password})
+	resp, err := http.Post(url+"/login", "application/json", strings.NewReader(string(body)))
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	defer resp.Body.Close()
+
+	var loginSession webSession
+	if resp.StatusCode != http.StatusOK || json.NewDecoder(resp.Body).Decode(&loginSession) != nil {
+		return "", resp.StatusCode
+	}
+	return loginSession.Token, resp.StatusCode
+}
+
+func TestLogin(t *testing.T) {
+
+	configPath, _ := ioutil.TempDir("", "webclient")
+	defer os.RemoveAll(configPath)
+
+	webAuth = "file"
+	sessionTTL = time.Hour
+	bus := msgbus.New()
+	gateway, err := newGateway(config.New("nodea", configPath), bus)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	gateway.start()
+
+	// a viewer can only ping and get broadcasts of test
+	ioutil.WriteFile(configPath+"/webusers.json", []byte("{\"roles\":{\"admin\":[\"*\"],\"viewer\":[\"test/ping\"]}}"), 0600)
+	if err := gateway.users.UserSet("bob", "secret", "viewer"); err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	if gateway.users.UserSet("eve", "secret", "unknown") == nil {
+		t.Error("User with unknown role should not be saved")
+	}
+
+	responder := bus.NewPlugin("Responder")
+	responder.Register()
+	responder.ListenForGroup("test", func(message *msgbus.Msg, group, command, payload string) {
+		if command == "ping" {
+			message.Answer(&responder, "pong", payload)
+		}
+	})
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/login", gateway.onLogin)
+	mux.HandleFunc("/logout", gateway.onLogout)
+	mux.HandleFunc("/ws", gateway.onWebsocketMessage)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http") + "/ws"
+
+	// failed logins
+	if _, status := testLogin(t, server.URL, "bob", "wrong"); status != http.StatusUnauthorized {
+		t.Errorf("Login with wrong password return %d", status)
+	}
+	if _, status := testLogin(t, server.URL, "nobody", "secret"); status != http.StatusUnauthorized {
+		t.Errorf("Login of unknown user return %d", status)
+	}
+	if _, resp, err := websocket.DefaultDialer.Dial(wsURL, nil); err == nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Error("Websocket without login should not be upgraded")
+	}
+
+	token, status := testLogin(t, server.URL, "bob", "secret")
+	if status != http.StatusOK || token == "" {
+		t.Errorf("Login failed with %d", status)
+		t.FailNow()
+	}
+	header := http.Header{"Authorization": {"Bearer " + token}}
+
+	// other origins are not allowed
+	if _, resp, err := websocket.DefaultDialer.Dial(wsURL, http.Header{"Authorization": {"Bearer " + token}, "Origin": {"http://evil.example.com"}}); err == nil || resp.StatusCode != http.StatusForbidden {
+		t.Error("Websocket from another origin should not be upgraded")
+	}
+
+	conn, address := testClient(t, wsURL, header)
+	defer conn.Close()
+
+	conn.WriteMessage(websocket.TextMessage, []byte("{\"t\":\"nodea\",\"g\":\"test\",\"c\":\"delete\"}"))
+	if message := readTestMessage(t, conn); message.Command != "error" {
+		t.Errorf("test/delete should be denied, but get %+v", message)
+		t.FailNow()
+	}
+	conn.WriteMessage(websocket.TextMessage, []byte("{\"t\":\"nodea\",\"g\":\"test\",\"c\":\"ping\"}"))
+	if message := readTestMessage(t, conn); message.Command != "pong" || message.NodeTarget != address {
+		t.Errorf("test/ping should be answered, but get %+v", message)
+		t.FailNow()
+	}
+
+	// broadcasts of groups without rules are not send
+	responder.Publish("nodea", "nodea", "nodes", "nodeUpdated", "")
+	responder.Publish("nodea", "nodea", "test", "changed", "")
+	if message := readTestMessage(t, conn); message.Command != "changed" {
+		t.Errorf("Only test/changed should be send, but get %+v", message)
+		t.FailNow()
+	}
+
+	// an expired session get no broadcasts and the websocket is closed
+	expiredToken, _ := testLogin(t, server.URL, "bob", "secret")
+	expiredConn, _ := testClient(t, wsURL, http.Header{"Authorization": {"Bearer " + expiredToken}})
+	defer expiredConn.Close()
+	gateway.sessionsMutex.Lock()
+	gateway.sessions[expiredToken].Expires = time.Now().Add(-time.Minute).Unix()
+	gateway.sessionsMutex.Unlock()
+	responder.Publish("nodea", "nodea", "test", "changed", "")
+	if message := readTestMessage(t, expiredConn); message.Command != "error" || message.Payload != "Session expired" {
+		t.Errorf("Session should be expired, but get %+v", message)
+	}
+	expiredConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, _, err := expiredConn.ReadMessage(); err == nil {
+		t.Error("Websocket of an expired session should be closed")
+	}
+	if message := readTestMessage(t, conn); message.Command != "changed" {
+		t.Errorf("Valid session should get test/changed, but get %+v", message)
+	}
+
+	// after the logout the session can not be used
+	logoutReq, _ := http.NewRequest(http.MethodPost, server.URL+"/logout", nil)
+	logoutReq.Header = header
+	if resp, err := http.DefaultClient.Do(logoutReq); err != nil || resp.StatusCode != http.StatusNoContent {
+		t.Error("Logout failed")
+		t.FailNow()
+	}
+	if message := readTestMessage(t, conn); message.Command != "error" || message.Payload != "Logged out" {
+		t.Errorf("Websocket should be logged out, but get %+v", message)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, _, err := conn.ReadMessage(); err == nil {
+		t.Error("Websocket of a logged out session should be closed")
+	}
+	if _, resp, err := websocket.DefaultDialer.Dial(wsURL, header); err == nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Error("Websocket with logged out session should not be upgraded")
+	}
+}
+
+func FuzzDecodeWebsocketMessage(f *testing.F) {
+
+	f.Add(websocket.TextMessage, []byte("{\"t\":\"node\",\"g\":\"nodes\",\"c\":\"getNodes\"}"))
+	f.Add(websocket.TextMessage, []byte("{\"g\":\"nodes\"}"))
+	f.Add(websocket.BinaryMessage, []byte("{\"g\":\"nodes\",\"c\":\"getNodes\"}"))
+
+	f.Fuzz(func(t *testing.T, messageType int, message []byte) {
+
+		newMessage, err := decodeWebsocketMessage(messageType, message)
+		if err != nil {
+			return
+		}
+		if messageType != websocket.TextMessage {
+			t.Errorf("Message of type %d is accepted", messageType)
+		}
+		if newMessage.Group == "" || newMessage.Command == "" {
+			t.Errorf("Message without group or command is accepted: %+v", newMessage)
+		}
+	})
+}